@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// access levels that can be granted on a collection
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// Grant is the access given to a principal on a collection
+type Grant struct {
+	Principal string `json:"principal"`
+	Name      string `json:"name"`
+	Access    string `json:"access"`
+}
+
+// ACL is the owner of a collection and the principals it is shared with
+type ACL struct {
+	Collection string  `json:"collection"`
+	Owner      string  `json:"owner"`
+	Grants     []Grant `json:"grants"`
+}
+
+// GetACL returns the grants of the collection of the root, only its owner
+// can list them
+func (c *Client) GetACL(rootHash string) (*ACL, error) {
+	var acl ACL
+	err := c.getJSON(fmt.Sprintf("%s/acl/%s", c.apiURL, rootHash), &acl)
+	if err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+// Share grants read or write access to the collection of the root to the
+// principal, the access of a principal already granted is replaced
+func (c *Client) Share(rootHash, principal, access string) (*ACL, error) {
+	values := url.Values{"access": {access}}
+	return c.sendACL(http.MethodPut, fmt.Sprintf("%s/acl/%s/%s?%s", c.apiURL, rootHash, principal, values.Encode()))
+}
+
+// Unshare revokes the access of the principal to the collection of the root
+func (c *Client) Unshare(rootHash, principal string) (*ACL, error) {
+	return c.sendACL(http.MethodDelete, fmt.Sprintf("%s/acl/%s/%s", c.apiURL, rootHash, principal))
+}
+
+func (c *Client) sendACL(method, url string) (*ACL, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var acl ACL
+	err = json.Unmarshal(body, &acl)
+	if err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
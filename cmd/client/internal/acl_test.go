@@ -0,0 +1,66 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	grants := map[string]string{}
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/collections/root" && r.Method == http.MethodDelete:
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case r.URL.Path == "/v1/acl/root/auditor" && r.Method == http.MethodPut:
+			access := r.URL.Query().Get("access")
+			if access != AccessRead && access != AccessWrite {
+				http.Error(w, "invalid grant", http.StatusBadRequest)
+				return
+			}
+			grants["auditor"] = access
+		case r.URL.Path == "/v1/acl/root/auditor" && r.Method == http.MethodDelete:
+			delete(grants, "auditor")
+		case r.URL.Path == "/v1/acl/root" && r.Method == http.MethodGet:
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+
+		acl := ACL{Collection: "root", Owner: "owner", Grants: []Grant{}}
+		for principal, access := range grants {
+			acl.Grants = append(acl.Grants, Grant{Principal: principal, Access: access})
+		}
+		json.NewEncoder(w).Encode(acl)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	acl, err := client.Share("root", "auditor", AccessRead)
+	require.NoError(t, err)
+	assert.Equal(t, []Grant{{Principal: "auditor", Access: AccessRead}}, acl.Grants)
+
+	acl, err = client.GetACL("root")
+	require.NoError(t, err)
+	assert.Equal(t, "owner", acl.Owner)
+	assert.Len(t, acl.Grants, 1)
+
+	_, err = client.Share("root", "auditor", "admin")
+	assert.EqualError(t, err, "invalid grant")
+
+	acl, err = client.Unshare("root", "auditor")
+	require.NoError(t, err)
+	assert.Empty(t, acl.Grants)
+
+	require.NoError(t, client.DeleteCollection("root"))
+	assert.True(t, deleted)
+	assert.EqualError(t, client.DeleteCollection("unknown"), "Not Found")
+}
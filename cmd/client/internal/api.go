@@ -0,0 +1,35 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// apiPrefix is the path of the versioned api of the server
+const apiPrefix = "/v1"
+
+// APIError is an error sent by the server, the code is the machine readable
+// kind of the error, e.g. not_found, forbidden or quota_exceeded
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// responseError returns the error of a response with an error status, the
+// servers without the versioned api send the message as plain text
+func responseError(status int, body []byte) error {
+	var result struct {
+		Error *APIError `json:"error"`
+	}
+	err := json.Unmarshal(body, &result)
+	if err != nil || result.Error == nil {
+		return &APIError{Status: status, Message: strings.TrimSpace(string(body))}
+	}
+	result.Error.Status = status
+	return result.Error
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/collections/root", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":{"code":"forbidden","message":"the credential can not change the collection"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL + "/")
+	err := client.DeleteCollection("root")
+	assert.EqualError(t, err, "the credential can not change the collection")
+
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusForbidden, apiErr.Status)
+	assert.Equal(t, "forbidden", apiErr.Code)
+
+	// The plain text errors keep their message
+	err = responseError(http.StatusNotFound, []byte("404 page not found\n"))
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, &APIError{Status: http.StatusNotFound, Message: "404 page not found"}, apiErr)
+}
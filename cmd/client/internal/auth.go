@@ -0,0 +1,132 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+)
+
+const (
+	// credentialsFile is the file of the config dir with the credentials
+	credentialsFile = ".credentials"
+	// tenantHeader selects the tenant of the requests
+	tenantHeader = "X-Zc-Tenant"
+)
+
+// Credentials authenticate the requests with a token or by signing them
+// with an hmac key, the tenant is only chosen by the admin credentials
+type Credentials struct {
+	Token  string `json:"token,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// LoadCredentials reads the credentials of the config dir, it returns nil
+// when there are none
+func LoadCredentials(configDir string) (*Credentials, error) {
+	data, err := os.ReadFile(filepath.Join(configDir, credentialsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var creds Credentials
+	err = json.Unmarshal(data, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %s", err)
+	}
+	if creds.Token == "" && (creds.KeyID == "" || creds.Secret == "") {
+		return nil, fmt.Errorf("invalid credentials file: a token or a key_id and a secret are required")
+	}
+	return &creds, nil
+}
+
+// SetCredentials authenticates the requests of the client, the token is
+// used when it is set, otherwise the requests are signed with the key
+func (c *Client) SetCredentials(creds Credentials) {
+	c.creds = &creds
+	if c.tenant == "" {
+		c.tenant = creds.Tenant
+	}
+	c.useTransport()
+}
+
+// SetTenant sends the requests to the keyspace of the tenant, the server
+// only accepts it from the admins and without authentication, the other
+// credentials are bound to their tenant
+func (c *Client) SetTenant(tenant string) {
+	c.tenant = tenant
+	c.useTransport()
+}
+
+// useTransport sends the requests with the credentials and the tenant
+func (c *Client) useTransport() {
+	base := c.transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.httpClient = &http.Client{Transport: &authTransport{base: base, creds: c.creds, tenant: c.tenant}}
+}
+
+// authTransport adds the credentials and the tenant to the requests
+type authTransport struct {
+	base   http.RoundTripper
+	creds  *Credentials
+	tenant string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.tenant != "" {
+		req.Header.Set(tenantHeader, t.tenant)
+	}
+	if t.creds == nil {
+		return t.base.RoundTrip(req)
+	}
+	if t.creds.Token != "" {
+		req.Header.Set("Authorization", auth.SchemeBearer+" "+t.creds.Token)
+		return t.base.RoundTrip(req)
+	}
+
+	contentHash, err := contentHash(req)
+	if err != nil {
+		return nil, err
+	}
+	err = auth.SignRequest(req, t.creds.KeyID, t.creds.Secret, time.Now(), contentHash)
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// contentHash returns the hash of the body of a request, the streamed
+// bodies and the large ones are not signed
+func contentHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return auth.ContentHash(nil), nil
+	}
+	if req.GetBody == nil || req.ContentLength < 0 || req.ContentLength > auth.MaxSignedBody {
+		return auth.UnsignedPayload, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return auth.ContentHash(data), nil
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	creds, err := LoadCredentials(dir)
+	require.NoError(t, err)
+	assert.Nil(t, creds)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, credentialsFile), []byte(`{"key_id":"key"}`), 0600))
+	_, err = LoadCredentials(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, credentialsFile), []byte(`{"key_id":"key","secret":"secret"}`), 0600))
+	creds, err = LoadCredentials(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Credentials{KeyID: "key", Secret: "secret"}, creds)
+}
+
+func TestCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if token, ok := auth.ParseBearer(authorization); ok {
+			assert.Equal(t, "token", token)
+			w.Write([]byte(`{"total":0}`))
+			return
+		}
+
+		keyID, signature, ok := auth.ParseHMAC(authorization)
+		require.True(t, ok)
+		assert.Equal(t, "key", keyID)
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		contentHash := r.Header.Get(auth.HeaderContentSHA256)
+		if contentHash != auth.UnsignedPayload {
+			assert.Equal(t, auth.ContentHash(body), contentHash)
+		}
+		toSign := auth.StringToSign(r.Method, r.URL.EscapedPath(), r.URL.Query(), r.Header.Get(auth.HeaderDate), r.Header.Get(auth.HeaderNonce), contentHash)
+		if !auth.Verify("secret", toSign, signature) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"root_hash":"root"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetCredentials(Credentials{Token: "token"})
+	_, err := client.ListCollections(0, 10)
+	require.NoError(t, err)
+
+	// The bodies in memory are signed, the streamed ones are not
+	client.SetCredentials(Credentials{KeyID: "key", Secret: "secret"})
+	client.SetMessage("signed")
+	_, err = client.Upload([][]byte{[]byte("file1")})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("file1"), 0644))
+	_, err = client.UploadPaths([]string{path})
+	require.NoError(t, err)
+
+	client.SetCredentials(Credentials{KeyID: "key", Secret: "wrong"})
+	_, err = client.Upload([][]byte{[]byte("file1")})
+	assert.Error(t, err)
+}
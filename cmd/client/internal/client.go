@@ -2,32 +2,136 @@ package client
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/jmsilvadev/zc/pkg/delta"
 	"github.com/jmsilvadev/zc/pkg/mkt"
 )
 
+const (
+	// OrderAppend keeps the existent files in their indexes and appends
+	// the new ones in the given order
+	OrderAppend = "append"
+	// OrderHash sorts all the files of the tree by hash
+	OrderHash = "hash"
+)
+
+// ErrInvalidFile is returned when a downloaded file does not match its proof
+var ErrInvalidFile = errors.New("the file is invalid")
+
 type Client struct {
-	serverURL string
+	// apiURL is the url of the versioned api of the server
+	apiURL string
+	mode   mkt.Mode
+	order  string
+	// commitMeta makes the leaves of the uploads commit to the metadata
+	commitMeta bool
+	// message is kept in the history with the versions created
+	message string
+	// partSize and retryDelay are used by the resumable uploads
+	partSize   int
+	retryDelay time.Duration
+	// httpClient sends the requests with the credentials and the tenant
+	httpClient *http.Client
+	creds      *Credentials
+	tenant     string
+	// transport sends the requests over TLS with the pinned CA and the
+	// client certificate, the default transport is used when it is nil
+	transport http.RoundTripper
+}
+
+// TreeFile is a file of a hierarchy identified by its slash separated path
+type TreeFile struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	File []byte `json:"file"`
+}
+
+// TreeEntry is a file or a directory of a hierarchy with the proof of its
+// path, the entries are only sent for directories
+type TreeEntry struct {
+	Entry   mkt.Entry      `json:"entry"`
+	File    []byte         `json:"file,omitempty"`
+	Entries []mkt.Entry    `json:"entries,omitempty"`
+	Proof   *mkt.PathProof `json:"proof"`
+	Mode    mkt.Mode       `json:"mode"`
+}
+
+// Download is a file downloaded with its proof and metadata, the leaf
+// commits to the metadata when CommitMeta is set
+type Download struct {
+	File       []byte        `json:"file"`
+	Proof      *mkt.Proof    `json:"proof"`
+	Meta       *mkt.Metadata `json:"meta,omitempty"`
+	CommitMeta bool          `json:"commit_meta,omitempty"`
+}
+
+// TreeResult is the mapping between the indexes and the leaves returned
+// by the server after an upload or an update
+type TreeResult struct {
+	RootHash string   `json:"root_hash"`
+	Leaves   []string `json:"leaves"`
+	// Indexes has the index in the tree of each sent file
+	Indexes []int `json:"indexes"`
 }
 
 // NewClient creates a new client with the given server URL
 func NewClient(serverURL string) *Client {
 	return &Client{
-		serverURL: serverURL,
+		apiURL:     strings.TrimSuffix(serverURL, "/") + apiPrefix,
+		mode:       mkt.SHA256,
+		order:      OrderAppend,
+		partSize:   defaultPartSize,
+		retryDelay: defaultRetryDelay,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// SetOrder sets how the server orders the leaves: OrderAppend or OrderHash
+func (c *Client) SetOrder(order string) error {
+	if order != OrderAppend && order != OrderHash {
+		return fmt.Errorf("invalid order %s, valid values: %s, %s", order, OrderAppend, OrderHash)
 	}
+	c.order = order
+	return nil
+}
+
+// SetMode sets the tree mode used to upload, compute and verify the hashes
+func (c *Client) SetMode(mode mkt.Mode) {
+	c.mode = mode
+}
+
+// Mode returns the tree mode used by the client
+func (c *Client) Mode() mkt.Mode {
+	return c.mode
+}
+
+// SetCommitMeta sets if the leaves of the uploads commit to the metadata of
+// the files, the updates keep the choice of the upload
+func (c *Client) SetCommitMeta(commit bool) {
+	c.commitMeta = commit
+}
+
+// SetMessage sets the message of the versions created by the uploads,
+// updates and patches
+func (c *Client) SetMessage(message string) {
+	c.message = message
 }
 
 // UploadFiles uploads a list of files to the server and returns the server response
-// TODO: create a streaming to transfer faster, but the text says
-// that the files are small so maybe dont do it now
 func (c *Client) UploadFiles(files [][]byte) (string, error) {
 	if len(files) == 0 {
 		return "", fmt.Errorf("invalid files")
@@ -38,7 +142,7 @@ func (c *Client) UploadFiles(files [][]byte) (string, error) {
 		return "", err
 	}
 
-	resp, err := http.Post(c.serverURL+"/upload", "application/json", bytes.NewBuffer(data))
+	resp, err := c.httpClient.Post(c.apiURL+"/upload"+c.query(), "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		return "", err
 	}
@@ -50,103 +154,328 @@ func (c *Client) UploadFiles(files [][]byte) (string, error) {
 	}
 
 	if resp.StatusCode > 300 {
-		return "", fmt.Errorf(string(body))
+		return "", responseError(resp.StatusCode, body)
 	}
 
 	return string(body), nil
 }
 
+// Upload uploads a list of files to the server and returns the indexes
+// of the files in the new tree
+func (c *Client) Upload(files [][]byte) (*TreeResult, error) {
+	body, err := c.UploadFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var result TreeResult
+	err = json.Unmarshal([]byte(body), &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 // UpdateFiles uploads a list of files to the server and includes
 // in the existent list offiles in the server
-// TODO: create a streaming to transfer faster, but the text says
-// that the files are small so maybe dont do it now
 func (c *Client) UpdateFiles(files [][]byte, configDir string) (string, error) {
+	result, err := c.Update(files, configDir)
+	if err != nil {
+		return "", err
+	}
+	return result.RootHash, nil
+}
+
+// Update works as UpdateFiles but returns the indexes of the files in the
+// new tree, the existent files keep their indexes
+func (c *Client) Update(files [][]byte, configDir string) (*TreeResult, error) {
 	if len(files) == 0 {
-		return "", fmt.Errorf("invalid files")
+		return nil, fmt.Errorf("invalid files")
 	}
 
 	data, err := json.Marshal(files)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	rootHash, err := c.GetLocalRootHash(configDir)
 	if err != nil {
-		return "", fmt.Errorf("error fetching the rootHash: %s", err)
+		return nil, fmt.Errorf("error fetching the rootHash: %s", err)
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/update/%s", c.serverURL, rootHash), "application/json", bytes.NewBuffer(data))
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/update/%s%s", c.apiURL, rootHash, c.query()), "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if resp.StatusCode > 300 {
-		return "", fmt.Errorf(string(body))
+		return nil, responseError(resp.StatusCode, body)
 	}
 
-	// TODO: create an entity
-	var result struct {
-		RootHash string `json:"root_hash"`
+	var result TreeResult
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&result)
+	if err != nil {
+		return nil, err
 	}
 
-	err = json.NewDecoder(bytes.NewReader(body)).Decode(&result)
+	return &result, nil
+}
+
+// UploadPaths works as Upload but streams the files from the disk as
+// multipart/form-data, so the files are never fully in memory
+func (c *Client) UploadPaths(paths []string) (*TreeResult, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("invalid files")
+	}
+	return c.postPaths(c.apiURL+"/upload"+c.query(), paths)
+}
+
+// UpdatePaths works as Update but streams the files from the disk
+func (c *Client) UpdatePaths(paths []string, configDir string) (*TreeResult, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("invalid files")
+	}
+
+	rootHash, err := c.GetLocalRootHash(configDir)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("error fetching the rootHash: %s", err)
 	}
 
-	return result.RootHash, nil
+	return c.postPaths(fmt.Sprintf("%s/update/%s%s", c.apiURL, rootHash, c.query()), paths)
+}
+
+// postPaths posts the files as multipart/form-data with their metadata, the
+// body is written while it is sent
+func (c *Client) postPaths(url string, paths []string) (*TreeResult, error) {
+	pr, pw := io.Pipe()
+	// Closing the reader stops the writer if the request fails
+	defer pr.Close()
+
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeParts(writer, paths))
+	}()
+
+	resp, err := c.httpClient.Post(url, writer.FormDataContentType(), pr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var result TreeResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// writeParts writes a "meta" and a "file" part per path
+func writeParts(writer *multipart.Writer, paths []string) error {
+	for _, f := range NewLocalFiles(paths) {
+		meta, err := FileMetadata(f)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		err = writer.WriteField("meta", string(data))
+		if err != nil {
+			return err
+		}
+
+		part, err := writer.CreateFormFile("file", f.Name)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(f.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
 }
 
 // DownloadFile downloads a file from the server by its index and returns the file and its proof
 func (c *Client) DownloadFile(index int, rootHash string) ([]byte, *mkt.Proof, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/download/%s/%d", c.serverURL, rootHash, index))
+	d, err := c.Download(index, rootHash)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer resp.Body.Close()
+	return d.File, d.Proof, nil
+}
 
-	// TODO: put this struct as entity
-	var result struct {
-		File  []byte     `json:"file"`
-		Proof *mkt.Proof `json:"proof"`
+// Download downloads a file from the server by its index with its proof and
+// its metadata
+func (c *Client) Download(index int, rootHash string) (*Download, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/download/%s/%d", c.apiURL, rootHash, index))
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	if resp.StatusCode > 300 {
-		return nil, nil, fmt.Errorf(string(body))
+		return nil, responseError(resp.StatusCode, body)
 	}
 
+	var result Download
 	err = json.NewDecoder(bytes.NewReader(body)).Decode(&result)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	return result.File, result.Proof, nil
+	return &result, nil
+}
+
+// DownloadFileTo streams the raw file of the index to the dir verifying its
+// proof while it is written and returns its path. The file is saved with
+// the name, the permissions and the modification time of its metadata, and
+// only when it is valid
+func (c *Client) DownloadFileTo(index int, rootHash, dir string) (string, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/raw/%s/%d", c.apiURL, rootHash, index))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return "", responseError(resp.StatusCode, body)
+	}
+
+	d := Download{CommitMeta: resp.Header.Get("X-Merkle-Commit-Meta") == "true"}
+	err = json.Unmarshal([]byte(resp.Header.Get("X-Merkle-Proof")), &d.Proof)
+	if err != nil {
+		return "", fmt.Errorf("invalid proof: %s", err)
+	}
+	if v := resp.Header.Get("X-Merkle-Meta"); v != "" {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(data, &d.Meta)
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid metadata: %s", err)
+		}
+	}
+
+	p := localPath(dir, index, d.Meta)
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := c.mode.NewLeafHash()
+	_, err = io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	leaf := c.leafOf(hex.EncodeToString(h.Sum(nil)), &d)
+	if leaf == "" || leaf != resp.Header.Get("X-Merkle-Leaf") || !mkt.VerifyProofWithMode(leaf, rootHash, d.Proof, c.mode) {
+		return "", ErrInvalidFile
+	}
+
+	if d.Meta != nil && d.Meta.Mode != 0 {
+		err = os.Chmod(tmp.Name(), os.FileMode(d.Meta.Mode).Perm())
+		if err != nil {
+			return "", err
+		}
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return "", err
+	}
+	if d.Meta != nil && d.Meta.ModTime != 0 {
+		mtime := time.Unix(d.Meta.ModTime, 0)
+		err = os.Chtimes(p, mtime, mtime)
+		if err != nil {
+			return "", err
+		}
+	}
+	return p, nil
 }
 
 // GetRootHash calculates the root hash of a list of files using a Merkle tree
 func (c *Client) GetRootHash(files [][]byte) string {
 	hashes := make([]string, len(files))
 	for i, v := range files {
-		hash := sha256.Sum256(v)
-		hashStr := hex.EncodeToString(hash[:])
-		hashes[i] = hashStr
+		hashes[i] = c.mode.HashLeaf(v)
+	}
+	return c.GetRootHashOfHashes(hashes)
+}
+
+// GetRootHashOfHashes calculates the root hash of the files with the given
+// hashes in the upload order, empty without files
+func (c *Client) GetRootHashOfHashes(hashes []string) string {
+	hashes = append([]string{}, hashes...)
+	if c.order == OrderHash {
+		sort.Strings(hashes)
 	}
 
-	m := mkt.NewMerkleTree(hashes)
+	m, err := mkt.NewMerkleTreeWithMode(hashes, c.mode)
+	if err != nil {
+		return ""
+	}
 	return m.Root.Hash
 }
 
+// HashFile returns the leaf hash of a file reading it from the disk
+func (c *Client) HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := c.mode.NewLeafHash()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (c *Client) GetLocalRootHash(configDir string) (string, error) {
 	// TODO: put this filename as a config env
 	rootHashPath := filepath.Join(configDir, ".rootHash")
@@ -157,10 +486,234 @@ func (c *Client) GetLocalRootHash(configDir string) (string, error) {
 	return string(rootHash), nil
 }
 
+// GetLocalMode returns the tree mode saved with the rootHash, the
+// default one is returned when the mode was never saved
+func (c *Client) GetLocalMode(configDir string) (mkt.Mode, error) {
+	mode, err := os.ReadFile(filepath.Join(configDir, ".mode"))
+	if errors.Is(err, os.ErrNotExist) {
+		return mkt.SHA256, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return mkt.ParseMode(string(mode))
+}
+
+// PatchFile replaces the file of the index with a new version sending only
+// the blocks that are not in the stored version, it returns the new tree
+// and the bytes of literal data sent
+func (c *Client) PatchFile(index int, file []byte, configDir string) (*TreeResult, int, error) {
+	rootHash, err := c.GetLocalRootHash(configDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching the rootHash: %s", err)
+	}
+
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/signature/%s/%d", c.apiURL, rootHash, index))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, 0, responseError(resp.StatusCode, body)
+	}
+
+	var sig delta.Signature
+	err = json.Unmarshal(body, &sig)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ops := delta.Compute(&sig, file)
+	data, err := json.Marshal(struct {
+		Hash      string     `json:"hash"`
+		BlockSize int        `json:"block_size"`
+		Ops       []delta.Op `json:"ops"`
+	}{
+		Hash:      c.mode.HashLeaf(file),
+		BlockSize: sig.BlockSize,
+		Ops:       ops,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err = c.httpClient.Post(fmt.Sprintf("%s/delta/%s/%d%s", c.apiURL, rootHash, index, c.query()), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, 0, responseError(resp.StatusCode, body)
+	}
+
+	var result TreeResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &result, delta.Size(ops), nil
+}
+
+// UploadTree uploads a hierarchy of files and returns the root hash that
+// commits to the files and to the directories layout
+func (c *Client) UploadTree(files []TreeFile) (string, error) {
+	if len(files) == 0 {
+		return "", fmt.Errorf("invalid files")
+	}
+
+	data, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Post(c.apiURL+"/tree"+c.query(), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode > 300 {
+		return "", responseError(resp.StatusCode, body)
+	}
+
+	var result struct {
+		RootHash string `json:"root_hash"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.RootHash, nil
+}
+
+// DownloadPath downloads a file or a directory listing of a hierarchy by
+// its slash separated path, the empty path is the root directory
+func (c *Client) DownloadPath(rootHash, p string) (*TreeEntry, error) {
+	parts, err := mkt.SplitPath(p)
+	if err != nil {
+		return nil, err
+	}
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/tree/%s/%s", c.apiURL, rootHash, strings.Join(parts, "/")))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var entry TreeEntry
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// GetTreeRootHash calculates the root hash of a hierarchy of files
+func (c *Client) GetTreeRootHash(files []TreeFile) (string, error) {
+	mktFiles := make([]mkt.File, len(files))
+	for i, f := range files {
+		mktFiles[i] = mkt.File{Path: f.Path, Mode: f.Mode, Hash: c.mode.HashLeaf(f.File)}
+	}
+
+	dir, err := mkt.NewDirectory(mktFiles, c.mode)
+	if err != nil {
+		return "", err
+	}
+	return dir.Hash, nil
+}
+
+// VerifyPath verifies that the downloaded entry is in the path of the
+// hierarchy of the given root hash
+func (c *Client) VerifyPath(p string, entry *TreeEntry, rootHash string) bool {
+	hash := c.mode.HashLeaf(entry.File)
+	if entry.Entry.Type == mkt.EntryDir {
+		var err error
+		hash, err = mkt.DirectoryHash(entry.Entries, c.mode)
+		if err != nil {
+			return false
+		}
+	}
+	if hash != entry.Entry.Hash {
+		return false
+	}
+
+	return mkt.VerifyPathProof(p, hash, rootHash, entry.Proof, c.mode)
+}
+
+// query returns the query string with the mode and the order when they
+// are not the default ones and the message of the version
+func (c *Client) query() string {
+	values := url.Values{}
+	if c.mode != mkt.SHA256 {
+		values.Set("mode", string(c.mode))
+	}
+	if c.order != OrderAppend {
+		values.Set("order", c.order)
+	}
+	if c.commitMeta {
+		values.Set("commit_meta", "true")
+	}
+	if c.message != "" {
+		values.Set("message", c.message)
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return "?" + values.Encode()
+}
+
 // VerifyProof verifies the proof of a file against the given root hash
 func (c *Client) VerifyProof(file []byte, proof *mkt.Proof, rootHash string) bool {
-	hash := sha256.Sum256(file)
-	hashStr := hex.EncodeToString(hash[:])
+	return mkt.VerifyProofWithMode(c.mode.HashLeaf(file), rootHash, proof, c.mode)
+}
 
-	return mkt.VerifyProof(hashStr, rootHash, proof)
+// VerifyDownload verifies the proof of a downloaded file against the given
+// root hash, the metadata is verified too when the leaf commits to it
+func (c *Client) VerifyDownload(d *Download, rootHash string) bool {
+	leaf := c.leafOf(c.mode.HashLeaf(d.File), d)
+	return leaf != "" && mkt.VerifyProofWithMode(leaf, rootHash, d.Proof, c.mode)
+}
+
+// leafOf returns the leaf of a downloaded file with the given content hash,
+// empty when the leaf commits to metadata that was not sent
+func (c *Client) leafOf(hash string, d *Download) string {
+	if !d.CommitMeta {
+		return hash
+	}
+	if d.Meta == nil {
+		return ""
+	}
+	return d.Meta.LeafHash(hash, c.mode)
 }
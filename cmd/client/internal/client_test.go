@@ -1,23 +1,27 @@
 package client
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/jmsilvadev/zc/pkg/delta"
 	"github.com/jmsilvadev/zc/pkg/mkt"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUploadFiles(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/upload", r.URL.Path)
+		assert.Equal(t, "/v1/upload", r.URL.Path)
 		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 
 		var files [][]byte
@@ -49,7 +53,7 @@ func TestDownloadFile(t *testing.T) {
 		m := mkt.NewMerkleTree(hashes)
 		expectedRootHash := m.Root.Hash
 
-		assert.Equal(t, "/download/"+expectedRootHash+"/0", r.URL.Path)
+		assert.Equal(t, "/v1/download/"+expectedRootHash+"/0", r.URL.Path)
 
 		response := struct {
 			File  []byte     `json:"file"`
@@ -80,7 +84,7 @@ func TestDownloadFile(t *testing.T) {
 
 func TestUpdateFiles(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/update/newRootHash", r.URL.Path)
+		assert.Equal(t, "/v1/update/newRootHash", r.URL.Path)
 		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
 
 		var files [][]byte
@@ -156,3 +160,329 @@ func getDefaultConfigDir() string {
 	// TODO: put this dirname as a config env
 	return filepath.Join(homeDir, ".zc")
 }
+
+func TestKeccak256SortedMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/upload", r.URL.Path)
+		assert.Equal(t, string(mkt.Keccak256Sorted), r.URL.Query().Get("mode"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetMode(mkt.Keccak256Sorted)
+	assert.Equal(t, mkt.Keccak256Sorted, client.Mode())
+
+	files := [][]byte{[]byte("file1"), []byte("file2")}
+	_, err := client.UploadFiles(files)
+	assert.NoError(t, err)
+
+	hashes := []string{mkt.Keccak256Sorted.HashLeaf(files[0]), mkt.Keccak256Sorted.HashLeaf(files[1])}
+	m, err := mkt.NewMerkleTreeWithMode(hashes, mkt.Keccak256Sorted)
+	assert.NoError(t, err)
+	assert.Equal(t, m.Root.Hash, client.GetRootHash(files))
+
+	proof, err := m.GetProof(hashes[1])
+	assert.NoError(t, err)
+	assert.True(t, client.VerifyProof(files[1], proof, m.Root.Hash))
+}
+
+func TestGetLocalMode(t *testing.T) {
+	client := NewClient("")
+	tempDir := t.TempDir()
+
+	mode, err := client.GetLocalMode(tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, mkt.SHA256, mode)
+
+	err = os.WriteFile(filepath.Join(tempDir, ".mode"), []byte(mkt.Keccak256Sorted), 0644)
+	assert.NoError(t, err)
+
+	mode, err = client.GetLocalMode(tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, mkt.Keccak256Sorted, mode)
+}
+
+func TestUpdateWithOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/update/rootHash", r.URL.Path)
+		assert.Equal(t, OrderHash, r.URL.Query().Get("order"))
+
+		json.NewEncoder(w).Encode(TreeResult{
+			RootHash: "newRootHash",
+			Leaves:   []string{"a", "b", "c"},
+			Indexes:  []int{2},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	assert.Error(t, client.SetOrder("name"))
+	assert.NoError(t, client.SetOrder(OrderHash))
+
+	tempDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(tempDir, ".rootHash"), []byte("rootHash"), 0644)
+	assert.NoError(t, err)
+
+	result, err := client.Update([][]byte{[]byte("file3")}, tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "newRootHash", result.RootHash)
+	assert.Equal(t, []int{2}, result.Indexes)
+
+	files := [][]byte{[]byte("file2"), []byte("file1")}
+	hashes := []string{mkt.SHA256.HashLeaf(files[1]), mkt.SHA256.HashLeaf(files[0])}
+	if hashes[0] > hashes[1] {
+		hashes[0], hashes[1] = hashes[1], hashes[0]
+	}
+	assert.Equal(t, mkt.NewMerkleTree(hashes).Root.Hash, client.GetRootHash(files))
+}
+
+func TestUploadTreeAndDownloadPath(t *testing.T) {
+	files := []TreeFile{
+		{Path: "a/b c.txt", Mode: 0o644, File: []byte("file1")},
+		{Path: "d.txt", Mode: 0o600, File: []byte("file2")},
+	}
+	mktFiles := []mkt.File{
+		{Path: files[0].Path, Mode: files[0].Mode, Hash: mkt.SHA256.HashLeaf(files[0].File)},
+		{Path: files[1].Path, Mode: files[1].Mode, Hash: mkt.SHA256.HashLeaf(files[1].File)},
+	}
+	dir, err := mkt.NewDirectory(mktFiles, mkt.SHA256)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			assert.Equal(t, "/v1/tree", r.URL.Path)
+			json.NewEncoder(w).Encode(map[string]string{"root_hash": dir.Hash})
+			return
+		}
+
+		assert.Equal(t, "/v1/tree/"+dir.Hash+"/a/b c.txt", r.URL.Path)
+		entry, proof, err := dir.GetPathProof("a/b c.txt", mkt.SHA256)
+		assert.NoError(t, err)
+		json.NewEncoder(w).Encode(TreeEntry{Entry: *entry, File: files[0].File, Proof: proof})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	rootHash, err := client.GetTreeRootHash(files)
+	assert.NoError(t, err)
+	assert.Equal(t, dir.Hash, rootHash)
+
+	result, err := client.UploadTree(files)
+	assert.NoError(t, err)
+	assert.Equal(t, dir.Hash, result)
+
+	entry, err := client.DownloadPath(rootHash, "a/b c.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, files[0].File, entry.File)
+	assert.True(t, client.VerifyPath("a/b c.txt", entry, rootHash))
+	assert.False(t, client.VerifyPath("d.txt", entry, rootHash))
+
+	entry.File = []byte("tampered")
+	assert.False(t, client.VerifyPath("a/b c.txt", entry, rootHash))
+}
+
+func TestPatchFile(t *testing.T) {
+	base := bytes.Repeat([]byte("stored version "), 1000)
+	changed := append([]byte("changed "), base...)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			assert.Equal(t, "/v1/signature/rootHash/2", r.URL.Path)
+			sig, err := delta.NewSignature(base, 512)
+			assert.NoError(t, err)
+			json.NewEncoder(w).Encode(sig)
+			return
+		}
+
+		assert.Equal(t, "/v1/delta/rootHash/2", r.URL.Path)
+		var req struct {
+			Hash      string     `json:"hash"`
+			BlockSize int        `json:"block_size"`
+			Ops       []delta.Op `json:"ops"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.NoError(t, err)
+
+		file, err := delta.Apply(base, req.BlockSize, req.Ops, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, changed, file)
+		assert.Equal(t, mkt.SHA256.HashLeaf(changed), req.Hash)
+
+		json.NewEncoder(w).Encode(TreeResult{RootHash: "newRootHash", Indexes: []int{2}})
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(tempDir, ".rootHash"), []byte("rootHash"), 0644)
+	assert.NoError(t, err)
+
+	client := NewClient(server.URL)
+	result, sent, err := client.PatchFile(2, changed, tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "newRootHash", result.RootHash)
+	assert.Less(t, sent, 2*512)
+}
+
+func TestUploadPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	files := [][]byte{[]byte("file1"), []byte("file2")}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(tempDir, fmt.Sprintf("file%d", i))
+		err := os.WriteFile(paths[i], f, 0644)
+		assert.NoError(t, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		assert.NoError(t, err)
+
+		var leaves []string
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+
+			// Each file is preceded by its metadata
+			assert.Equal(t, "meta", part.FormName())
+			var meta mkt.Metadata
+			assert.NoError(t, json.NewDecoder(part).Decode(&meta))
+			assert.Equal(t, fmt.Sprintf("file%d", len(leaves)), meta.Name)
+			assert.Equal(t, uint32(0644), meta.Mode)
+
+			part, err = reader.NextPart()
+			assert.NoError(t, err)
+			assert.Equal(t, "file", part.FormName())
+			content, _ := io.ReadAll(part)
+			assert.Equal(t, int64(len(content)), meta.Size)
+			leaves = append(leaves, mkt.SHA256.HashLeaf(content))
+		}
+
+		json.NewEncoder(w).Encode(TreeResult{
+			RootHash: mkt.NewMerkleTree(leaves).Root.Hash,
+			Leaves:   leaves,
+			Indexes:  []int{0, 1},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	hashes := make([]string, len(paths))
+	for i, p := range paths {
+		hash, err := client.HashFile(p)
+		assert.NoError(t, err)
+		assert.Equal(t, mkt.SHA256.HashLeaf(files[i]), hash)
+		hashes[i] = hash
+	}
+
+	result, err := client.UploadPaths(paths)
+	assert.NoError(t, err)
+	assert.Equal(t, hashes, result.Leaves)
+	assert.Equal(t, client.GetRootHash(files), result.RootHash)
+	assert.Equal(t, client.GetRootHashOfHashes(hashes), result.RootHash)
+
+	err = os.WriteFile(filepath.Join(tempDir, ".rootHash"), []byte("rootHash"), 0644)
+	assert.NoError(t, err)
+	result, err = client.UpdatePaths(paths[:1], tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, hashes[:1], result.Leaves)
+
+	_, err = client.UploadPaths([]string{filepath.Join(tempDir, "missing")})
+	assert.Error(t, err)
+	_, err = client.UploadPaths(nil)
+	assert.Error(t, err)
+}
+
+func TestDownloadFileTo(t *testing.T) {
+	files := [][]byte{[]byte("file1"), []byte("file2")}
+	meta := mkt.Metadata{Name: "docs/b.txt", Size: 5, Mode: 0o600, ModTime: 1700000000}
+	hashes := []string{mkt.SHA256.HashLeaf(files[0]), meta.LeafHash(mkt.SHA256.HashLeaf(files[1]), mkt.SHA256)}
+	m := mkt.NewMerkleTree(hashes)
+
+	content := files[0]
+	sentMeta := meta
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index := 0
+		if r.URL.Path == "/v1/raw/"+m.Root.Hash+"/1" {
+			index = 1
+			metaJSON, _ := json.Marshal(sentMeta)
+			w.Header().Set("X-Merkle-Meta", base64.StdEncoding.EncodeToString(metaJSON))
+			w.Header().Set("X-Merkle-Commit-Meta", "true")
+		}
+
+		proof, _ := m.GetProof(hashes[index])
+		proofJSON, _ := json.Marshal(proof)
+		w.Header().Set("X-Merkle-Proof", string(proofJSON))
+		w.Header().Set("X-Merkle-Leaf", hashes[index])
+		if index == 1 {
+			w.Write(files[1])
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	dir := t.TempDir()
+
+	// The files without metadata are saved by their index
+	path, err := client.DownloadFileTo(0, m.Root.Hash, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "downloaded_file_0"), path)
+	downloaded, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, files[0], downloaded)
+
+	path, err = client.DownloadFileTo(1, m.Root.Hash, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "docs", "b.txt"), path)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.Equal(t, int64(1700000000), info.ModTime().Unix())
+
+	// A tampered file or metadata is not saved
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0755)
+	content = []byte("tampered")
+	_, err = client.DownloadFileTo(0, m.Root.Hash, dir)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	sentMeta.Name = "docs/c.txt"
+	_, err = client.DownloadFileTo(1, m.Root.Hash, dir)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+	assert.NoFileExists(t, filepath.Join(dir, "docs", "c.txt"))
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		assert.True(t, e.IsDir(), e.Name())
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	client := NewClient("")
+	file := []byte("file1")
+	meta := mkt.Metadata{Name: "a.txt", Size: 5}
+
+	for _, commit := range []bool{false, true} {
+		client.SetCommitMeta(commit)
+		leaf := client.LeafHash(mkt.SHA256.HashLeaf(file), meta)
+		assert.Equal(t, commit, leaf != mkt.SHA256.HashLeaf(file))
+
+		m := mkt.NewMerkleTree([]string{leaf, mkt.SHA256.HashLeaf([]byte("file2"))})
+		proof, _ := m.GetProof(leaf)
+
+		d := &Download{File: file, Proof: proof, Meta: &meta, CommitMeta: commit}
+		assert.True(t, client.VerifyDownload(d, m.Root.Hash))
+
+		// The metadata is only verified when the leaf commits to it
+		d.Meta = &mkt.Metadata{Name: "b.txt", Size: 5}
+		assert.Equal(t, !commit, client.VerifyDownload(d, m.Root.Hash))
+		d.Meta = nil
+		assert.Equal(t, !commit, client.VerifyDownload(d, m.Root.Hash))
+	}
+}
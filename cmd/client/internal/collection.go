@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+// Collection is a root known by the server, the type is flat for the
+// collections of files by index and tree for the hierarchies
+type Collection struct {
+	RootHash string `json:"root_hash"`
+	Type     string `json:"type"`
+}
+
+// CollectionList is a page of the roots known by the server
+type CollectionList struct {
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Roots  []Collection `json:"roots"`
+}
+
+// CollectionInfo is the summary of a collection, the leaves of a tree are
+// its files
+type CollectionInfo struct {
+	RootHash   string   `json:"root_hash"`
+	Type       string   `json:"type"`
+	Mode       mkt.Mode `json:"mode"`
+	CommitMeta bool     `json:"commit_meta,omitempty"`
+	LeafCount  int      `json:"leaf_count"`
+	TotalBytes int64    `json:"total_bytes"`
+}
+
+// Leaf is a file of a collection
+type Leaf struct {
+	Index int           `json:"index"`
+	Hash  string        `json:"hash"`
+	Size  int64         `json:"size"`
+	Meta  *mkt.Metadata `json:"meta,omitempty"`
+}
+
+// LeafList is a page of the leaves of a collection
+type LeafList struct {
+	RootHash  string `json:"root_hash"`
+	LeafCount int    `json:"leaf_count"`
+	Offset    int    `json:"offset"`
+	Limit     int    `json:"limit"`
+	Leaves    []Leaf `json:"leaves"`
+}
+
+// ListCollections returns a page of the roots known by the server
+func (c *Client) ListCollections(offset, limit int) (*CollectionList, error) {
+	var list CollectionList
+	err := c.getJSON(fmt.Sprintf("%s/collections?offset=%d&limit=%d", c.apiURL, offset, limit), &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetCollectionInfo returns the summary of the collection of the root
+func (c *Client) GetCollectionInfo(rootHash string) (*CollectionInfo, error) {
+	var info CollectionInfo
+	err := c.getJSON(fmt.Sprintf("%s/collections/%s", c.apiURL, rootHash), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListLeaves returns a page of the leaves of the collection of the root
+func (c *Client) ListLeaves(rootHash string, offset, limit int) (*LeafList, error) {
+	var list LeafList
+	err := c.getJSON(fmt.Sprintf("%s/collections/%s/leaves?offset=%d&limit=%d", c.apiURL, rootHash, offset, limit), &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// DeleteCollection deletes the collection of the root with all its
+// versions, only its owner can delete it
+func (c *Client) DeleteCollection(rootHash string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/collections/%s", c.apiURL, rootHash), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return responseError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (c *Client) getJSON(url string, v any) error {
+	resp, err := c.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode > 300 {
+		return responseError(resp.StatusCode, body)
+	}
+
+	return json.Unmarshal(body, v)
+}
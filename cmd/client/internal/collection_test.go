@@ -0,0 +1,52 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		switch r.URL.Path {
+		case "/v1/collections":
+			assert.Equal(t, "10", r.URL.Query().Get("offset"))
+			assert.Equal(t, "5", r.URL.Query().Get("limit"))
+			json.NewEncoder(w).Encode(CollectionList{Total: 11, Offset: 10, Limit: 5, Roots: []Collection{{RootHash: "root", Type: "flat"}}})
+		case "/v1/collections/root":
+			json.NewEncoder(w).Encode(CollectionInfo{RootHash: "root", Type: "flat", Mode: mkt.SHA256, LeafCount: 2, TotalBytes: 10})
+		case "/v1/collections/root/leaves":
+			assert.Equal(t, "1", r.URL.Query().Get("offset"))
+			json.NewEncoder(w).Encode(LeafList{RootHash: "root", LeafCount: 2, Offset: 1, Limit: 100, Leaves: []Leaf{{Index: 1, Hash: "h", Size: 4, Meta: &mkt.Metadata{Name: "a.txt", Size: 4}}}})
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	list, err := client.ListCollections(10, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 11, list.Total)
+	assert.Equal(t, []Collection{{RootHash: "root", Type: "flat"}}, list.Roots)
+
+	info, err := client.GetCollectionInfo("root")
+	require.NoError(t, err)
+	assert.Equal(t, 2, info.LeafCount)
+	assert.Equal(t, int64(10), info.TotalBytes)
+
+	leaves, err := client.ListLeaves("root", 1, 100)
+	require.NoError(t, err)
+	require.Len(t, leaves.Leaves, 1)
+	assert.Equal(t, "a.txt", leaves.Leaves[0].Meta.Name)
+
+	_, err = client.GetCollectionInfo("unknown")
+	assert.EqualError(t, err, "Not Found")
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Version is a root of the history of a collection, the roots stored before
+// the history have no time
+type Version struct {
+	RootHash string    `json:"root_hash"`
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// History has the versions retained of a collection, oldest first, the
+// head is its current root
+type History struct {
+	Collection string    `json:"collection"`
+	Head       string    `json:"head"`
+	Versions   []Version `json:"versions"`
+}
+
+// GetHistory returns the history of the collection of the root
+func (c *Client) GetHistory(rootHash string) (*History, error) {
+	var history History
+	err := c.getJSON(fmt.Sprintf("%s/history/%s", c.apiURL, rootHash), &history)
+	if err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+// Rollback makes the version with the root the head of the collection,
+// the files of the version are not sent again
+func (c *Client) Rollback(rootHash, to string) (*History, error) {
+	return c.rollback(rootHash, url.Values{"to": {to}})
+}
+
+// RollbackAt makes the version that was the head at the time the head of
+// the collection again
+func (c *Client) RollbackAt(rootHash string, at time.Time) (*History, error) {
+	return c.rollback(rootHash, url.Values{"at": {at.UTC().Format(time.RFC3339)}})
+}
+
+func (c *Client) rollback(rootHash string, values url.Values) (*History, error) {
+	if c.message != "" {
+		values.Set("message", c.message)
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("%s/history/%s/rollback?%s", c.apiURL, rootHash, values.Encode()), "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var history History
+	err = json.Unmarshal(body, &history)
+	if err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	versions := []Version{{RootHash: "first", Time: at, Op: "upload"}, {RootHash: "second", Time: at.Add(time.Hour), Op: "update", Message: "fix"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/history/second":
+			assert.Equal(t, http.MethodGet, r.Method)
+			json.NewEncoder(w).Encode(History{Collection: "first", Head: "second", Versions: versions})
+		case "/v1/history/second/rollback":
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "undo", r.URL.Query().Get("message"))
+			if r.URL.Query().Get("to") != "first" && r.URL.Query().Get("at") != "2024-01-02T03:04:05Z" {
+				http.Error(w, "version not found", http.StatusNotFound)
+				return
+			}
+			rollback := append(versions, Version{RootHash: "first", Time: at.Add(2 * time.Hour), Op: "rollback", Message: "undo"})
+			json.NewEncoder(w).Encode(History{Collection: "first", Head: "first", Versions: rollback})
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	history, err := client.GetHistory("second")
+	require.NoError(t, err)
+	assert.Equal(t, "second", history.Head)
+	assert.Equal(t, versions, history.Versions)
+
+	client.SetMessage("undo")
+	history, err = client.Rollback("second", "first")
+	require.NoError(t, err)
+	assert.Equal(t, "first", history.Head)
+	assert.Len(t, history.Versions, 3)
+
+	history, err = client.RollbackAt("second", at.In(time.FixedZone("", 3600)))
+	require.NoError(t, err)
+	assert.Equal(t, "first", history.Head)
+
+	_, err = client.Rollback("second", "unknown")
+	assert.EqualError(t, err, "version not found")
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+// LocalFile is a file of the disk to upload, the name is the slash
+// separated path saved in its metadata
+type LocalFile struct {
+	Path string
+	Name string
+}
+
+// NewLocalFiles returns the files of the paths named by their base names
+func NewLocalFiles(paths []string) []LocalFile {
+	files := make([]LocalFile, len(paths))
+	for i, p := range paths {
+		files[i] = LocalFile{Path: p, Name: filepath.Base(p)}
+	}
+	return files
+}
+
+// FileMetadata returns the metadata of a local file, the content type is
+// guessed by the extension of the name
+func FileMetadata(f LocalFile) (mkt.Metadata, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return mkt.Metadata{}, err
+	}
+
+	meta := mkt.Metadata{
+		Name:        f.Name,
+		Size:        info.Size(),
+		Mode:        uint32(info.Mode().Perm()),
+		ModTime:     info.ModTime().Unix(),
+		ContentType: mime.TypeByExtension(path.Ext(f.Name)),
+	}
+	return meta, meta.Validate()
+}
+
+// LeafHash returns the leaf of a file with the given content hash and
+// metadata, the leaf commits to the metadata when it is enabled
+func (c *Client) LeafHash(hash string, meta mkt.Metadata) string {
+	if !c.commitMeta {
+		return hash
+	}
+	return meta.LeafHash(hash, c.mode)
+}
+
+// localPath returns where a downloaded file is saved in the dir, the files
+// without a name are saved as downloaded_file_<index>
+func localPath(dir string, index int, meta *mkt.Metadata) string {
+	if meta == nil || meta.Name == "" || meta.Validate() != nil {
+		return filepath.Join(dir, "downloaded_file_"+strconv.Itoa(index))
+	}
+	return filepath.Join(dir, filepath.FromSlash(meta.Name))
+}
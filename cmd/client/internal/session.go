@@ -0,0 +1,310 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// defaultPartSize is the size of the data sent in each request of a
+	// resumable upload
+	defaultPartSize = 4 << 20
+	// defaultRetryDelay is the wait before resuming after an error, it
+	// grows with the consecutive errors
+	defaultRetryDelay = time.Second
+	// maxRetries is the number of consecutive errors before giving up, the
+	// upload is resumed by the next run
+	maxRetries = 5
+
+	// SessionUpload and SessionUpdate are the operations of the sessions
+	SessionUpload = "upload"
+	SessionUpdate = "update"
+)
+
+// ErrSessionNotFound is returned for unknown or expired sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionFile is the progress of a file of a resumable upload
+type SessionFile struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+}
+
+// Session is a resumable upload in the server
+type Session struct {
+	ID      string        `json:"id"`
+	Op      string        `json:"op"`
+	Root    string        `json:"root,omitempty"`
+	Mode    mkt.Mode      `json:"mode"`
+	Order   string        `json:"order"`
+	Files   []SessionFile `json:"files"`
+	Expires time.Time     `json:"expires"`
+}
+
+// localSession is the session saved in the config dir, it is resumed when
+// the same files are uploaded again
+type localSession struct {
+	ID    string         `json:"id"`
+	Op    string         `json:"op"`
+	Root  string         `json:"root,omitempty"`
+	Paths []string       `json:"paths"`
+	Sizes []int64        `json:"sizes"`
+	Meta  []mkt.Metadata `json:"meta"`
+	// CommitMeta is kept to not resume an upload with other leaves
+	CommitMeta bool `json:"commit_meta,omitempty"`
+}
+
+// CreateSession creates a resumable upload of files with the given sizes
+// and optionally their metadata, the root is the collection updated or
+// replaced
+func (c *Client) CreateSession(op, root string, sizes []int64, meta []mkt.Metadata) (*Session, error) {
+	data, err := json.Marshal(struct {
+		Op         string         `json:"op"`
+		Root       string         `json:"root,omitempty"`
+		Mode       string         `json:"mode,omitempty"`
+		Order      string         `json:"order,omitempty"`
+		CommitMeta bool           `json:"commit_meta,omitempty"`
+		Message    string         `json:"message,omitempty"`
+		Sizes      []int64        `json:"sizes"`
+		Meta       []mkt.Metadata `json:"meta,omitempty"`
+	}{
+		Op:         op,
+		Root:       root,
+		Mode:       string(c.mode),
+		Order:      c.order,
+		CommitMeta: c.commitMeta,
+		Message:    c.message,
+		Sizes:      sizes,
+		Meta:       meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Post(c.apiURL+"/sessions", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	return decodeSession(resp)
+}
+
+// GetSession returns the progress of a session
+func (c *Client) GetSession(id string) (*Session, error) {
+	resp, err := c.httpClient.Get(c.apiURL + "/sessions/" + id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSession(resp)
+}
+
+// PutSessionPart sends the data of a file of the session at the offset and
+// returns the progress of the session, the progress is also returned when
+// the offset is not the expected one
+func (c *Client) PutSessionPart(id string, index int, offset int64, data []byte) (*Session, error) {
+	url := fmt.Sprintf("%s/sessions/%s/%d?offset=%d", c.apiURL, id, index, offset)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSession(resp)
+}
+
+// FinalizeSession builds the tree of a complete session
+func (c *Client) FinalizeSession(id string) (*TreeResult, error) {
+	resp, err := c.httpClient.Post(c.apiURL+"/sessions/"+id+"/finalize", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode > 300 {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var result TreeResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UploadResumable uploads or updates the files in parts with their
+// metadata, the connection errors are retried from the last offset received
+// by the server. The session is saved in the config dir, so an upload
+// interrupted is resumed by the next call with the same files
+func (c *Client) UploadResumable(files []LocalFile, configDir, op string) (*TreeResult, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("invalid files")
+	}
+
+	local := localSession{
+		Op:         op,
+		Paths:      make([]string, len(files)),
+		Sizes:      make([]int64, len(files)),
+		Meta:       make([]mkt.Metadata, len(files)),
+		CommitMeta: c.commitMeta,
+	}
+	if op == SessionUpdate {
+		rootHash, err := c.GetLocalRootHash(configDir)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching the rootHash: %s", err)
+		}
+		local.Root = rootHash
+	}
+
+	for i, f := range files {
+		meta, err := FileMetadata(f)
+		if err != nil {
+			return nil, err
+		}
+		local.Paths[i] = f.Path
+		local.Sizes[i] = meta.Size
+		local.Meta[i] = meta
+	}
+
+	sess, err := c.resumeSession(configDir, &local)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range local.Paths {
+		err = c.sendFile(sess.ID, i, p, sess.Files[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := c.FinalizeSession(sess.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(filepath.Join(configDir, ".session"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// resumeSession returns the session saved for the same files or a new one
+func (c *Client) resumeSession(configDir string, local *localSession) (*Session, error) {
+	sessionPath := filepath.Join(configDir, ".session")
+
+	var saved localSession
+	data, err := os.ReadFile(sessionPath)
+	if err == nil && json.Unmarshal(data, &saved) == nil {
+		local.ID = saved.ID
+		if reflect.DeepEqual(saved, *local) {
+			sess, err := c.GetSession(saved.ID)
+			if err == nil {
+				return sess, nil
+			}
+			if !errors.Is(err, ErrSessionNotFound) {
+				return nil, err
+			}
+		}
+	}
+
+	sess, err := c.CreateSession(local.Op, local.Root, local.Sizes, local.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	local.ID = sess.ID
+	data, err = json.Marshal(local)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(sessionPath, data, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error saving session: %s error: %s", sessionPath, err)
+	}
+	return sess, nil
+}
+
+// sendFile sends the file from the offset of its progress
+func (c *Client) sendFile(id string, index int, path string, progress SessionFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, c.partSize)
+	offset := progress.Offset
+	retries := 0
+	for offset < progress.Size {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if int64(n) > progress.Size-offset {
+			n = int(progress.Size - offset)
+		}
+
+		sess, err := c.PutSessionPart(id, index, offset, buf[:n])
+		if err == nil {
+			offset = sess.Files[index].Offset
+			retries = 0
+			continue
+		}
+		if errors.Is(err, ErrSessionNotFound) || retries == maxRetries {
+			return err
+		}
+
+		// Wait and continue from the data received by the server
+		retries++
+		time.Sleep(time.Duration(retries) * c.retryDelay)
+		sess, err = c.GetSession(id)
+		if err == nil {
+			offset = sess.Files[index].Offset
+		}
+	}
+	return nil
+}
+
+// decodeSession returns the session of the response, the conflicts also
+// return the progress of the session
+func decodeSession(resp *http.Response) (*Session, error) {
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSessionNotFound
+	}
+	if resp.StatusCode > 300 && resp.StatusCode != http.StatusConflict {
+		return nil, responseError(resp.StatusCode, body)
+	}
+
+	var sess Session
+	err = json.Unmarshal(body, &sess)
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
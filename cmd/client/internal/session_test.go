@@ -0,0 +1,156 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakySessions is an in memory session server that drops the connection
+// of the PUTs while drop is positive, after dropAfter PUTs were received
+type flakySessions struct {
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	data      map[string][][]byte
+	drop      int
+	dropAfter int
+	puts      []int64
+	created   int
+	meta      []mkt.Metadata
+}
+
+func (f *flakySessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/sessions":
+		var req struct {
+			Op    string         `json:"op"`
+			Root  string         `json:"root"`
+			Sizes []int64        `json:"sizes"`
+			Meta  []mkt.Metadata `json:"meta"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.created++
+		f.meta = req.Meta
+		sess := &Session{ID: strconv.Itoa(f.created), Op: req.Op, Root: req.Root, Mode: mkt.SHA256}
+		for _, size := range req.Sizes {
+			sess.Files = append(sess.Files, SessionFile{Size: size})
+		}
+		f.sessions[sess.ID] = sess
+		f.data[sess.ID] = make([][]byte, len(req.Sizes))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sess)
+	case r.Method == http.MethodGet:
+		sess, ok := f.sessions[parts[3]]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(sess)
+	case r.Method == http.MethodPut:
+		if f.drop > 0 && len(f.puts) >= f.dropAfter {
+			f.drop--
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		sess := f.sessions[parts[3]]
+		index, _ := strconv.Atoi(parts[4])
+		offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		f.puts = append(f.puts, offset)
+		if offset != sess.Files[index].Offset {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(sess)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.data[sess.ID][index] = append(f.data[sess.ID][index], data...)
+		sess.Files[index].Offset += int64(len(data))
+		json.NewEncoder(w).Encode(sess)
+	case r.Method == http.MethodPost && parts[4] == "finalize":
+		var leaves []string
+		for _, d := range f.data[parts[3]] {
+			leaves = append(leaves, mkt.SHA256.HashLeaf(d))
+		}
+		delete(f.sessions, parts[3])
+		json.NewEncoder(w).Encode(TreeResult{RootHash: mkt.NewMerkleTree(leaves).Root.Hash, Leaves: leaves})
+	}
+}
+
+func TestUploadResumable(t *testing.T) {
+	fake := &flakySessions{sessions: map[string]*Session{}, data: map[string][][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.partSize = 4
+	client.retryDelay = 0
+
+	tempDir := t.TempDir()
+	files := [][]byte{[]byte("0123456789"), []byte("abc"), {}}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(tempDir, "file"+strconv.Itoa(i))
+		require.NoError(t, os.WriteFile(paths[i], f, 0644))
+	}
+
+	// The dropped connections are retried
+	fake.drop = 2
+	result, err := client.UploadResumable(NewLocalFiles(paths), tempDir, SessionUpload)
+	require.NoError(t, err)
+	assert.Equal(t, client.GetRootHash(files), result.RootHash)
+	assert.Equal(t, []int64{0, 4, 8, 0}, fake.puts)
+	assert.NoFileExists(t, filepath.Join(tempDir, ".session"))
+	require.Len(t, fake.meta, len(files))
+	for i, meta := range fake.meta {
+		assert.Equal(t, "file"+strconv.Itoa(i), meta.Name)
+		assert.Equal(t, int64(len(files[i])), meta.Size)
+	}
+
+	// An upload that gives up is resumed by the next call
+	fake.puts = nil
+	fake.drop = maxRetries + 1
+	fake.dropAfter = 1
+	client.partSize = 8
+	_, err = client.UploadResumable(NewLocalFiles(paths), tempDir, SessionUpload)
+	require.Error(t, err)
+	assert.FileExists(t, filepath.Join(tempDir, ".session"))
+
+	fake.drop = 0
+	fake.puts = nil
+	created := fake.created
+	result, err = client.UploadResumable(NewLocalFiles(paths), tempDir, SessionUpload)
+	require.NoError(t, err)
+	assert.Equal(t, created, fake.created)
+	assert.Equal(t, []int64{8, 0}, fake.puts)
+	assert.Equal(t, client.GetRootHash(files), result.RootHash)
+
+	// A saved session of other files is not resumed
+	fake.drop = maxRetries + 1
+	fake.dropAfter = 0
+	_, err = client.UploadResumable(NewLocalFiles(paths[:1]), tempDir, SessionUpload)
+	require.Error(t, err)
+	fake.drop = 0
+	_, err = client.UploadResumable(NewLocalFiles(paths[1:]), tempDir, SessionUpload)
+	require.NoError(t, err)
+	assert.Equal(t, created+2, fake.created)
+
+	_, err = client.UploadResumable(nil, tempDir, SessionUpload)
+	assert.Error(t, err)
+	_, err = client.GetSession("unknown")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
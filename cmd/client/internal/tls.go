@@ -0,0 +1,40 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/jmsilvadev/zc/pkg/certs"
+)
+
+// SetTLS verifies the server with the CA bundle instead of the system roots
+// and presents the client certificate to the servers requiring one, the
+// empty files are not used
+func (c *Client) SetTLS(caFile, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("the client certificate and its key must be set together")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := certs.LoadPool(caFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.transport = transport
+	c.useTransport()
+	return nil
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/certs"
+	"github.com/jmsilvadev/zc/pkg/certs/certstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetTLS(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+	reloader, err := certs.NewReloader(files.ServerCert, files.ServerKey, files.CA)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Len(t, r.TLS.PeerCertificates, 1)
+		assert.Equal(t, "zc test client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		w.Write([]byte("upload successful"))
+	}))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetCredentials(Credentials{Token: "token"})
+	require.NoError(t, client.SetTLS(files.CA, files.ClientCert, files.ClientKey))
+	resp, err := client.UploadFiles([][]byte{[]byte("file1")})
+	require.NoError(t, err)
+	assert.Equal(t, "upload successful", resp)
+
+	// The server refuses the clients without a certificate
+	client = NewClient(server.URL)
+	require.NoError(t, client.SetTLS(files.CA, "", ""))
+	_, err = client.UploadFiles([][]byte{[]byte("file1")})
+	assert.Error(t, err)
+
+	// The server is not trusted without the CA
+	client = NewClient(server.URL)
+	require.NoError(t, client.SetTLS("", files.ClientCert, files.ClientKey))
+	_, err = client.UploadFiles([][]byte{[]byte("file1")})
+	assert.Error(t, err)
+
+	assert.Error(t, client.SetTLS(files.CA, files.ClientCert, ""))
+	assert.Error(t, client.SetTLS(files.ServerKey, "", ""))
+}
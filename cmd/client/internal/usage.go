@@ -0,0 +1,31 @@
+package client
+
+import "fmt"
+
+// Usage is what the keyspace of a tenant stores, the files are counted once
+// by content
+type Usage struct {
+	Bytes       int64 `json:"bytes"`
+	Files       int64 `json:"files"`
+	Collections int64 `json:"collections"`
+}
+
+// TenantUsage is the usage of a tenant with its quota, zero limits are
+// unlimited
+type TenantUsage struct {
+	Name           string `json:"name"`
+	MaxBytes       int64  `json:"max_bytes"`
+	MaxFiles       int64  `json:"max_files"`
+	MaxCollections int64  `json:"max_collections"`
+	Usage          Usage  `json:"usage"`
+}
+
+// GetUsage returns the usage of the tenant of the client
+func (c *Client) GetUsage() (*TenantUsage, error) {
+	var usage TenantUsage
+	err := c.getJSON(fmt.Sprintf("%s/usage", c.apiURL), &usage)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/usage", r.URL.Path)
+		tenant := r.Header.Get(tenantHeader)
+		if tenant == "" {
+			tenant = "default"
+		}
+		token, _ := auth.ParseBearer(r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(TenantUsage{Name: tenant + " " + token, MaxFiles: 10, Usage: Usage{Bytes: 5, Files: 1, Collections: 1}})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	usage, err := client.GetUsage()
+	require.NoError(t, err)
+	assert.Equal(t, "default ", usage.Name)
+	assert.Equal(t, int64(10), usage.MaxFiles)
+	assert.Equal(t, Usage{Bytes: 5, Files: 1, Collections: 1}, usage.Usage)
+
+	// The tenant of the credentials is used unless another one is set
+	client.SetCredentials(Credentials{Token: "admin", Tenant: "team-a"})
+	usage, err = client.GetUsage()
+	require.NoError(t, err)
+	assert.Equal(t, "team-a admin", usage.Name)
+
+	client.SetTenant("team-b")
+	usage, err = client.GetUsage()
+	require.NoError(t, err)
+	assert.Equal(t, "team-b admin", usage.Name)
+}
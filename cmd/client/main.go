@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	client "github.com/jmsilvadev/zc/cmd/client/internal"
+	"github.com/jmsilvadev/zc/pkg/mkt"
 )
 
 func main() {
@@ -22,15 +28,33 @@ func run(flagSet *flag.FlagSet, args []string) error {
 	dir := flagSet.String("dir", "", "Directory containing files for upload")
 	filesList := flagSet.String("files", "", "Comma-separated list of files for upload")
 	serverHost := flagSet.String("host", "http://localhost:5000", "Server host")
-	operation := flagSet.String("operation", "upload", "Operation to perform: upload, update or download. Attention: perform an upload will always remove the existent data")
+	operation := flagSet.String("operation", "upload", "Operation to perform: upload, update, patch, download, upload-tree, restore, list, info, history, rollback, usage, share, unshare or grants. Patch replaces the file of the index sending only the changed blocks, list shows the files of the collection, info its summary, history its versions, rollback makes a previous version the current one, usage shows what the tenant stores with its quota, share and unshare grant and revoke the access of a principal to the collection and grants lists them. Attention: perform an upload will always remove the existent data")
 	index := flagSet.Int("index", -1, "Index of the file to download")
 	del := flagSet.Bool("delete", true, "If the client can delete the local files after the upload")
-	configDir := flagSet.String("config-dir", getDefaultConfigDir(), "Directory to store rootHash and downloaded files")
+	configDir := flagSet.String("config-dir", getDefaultConfigDir(), "Directory to store rootHash and downloaded files, the credentials are read from its .credentials file")
+	treePath := flagSet.String("path", "", "Slash separated path of the file to download from a tree uploaded with upload-tree")
+	order := flagSet.String("order", client.OrderAppend, "Order of the files in the tree: append keeps the existent indexes and appends the new files in the given order, hash sorts all the files by hash")
+	modeName := flagSet.String("mode", string(mkt.SHA256), "Tree mode used in the upload: sha256 or keccak256-sorted (OpenZeppelin MerkleProof compatible). Update and download use the mode saved by the upload")
+	root := flagSet.String("root", "", "Root hash used by list, info, history and download, by default the root saved by the upload. With the rollback operation, the root of the version restored")
+	all := flagSet.Bool("all", false, "With the list operation, lists the roots known by the server instead of the files of the collection")
+	offset := flagSet.Int("offset", 0, "Position of the first item listed by the list operation")
+	limit := flagSet.Int("limit", 100, "Maximum number of items listed by the list operation")
+	at := flagSet.String("at", "", "With the rollback operation, restores the version that was current at this RFC3339 time")
+	message := flagSet.String("message", "", "Message kept in the history with the version created by the operation")
+	principal := flagSet.String("principal", "", "Id of the credential that share and unshare grant or revoke the access to the collection")
+	access := flagSet.String("access", client.AccessRead, "Access granted by share: read downloads and verifies the collection, write also changes it")
+	tenant := flagSet.String("tenant", "", "Tenant of the requests, only used by the admin credentials and by the servers without authentication, the other credentials are bound to their tenant")
+	caFile := flagSet.String("ca", "", "PEM bundle of the CAs trusted to verify an https server instead of the system roots")
+	certFile := flagSet.String("cert", "", "PEM certificate presented to the https servers requiring client certificates, used with -key")
+	keyFile := flagSet.String("key", "", "PEM key of the client certificate")
+	commitMeta := flagSet.Bool("commit-meta", false, "If the leaves of the upload commit to the metadata of the files (name, size, permissions, modification time and content type). Update keeps the choice of the upload")
 
 	flagSet.Parse(args)
 
-	if *operation != "upload" && *operation != "update" && *operation != "download" {
-		return fmt.Errorf("invalid operation. Please specify 'upload' or 'update' or 'download' using the -operation parameter")
+	switch *operation {
+	case "upload", "update", "patch", "download", "upload-tree", "restore", "list", "info", "history", "rollback", "usage", "share", "unshare", "grants":
+	default:
+		return fmt.Errorf("invalid operation. Please specify 'upload', 'update', 'patch', 'download', 'upload-tree', 'restore', 'list', 'info', 'history', 'rollback', 'usage', 'share', 'unshare' or 'grants' using the -operation parameter")
 	}
 
 	err := isDirAvailable(*configDir)
@@ -39,14 +63,110 @@ func run(flagSet *flag.FlagSet, args []string) error {
 	}
 
 	c := client.NewClient(*serverHost)
+	err = c.SetOrder(*order)
+	if err != nil {
+		return err
+	}
+	c.SetMessage(*message)
+
+	if *caFile != "" || *certFile != "" || *keyFile != "" {
+		err = c.SetTLS(*caFile, *certFile, *keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading the TLS files: %s", err)
+		}
+	}
+
+	creds, err := client.LoadCredentials(*configDir)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		c.SetCredentials(*creds)
+	}
+	if *tenant != "" {
+		c.SetTenant(*tenant)
+	}
+
+	if *operation == "usage" {
+		return usage(c)
+	}
+
+	if *operation == "upload" || *operation == "upload-tree" {
+		mode, err := mkt.ParseMode(*modeName)
+		if err != nil {
+			return err
+		}
+		c.SetMode(mode)
+		c.SetCommitMeta(*commitMeta)
+	}
+
 	if *operation == "upload" {
-		err := upload(c, dir, filesList, *configDir)
+		err = upload(c, dir, filesList, *configDir)
 		if err == nil && *del {
 			return removeLocalFiles(*dir, *filesList)
 		}
 		return nil
 	}
 
+	if *operation == "upload-tree" {
+		err = uploadTree(c, *dir, *configDir)
+		if err != nil {
+			return err
+		}
+		if *del {
+			return removeLocalFiles(*dir, "")
+		}
+		return nil
+	}
+
+	if *operation == "list" && *all {
+		return listCollections(c, *offset, *limit)
+	}
+
+	if *operation == "list" || *operation == "info" {
+		if *root == "" {
+			*root, err = c.GetLocalRootHash(*configDir)
+			if err != nil {
+				return fmt.Errorf("error fetching the rootHash: %s", err)
+			}
+		}
+		if *operation == "info" {
+			return info(c, *root)
+		}
+		return listLeaves(c, *root, *offset, *limit)
+	}
+
+	if *operation == "history" {
+		rootHash, err := localRoot(c, *root, *configDir)
+		if err != nil {
+			return err
+		}
+		return history(c, rootHash)
+	}
+
+	if *operation == "share" || *operation == "unshare" || *operation == "grants" {
+		rootHash, err := localRoot(c, *root, *configDir)
+		if err != nil {
+			return err
+		}
+		return share(c, *operation, rootHash, *principal, *access)
+	}
+
+	if *operation == "rollback" {
+		// The root is the version restored, the collection is the local one
+		rootHash, err := localRoot(c, "", *configDir)
+		if err != nil {
+			return err
+		}
+		return rollback(c, rootHash, *root, *at, *configDir)
+	}
+
+	mode, err := c.GetLocalMode(*configDir)
+	if err != nil {
+		return fmt.Errorf("error fetching the mode: %s", err)
+	}
+	c.SetMode(mode)
+
 	if *operation == "update" {
 		err := update(c, dir, filesList, *configDir)
 		if err == nil && *del {
@@ -55,7 +175,19 @@ func run(flagSet *flag.FlagSet, args []string) error {
 		return nil
 	}
 
-	return download(c, index, configDir)
+	if *operation == "patch" {
+		return patch(c, *index, *filesList, *configDir)
+	}
+
+	if *operation == "restore" {
+		return restore(c, *dir, *configDir)
+	}
+
+	if *treePath != "" {
+		return downloadPath(c, *treePath, *root, *configDir)
+	}
+
+	return download(c, index, *root, configDir)
 }
 
 func upload(c *client.Client, dir, filesList *string, configDir string) error {
@@ -63,125 +195,504 @@ func upload(c *client.Client, dir, filesList *string, configDir string) error {
 		return fmt.Errorf("please provide the directory containing the files using the -dir parameter or a list of files using the -files parameter")
 	}
 
-	var files [][]byte
-	if *dir != "" {
-		files = getFilesFromDir(*dir)
+	files, hashes, leaves, err := getUploadFiles(c, *dir, *filesList)
+	if err != nil {
+		return err
 	}
 
-	if *filesList != "" {
-		files = getFiles(*filesList)
+	rootHash := c.GetRootHashOfHashes(leaves)
+	result, err := c.UploadResumable(files, configDir, client.SessionUpload)
+	if err != nil {
+		return fmt.Errorf("error uploading files: %s", err)
 	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no files found for upload")
+	if result.RootHash != rootHash || !isValid(c, hashes, result.Indexes, rootHash) {
+		return fmt.Errorf("the upload process was unsuccessful, it's not safe to delete from the local filesystem")
+	}
+
+	err = saveLocalRoot(configDir, rootHash, c.Mode())
+	if err != nil {
+		return err
+	}
+
+	printIndexes(result.Indexes)
+	fmt.Println("All files were uploaded and validated properly.")
+	return nil
+}
+
+func update(c *client.Client, dir, filesList *string, configDir string) error {
+	if *dir == "" && *filesList == "" {
+		return fmt.Errorf("please provide the directory containing the files using the -dir parameter or a list of files using the -files parameter")
+	}
+
+	files, hashes, _, err := getUploadFiles(c, *dir, *filesList)
+	if err != nil {
+		return err
 	}
 
-	rootHash := c.GetRootHash(files)
-	_, err := c.UploadFiles(files)
+	result, err := c.UploadResumable(files, configDir, client.SessionUpdate)
 	if err != nil {
 		return fmt.Errorf("error uploading files: %s", err)
 	}
 
-	if !isValid(c, files, rootHash) {
+	rootHash := result.RootHash
+	if !isValid(c, hashes, result.Indexes, rootHash) {
 		return fmt.Errorf("the upload process was unsuccessful, it's not safe to delete from the local filesystem")
 	}
 
-	rootHashPath := filepath.Join(configDir, ".rootHash")
-	err = os.WriteFile(rootHashPath, []byte(rootHash), 0644)
+	err = saveLocalRoot(configDir, rootHash, c.Mode())
 	if err != nil {
-		return fmt.Errorf("error saving rootHash: %s error: %s", rootHashPath, err)
+		return err
 	}
 
+	printIndexes(result.Indexes)
 	fmt.Println("All files were uploaded and validated properly.")
 	return nil
 }
 
-func update(c *client.Client, dir, filesList *string, configDir string) error {
-	if *dir == "" && *filesList == "" {
-		return fmt.Errorf("please provide the directory containing the files using the -dir parameter or a list of files using the -files parameter")
+// getUploadFiles returns the files to upload with their content hashes and
+// their leaves, the files are hashed from the disk and streamed in the
+// upload. The files of the dir are named by their path relative to it
+func getUploadFiles(c *client.Client, dir, filesList string) ([]client.LocalFile, []string, []string, error) {
+	var files []client.LocalFile
+	if dir != "" {
+		for _, p := range getPathsFromDir(dir) {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			files = append(files, client.LocalFile{Path: p, Name: filepath.ToSlash(rel)})
+		}
 	}
 
-	var files [][]byte
-	if *dir != "" {
-		files = getFilesFromDir(*dir)
+	if filesList != "" {
+		files = client.NewLocalFiles(getPaths(filesList))
 	}
 
-	if *filesList != "" {
-		files = getFiles(*filesList)
+	if len(files) == 0 {
+		return nil, nil, nil, fmt.Errorf("no files found for upload")
+	}
+
+	hashes := make([]string, len(files))
+	leaves := make([]string, len(files))
+	for i, f := range files {
+		hash, err := c.HashFile(f.Path)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error reading file: %s", err)
+		}
+		meta, err := client.FileMetadata(f)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error reading file: %s", err)
+		}
+		hashes[i] = hash
+		leaves[i] = c.LeafHash(hash, meta)
+	}
+	return files, hashes, leaves, nil
+}
+
+// listCollections prints a page of the roots known by the server
+func listCollections(c *client.Client, offset, limit int) error {
+	list, err := c.ListCollections(offset, limit)
+	if err != nil {
+		return fmt.Errorf("error listing the collections: %s", err)
+	}
+
+	for _, r := range list.Roots {
+		fmt.Printf("%s %s\n", r.RootHash, r.Type)
+	}
+	fmt.Printf("%d of %d collections listed from %d\n", len(list.Roots), list.Total, list.Offset)
+	return nil
+}
+
+// listLeaves prints a page of the files of the collection
+func listLeaves(c *client.Client, rootHash string, offset, limit int) error {
+	list, err := c.ListLeaves(rootHash, offset, limit)
+	if err != nil {
+		return fmt.Errorf("error listing the files: %s", err)
+	}
+
+	for _, l := range list.Leaves {
+		name := ""
+		if l.Meta != nil {
+			name = l.Meta.Name
+		}
+		fmt.Printf("%d %s %d %s\n", l.Index, l.Hash, l.Size, name)
+	}
+	fmt.Printf("%d of %d files listed from %d\n", len(list.Leaves), list.LeafCount, list.Offset)
+	return nil
+}
+
+// info prints the summary of the collection
+func info(c *client.Client, rootHash string) error {
+	info, err := c.GetCollectionInfo(rootHash)
+	if err != nil {
+		return fmt.Errorf("error fetching the collection: %s", err)
+	}
+
+	fmt.Printf("Root: %s\n", info.RootHash)
+	fmt.Printf("Type: %s\n", info.Type)
+	fmt.Printf("Mode: %s\n", info.Mode)
+	fmt.Printf("Commit metadata: %t\n", info.CommitMeta)
+	fmt.Printf("Files: %d\n", info.LeafCount)
+	fmt.Printf("Total bytes: %d\n", info.TotalBytes)
+	return nil
+}
+
+// usage prints what the tenant stores with its quota
+func usage(c *client.Client) error {
+	u, err := c.GetUsage()
+	if err != nil {
+		return fmt.Errorf("error fetching the usage: %s", err)
+	}
+
+	limit := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	if u.Name != "" {
+		fmt.Printf("Tenant: %s\n", u.Name)
+	}
+	fmt.Printf("Bytes: %d of %s\n", u.Usage.Bytes, limit(u.MaxBytes))
+	fmt.Printf("Files: %d of %s\n", u.Usage.Files, limit(u.MaxFiles))
+	fmt.Printf("Collections: %d of %s\n", u.Usage.Collections, limit(u.MaxCollections))
+	return nil
+}
+
+// share grants or revokes the access of the principal to the collection and
+// prints its grants
+func share(c *client.Client, operation, rootHash, principal, access string) error {
+	if operation != "grants" && principal == "" {
+		return fmt.Errorf("please provide the id of the credential using the -principal parameter")
+	}
+
+	var acl *client.ACL
+	var err error
+	switch operation {
+	case "share":
+		acl, err = c.Share(rootHash, principal, access)
+	case "unshare":
+		acl, err = c.Unshare(rootHash, principal)
+	default:
+		acl, err = c.GetACL(rootHash)
+	}
+	if err != nil {
+		return fmt.Errorf("error sharing the collection: %s", err)
+	}
+
+	fmt.Printf("Collection: %s\n", acl.Collection)
+	if acl.Owner != "" {
+		fmt.Printf("Owner: %s\n", acl.Owner)
+	}
+	for _, g := range acl.Grants {
+		fmt.Printf("%s %s %s\n", g.Principal, g.Access, g.Name)
+	}
+	fmt.Printf("%d grants\n", len(acl.Grants))
+	return nil
+}
+
+// history prints the versions of the collection, oldest first
+func history(c *client.Client, rootHash string) error {
+	h, err := c.GetHistory(rootHash)
+	if err != nil {
+		return fmt.Errorf("error fetching the history: %s", err)
+	}
+
+	for _, v := range h.Versions {
+		when := "-"
+		if !v.Time.IsZero() {
+			when = v.Time.Format(time.RFC3339)
+		}
+		fmt.Printf("%s %s %s %s\n", when, v.RootHash, v.Op, v.Message)
+	}
+	fmt.Printf("Current version: %s\n", h.Head)
+	return nil
+}
+
+// rollback makes the version of the root to, or the one current at the
+// time at, the current version of the collection and saves its root
+func rollback(c *client.Client, rootHash, to, at, configDir string) error {
+	if (to == "") == (at == "") {
+		return fmt.Errorf("please provide the root of the version using the -root parameter or its time using the -at parameter")
+	}
+
+	var h *client.History
+	var err error
+	if to != "" {
+		h, err = c.Rollback(rootHash, to)
+	} else {
+		var when time.Time
+		when, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			return fmt.Errorf("invalid time %s, use RFC3339 like 2006-01-02T15:04:05Z", at)
+		}
+		h, err = c.RollbackAt(rootHash, when)
+	}
+	if err != nil {
+		return fmt.Errorf("error rolling back: %s", err)
+	}
+
+	// The versions of a collection replaced by an upload may have other modes
+	info, err := c.GetCollectionInfo(h.Head)
+	if err != nil {
+		return fmt.Errorf("error fetching the collection: %s", err)
+	}
+
+	err = saveLocalRoot(configDir, h.Head, info.Mode)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Collection rolled back to %s\n", h.Head)
+	return nil
+}
+
+// download saves the file of the index of the root, by default the root
+// saved by the upload
+func download(c *client.Client, index *int, rootHash string, configDir *string) error {
+	if *index == -1 || *configDir == "" {
+		return fmt.Errorf("please provide the index and configDir parameters for the download operation")
+	}
+
+	rootHash, err := localRoot(c, rootHash, *configDir)
+	if err != nil {
+		return err
+	}
+
+	// TODO: put this dirname as a config env
+	filePath, err := c.DownloadFileTo(*index, rootHash, filepath.Join(*configDir, "downloaded"))
+	if errors.Is(err, client.ErrInvalidFile) {
+		fmt.Println("The download process was unsuccessful or the file is invalid")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading file: %s", err)
+	}
+
+	fmt.Printf("File downloaded, verified and saved as %s\n", filePath)
+	return nil
+}
+
+// patch replaces the file of the index with a new version using a delta
+func patch(c *client.Client, index int, filesList, configDir string) error {
+	filePaths := strings.Split(filesList, ",")
+	if index == -1 || len(filePaths) != 1 || filePaths[0] == "" {
+		return fmt.Errorf("please provide the index and a single file using the -index and -files parameters for the patch operation")
+	}
+
+	file, err := os.ReadFile(strings.TrimSpace(filePaths[0]))
+	if err != nil {
+		return fmt.Errorf("error reading file: %s", err)
+	}
+
+	result, sent, err := c.PatchFile(index, file, configDir)
+	if err != nil {
+		return fmt.Errorf("error patching file: %s", err)
+	}
+
+	if !isValid(c, []string{c.Mode().HashLeaf(file)}, result.Indexes, result.RootHash) {
+		return fmt.Errorf("the patch process was unsuccessful")
+	}
+
+	err = saveLocalRoot(configDir, result.RootHash, c.Mode())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("File %d patched and validated properly, %d of %d bytes sent.\n", index, sent, len(file))
+	return nil
+}
+
+func uploadTree(c *client.Client, dir, configDir string) error {
+	if dir == "" {
+		return fmt.Errorf("please provide the directory containing the files using the -dir parameter")
+	}
+
+	files, err := getTreeFilesFromDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %s", err)
 	}
 
 	if len(files) == 0 {
 		return fmt.Errorf("no files found for upload")
 	}
 
-	rootHash, err := c.UpdateFiles(files, configDir)
+	rootHash, err := c.GetTreeRootHash(files)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.UploadTree(files)
 	if err != nil {
 		return fmt.Errorf("error uploading files: %s", err)
 	}
 
-	if !isValid(c, files, rootHash) {
+	isValid := result == rootHash
+	for _, f := range files {
+		entry, err := c.DownloadPath(rootHash, f.Path)
+		if err != nil {
+			fmt.Println("Error downloading file:", err)
+			isValid = false
+			break
+		}
+		if !bytes.Equal(entry.File, f.File) || entry.Entry.Mode != f.Mode || !c.VerifyPath(f.Path, entry, rootHash) {
+			isValid = false
+		}
+	}
+
+	if !isValid {
 		return fmt.Errorf("the upload process was unsuccessful, it's not safe to delete from the local filesystem")
 	}
 
-	rootHashPath := filepath.Join(configDir, ".rootHash")
-	err = os.WriteFile(rootHashPath, []byte(rootHash), 0644)
+	err = saveLocalRoot(configDir, rootHash, c.Mode())
 	if err != nil {
-		return fmt.Errorf("error saving rootHash: %s error: %s", rootHashPath, err)
+		return err
 	}
 
 	fmt.Println("All files were uploaded and validated properly.")
 	return nil
 }
 
-func download(c *client.Client, index *int, configDir *string) error {
-	if *index == -1 || *configDir == "" {
-		return fmt.Errorf("please provide the index and configDir parameters for the download operation")
+// restore downloads and verifies the whole hierarchy into the dir
+func restore(c *client.Client, dir, configDir string) error {
+	if dir == "" {
+		return fmt.Errorf("please provide the destination directory using the -dir parameter")
 	}
 
-	rootHash, err := c.GetLocalRootHash(*configDir)
+	rootHash, err := c.GetLocalRootHash(configDir)
 	if err != nil {
 		return fmt.Errorf("error fetching the rootHash: %s", err)
 	}
 
-	file, proof, err := c.DownloadFile(*index, rootHash)
+	count := 0
+	pending := []string{""}
+	for len(pending) > 0 {
+		p := pending[0]
+		pending = pending[1:]
+
+		entry, err := c.DownloadPath(rootHash, p)
+		if err != nil {
+			return fmt.Errorf("error downloading %s: %s", p, err)
+		}
+		if !c.VerifyPath(p, entry, rootHash) {
+			return fmt.Errorf("the path %s is invalid", p)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(p))
+		if entry.Entry.Type == mkt.EntryDir {
+			err = os.MkdirAll(target, 0755)
+			if err != nil {
+				return fmt.Errorf("error creating directory: %s error: %v", target, err)
+			}
+			for _, e := range entry.Entries {
+				pending = append(pending, path.Join(p, e.Name))
+			}
+			continue
+		}
+
+		err = os.WriteFile(target, entry.File, os.FileMode(entry.Entry.Mode).Perm())
+		if err != nil {
+			return fmt.Errorf("error saving file: %s error: %v", target, err)
+		}
+		count++
+	}
+
+	fmt.Printf("%d files downloaded, verified and restored in %s\n", count, dir)
+	return nil
+}
+
+func downloadPath(c *client.Client, p, rootHash, configDir string) error {
+	rootHash, err := localRoot(c, rootHash, configDir)
+	if err != nil {
+		return err
+	}
+
+	entry, err := c.DownloadPath(rootHash, p)
 	if err != nil {
 		return fmt.Errorf("error downloading file: %s", err)
 	}
 
-	if c.VerifyProof(file, proof, rootHash) {
-		// TODO: put this filepath as a config env
-		filePath := fmt.Sprintf(*configDir+"/downloaded_file_%d", index)
-		err = os.WriteFile(filePath, file, 0644)
-		if err != nil {
-			return fmt.Errorf("error saving file: %s error: %v", filePath, err)
-		}
+	if entry.Entry.Type != mkt.EntryFile {
+		return fmt.Errorf("%s is a directory, use the restore operation", p)
+	}
 
-		fmt.Printf("File downloaded, verified and saved as %s\n", filePath)
+	if !c.VerifyPath(p, entry, rootHash) {
+		fmt.Println("The download process was unsuccessful or the file is invalid")
 		return nil
 	}
 
-	fmt.Println("The download process was unsuccessful or the file is invalid")
+	filePath := filepath.Join(configDir, "downloaded", filepath.FromSlash(p))
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %s error: %v", filePath, err)
+	}
+	err = os.WriteFile(filePath, entry.File, os.FileMode(entry.Entry.Mode).Perm())
+	if err != nil {
+		return fmt.Errorf("error saving file: %s error: %v", filePath, err)
+	}
+
+	fmt.Printf("File downloaded, verified and saved as %s\n", filePath)
+	return nil
+}
+
+// localRoot returns the root given or the root saved by the upload
+func localRoot(c *client.Client, rootHash, configDir string) (string, error) {
+	if rootHash != "" {
+		return rootHash, nil
+	}
+	rootHash, err := c.GetLocalRootHash(configDir)
+	if err != nil {
+		return "", fmt.Errorf("error fetching the rootHash: %s", err)
+	}
+	return rootHash, nil
+}
+
+func saveLocalRoot(configDir, rootHash string, mode mkt.Mode) error {
+	rootHashPath := filepath.Join(configDir, ".rootHash")
+	err := os.WriteFile(rootHashPath, []byte(rootHash), 0644)
+	if err != nil {
+		return fmt.Errorf("error saving rootHash: %s error: %s", rootHashPath, err)
+	}
+
+	modePath := filepath.Join(configDir, ".mode")
+	err = os.WriteFile(modePath, []byte(mode), 0644)
+	if err != nil {
+		return fmt.Errorf("error saving mode: %s error: %s", modePath, err)
+	}
 	return nil
 }
 
-func isValid(c *client.Client, files [][]byte, rootHash string) bool {
+// isValid downloads the files of the indexes and checks them against the
+// hashes of the local files and the root
+func isValid(c *client.Client, hashes []string, indexes []int, rootHash string) bool {
+	if len(indexes) != len(hashes) {
+		return false
+	}
+
 	isValid := true
-	for i := range files {
-		file, proof, err := c.DownloadFile(i, rootHash)
+	for i := range hashes {
+		d, err := c.Download(indexes[i], rootHash)
 		if err != nil {
 			fmt.Println("Error downloading file:", err)
 			return false
 		}
 
-		if !c.VerifyProof(file, proof, rootHash) {
+		if c.Mode().HashLeaf(d.File) != hashes[i] || !c.VerifyDownload(d, rootHash) {
 			isValid = false
 		}
 	}
 	return isValid
 }
 
-func getFiles(filesList string) [][]byte {
-	var files [][]byte
+func printIndexes(indexes []int) {
+	for i, index := range indexes {
+		fmt.Printf("File %d stored at index %d\n", i+1, index)
+	}
+}
+
+func getPaths(filesList string) []string {
+	var paths []string
 
 	filePaths := strings.Split(filesList, ",")
 	for _, filePath := range filePaths {
@@ -195,31 +706,21 @@ func getFiles(filesList string) [][]byte {
 			fmt.Println("Error resolving file path:", filePath, err)
 			return nil
 		}
-
-		fileContent, err := os.ReadFile(absPath)
-		if err != nil {
-			fmt.Println("Error reading file:", absPath, err)
-			return nil
-		}
-		files = append(files, fileContent)
+		paths = append(paths, absPath)
 	}
 
-	return files
+	return paths
 }
 
-func getFilesFromDir(dir string) [][]byte {
-	var files [][]byte
+func getPathsFromDir(dir string) []string {
+	var paths []string
 
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if !info.IsDir() {
-			fileContent, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
-			files = append(files, fileContent)
+			paths = append(paths, path)
 		}
 		return nil
 	})
@@ -228,7 +729,42 @@ func getFilesFromDir(dir string) [][]byte {
 		fmt.Println("Error reading directory:", err)
 		return nil
 	}
-	return files
+	return paths
+}
+
+// getTreeFilesFromDir reads the files of the dir keeping their paths
+// relative to the dir and their permissions
+func getTreeFilesFromDir(dir string) ([]client.TreeFile, error) {
+	var files []client.TreeFile
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fileContent, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, client.TreeFile{
+			Path: filepath.ToSlash(rel),
+			Mode: uint32(info.Mode().Perm()),
+			File: fileContent,
+		})
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
 }
 
 func getDefaultConfigDir() string {
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/jmsilvadev/zc/cmd/server/servertest"
+	"github.com/jmsilvadev/zc/pkg/certs"
+	"github.com/jmsilvadev/zc/pkg/certs/certstest"
+	"github.com/jmsilvadev/zc/pkg/mkt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRunUpload(t *testing.T) {
@@ -53,7 +61,7 @@ func TestRunInvalidOperation(t *testing.T) {
 	args := []string{"-operation", "invalid"}
 	err := run(flagSet, args)
 	assert.Error(t, err)
-	assert.Equal(t, "invalid operation. Please specify 'upload' or 'update' or 'download' using the -operation parameter", err.Error())
+	assert.Equal(t, "invalid operation. Please specify 'upload', 'update', 'patch', 'download', 'upload-tree', 'restore', 'list', 'info', 'history', 'rollback', 'usage', 'share', 'unshare' or 'grants' using the -operation parameter", err.Error())
 }
 
 func TestRunMissingIndex(t *testing.T) {
@@ -72,3 +80,210 @@ func TestRunMissingRootHash(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "error fetching the rootHash")
 }
+
+func TestRunUploadTreeAndRestore(t *testing.T) {
+	tempDir := t.TempDir()
+	configDir := t.TempDir()
+	restoreDir := t.TempDir()
+	host := servertest.New(t).URL
+
+	err := os.MkdirAll(filepath.Join(tempDir, "a", "b"), 0755)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tempDir, "a", "b", "c.txt"), []byte("tree content c"), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tempDir, "d.txt"), []byte("tree content d"), 0644)
+	assert.NoError(t, err)
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	args := []string{"-operation", "upload-tree", "-dir", tempDir, "-delete=false", "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.NoError(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	args = []string{"-operation", "download", "-path", "a/b/c.txt", "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(configDir, "downloaded", "a", "b", "c.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tree content c"), content)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	args = []string{"-operation", "restore", "-dir", restoreDir, "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(restoreDir, "a", "b", "c.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	content, err = os.ReadFile(filepath.Join(restoreDir, "d.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("tree content d"), content)
+}
+
+func TestRunPatch(t *testing.T) {
+	tempDir := t.TempDir()
+	configDir := t.TempDir()
+	host := servertest.New(t).URL
+
+	content := bytes.Repeat([]byte("a line of a large log file\n"), 10000)
+	tempFile := filepath.Join(tempDir, "large.log")
+	err := os.WriteFile(tempFile, content, 0644)
+	assert.NoError(t, err)
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	args := []string{"-operation", "upload", "-files", tempFile, "-delete=false", "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.NoError(t, err)
+
+	content = append(content, []byte("a new line\n")...)
+	err = os.WriteFile(tempFile, content, 0644)
+	assert.NoError(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	args = []string{"-operation", "patch", "-index", "0", "-files", tempFile, "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.NoError(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	args = []string{"-operation", "patch", "-files", tempFile, "-config-dir", configDir, "-host", host}
+	err = run(flagSet, args)
+	assert.Error(t, err)
+}
+
+func TestRunListAndInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/collections":
+			w.Write([]byte(`{"total":1,"roots":[{"root_hash":"root","type":"flat"}]}`))
+		case "/v1/collections/root":
+			w.Write([]byte(`{"root_hash":"root","type":"flat","mode":"sha256","leaf_count":1,"total_bytes":4}`))
+		case "/v1/collections/root/leaves":
+			w.Write([]byte(`{"root_hash":"root","leaf_count":1,"leaves":[{"index":0,"hash":"h","size":4}]}`))
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	for _, args := range [][]string{
+		{"-operation", "list", "-all"},
+		{"-operation", "list", "-root", "root"},
+		{"-operation", "info", "-root", "root"},
+	} {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		err := run(flagSet, append(args, "-config-dir", tempDir, "-host", server.URL))
+		assert.NoError(t, err)
+	}
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	err := run(flagSet, []string{"-operation", "info", "-root", "unknown", "-config-dir", tempDir, "-host", server.URL})
+	assert.Error(t, err)
+}
+
+func TestRunHistoryAndRollback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/history/second":
+			w.Write([]byte(`{"collection":"first","head":"second","versions":[{"root_hash":"first","op":"upload"},{"root_hash":"second","time":"2024-01-02T03:04:05Z","op":"update","message":"fix"}]}`))
+		case "/v1/history/second/rollback":
+			assert.Equal(t, "undo", r.URL.Query().Get("message"))
+			w.Write([]byte(`{"collection":"first","head":"first","versions":[{"root_hash":"first","op":"upload"},{"root_hash":"second","op":"update"},{"root_hash":"first","op":"rollback"}]}`))
+		case "/v1/collections/first":
+			w.Write([]byte(`{"root_hash":"first","type":"flat","mode":"keccak256-sorted","leaf_count":1,"total_bytes":4}`))
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	configDir := t.TempDir()
+	require.NoError(t, saveLocalRoot(configDir, "second", mkt.SHA256))
+
+	for _, args := range [][]string{
+		{"-operation", "history"},
+		{"-operation", "history", "-root", "second"},
+		{"-operation", "rollback", "-root", "first", "-message", "undo"},
+	} {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		err := run(flagSet, append(args, "-config-dir", configDir, "-host", server.URL))
+		assert.NoError(t, err)
+	}
+
+	// The root and the mode of the version restored are saved
+	root, err := os.ReadFile(filepath.Join(configDir, ".rootHash"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(root))
+	mode, err := os.ReadFile(filepath.Join(configDir, ".mode"))
+	require.NoError(t, err)
+	assert.Equal(t, "keccak256-sorted", string(mode))
+
+	for _, args := range [][]string{
+		{"-operation", "rollback"},
+		{"-operation", "rollback", "-root", "first", "-at", "2024-01-02T03:04:05Z"},
+		{"-operation", "rollback", "-at", "yesterday"},
+		{"-operation", "history", "-root", "unknown"},
+	} {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		err := run(flagSet, append(args, "-config-dir", configDir, "-host", server.URL))
+		assert.Error(t, err, args)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/usage", r.URL.Path)
+		assert.Equal(t, "team-a", r.Header.Get("X-Zc-Tenant"))
+		w.Write([]byte(`{"name":"team-a","max_bytes":100,"usage":{"bytes":5,"files":1,"collections":1}}`))
+	}))
+	defer server.Close()
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	err := run(flagSet, []string{"-operation", "usage", "-tenant", "team-a", "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.NoError(t, err)
+}
+
+func TestRunShare(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/acl/root/auditor", r.URL.Path)
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "read", r.URL.Query().Get("access"))
+		w.Write([]byte(`{"collection":"root","owner":"team","grants":[{"principal":"auditor","access":"read"}]}`))
+	}))
+	defer server.Close()
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	err := run(flagSet, []string{"-operation", "share", "-root", "root", "-principal", "auditor", "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.NoError(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	err = run(flagSet, []string{"-operation", "unshare", "-root", "root", "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.EqualError(t, err, "please provide the id of the credential using the -principal parameter")
+}
+
+func TestRunTLS(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+	reloader, err := certs.NewReloader(files.ServerCert, files.ServerKey, files.CA)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/usage", r.URL.Path)
+		w.Write([]byte(`{"name":"team-a","max_bytes":100,"usage":{"bytes":5,"files":1,"collections":1}}`))
+	}))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	err = run(flagSet, []string{"-operation", "usage", "-ca", files.CA, "-cert", files.ClientCert, "-key", files.ClientKey, "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.NoError(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	err = run(flagSet, []string{"-operation", "usage", "-ca", files.CA, "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.Error(t, err)
+
+	flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+	err = run(flagSet, []string{"-operation", "usage", "-cert", files.ClientCert, "-config-dir", t.TempDir(), "-host", server.URL})
+	assert.ErrorContains(t, err, "error loading the TLS files")
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+// aclKey stores the access control list of a collection by its id, the
+// collections created by a principal are only reachable by their owner, the
+// principals with a grant and the admins
+const aclKey = "acl_"
+
+// access levels of a principal to a collection, each level includes the
+// previous ones
+const (
+	accessNone = iota
+	accessRead
+	accessWrite
+	// accessOwner also shares and deletes the collection
+	accessOwner
+)
+
+const (
+	grantRead  = "read"
+	grantWrite = "write"
+)
+
+var (
+	// errInvalidGrant is returned when a grant is not valid
+	errInvalidGrant = errors.New("invalid grant")
+	// errForbidden is returned when a principal does not have the access
+	// needed
+	errForbidden = errors.New("forbidden")
+	// errRootExists is returned when a change builds a root already stored
+	// in a collection the principal can not change
+	errRootExists = errors.New("the root already exists in another collection")
+)
+
+// acl is the owner of a collection with the grants by principal id, a
+// collection without owner is only shared by the admins
+type acl struct {
+	Owner  string            `json:"owner,omitempty"`
+	Grants map[string]string `json:"grants,omitempty"`
+}
+
+// grant is the access given to a principal
+type grant struct {
+	Principal string `json:"principal"`
+	Name      string `json:"name,omitempty"`
+	Access    string `json:"access"`
+}
+
+// aclResult is the access control list of a collection
+type aclResult struct {
+	Collection string  `json:"collection"`
+	Owner      string  `json:"owner,omitempty"`
+	Grants     []grant `json:"grants"`
+}
+
+// newOwnedBatch returns a batch whose new collections are owned by the
+// principal, nil without authentication
+func (s *Server) newOwnedBatch(p *Principal) *intentBatch {
+	b := s.newBatch()
+	b.principal = p
+	if p != nil {
+		b.owner = p.ID
+	}
+	return b
+}
+
+// storedTree reports if the tree of the root is already stored, the
+// principal of the batch must be able to change its collection. The tree of
+// a stored root is not written again, so its metadata is kept
+func (s *Server) storedTree(b *intentBatch, root string) (bool, error) {
+	_, err := s.getCollectionType(root)
+	if errors.Is(err, errCollectionNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = s.checkAccess(b.principal, root, accessWrite)
+	if errors.Is(err, errCollectionNotFound) || errors.Is(err, errForbidden) {
+		return true, fmt.Errorf("%w: %s", errRootExists, root)
+	}
+	return true, err
+}
+
+// getACL returns the id of the collection of the root and its acl, the
+// collections without acl return db.ErrNotFound
+func (s *Server) getACL(root string) (string, acl, error) {
+	id := root
+	stored, err := s.db.Get(collectionOfKey + root)
+	if err == nil {
+		id = string(stored)
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return "", acl{}, err
+	}
+
+	data, err := s.db.Get(aclKey + id)
+	if err != nil {
+		return id, acl{}, err
+	}
+	var a acl
+	err = json.Unmarshal(data, &a)
+	return id, a, err
+}
+
+// accessOf returns the access of the principal to the collection of the
+// root. Without authentication and for the admins everything is allowed,
+// the collections without acl are only reachable by the admins until they
+// share them
+func (s *Server) accessOf(p *Principal, root string) (int, error) {
+	if p == nil || p.Admin {
+		return accessOwner, nil
+	}
+
+	_, a, err := s.getACL(root)
+	if errors.Is(err, db.ErrNotFound) {
+		return accessNone, nil
+	}
+	if err != nil {
+		return accessNone, err
+	}
+
+	if a.Owner != "" && a.Owner == p.ID {
+		return accessOwner, nil
+	}
+	switch a.Grants[p.ID] {
+	case grantWrite:
+		return accessWrite, nil
+	case grantRead:
+		return accessRead, nil
+	}
+	return accessNone, nil
+}
+
+// authorized checks the access of the principal of the request to the
+// collection of the root of the path: the reads need read access, the
+// deletes the owner and the other methods write access. The collections the
+// principal can not read are not found
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pathParts := strings.Split(r.URL.Path, "/")
+		if len(pathParts) < 3 || pathParts[2] == "" {
+			h(w, r)
+			return
+		}
+
+		need := accessWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			need = accessRead
+		case http.MethodDelete:
+			need = accessOwner
+		}
+		if !s.allow(w, principalOf(r), pathParts[2], need) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// allow reports if the principal has the access needed to the collection of
+// the root, the error is sent when it does not. The roots that do not exist
+// are not found
+func (s *Server) allow(w http.ResponseWriter, p *Principal, root string, need int) bool {
+	err := s.checkAccess(p, root, need)
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return false
+	}
+	if errors.Is(err, errForbidden) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// checkAccess returns errCollectionNotFound when the principal can not read
+// the collection of the root and errForbidden when it can but without the
+// access needed
+func (s *Server) checkAccess(p *Principal, root string, need int) error {
+	level, err := s.accessOf(p, root)
+	if err == nil && level >= accessRead && level < need {
+		_, err = s.getCollectionType(root)
+		if errors.Is(err, errCollectionNotFound) {
+			level = accessNone
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if level < accessRead {
+		return errCollectionNotFound
+	}
+	if level < need {
+		return errForbidden
+	}
+	return nil
+}
+
+// readableRoots returns the roots of the collections the principal can read
+func (s *Server) readableRoots(p *Principal, roots []string) ([]string, error) {
+	if p == nil || p.Admin {
+		return roots, nil
+	}
+
+	readable := make([]string, 0, len(roots))
+	for _, root := range roots {
+		level, err := s.accessOf(p, root)
+		if err != nil {
+			return nil, err
+		}
+		if level >= accessRead {
+			readable = append(readable, root)
+		}
+	}
+	return readable, nil
+}
+
+// ACLHandler manages the sharing of the collection of a root by its owner:
+// GET /acl/<root> lists the grants, PUT /acl/<root>/<principal>?access=read
+// or write grants the access to a principal and DELETE
+// /acl/<root>/<principal> revokes it
+func (s *Server) ACLHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/acl/"), "/"), "/")
+	root := parts[0]
+	if root == "" || len(parts) > 2 {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	if !s.allow(w, principalOf(r), root, accessOwner) {
+		return
+	}
+
+	_, err := s.getCollectionType(root)
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+	case r.Method == http.MethodPut && len(parts) == 2:
+		err = s.share(root, parts[1], r.URL.Query().Get("access"))
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		err = s.share(root, parts[1], "")
+	default:
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, errInvalidGrant) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := s.aclOf(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// share grants the access to the principal, an empty access revokes it.
+// The principal must be a credential of the tenant of the server
+func (s *Server) share(root, principal, access string) error {
+	if access != "" && access != grantRead && access != grantWrite {
+		return fmt.Errorf("%w: the access must be %s or %s", errInvalidGrant, grantRead, grantWrite)
+	}
+
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	id, a, err := s.getACL(root)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	if access == "" {
+		if _, ok := a.Grants[principal]; !ok {
+			return db.ErrNotFound
+		}
+		delete(a.Grants, principal)
+	} else {
+		c, err := s.getCredential(principal)
+		if errors.Is(err, db.ErrNotFound) || (err == nil && !s.ownsCredential(c)) {
+			return fmt.Errorf("%w: unknown principal %s", errInvalidGrant, principal)
+		}
+		if err != nil {
+			return err
+		}
+		if a.Grants == nil {
+			a.Grants = make(map[string]string)
+		}
+		a.Grants[principal] = access
+	}
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(aclKey+id, data)
+}
+
+// ownsCredential reports if the credential reaches the keyspace of the
+// server, the credentials without tenant use the default one
+func (s *Server) ownsCredential(c credential) bool {
+	if s.tenant == "" {
+		return true
+	}
+	tenant := c.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	return tenant == s.tenant
+}
+
+// aclOf returns the grants of the collection of the root with the names of
+// their principals
+func (s *Server) aclOf(root string) (aclResult, error) {
+	id, a, err := s.getACL(root)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return aclResult{}, err
+	}
+
+	result := aclResult{Collection: id, Owner: a.Owner, Grants: []grant{}}
+	for principal, access := range a.Grants {
+		g := grant{Principal: principal, Access: access}
+		c, err := s.getCredential(principal)
+		if err == nil {
+			g.Name = c.Name
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return aclResult{}, err
+		}
+		result.Grants = append(result.Grants, g)
+	}
+	sort.Slice(result.Grants, func(i, j int) bool {
+		return result.Grants[i].Principal < result.Grants[j].Principal
+	})
+	return result, nil
+}
+
+// deleteCollection deletes all the versions of the collection of the root
+// with its history and its acl
+func (s *Server) deleteCollection(root string) error {
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	id, versions, err := s.getHistory(root)
+	if err != nil {
+		return err
+	}
+
+	b := s.newBatch()
+	_, err = s.db.Get(historyKey + id)
+	if errors.Is(err, db.ErrNotFound) {
+		// A root stored before the history was counted as a collection
+		b.legacyRoots++
+	} else if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, v := range versions {
+		counts[v.Root]--
+	}
+	err = s.putVersionCounts(b, counts)
+	if err != nil {
+		return err
+	}
+	b.Delete(historyKey + id)
+	b.Delete(aclKey + id)
+	return s.commit("delete", id, b)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeACL(t *testing.T, w *httptest.ResponseRecorder) aclResult {
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result aclResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	return result
+}
+
+func TestCollectionACL(t *testing.T) {
+	server, _ := newAuthServer(authToken)
+	ownerID, owner := createCredential(t, server, credentialRequest{Name: "team", Kind: authToken})
+	auditorID, auditor := createCredential(t, server, credentialRequest{Name: "auditor", Kind: authToken})
+	editorID, editor := createCredential(t, server, credentialRequest{Name: "editor", Kind: authToken})
+
+	first := decodeTree(t, sendFiles(server, "/upload", owner, [][]byte{[]byte("dataset")}))
+	download := "/download/" + first.RootHash + "/0"
+
+	// The collections of an owner are not found by the others
+	assert.Equal(t, http.StatusNotFound, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), auditor).Code)
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), auditor)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), first.RootHash)
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+first.RootHash+"/"+auditorID+"?access=read", nil), auditor)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// A read grant downloads and verifies but does not change the collection
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+first.RootHash+"/"+auditorID+"?access=read", nil), owner)
+	result := decodeACL(t, w)
+	assert.Equal(t, ownerID, result.Owner)
+	assert.Equal(t, []grant{{Principal: auditorID, Name: "auditor", Access: grantRead}}, result.Grants)
+
+	assert.Equal(t, http.StatusOK, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), auditor).Code)
+	assert.Equal(t, http.StatusOK, serveAs(server, httptest.NewRequest(http.MethodGet, "/history/"+first.RootHash, nil), auditor).Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), auditor)
+	assert.Contains(t, w.Body.String(), first.RootHash)
+	w = sendFiles(server, "/update/"+first.RootHash, auditor, [][]byte{[]byte("forged")})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/collections/"+first.RootHash, nil), auditor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/acl/"+first.RootHash, nil), auditor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"op":"update","root":"`+first.RootHash+`","sizes":[1]}`)), auditor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// A write grant changes the collection, the grants follow its versions
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+first.RootHash+"/"+editorID+"?access=write", nil), owner)
+	assert.Len(t, decodeACL(t, w).Grants, 2)
+	second := decodeTree(t, sendFiles(server, "/update/"+first.RootHash, editor, [][]byte{[]byte("dataset v2")}))
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+second.RootHash+"/1", nil), auditor)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/acl/"+second.RootHash, nil), editor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The sessions are only used by their owners
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"op":"update","root":"`+second.RootHash+`","sizes":[1]}`)), editor)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var sess session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	assert.Equal(t, editorID, sess.Owner)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/sessions/"+sess.ID, nil), auditor)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The revoked grants lose the access
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/acl/"+second.RootHash+"/"+auditorID, nil), owner)
+	assert.Equal(t, []grant{{Principal: editorID, Name: "editor", Access: grantWrite}}, decodeACL(t, w).Grants)
+	assert.Equal(t, http.StatusNotFound, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), auditor).Code)
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodPut, "/acl/" + second.RootHash + "/" + auditorID + "?access=admin", http.StatusBadRequest},
+		{http.MethodPut, "/acl/" + second.RootHash + "/unknown?access=read", http.StatusBadRequest},
+		{http.MethodDelete, "/acl/" + second.RootHash + "/" + auditorID, http.StatusNotFound},
+		{http.MethodPut, "/acl/unknown/" + auditorID + "?access=read", http.StatusBadRequest},
+		{http.MethodPut, "/acl/" + unknownRoot + "/" + auditorID + "?access=read", http.StatusNotFound},
+		{http.MethodPost, "/acl/" + second.RootHash, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w = serveAs(server, httptest.NewRequest(tt.method, tt.url, nil), owner)
+		assert.Equal(t, tt.status, w.Code, tt.method+" "+tt.url)
+	}
+
+	// The admins reach every collection
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/acl/"+second.RootHash, nil), "admin-token")
+	assert.Equal(t, ownerID, decodeACL(t, w).Owner)
+}
+
+func TestDeleteCollection(t *testing.T) {
+	server, mockDB := newAuthServer(authToken)
+	_, owner := createCredential(t, server, credentialRequest{Name: "team", Kind: authToken})
+	_, editor := createCredential(t, server, credentialRequest{Name: "editor", Kind: authToken})
+	credentials := keysOf(mockDB.data, "")
+
+	first := decodeTree(t, sendFiles(server, "/upload", owner, [][]byte{[]byte("file1"), []byte("file2")}))
+	second := decodeTree(t, sendFiles(server, "/update/"+first.RootHash, owner, [][]byte{[]byte("file3")}))
+	shared := decodeTree(t, sendFiles(server, "/upload", editor, [][]byte{[]byte("file1")}))
+
+	w := serveAs(server, httptest.NewRequest(http.MethodDelete, "/collections/"+first.RootHash, nil), owner)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	// All the versions are deleted, the files of other collections are kept
+	for _, root := range []string{first.RootHash, second.RootHash} {
+		w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections/"+root, nil), "admin-token")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+shared.RootHash+"/0", nil), editor)
+	assert.Equal(t, http.StatusOK, w.Code)
+	u, err := server.getUsage()
+	require.NoError(t, err)
+	assert.Equal(t, usage{Bytes: 5, Files: 1, Collections: 1}, u)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/collections/"+shared.RootHash, nil), editor)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	// The chunks are left to the garbage collector
+	for k := range mockDB.data {
+		if _, ok := credentials[k]; !ok && !strings.HasPrefix(k, chunkKey) {
+			assert.Equal(t, usageKey, k)
+		}
+	}
+	u, err = server.getUsage()
+	require.NoError(t, err)
+	assert.Equal(t, usage{}, u)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/collections/"+shared.RootHash, nil), editor)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDeleteLegacyCollection(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	root := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")}).RootHash
+	for k := range mockDB.data {
+		if strings.HasPrefix(k, historyKey) || strings.HasPrefix(k, collectionOfKey) || strings.HasPrefix(k, versionsKey) {
+			delete(mockDB.data, k)
+		}
+	}
+	require.NoError(t, server.repairUsage())
+
+	require.NoError(t, server.deleteCollection(root))
+	u, err := server.getUsage()
+	require.NoError(t, err)
+	assert.Equal(t, usage{}, u)
+	for k := range mockDB.data {
+		if !strings.HasPrefix(k, chunkKey) {
+			assert.Equal(t, usageKey, k)
+		}
+	}
+}
+
+func TestLegacyCollectionACL(t *testing.T) {
+	server, mockDB := newAuthServer(authToken)
+	readerID, reader := createCredential(t, server, credentialRequest{Name: "reader", Kind: authToken})
+	root := decodeTree(t, sendFiles(server, "/upload", "admin-token", [][]byte{[]byte("legacy")})).RootHash
+	for k := range mockDB.data {
+		if strings.HasPrefix(k, aclKey) {
+			delete(mockDB.data, k)
+		}
+	}
+	download := "/download/" + root + "/0"
+
+	// The collections without acl are only reachable by the admins
+	assert.Equal(t, http.StatusNotFound, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), reader).Code)
+	assert.Equal(t, http.StatusNotFound, sendFiles(server, "/update/"+root, reader, [][]byte{[]byte("forged")}).Code)
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), reader)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), root)
+	assert.Equal(t, http.StatusOK, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), "admin-token").Code)
+
+	// The admins share them like the other collections
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+root+"/"+readerID+"?access=read", nil), "admin-token")
+	result := decodeACL(t, w)
+	assert.Empty(t, result.Owner)
+	assert.Equal(t, http.StatusOK, serveAs(server, httptest.NewRequest(http.MethodGet, download, nil), reader).Code)
+	assert.Equal(t, http.StatusForbidden, sendFiles(server, "/update/"+root, reader, [][]byte{[]byte("forged")}).Code)
+}
+
+func TestUploadStoredRoot(t *testing.T) {
+	server, _ := newAuthServer(authToken)
+	_, owner := createCredential(t, server, credentialRequest{Name: "team", Kind: authToken})
+	otherID, other := createCredential(t, server, credentialRequest{Name: "other", Kind: authToken})
+
+	upload := func(token, name string) *httptest.ResponseRecorder {
+		body, contentType := multipartMetaBody(t, [][]byte{[]byte("report")}, []mkt.Metadata{{Name: name}})
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		return serveAs(server, req, token)
+	}
+	requireName := func(root, leaf, name string) {
+		meta, err := server.getMeta(root, leaf)
+		require.NoError(t, err)
+		require.Equal(t, name, meta.Name)
+	}
+	first := decodeTree(t, upload(owner, "secret-report.txt"))
+
+	// The same files of another principal do not change the collection
+	assert.Equal(t, http.StatusConflict, upload(other, "other.txt").Code)
+	assert.Equal(t, http.StatusConflict, sendFiles(server, "/upload", other, [][]byte{[]byte("report")}).Code)
+	requireName(first.RootHash, first.Leaves[0], "secret-report.txt")
+	assert.Equal(t, http.StatusNotFound, serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+first.RootHash+"/0", nil), other).Code)
+
+	// The owner and the writers get the root without changing its metadata
+	again := decodeTree(t, upload(owner, "renamed.txt"))
+	assert.Equal(t, first.RootHash, again.RootHash)
+	w := serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+first.RootHash+"/"+otherID+"?access=write", nil), owner)
+	require.Equal(t, http.StatusOK, w.Code)
+	again = decodeTree(t, upload(other, "other.txt"))
+	assert.Equal(t, first.RootHash, again.RootHash)
+	requireName(first.RootHash, first.Leaves[0], "secret-report.txt")
+
+	// A change of another collection does not take a stored root
+	shared := decodeTree(t, sendFiles(server, "/upload", owner, [][]byte{[]byte("a"), []byte("b")}))
+	own := decodeTree(t, sendFiles(server, "/upload", other, [][]byte{[]byte("a")}))
+	w = sendFiles(server, "/update/"+own.RootHash, other, [][]byte{[]byte("b")})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+shared.RootHash+"/"+otherID+"?access=write", nil), owner)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = sendFiles(server, "/update/"+own.RootHash, other, [][]byte{[]byte("b")})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	id, _, err := server.getACL(shared.RootHash)
+	require.NoError(t, err)
+	assert.Equal(t, shared.RootHash, id)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// apiPrefix is the path of the versioned api, the unversioned paths are
+// deprecated aliases of its routes
+const apiPrefix = "/v1"
+
+// route is an endpoint of the api, it is served by the method patterns of
+// the versioned api and by the path of the deprecated alias with the methods
+// of the patterns
+type route struct {
+	// alias is the unversioned path, the paths ending with a slash match
+	// all the paths below it
+	alias   string
+	handler http.HandlerFunc
+	// patterns are the methods and the paths of the versioned api, without
+	// the prefix, in the syntax of the http.ServeMux
+	patterns []string
+}
+
+// dataRoutes are the endpoints of the data of the keyspace of the server, the
+// roots and the indexes in the paths are checked before the access to them
+func (s *Server) dataRoutes() []route {
+	return []route{
+		// uploads creates a new merkle tree
+		{"/upload", s.limited(s.tracked(s.UploadHandler)), []string{"POST /upload"}},
+		// uploads creates a new merkle tree but uses the existent one
+		{"/update/", s.rooted(s.authorized(s.limited(s.tracked(s.UpdatedHandler)))), []string{"POST /update/{root}"}},
+		{"/download/", s.rooted(s.authorized(s.indexed(s.DownloadHandler))), []string{"GET /download/{root}/{index}"}},
+		// raw bytes with the proof in the headers
+		{"/raw/", s.rooted(s.authorized(s.indexed(s.RawDownloadHandler))), []string{"GET /raw/{root}/{index}", "HEAD /raw/{root}/{index}"}},
+		// hierarchical trees that commit to the directories layout
+		{"/tree", s.limited(s.tracked(s.TreeUploadHandler)), []string{"POST /tree"}},
+		{"/tree/", s.rooted(s.authorized(s.TreeDownloadHandler)), []string{"GET /tree/{root}/{path...}"}},
+		// rsync like updates of a modified file
+		{"/signature/", s.rooted(s.authorized(s.indexed(s.SignatureHandler))), []string{"GET /signature/{root}/{index}"}},
+		{"/delta/", s.rooted(s.authorized(s.indexed(s.limited(s.tracked(s.DeltaHandler))))), []string{"POST /delta/{root}/{index}"}},
+		// resumable uploads
+		{"/sessions", s.limited(s.SessionCreateHandler), []string{"POST /sessions"}},
+		{"/sessions/", s.limited(s.tracked(s.SessionHandler)), []string{
+			"GET /sessions/{id}",
+			"PUT /sessions/{id}/{index}",
+			"POST /sessions/{id}/finalize",
+			"DELETE /sessions/{id}",
+		}},
+		// listing of the roots and their leaves and deletion of the collections
+		{"/collections", s.CollectionsHandler, []string{"GET /collections"}},
+		{"/collections/", s.rooted(s.authorized(s.CollectionHandler)), []string{
+			"GET /collections/{root}",
+			"GET /collections/{root}/leaves",
+			"DELETE /collections/{root}",
+		}},
+		// versions of the collections and point in time rollbacks
+		{"/history/", s.rooted(s.authorized(s.HistoryHandler)), []string{
+			"GET /history/{root}",
+			"POST /history/{root}/rollback",
+		}},
+		// sharing of the collections by their owners
+		{"/acl/", s.rooted(s.ACLHandler), []string{
+			"GET /acl/{root}",
+			"PUT /acl/{root}/{principal}",
+			"DELETE /acl/{root}/{principal}",
+		}},
+		// what the keyspace stores and its quota
+		{"/usage", s.UsageHandler, []string{"GET /usage"}},
+		// mark and sweep of the keys not reachable from the live roots
+		{"/admin/gc", s.GCHandler, []string{"POST /admin/gc"}},
+	}
+}
+
+// adminRoutes are the endpoints of the credentials and of the tenants, they
+// are served by the global server
+func (s *Server) adminRoutes() []route {
+	routes := []route{
+		// credentials of the authentication
+		{"/admin/tokens", s.CredentialsHandler, []string{"GET /admin/tokens", "POST /admin/tokens"}},
+		{"/admin/tokens/", s.CredentialsHandler, []string{"DELETE /admin/tokens/{id}"}},
+	}
+	if s.conf.Tenants {
+		routes = append(routes,
+			// tenants with their quotas
+			route{"/admin/tenants", s.TenantsHandler, []string{"GET /admin/tenants", "POST /admin/tenants"}},
+			route{"/admin/tenants/", s.TenantsHandler, []string{"GET /admin/tenants/{name}", "PUT /admin/tenants/{name}"}},
+		)
+	}
+	return routes
+}
+
+// register adds the routes to the mux. The versioned routes only match
+// their methods and their paths and the handlers receive the paths without
+// the prefix, the aliases refuse the other methods with 405 and announce
+// their successor
+func register(mux *http.ServeMux, routes []route) {
+	for _, rt := range routes {
+		var methods []string
+		for _, pattern := range rt.patterns {
+			method, path, _ := strings.Cut(pattern, " ")
+			mux.Handle(method+" "+apiPrefix+path, http.StripPrefix(apiPrefix, rt.handler))
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+		mux.HandleFunc(rt.alias, deprecated(allowed(rt.handler, methods...)))
+	}
+}
+
+// deprecated marks the responses of an unversioned alias with the
+// Deprecation header and the link to the versioned path
+func deprecated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiPrefix+r.URL.Path+`>; rel="successor-version"`)
+		h(w, r)
+	}
+}
+
+// errorCodes are the codes of the errors of the versioned api by status
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusInternalServerError:   "internal",
+	http.StatusInsufficientStorage:   "quota_exceeded",
+}
+
+// errorCode returns the code of the errors of the status
+func errorCode(status int) string {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	}
+	return code
+}
+
+// apiError is the body of the errors of the versioned api
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonErrors sends the errors of the versioned api as JSON, the handlers
+// and the mux write their errors as plain text with http.Error and the
+// unversioned aliases keep them
+func jsonErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ew := &errorWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, r)
+		if ew.status == 0 {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(ew.status)
+		json.NewEncoder(w).Encode(apiError{Error: apiErrorBody{
+			Code:    errorCode(ew.status),
+			Message: strings.TrimSpace(ew.body.String()),
+		}})
+	})
+}
+
+// errorWriter keeps the plain text errors written by the handlers, the
+// other responses are written as they are
+type errorWriter struct {
+	http.ResponseWriter
+	// status is the status of the kept error
+	status int
+	body   bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets the http.ResponseController reach the connection
+func (w *errorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
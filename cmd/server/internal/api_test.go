@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeAPIError returns the error of a response of the versioned api
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) apiErrorBody {
+	t.Helper()
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var result apiError
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result), w.Body.String())
+	return result.Error
+}
+
+func TestVersionedAPI(t *testing.T) {
+	server, _ := newChunkingServer()
+	body, _ := json.Marshal([][]byte{[]byte("file1"), []byte("file2")})
+	w := serveAs(server, httptest.NewRequest(http.MethodPost, "/v1/upload", bytes.NewBuffer(body)), "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	var upload treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&upload))
+	root := upload.RootHash
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/download/"+root+"/1", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodHead, "/v1/raw/"+root+"/0", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/collections/"+root+"/leaves", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	tests := []struct {
+		method  string
+		url     string
+		status  int
+		code    string
+		message string
+	}{
+		{http.MethodGet, "/v1/download/" + root + "/2", http.StatusNotFound, "not_found", "the index 2 is out of the leaves of the root"},
+		{http.MethodGet, "/v1/download/" + root[:10] + "/0", http.StatusBadRequest, "invalid_request", "invalid root"},
+		{http.MethodGet, "/v1/download/" + root, http.StatusNotFound, "not_found", ""},
+		{http.MethodGet, "/v1/collections/" + unknownRoot, http.StatusNotFound, "not_found", errNotFound},
+		{http.MethodGet, "/v1/unknown", http.StatusNotFound, "not_found", ""},
+		{http.MethodPost, "/v1/download/" + root + "/0", http.StatusMethodNotAllowed, "method_not_allowed", ""},
+		{http.MethodPost, "/v1/sessions/" + strings.Repeat("a", 32), http.StatusMethodNotAllowed, "method_not_allowed", ""},
+		{http.MethodPost, "/v1/upload", http.StatusBadRequest, "invalid_request", ""},
+	}
+	for _, tt := range tests {
+		w := serveAs(server, httptest.NewRequest(tt.method, tt.url, strings.NewReader("x")), "")
+		assert.Equal(t, tt.status, w.Code, tt.method+" "+tt.url)
+		e := decodeAPIError(t, w)
+		assert.Equal(t, tt.code, e.Code, tt.method+" "+tt.url)
+		assert.Contains(t, e.Message, tt.message, tt.method+" "+tt.url)
+	}
+
+	// The methods of the versioned routes come from their patterns
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/v1/history/"+root, nil), "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+
+	// The bodies over the limit
+	server.conf.MaxBodySize = 8
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/v1/upload", bytes.NewBuffer(body)), "")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "body_too_large", decodeAPIError(t, w).Code)
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	server, _ := newChunkingServer()
+	upload := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+upload.RootHash+"/0", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, `</v1/download/`+upload.RootHash+`/0>; rel="successor-version"`, w.Header().Get("Link"))
+
+	// The aliases keep their plain text errors
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections/"+unknownRoot, nil), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, errNotFound+"\n", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+}
+
+func TestVersionedAdmin(t *testing.T) {
+	server, _ := newAuthServer(authToken)
+	_, token := createCredential(t, server, credentialRequest{Name: "team", Kind: authToken})
+
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/admin/tokens", nil), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "forbidden", decodeAPIError(t, w).Code)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/admin/tokens", nil), "admin-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/collections", nil), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	e := decodeAPIError(t, w)
+	assert.Equal(t, "unauthorized", e.Code)
+	assert.Equal(t, errUnauthorized.Error(), e.Message)
+}
+
+func TestVersionedTenants(t *testing.T) {
+	server, _ := newTenantServer(t, tenant{Name: "a"})
+	_, token := createCredential(t, server, credentialRequest{Name: "team a", Kind: authToken, Tenant: "a"})
+
+	root := decodeTree(t, sendFiles(server, "/v1/upload", token, [][]byte{[]byte("file1")}))
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/download/"+root.RootHash+"/0", nil), token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/admin/tenants/a", nil), "admin-token")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/admin/tenants/b", nil), "admin-token")
+	assert.Equal(t, "not_found", decodeAPIError(t, w).Code)
+}
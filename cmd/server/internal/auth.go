@@ -0,0 +1,572 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+const (
+	// credentialKey stores the credentials by id, the tokens are only
+	// stored by their hash
+	credentialKey = "credential_"
+	// tokenKey links the sha256 of a token to the id of its credential
+	tokenKey = "token_"
+	// nonceKey stores the nonces of the signed requests: nonceKey + date +
+	// key + nonce, they are kept while their date is in the allowed skew
+	nonceKey = "nonce_"
+
+	authToken = "token"
+	authHMAC  = "hmac"
+
+	// adminID is the principal of the admin token of the configuration
+	adminID = "admin"
+	// defaultAuthMaxSkew is used when the skew is not configured
+	defaultAuthMaxSkew = 5 * time.Minute
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request
+	// does not have its kind of credentials, the next one is tried
+	ErrNoCredentials = errors.New("no credentials")
+	// errUnauthorized is returned when the credentials are not valid
+	errUnauthorized = errors.New("unauthorized")
+	// errBodyTooLarge is returned when a signed body is larger than
+	// auth.MaxSignedBody
+	errBodyTooLarge = errors.New("the signed body is too large, send it as an unsigned payload")
+	// errInvalidCredential is returned when a credential can not be created
+	errInvalidCredential = errors.New("invalid credential")
+)
+
+// Principal is the identity of an authenticated request, the requests of
+// a principal with a tenant only reach its keyspace
+type Principal struct {
+	ID     string
+	Name   string
+	Admin  bool
+	Tenant string
+}
+
+// principalKey is the key of the principal in the context of the requests
+type principalKey struct{}
+
+// principalOf returns the principal of an authenticated request, nil when
+// the authentication is disabled
+func principalOf(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// unsignedKey marks the context of the calls that can send an unsigned
+// payload, the gRPC calls sign their method without the messages
+type unsignedKey struct{}
+
+// unsignedRoutes are the methods and the paths of the routes that accept an
+// unsigned payload, their bodies stream the files verified by the proofs.
+// The paths ending with a slash match the paths below them
+var unsignedRoutes = []string{"POST /upload", "POST /update/", "POST /tree", "POST /delta/", "PUT /sessions/"}
+
+// unsignedAllowed reports if the request can send an unsigned payload
+func unsignedAllowed(r *http.Request) bool {
+	if allowed, _ := r.Context().Value(unsignedKey{}).(bool); allowed {
+		return true
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	for _, rt := range unsignedRoutes {
+		method, prefix, _ := strings.Cut(rt, " ")
+		if r.Method != method {
+			continue
+		}
+		if path == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator verifies the credentials of a request, it returns
+// ErrNoCredentials when the request does not have its kind of credentials
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// credential is a token or an hmac key, the secret is only kept for the
+// keys since the signatures are checked with it
+type credential struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind"`
+	Admin   bool      `json:"admin,omitempty"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Created time.Time `json:"created"`
+	// TokenHash is the sha256 of the token, to delete its link
+	TokenHash string `json:"token_hash,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// credentialRequest creates a credential, the kind is token or hmac. The
+// credentials without a tenant use the default one
+type credentialRequest struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Admin  bool   `json:"admin"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// nonceState serializes the checks of the nonces and their cleanup
+type nonceState struct {
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// UseAuthenticator adds an authenticator to the ones tried for each
+// request, the requests are refused without valid credentials once there is
+// one
+func (s *Server) UseAuthenticator(a Authenticator) {
+	s.auth = append(s.auth, a)
+}
+
+// useAuthMethods adds the authenticators of the configured methods, the
+// unknown ones are reported by checkAuth
+func (s *Server) useAuthMethods(methods []string) {
+	for _, m := range methods {
+		switch m {
+		case authToken:
+			s.UseAuthenticator(&tokenAuthenticator{s: s})
+		case authHMAC:
+			s.UseAuthenticator(&hmacAuthenticator{s: s})
+		}
+	}
+}
+
+// checkAuth validates the configured authentication methods, the server
+// does not start with an unknown one so it is never open by mistake, nor
+// with the tenants and without authentication, as the tenants are chosen by
+// the credentials
+func (s *Server) checkAuth() error {
+	for _, m := range s.conf.Auth {
+		if m != authToken && m != authHMAC {
+			return fmt.Errorf("unknown authentication method %s, valid values: %s, %s", m, authToken, authHMAC)
+		}
+	}
+	if len(s.auth) == 0 && s.conf.Tenants {
+		return errors.New("the tenants require an authentication method")
+	}
+	if len(s.auth) == 0 {
+		s.conf.Logger.Warn("The authentication is disabled, do not expose the server outside localhost")
+	}
+	return nil
+}
+
+// authenticate wraps the routes with the authenticators, the admin
+// endpoints also require an admin principal
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.auth) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := s.authenticateRequest(r)
+		if errors.Is(err, ErrNoCredentials) {
+			w.Header().Set("WWW-Authenticate", auth.SchemeBearer+", "+auth.SchemeHMAC)
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errUnauthorized) {
+			s.conf.Logger.Warn("Authentication failed: " + err.Error())
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+
+		if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, apiPrefix), "/admin/") && !principal.Admin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// authenticateRequest returns the principal of the first authenticator
+// with credentials in the request, ErrNoCredentials when none has them
+func (s *Server) authenticateRequest(r *http.Request) (*Principal, error) {
+	for _, a := range s.auth {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// tokenAuthenticator accepts the static tokens sent as bearer tokens
+type tokenAuthenticator struct {
+	s *Server
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := auth.ParseBearer(r.Header.Get("Authorization"))
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	admin := a.s.conf.AuthAdminToken
+	if admin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(admin)) == 1 {
+		return &Principal{ID: adminID, Name: adminID, Admin: true}, nil
+	}
+
+	id, err := a.s.db.Get(tokenKey + auth.ContentHash([]byte(token)))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("%w: unknown token", errUnauthorized)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.s.principal(string(id), authToken)
+}
+
+// hmacAuthenticator accepts the requests signed with an hmac key, the date
+// must be in the allowed skew and each nonce is accepted once
+type hmacAuthenticator struct {
+	s *Server
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	keyID, signature, ok := auth.ParseHMAC(r.Header.Get("Authorization"))
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	c, err := a.s.getCredential(keyID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && c.Kind != authHMAC) {
+		return nil, fmt.Errorf("%w: unknown key %s", errUnauthorized, keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	date := r.Header.Get(auth.HeaderDate)
+	unix, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid date %s", errUnauthorized, date)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.s.authMaxSkew() {
+		return nil, fmt.Errorf("%w: the date of the key %s is out of the allowed skew", errUnauthorized, keyID)
+	}
+
+	nonce := r.Header.Get(auth.HeaderNonce)
+	if nonce == "" || len(nonce) > 64 {
+		return nil, fmt.Errorf("%w: invalid nonce", errUnauthorized)
+	}
+
+	contentHash := r.Header.Get(auth.HeaderContentSHA256)
+	if contentHash == "" {
+		return nil, fmt.Errorf("%w: the content hash is required", errUnauthorized)
+	}
+	if contentHash == auth.UnsignedPayload && !unsignedAllowed(r) {
+		return nil, fmt.Errorf("%w: the content hash of %s %s is required", errUnauthorized, r.Method, r.URL.Path)
+	}
+	if contentHash != auth.UnsignedPayload {
+		body, err := io.ReadAll(io.LimitReader(r.Body, auth.MaxSignedBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > auth.MaxSignedBody {
+			return nil, errBodyTooLarge
+		}
+		if auth.ContentHash(body) != contentHash {
+			return nil, fmt.Errorf("%w: the body does not match its hash", errUnauthorized)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	toSign := auth.StringToSign(r.Method, r.URL.EscapedPath(), r.URL.Query(), date, nonce, contentHash)
+	if !auth.Verify(c.Secret, toSign, signature) {
+		return nil, fmt.Errorf("%w: invalid signature of the key %s", errUnauthorized, keyID)
+	}
+
+	err = a.s.useNonce(unix, keyID, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{ID: c.ID, Name: c.Name, Admin: c.Admin, Tenant: c.Tenant}, nil
+}
+
+// useNonce records the nonce of a signed request, a nonce already used is
+// a replay. The nonces out of the allowed skew are deleted, the requests
+// with their dates are refused anyway
+func (s *Server) useNonce(date int64, keyID, nonce string) error {
+	s.nonces.mu.Lock()
+	defer s.nonces.mu.Unlock()
+
+	key := nonceKey + fmt.Sprintf("%020d", date) + keyID + "_" + nonce
+	_, err := s.db.Get(key)
+	if err == nil {
+		return fmt.Errorf("%w: the nonce of the key %s was already used", errUnauthorized, keyID)
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	err = s.db.Put(key, []byte{})
+	if err != nil {
+		return err
+	}
+
+	if time.Since(s.nonces.lastSweep) < s.authMaxSkew() {
+		return nil
+	}
+	s.nonces.lastSweep = time.Now()
+	return s.deleteExpiredNonces()
+}
+
+// deleteExpiredNonces deletes the nonces with dates out of the allowed skew,
+// the keys are ordered by date
+func (s *Server) deleteExpiredNonces() error {
+	keys, err := s.db.KeysByPrefix(nonceKey)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	oldest := nonceKey + fmt.Sprintf("%020d", time.Now().Add(-s.authMaxSkew()).Unix())
+	b := s.db.NewBatch()
+	for _, k := range keys {
+		if k >= oldest {
+			break
+		}
+		b.Delete(k)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.db.Write(b)
+}
+
+// authMaxSkew returns the configured skew or the default one
+func (s *Server) authMaxSkew() time.Duration {
+	if s.conf.AuthMaxSkew <= 0 {
+		return defaultAuthMaxSkew
+	}
+	return s.conf.AuthMaxSkew
+}
+
+// principal returns the principal of a credential of the kind
+func (s *Server) principal(id, kind string) (*Principal, error) {
+	c, err := s.getCredential(id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && c.Kind != kind) {
+		return nil, fmt.Errorf("%w: unknown credential %s", errUnauthorized, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{ID: c.ID, Name: c.Name, Admin: c.Admin, Tenant: c.Tenant}, nil
+}
+
+// getCredential returns the credential of the id
+func (s *Server) getCredential(id string) (credential, error) {
+	data, err := s.global.Get(credentialKey + id)
+	if err != nil {
+		return credential{}, err
+	}
+	var c credential
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// CredentialsHandler manages the credentials: GET /admin/tokens lists them
+// without their secrets, POST /admin/tokens creates a token or an hmac key
+// and returns its secret once and DELETE /admin/tokens/<id> revokes one
+func (s *Server) CredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tokens"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		s.listCredentials(w)
+	case r.Method == http.MethodPost && id == "":
+		s.createCredential(w, r)
+	case r.Method == http.MethodDelete && id != "":
+		s.deleteCredential(w, id)
+	default:
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listCredentials(w http.ResponseWriter) {
+	values, err := s.db.GetByPrefix(credentialKey)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	credentials := make([]credential, 0, len(values))
+	for _, data := range values {
+		var c credential
+		err = json.Unmarshal(data, &c)
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+		c.Secret = ""
+		c.TokenHash = ""
+		credentials = append(credentials, c)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].ID < credentials[j].ID
+	})
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentials)
+}
+
+func (s *Server) createCredential(w http.ResponseWriter, r *http.Request) {
+	var req credentialRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	c, secret, err := s.newCredential(req)
+	if errors.Is(err, errInvalidCredential) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is only returned here
+	result := struct {
+		credential
+		Token  string `json:"token,omitempty"`
+		Secret string `json:"secret,omitempty"`
+	}{credential: c}
+	result.TokenHash = ""
+	if c.Kind == authToken {
+		result.Token = secret
+	} else {
+		result.Secret = secret
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// newCredential stores a new credential and returns it with its token or
+// its secret
+func (s *Server) newCredential(req credentialRequest) (credential, string, error) {
+	if req.Kind != authToken && req.Kind != authHMAC {
+		return credential{}, "", fmt.Errorf("%w: the kind must be %s or %s", errInvalidCredential, authToken, authHMAC)
+	}
+	if req.Tenant != "" {
+		if !s.conf.Tenants {
+			return credential{}, "", fmt.Errorf("%w: the tenants are disabled", errInvalidCredential)
+		}
+		_, err := s.getTenant(req.Tenant)
+		if errors.Is(err, db.ErrNotFound) {
+			return credential{}, "", fmt.Errorf("%w: unknown tenant %s", errInvalidCredential, req.Tenant)
+		}
+		if err != nil {
+			return credential{}, "", err
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return credential{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return credential{}, "", err
+	}
+
+	c := credential{ID: id, Name: req.Name, Kind: req.Kind, Admin: req.Admin, Tenant: req.Tenant, Created: time.Now().UTC()}
+	b := s.db.NewBatch()
+	if c.Kind == authToken {
+		secret = "zc_" + secret
+		c.TokenHash = auth.ContentHash([]byte(secret))
+		b.Put(tokenKey+c.TokenHash, []byte(c.ID))
+	} else {
+		c.Secret = secret
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return credential{}, "", err
+	}
+	b.Put(credentialKey+c.ID, data)
+	return c, secret, s.db.Write(b)
+}
+
+func (s *Server) deleteCredential(w http.ResponseWriter, id string) {
+	c, err := s.getCredential(id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	b := s.db.NewBatch()
+	if c.TokenHash != "" {
+		b.Delete(tokenKey + c.TokenHash)
+	}
+	b.Delete(credentialKey + id)
+	err = s.db.Write(b)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
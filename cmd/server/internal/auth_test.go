@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthServer(methods ...string) (*Server, *MockDatabase) {
+	server, mockDB := newChunkingServer()
+	server.conf.Auth = methods
+	server.conf.AuthAdminToken = "admin-token"
+	server.useAuthMethods(methods)
+	return server, mockDB
+}
+
+func serveAs(server *Server, req *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	waitGC(server)
+	return w
+}
+
+// createCredential creates a credential with the admin token and returns
+// its token or its secret
+func createCredential(t *testing.T, server *Server, req credentialRequest) (string, string) {
+	body, _ := json.Marshal(req)
+	w := serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/tokens", bytes.NewBuffer(body)), "admin-token")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var result struct {
+		ID     string `json:"id"`
+		Token  string `json:"token"`
+		Secret string `json:"secret"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	if req.Kind == authToken {
+		return result.ID, result.Token
+	}
+	return result.ID, result.Secret
+}
+
+func TestAuthDisabled(t *testing.T) {
+	server, _ := newChunkingServer()
+	require.NoError(t, server.checkAuth())
+
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	server.conf.Auth = []string{"password"}
+	assert.EqualError(t, server.checkAuth(), "unknown authentication method password, valid values: token, hmac")
+
+	// The tenants are chosen by the credentials
+	server.conf.Auth = nil
+	server.conf.Tenants = true
+	assert.EqualError(t, server.checkAuth(), "the tenants require an authentication method")
+}
+
+func TestTokenAuth(t *testing.T) {
+	server, mockDB := newAuthServer(authToken)
+	require.NoError(t, server.checkAuth())
+
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), auth.SchemeBearer)
+
+	id, token := createCredential(t, server, credentialRequest{Name: "ci", Kind: authToken})
+	assert.True(t, strings.HasPrefix(token, "zc_"))
+	assert.NotContains(t, string(mockDB.data[credentialKey+id]), token)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), "zc_unknown")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The admin endpoints need an admin credential
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/gc?dry_run=true", nil), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, admin := createCredential(t, server, credentialRequest{Name: "ops", Kind: authToken, Admin: true})
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/gc?dry_run=true", nil), admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/admin/tokens", nil), admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	var credentials []credential
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&credentials))
+	require.Len(t, credentials, 2)
+	for _, c := range credentials {
+		assert.Empty(t, c.TokenHash)
+		assert.Empty(t, c.Secret)
+	}
+
+	// A revoked token is refused
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/admin/tokens/"+id, nil), admin)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/admin/tokens/"+id, nil), admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	body, _ := json.Marshal(credentialRequest{Name: "x", Kind: "password"})
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/tokens", bytes.NewBuffer(body)), admin)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHMACAuth(t *testing.T) {
+	server, mockDB := newAuthServer(authToken, authHMAC)
+	keyID, secret := createCredential(t, server, credentialRequest{Name: "backup", Kind: authHMAC})
+
+	files, _ := json.Marshal([][]byte{[]byte("file1")})
+	signed := func(body []byte, date time.Time, contentHash string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/upload?message=signed", bytes.NewBuffer(body))
+		require.NoError(t, auth.SignRequest(req, keyID, secret, date, contentHash))
+		return req
+	}
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		server.routes().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	req := signed(files, time.Now(), auth.ContentHash(files))
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(bytes.NewReader(files))
+	assert.Equal(t, http.StatusOK, serve(req))
+
+	// Each request is accepted once
+	assert.Equal(t, http.StatusUnauthorized, serve(replay))
+
+	// The body, the query and the date are signed
+	req = signed(files, time.Now(), auth.ContentHash(files))
+	req.Body = io.NopCloser(bytes.NewReader([]byte(`["dGFtcGVyZWQ="]`)))
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+
+	req = signed(files, time.Now(), auth.ContentHash(files))
+	req.URL.RawQuery = "message=changed"
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+
+	assert.Equal(t, http.StatusUnauthorized, serve(signed(files, time.Now().Add(-time.Hour), auth.ContentHash(files))))
+
+	req = signed(files, time.Now(), auth.ContentHash(files))
+	req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), keyID, "unknown", 1))
+	assert.Equal(t, http.StatusUnauthorized, serve(req))
+
+	// The streamed uploads are verified by their proofs, the other bodies
+	// are signed
+	assert.Equal(t, http.StatusOK, serve(signed(files, time.Now(), auth.UnsignedPayload)))
+	for _, url := range []string{"/upload/x", "/v1/tree/x", "/collections", "/v1/admin/tokens"} {
+		req = httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(files))
+		require.NoError(t, auth.SignRequest(req, keyID, secret, time.Now(), auth.UnsignedPayload))
+		assert.Equal(t, http.StatusUnauthorized, serve(req), url)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/v1/upload", bytes.NewBuffer(files))
+	require.NoError(t, auth.SignRequest(req, keyID, secret, time.Now(), auth.UnsignedPayload))
+	assert.Equal(t, http.StatusOK, serve(req))
+
+	// The nonces out of the skew are deleted
+	mockDB.data[nonceKey+"00000000000000000001"+keyID+"_old"] = []byte{}
+	require.NoError(t, server.deleteExpiredNonces())
+	assert.NotContains(t, mockDB.data, nonceKey+"00000000000000000001"+keyID+"_old")
+	// Only the nonces of the accepted requests are kept
+	assert.Equal(t, 3, countKeys(mockDB.data, nonceKey))
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+const (
+	// blobKey stores the content of a file once by its sha256, the files
+	// of every root with the same content share it
+	blobKey = "blob_"
+	// blobManifestKey stores the manifest of a chunked blob
+	blobManifestKey = "blobmanifest_"
+	// refKey links a file of a root to its blob: refKey + root + hash has
+	// the sha256 of the content
+	refKey = "ref_"
+	// refCountKey stores how many refs link to a blob, the blob is deleted
+	// with its last ref
+	refCountKey = "refs_"
+)
+
+// blobID returns the id of a blob, the sha256 of its content
+func blobID(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// putRef adds to the batch the link of a file of a root to a blob, the new
+// blobs are written by commit
+func (b *intentBatch) putRef(root, hash string, f stagedFile) {
+	b.Put(refKey+root+hash, []byte(f.id))
+	if _, ok := b.blobs[f.id]; !ok {
+		b.blobs[f.id] = f
+	}
+}
+
+// putBlobs adds to the batch the reference counts changed by the refs of
+// the batch, the contents of the blobs that are not stored yet and the
+// deletion of the blobs without refs. It returns the bytes and files added or removed, it
+// must be called with the refs lock held until the batch is written
+func (s *Server) putBlobs(b *intentBatch) (usage, error) {
+	// The last write of each ref is the one that is kept
+	refs := make(map[string]string)
+	for _, op := range b.ops {
+		if !strings.HasPrefix(op.Key, refKey) {
+			continue
+		}
+		refs[op.Key] = ""
+		if !op.Delete {
+			refs[op.Key] = string(op.Value)
+		}
+	}
+
+	deltas := make(map[string]int)
+	for key, id := range refs {
+		old, err := s.db.Get(key)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return usage{}, err
+		}
+		if string(old) == id {
+			continue
+		}
+		if len(old) != 0 {
+			deltas[string(old)]--
+		}
+		if id != "" {
+			deltas[id]++
+		}
+	}
+
+	ids := make([]string, 0, len(deltas))
+	for id := range deltas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var u usage
+	for _, id := range ids {
+		if deltas[id] == 0 {
+			continue
+		}
+		count, err := s.getRefCount(id)
+		if err != nil {
+			return usage{}, err
+		}
+
+		n := count + deltas[id]
+		if n <= 0 {
+			size, err := s.blobSize(id)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return usage{}, err
+			}
+			if err == nil {
+				u.Bytes -= size
+				u.Files--
+			}
+			b.Delete(refCountKey + id)
+			b.Delete(blobKey + id)
+			b.Delete(blobManifestKey + id)
+			continue
+		}
+		b.Put(refCountKey+id, []byte(strconv.Itoa(n)))
+
+		if count == 0 {
+			f, ok := b.blobs[id]
+			if !ok {
+				return usage{}, fmt.Errorf("the blob %s is not stored", id)
+			}
+			size, err := f.size()
+			if err != nil {
+				return usage{}, err
+			}
+			u.Bytes += size
+			u.Files++
+			if f.manifest != nil {
+				b.putContent(blobManifestKey+id, f.manifest)
+			} else {
+				b.putContent(blobKey+id, f.content)
+			}
+		}
+	}
+	return u, nil
+}
+
+// blobSize returns the size of the content of a stored blob
+func (s *Server) blobSize(id string) (int64, error) {
+	content, err := s.db.Get(blobKey + id)
+	if err == nil {
+		return int64(len(content)), nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return 0, err
+	}
+
+	data, err := s.db.Get(blobManifestKey + id)
+	if err != nil {
+		return 0, err
+	}
+	return stagedFile{manifest: data}.size()
+}
+
+// getRefCount returns how many refs link to the blob
+func (s *Server) getRefCount(id string) (int, error) {
+	data, err := s.db.Get(refCountKey + id)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+// getRef returns the id of the blob of a file of a root
+func (s *Server) getRef(root, hash string) (string, error) {
+	id, err := s.db.Get(refKey + root + hash)
+	if err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// openBlob returns a reader of the content of a blob and its size
+func (s *Server) openBlob(id string) (io.ReadSeeker, int64, error) {
+	data, err := s.db.Get(blobManifestKey + id)
+	if errors.Is(err, db.ErrNotFound) {
+		content, err := s.db.Get(blobKey + id)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(content), int64(len(content)), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.openManifest(data, id)
+}
+
+// migrateBlobs moves the files stored by root, with the content or the
+// manifest in each root, to the blobs. Each file is moved in its own commit
+// so an interrupted migration continues on the next start
+func (s *Server) migrateBlobs() error {
+	for _, prefix := range []string{fileKey, manifestKey} {
+		keys, err := s.db.KeysByPrefix(prefix)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			// NOTE: the keys are prefix + root + leaf, the leaves are hex
+			// encoded 32 bytes hashes
+			rest := strings.TrimPrefix(k, prefix)
+			if len(rest) <= 64 {
+				continue
+			}
+			root, hash := rest[:len(rest)-64], rest[len(rest)-64:]
+
+			f, err := s.legacyFile(prefix, k)
+			if err != nil {
+				return err
+			}
+
+			b := s.newBatch()
+			b.putRef(root, hash, f)
+			b.Delete(k)
+			err = s.commit("blob migration", root, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacyFile returns a file stored by root as a staged file with the id of
+// its content, the chunks of the manifests are read to hash the content
+func (s *Server) legacyFile(prefix, key string) (stagedFile, error) {
+	data, err := s.db.Get(key)
+	if err != nil {
+		return stagedFile{}, err
+	}
+
+	if prefix == fileKey {
+		return stagedFile{content: data, id: blobID(data)}, nil
+	}
+
+	r, _, err := s.openManifest(data, key)
+	if err != nil {
+		return stagedFile{}, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return stagedFile{}, err
+	}
+	return stagedFile{manifest: data, id: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// openManifest returns a reader of a chunked file and its size, name
+// identifies the file in the errors
+func (s *Server) openManifest(data []byte, name string) (io.ReadSeeker, int64, error) {
+	var m manifest
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if chunksRoot(m.Chunks) != m.Root {
+		return nil, 0, fmt.Errorf("invalid manifest of the file %s", name)
+	}
+
+	f := &chunkedFile{s: s, hash: name, chunks: m.Chunks, offsets: make([]int64, len(m.Chunks)+1), cur: -1}
+	for i, h := range m.Chunks {
+		size := 0
+		if len(m.Sizes) == len(m.Chunks) {
+			size = m.Sizes[i]
+		} else {
+			chunk, err := f.getChunk(h)
+			if err != nil {
+				return nil, 0, err
+			}
+			size = len(chunk)
+		}
+		f.offsets[i+1] = f.offsets[i] + int64(size)
+	}
+
+	if f.offsets[len(m.Chunks)] != int64(m.Size) {
+		return nil, 0, fmt.Errorf("invalid size of the file %s", name)
+	}
+	return f, int64(m.Size), nil
+}
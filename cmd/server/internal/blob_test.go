@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func uploadJSON(t *testing.T, server *Server, url string, files [][]byte) treeResult {
+	handler := server.UploadHandler
+	if strings.HasPrefix(url, "/update/") {
+		handler = server.UpdatedHandler
+	}
+	result, status := postFiles(server, handler, url, files)
+	require.Equal(t, http.StatusOK, status)
+	return result
+}
+
+func TestBlobsSharedByCollections(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	// Only the last version is kept so the old roots are deleted
+	server.conf.HistoryKeep = 1
+
+	shared := []byte("shared content")
+	id := blobID(shared)
+
+	first := uploadJSON(t, server, "/upload", [][]byte{shared, []byte("first")})
+	second := uploadJSON(t, server, "/upload", [][]byte{shared, []byte("second")})
+	assert.Equal(t, 3, countKeys(mockDB.data, blobManifestKey))
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+id])
+
+	// The update links the files kept to the new root without writing them
+	third := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("third")})
+	assert.Equal(t, 4, countKeys(mockDB.data, blobManifestKey))
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+id])
+	assert.Equal(t, 0, countKeys(mockDB.data, refKey+first.RootHash))
+
+	for i, expected := range [][]byte{shared, []byte("first"), []byte("third")} {
+		content, err := server.getFile(third.RootHash, third.Leaves[i])
+		require.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+
+	// The blobs are deleted with their last ref
+	_, err := replaceFiles(server, second.RootHash, [][]byte{[]byte("other")})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), mockDB.data[refCountKey+id])
+	assert.Nil(t, mockDB.data[blobManifestKey+blobID([]byte("second"))])
+	assert.Nil(t, mockDB.data[refCountKey+blobID([]byte("second"))])
+
+	_, err = replaceFiles(server, third.RootHash, [][]byte{[]byte("other2")})
+	require.NoError(t, err)
+	assert.Nil(t, mockDB.data[blobManifestKey+id])
+	assert.Nil(t, mockDB.data[refCountKey+id])
+	assert.Equal(t, 2, countKeys(mockDB.data, blobManifestKey))
+}
+
+func TestBlobsDuplicatedInAnUpload(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	file := make([]byte, 5000)
+	result := uploadJSON(t, server, "/upload", [][]byte{file, file})
+	assert.Len(t, result.Leaves, 2)
+	assert.Equal(t, 1, countKeys(mockDB.data, blobManifestKey))
+	assert.Equal(t, []byte("1"), mockDB.data[refCountKey+blobID(file)])
+}
+
+func TestMigrateBlobs(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	content := []byte("stored before the blobs")
+	hash := mkt.SHA256.HashLeaf(content)
+	root1, root2 := mkt.SHA256.HashLeaf([]byte("root1")), mkt.SHA256.HashLeaf([]byte("root2"))
+	mockDB.data[fileKey+root1+hash] = content
+	mockDB.data[fileKey+root2+hash] = content
+
+	// A file chunked before the blobs
+	chunked := make([]byte, 3000)
+	chunkedHash := mkt.SHA256.HashLeaf(chunked)
+	staged, err := server.stageFile(chunked)
+	require.NoError(t, err)
+	mockDB.data[manifestKey+root1+chunkedHash] = staged.manifest
+
+	require.NoError(t, server.migrateBlobs())
+	assert.Equal(t, 0, countKeys(mockDB.data, fileKey))
+	assert.Equal(t, 0, countKeys(mockDB.data, manifestKey))
+	assert.Equal(t, 0, countKeys(mockDB.data, intentKey))
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+blobID(content)])
+	assert.Equal(t, staged.manifest, mockDB.data[blobManifestKey+blobID(chunked)])
+
+	for _, root := range []string{root1, root2} {
+		result, err := server.getFile(root, hash)
+		require.NoError(t, err)
+		assert.Equal(t, content, result)
+	}
+	result, err := server.getFile(root1, chunkedHash)
+	require.NoError(t, err)
+	assert.Equal(t, chunked, result)
+
+	// Nothing left to migrate
+	require.NoError(t, server.migrateBlobs())
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+blobID(content)])
+}
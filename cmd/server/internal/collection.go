@@ -0,0 +1,420 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// collectionFlat is a collection of files identified by their index
+	collectionFlat = "flat"
+	// collectionTree is a hierarchy uploaded with /tree
+	collectionTree = "tree"
+
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var errCollectionNotFound = errors.New("collection not found")
+
+// collectionSummary is a root known by the server
+type collectionSummary struct {
+	RootHash string `json:"root_hash"`
+	Type     string `json:"type"`
+}
+
+// collectionInfo is the summary of a collection, the leaves of a tree are
+// its files
+type collectionInfo struct {
+	RootHash   string   `json:"root_hash"`
+	Type       string   `json:"type"`
+	Mode       mkt.Mode `json:"mode"`
+	CommitMeta bool     `json:"commit_meta,omitempty"`
+	LeafCount  int      `json:"leaf_count"`
+	TotalBytes int64    `json:"total_bytes"`
+}
+
+// leafInfo is a leaf of a collection
+type leafInfo struct {
+	Index int           `json:"index"`
+	Hash  string        `json:"hash"`
+	Size  int64         `json:"size"`
+	Meta  *mkt.Metadata `json:"meta,omitempty"`
+}
+
+// CollectionsHandler lists the roots known by the server sorted by hash
+// that the principal can read, the query parameters offset and limit
+// paginate the list
+func (s *Server) CollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, roots, err := s.listCollections(principalOf(r), offset, limit)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	result := struct {
+		Total  int                 `json:"total"`
+		Offset int                 `json:"offset"`
+		Limit  int                 `json:"limit"`
+		Roots  []collectionSummary `json:"roots"`
+	}{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Roots:  roots,
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// listCollections returns the count of the roots the principal can read
+// and the summaries of the page
+func (s *Server) listCollections(p *Principal, offset, limit int) (int, []collectionSummary, error) {
+	roots, err := s.getRoots()
+	if err == nil {
+		roots, err = s.readableRoots(p, roots)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	summaries := []collectionSummary{}
+	for _, root := range page(roots, offset, limit) {
+		typ, err := s.getCollectionType(root)
+		if err != nil {
+			return 0, nil, err
+		}
+		summaries = append(summaries, collectionSummary{RootHash: root, Type: typ})
+	}
+	return len(roots), summaries, nil
+}
+
+// CollectionHandler inspects a collection: GET /collections/root returns
+// its summary, GET /collections/root/leaves?offset=n&limit=m lists its
+// leaves with their sizes and metadata and DELETE /collections/root deletes
+// the collection with all its versions
+func (s *Server) CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 3 || pathParts[2] == "" {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+	root := pathParts[2]
+
+	switch {
+	case r.Method == http.MethodDelete && len(pathParts) == 3:
+		s.collectionDelete(w, root)
+	case r.Method == http.MethodDelete:
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+	case len(pathParts) == 3:
+		s.collectionInfo(w, root)
+	case len(pathParts) == 4 && pathParts[3] == "leaves":
+		s.collectionLeaves(w, r, root)
+	default:
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+	}
+}
+
+func (s *Server) collectionInfo(w http.ResponseWriter, root string) {
+	typ, err := s.getCollectionType(root)
+	if err != nil {
+		s.collectionError(w, err)
+		return
+	}
+
+	info := collectionInfo{RootHash: root, Type: typ}
+	info.Mode, err = s.getMode(root)
+	if err == nil {
+		info.CommitMeta, err = s.getCommitMeta(root)
+	}
+	if err != nil {
+		s.collectionError(w, err)
+		return
+	}
+
+	var sizes []int64
+	if typ == collectionTree {
+		sizes, err = s.treeSizes(root)
+	} else {
+		sizes, err = s.leafSizes(root)
+	}
+	if err != nil {
+		s.collectionError(w, err)
+		return
+	}
+
+	info.LeafCount = len(sizes)
+	for _, size := range sizes {
+		info.TotalBytes += size
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *Server) collectionDelete(w http.ResponseWriter, root string) {
+	err := s.deleteCollection(root)
+	if errors.Is(err, errCollectionNotFound) {
+		s.collectionError(w, err)
+		return
+	}
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) collectionLeaves(w http.ResponseWriter, r *http.Request, root string) {
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	typ, err := s.getCollectionType(root)
+	if err != nil {
+		s.collectionError(w, err)
+		return
+	}
+	if typ == collectionTree {
+		http.Error(w, "the leaves of a tree are listed with /tree", http.StatusBadRequest)
+		return
+	}
+
+	leaves, err := s.getLeaves(root)
+	if err != nil {
+		s.collectionError(w, err)
+		return
+	}
+
+	result := struct {
+		RootHash  string     `json:"root_hash"`
+		LeafCount int        `json:"leaf_count"`
+		Offset    int        `json:"offset"`
+		Limit     int        `json:"limit"`
+		Leaves    []leafInfo `json:"leaves"`
+	}{
+		RootHash:  root,
+		LeafCount: len(leaves),
+		Offset:    offset,
+		Limit:     limit,
+		Leaves:    []leafInfo{},
+	}
+
+	for i, h := range page(leaves, offset, limit) {
+		leaf := leafInfo{Index: offset + i, Hash: h}
+		leaf.Meta, err = s.getMeta(root, h)
+		if err == nil {
+			leaf.Size, err = s.fileSize(root, h, leaf.Meta)
+		}
+		if err != nil {
+			s.collectionError(w, err)
+			return
+		}
+		result.Leaves = append(result.Leaves, leaf)
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// getRoots returns the roots retained by the histories sorted by hash, one
+// key by root is read
+func (s *Server) getRoots() ([]string, error) {
+	keys, err := s.db.KeysByPrefix(versionsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]string, len(keys))
+	for i, k := range keys {
+		roots[i] = strings.TrimPrefix(k, versionsKey)
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// storedRoots returns the roots of the flat collections and the trees
+// sorted by hash, with the ones that are not in a history. The flat
+// collections stored before the modes are found by their proofs, so all the
+// proofs are read
+func (s *Server) storedRoots() ([]string, error) {
+	found := make(map[string]bool)
+
+	keys, err := s.db.KeysByPrefix(modeKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		found[strings.TrimPrefix(k, modeKey)] = true
+	}
+
+	// NOTE: the proofs are proofKey + root + leaf, the leaves are hex
+	// encoded 32 bytes hashes
+	keys, err = s.db.KeysByPrefix(proofKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, proofKey)
+		if len(k) > 64 {
+			found[k[:len(k)-64]] = true
+		}
+	}
+
+	roots := make([]string, 0, len(found))
+	for root := range found {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// getCollectionType returns if the root is a flat collection or a tree,
+// errCollectionNotFound is returned for unknown roots
+func (s *Server) getCollectionType(root string) (string, error) {
+	_, err := s.db.Get(dirKey + root + root)
+	if err == nil {
+		return collectionTree, nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return "", err
+	}
+
+	_, err = s.db.Get(root + "0")
+	if errors.Is(err, db.ErrNotFound) {
+		return "", errCollectionNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return collectionFlat, nil
+}
+
+// leafSizes returns the sizes of the files of a flat collection by index
+func (s *Server) leafSizes(root string) ([]int64, error) {
+	leaves, err := s.getLeaves(root)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]int64, len(leaves))
+	for i, h := range leaves {
+		meta, err := s.getMeta(root, h)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i], err = s.fileSize(root, h, meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// treeSizes returns the sizes of the files of a tree walking its
+// directories from the root
+func (s *Server) treeSizes(root string) ([]int64, error) {
+	var sizes []int64
+	pending := []string{root}
+	for len(pending) > 0 {
+		entries, err := s.getEntries(root, pending[0])
+		if err != nil {
+			return nil, err
+		}
+		pending = pending[1:]
+
+		for _, e := range entries {
+			if e.Type == mkt.EntryDir {
+				pending = append(pending, e.Hash)
+				continue
+			}
+			size, err := s.fileSize(root, e.Hash, nil)
+			if err != nil {
+				return nil, err
+			}
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes, nil
+}
+
+// fileSize returns the size of a file of a root, it is taken from the
+// metadata when it exists
+func (s *Server) fileSize(root, hash string, meta *mkt.Metadata) (int64, error) {
+	if meta != nil {
+		return meta.Size, nil
+	}
+
+	_, size, err := s.openFile(root, hash)
+	return size, err
+}
+
+func (s *Server) collectionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	s.conf.Logger.Error(err.Error())
+	http.Error(w, errInternal, http.StatusInternalServerError)
+}
+
+// parsePage returns the offset and the limit of a paginated list
+func parsePage(r *http.Request) (int, int, error) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset " + v)
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, errors.New("invalid limit " + v + ", valid values: 1 to " + strconv.Itoa(maxPageLimit))
+		}
+	}
+	return offset, limit, nil
+}
+
+// page returns the items of the page
+func page(items []string, offset, limit int) []string {
+	if offset >= len(items) {
+		return nil
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
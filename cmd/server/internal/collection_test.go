@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getCollection(server *Server, url string, v any) int {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		json.NewDecoder(w.Body).Decode(v)
+	}
+	return w.Code
+}
+
+func TestCollectionHandlers(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	files := [][]byte{[]byte("hello"), make([]byte, 5000), []byte("<html></html>")}
+	metas := []mkt.Metadata{{Name: "hello.txt"}, {Name: "zero.bin"}, {Name: "index.html", ContentType: "text/html"}}
+	body, contentType := multipartMetaBody(t, files, metas)
+	req := httptest.NewRequest(http.MethodPost, "/upload?commit_meta=true", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var flat treeResult
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&flat))
+
+	treeBody, _ := json.Marshal([]treeFile{
+		{Path: "a.txt", Mode: 0o644, File: []byte("aaa")},
+		{Path: "src/b.go", Mode: 0o644, File: []byte("package b")},
+	})
+	req = httptest.NewRequest(http.MethodPost, "/tree", bytes.NewBuffer(treeBody))
+	w = httptest.NewRecorder()
+	server.TreeUploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var tree struct {
+		RootHash string `json:"root_hash"`
+	}
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&tree))
+
+	// The roots
+	var roots struct {
+		Total int                 `json:"total"`
+		Roots []collectionSummary `json:"roots"`
+	}
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections", &roots))
+	assert.Equal(t, 2, roots.Total)
+	assert.ElementsMatch(t, []collectionSummary{
+		{RootHash: flat.RootHash, Type: collectionFlat},
+		{RootHash: tree.RootHash, Type: collectionTree},
+	}, roots.Roots)
+
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections?offset=1&limit=1", &roots))
+	assert.Equal(t, 2, roots.Total)
+	assert.Len(t, roots.Roots, 1)
+
+	// The summaries
+	var info collectionInfo
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections/"+flat.RootHash, &info))
+	assert.Equal(t, collectionInfo{
+		RootHash:   flat.RootHash,
+		Type:       collectionFlat,
+		Mode:       mkt.SHA256,
+		CommitMeta: true,
+		LeafCount:  3,
+		TotalBytes: 5018,
+	}, info)
+
+	info = collectionInfo{}
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections/"+tree.RootHash, &info))
+	assert.Equal(t, collectionInfo{
+		RootHash:   tree.RootHash,
+		Type:       collectionTree,
+		Mode:       mkt.SHA256,
+		LeafCount:  2,
+		TotalBytes: 12,
+	}, info)
+
+	// The leaves
+	var leaves struct {
+		LeafCount int        `json:"leaf_count"`
+		Leaves    []leafInfo `json:"leaves"`
+	}
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections/"+flat.RootHash+"/leaves?offset=1&limit=5", &leaves))
+	assert.Equal(t, 3, leaves.LeafCount)
+	require.Len(t, leaves.Leaves, 2)
+	assert.Equal(t, 1, leaves.Leaves[0].Index)
+	assert.Equal(t, flat.Leaves[1], leaves.Leaves[0].Hash)
+	assert.Equal(t, int64(5000), leaves.Leaves[0].Size)
+	assert.Equal(t, "zero.bin", leaves.Leaves[0].Meta.Name)
+	assert.Equal(t, 2, leaves.Leaves[1].Index)
+	assert.Equal(t, "text/html", leaves.Leaves[1].Meta.ContentType)
+
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections/"+flat.RootHash+"/leaves?offset=10", &leaves))
+	assert.Empty(t, leaves.Leaves)
+
+	// The files without metadata use the manifests
+	server.db.Delete(metaKey + flat.RootHash + flat.Leaves[1])
+	require.Equal(t, http.StatusOK, getCollection(server, "/collections/"+flat.RootHash+"/leaves?limit=2", &leaves))
+	assert.Equal(t, int64(5000), leaves.Leaves[1].Size)
+	assert.Nil(t, leaves.Leaves[1].Meta)
+}
+
+func TestCollectionHandlersErrors(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/collections?limit=0", http.StatusBadRequest},
+		{"/collections?offset=-1", http.StatusBadRequest},
+		{"/collections/", http.StatusBadRequest},
+		{"/collections/unknown", http.StatusBadRequest},
+		{"/collections/" + unknownRoot, http.StatusNotFound},
+		{"/collections/" + unknownRoot + "/leaves", http.StatusNotFound},
+		{"/collections/unknown/other", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, tt.status, getCollection(server, tt.url, nil))
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/collections", nil)
+	w := httptest.NewRecorder()
+	server.CollectionsHandler(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/delta"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+// deltaRequest is the delta of a modified file, the hash is the content
+// hash of the new version used to check the reconstruction
+type deltaRequest struct {
+	Hash      string     `json:"hash"`
+	BlockSize int        `json:"block_size"`
+	Ops       []delta.Op `json:"ops"`
+}
+
+// SignatureHandler returns the block signatures of the stored version of
+// a file, so the client can compute the delta of its new version
+func (s *Server) SignatureHandler(w http.ResponseWriter, r *http.Request) {
+	// NOTE: /signature/root/index
+	root, index, ok := parseRootIndex(r.URL.Path)
+	if !ok {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	leaves, err := s.getLeaves(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	if index >= len(leaves) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	base, err := s.getFile(root, leaves[index])
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	blockSize := delta.DefaultBlockSize(len(base))
+	if v := r.URL.Query().Get("block_size"); v != "" {
+		blockSize, err = strconv.Atoi(v)
+		if err != nil || blockSize < delta.MinBlockSize || blockSize > delta.MaxBlockSize {
+			http.Error(w, errBadRequest, http.StatusBadRequest)
+			return
+		}
+	}
+
+	sig, err := delta.NewSignature(base, blockSize)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sig)
+}
+
+// DeltaHandler rebuilds the new version of a file from the stored one and
+// the delta sent, the new version replaces the old one in the same index
+// keeping its metadata
+func (s *Server) DeltaHandler(w http.ResponseWriter, r *http.Request) {
+	// NOTE: /delta/root/index
+	root, index, ok := parseRootIndex(r.URL.Path)
+	if !ok {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	var req deltaRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if tooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	mode, err := s.getMode(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	commit, err := s.getCommitMeta(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	oldHashes, err := s.getLeaves(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	if index >= len(oldHashes) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	base, err := s.getFile(root, oldHashes[index])
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// The file rebuilt is limited as the files sent in the body
+	file, err := delta.Apply(base, req.BlockSize, req.Ops, int(s.maxBodySize()))
+	if errors.Is(err, delta.ErrTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if mode.HashLeaf(file) != req.Hash {
+		http.Error(w, "the delta does not rebuild the file "+req.Hash, http.StatusBadRequest)
+		return
+	}
+
+	meta, err := s.getMeta(root, oldHashes[index])
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	budget, err := s.stagingBudget()
+	if err == nil {
+		err = budget.take(int64(len(file)))
+	}
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	staged, err := s.stageFile(file)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	if meta != nil {
+		staged = staged.withMeta(*meta)
+	}
+
+	hash := leafHash(mode, commit, req.Hash, staged.meta)
+	hashes := make([]string, len(oldHashes))
+	copy(hashes, oldHashes)
+	hashes[index] = hash
+
+	m, err := mkt.NewMerkleTreeWithMode(hashes, mode)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	b := s.newOwnedBatch(principalOf(r))
+	err = s.replaceTree(b, root, oldHashes, m, commit, hashes, map[string]stagedFile{hash: staged})
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	err = s.commitVersion(b, "delta", root, m.Root.Hash, r.URL.Query().Get("message"))
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	result := newTreeResult(m.Root.Hash, hashes, nil)
+	result.Indexes = []int{index}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseRootIndex returns the root and the index of the paths /action/root/index
+func parseRootIndex(path string) (string, int, bool) {
+	pathParts := strings.Split(path, "/")
+	if len(pathParts) < 4 || pathParts[2] == "" {
+		return "", 0, false
+	}
+
+	index, err := strconv.Atoi(pathParts[3])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return pathParts[2], index, true
+}
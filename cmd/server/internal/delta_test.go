@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/delta"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaHandlers(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	base := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+	changed := append([]byte{}, base...)
+	copy(changed[100*1024:], []byte("a few changed bytes"))
+
+	filesJSON, _ := json.Marshal([][]byte{[]byte("other file"), base, []byte("last file")})
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var upload treeResult
+	json.NewDecoder(w.Result().Body).Decode(&upload)
+
+	req = httptest.NewRequest(http.MethodGet, "/signature/"+upload.RootHash+"/1", nil)
+	w = httptest.NewRecorder()
+	server.SignatureHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var sig delta.Signature
+	err := json.NewDecoder(w.Result().Body).Decode(&sig)
+	assert.NoError(t, err)
+	assert.Equal(t, len(base), sig.Size)
+
+	ops := delta.Compute(&sig, changed)
+	assert.Less(t, delta.Size(ops), 2*sig.BlockSize)
+
+	hash := mkt.SHA256.HashLeaf(changed)
+	body, _ := json.Marshal(deltaRequest{Hash: hash, BlockSize: sig.BlockSize, Ops: ops})
+	req = httptest.NewRequest(http.MethodPost, "/delta/"+upload.RootHash+"/1", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	server.DeltaHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var result treeResult
+	json.NewDecoder(w.Result().Body).Decode(&result)
+	assert.Equal(t, []int{1}, result.Indexes)
+	assert.Equal(t, []string{upload.Leaves[0], hash, upload.Leaves[2]}, result.Leaves)
+
+	for i, expected := range [][]byte{[]byte("other file"), changed, []byte("last file")} {
+		content, err := server.getFile(result.RootHash, result.Leaves[i])
+		assert.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+
+	// A delta that does not rebuild the announced file is refused
+	body, _ = json.Marshal(deltaRequest{Hash: mkt.SHA256.HashLeaf([]byte("x")), BlockSize: sig.BlockSize, Ops: ops})
+	req = httptest.NewRequest(http.MethodPost, "/delta/"+result.RootHash+"/1", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	server.DeltaHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	// The blocks out of the base and the files over the body size are refused
+	whole := delta.Op{Block: 0, Count: (len(base) + sig.BlockSize - 1) / sig.BlockSize}
+	server.conf.MaxBodySize = 10 * len(base)
+	tests := []struct {
+		ops    []delta.Op
+		status int
+	}{
+		{[]delta.Op{{Block: 1, Count: math.MaxInt}}, http.StatusBadRequest},
+		{[]delta.Op{{Block: math.MaxInt, Count: 1}}, http.StatusBadRequest},
+		{[]delta.Op{whole, whole, whole, whole, whole, whole, whole, whole, whole, whole, whole}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		body, _ = json.Marshal(deltaRequest{Hash: hash, BlockSize: sig.BlockSize, Ops: tt.ops})
+		req = httptest.NewRequest(http.MethodPost, "/delta/"+result.RootHash+"/1", bytes.NewBuffer(body))
+		w = httptest.NewRecorder()
+		server.DeltaHandler(w, req)
+		assert.Equal(t, tt.status, w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/signature/"+result.RootHash+"/3", nil)
+	w = httptest.NewRecorder()
+	server.SignatureHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodGet, "/signature/"+result.RootHash+"/x", nil)
+	w = httptest.NewRecorder()
+	server.SignatureHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
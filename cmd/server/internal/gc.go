@@ -0,0 +1,556 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+// gcBatchSize is the number of keys deleted by each batch of the sweep
+const gcBatchSize = 1000
+
+// errGCRunning is returned when a collection is started while another one
+// is running
+var errGCRunning = errors.New("a garbage collection is already running")
+
+// gcProtected are the prefixes of the keys not managed by the collections,
+// the intents, the sessions and the nonces expire by themselves, the files
+// stored before the blobs are moved by the migration, the histories are
+// pruned by their retention, the credentials are revoked by the admins, the
+// keyspaces of the tenants are collected by their own servers and the
+// migrations are recorded once
+var gcProtected = []string{intentKey, sessionKey, sessionPartKey, fileKey, manifestKey, historyKey, credentialKey, tokenKey, nonceKey, tenantKey, namespaceKey, usageKey, aclKey, migratedKey}
+
+// gcKinds are the prefixes of the keys reported by kind, the keys without
+// a prefix are the indexes of the roots
+var gcKinds = []string{chunkKey, blobKey, blobManifestKey, refKey, refCountKey, proofKey, modeKey, metaKey, commitMetaKey, dirKey, collectionOfKey, versionsKey}
+
+// gcReport is the result of a garbage collection, in a dry run it has what
+// would be removed
+type gcReport struct {
+	DryRun    bool `json:"dry_run"`
+	LiveRoots int  `json:"live_roots"`
+	// Removed has the number of keys removed by kind
+	Removed map[string]int `json:"removed"`
+	Keys    int            `json:"keys"`
+	Bytes   int64          `json:"bytes"`
+	// RefCounts is the number of reference counts repaired
+	RefCounts int    `json:"ref_counts"`
+	Duration  string `json:"duration"`
+}
+
+// gcState tracks what a running collection must keep: the chunks used by
+// the uploads in progress, which are only referenced when they are
+// committed, and the keys committed since the collection started
+type gcState struct {
+	// run allows one collection at a time
+	run sync.Mutex
+
+	mu      sync.Mutex
+	running bool
+	staging int
+	chunks  map[string]bool
+	written map[string]bool
+
+	// refused is set by the refused operations until the deferred
+	// collection starts, deferring is set while it runs
+	refused   bool
+	deferring bool
+	deferred  sync.WaitGroup
+}
+
+// beginStaging marks the start of an operation that stages chunks
+func (g *gcState) beginStaging() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.staging++
+}
+
+// endStaging marks the end of an operation that stages chunks, its chunks
+// are referenced or abandoned so they are forgotten with the last one
+func (g *gcState) endStaging() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.staging--
+	if g.staging == 0 && !g.running {
+		g.chunks = nil
+	}
+}
+
+// useChunk records a chunk written or reused by an operation in progress
+func (g *gcState) useChunk(hash string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.staging == 0 && !g.running {
+		return
+	}
+	if g.chunks == nil {
+		g.chunks = make(map[string]bool)
+	}
+	g.chunks[hash] = true
+}
+
+// committed records the keys and the blobs written by a commit while a
+// collection is running
+func (g *gcState) committed(ops []intentOp) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.running {
+		return
+	}
+	// NOTE: every blob whose references changed has a write of its count
+	for _, op := range ops {
+		g.written[op.Key] = true
+		if strings.HasPrefix(op.Key, refCountKey) {
+			g.written[strings.TrimPrefix(op.Key, refCountKey)] = true
+		}
+	}
+}
+
+// tracked wraps the handlers that stage chunks before their commit, the
+// chunks of the requests refused by the quota or the body size are
+// collected once the request ends
+func (s *Server) tracked(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		func() {
+			s.gc.beginStaging()
+			defer s.gc.endStaging()
+			h(sw, r)
+		}()
+		if sw.status == http.StatusInsufficientStorage || sw.status == http.StatusRequestEntityTooLarge {
+			s.collectRefused()
+		}
+	}
+}
+
+// statusWriter records the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// collectRefused schedules a collection of the chunks staged by the refused
+// operations, they are not referenced nor counted in the usage so they are
+// removed without waiting for the scheduled collections. The collection
+// runs out of the request and the refusals while it is pending share it
+func (s *Server) collectRefused() {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	s.gc.refused = true
+	if s.gc.deferring {
+		return
+	}
+	s.gc.deferring = true
+	s.gc.deferred.Add(1)
+	go s.deferredGC()
+}
+
+// deferredGC collects the garbage until no operation was refused since the
+// last collection started
+func (s *Server) deferredGC() {
+	defer s.gc.deferred.Done()
+	for {
+		s.gc.mu.Lock()
+		if !s.gc.refused {
+			s.gc.deferring = false
+			s.gc.mu.Unlock()
+			return
+		}
+		s.gc.refused = false
+		s.gc.mu.Unlock()
+
+		report, err := s.collectGarbage(false)
+		if errors.Is(err, errGCRunning) {
+			// NOTE: the running collection keeps the chunks staged since
+			// it started, they are collected once it ends
+			s.gc.run.Lock()
+			s.gc.run.Unlock()
+			s.gc.mu.Lock()
+			s.gc.refused = true
+			s.gc.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			s.conf.Logger.Error("Garbage collection error: " + err.Error())
+			continue
+		}
+		s.conf.Logger.Info("Garbage collection of the refused operations removed " + strconv.Itoa(report.Keys) + " keys" + s.tenantSuffix())
+	}
+}
+
+// GCHandler runs a garbage collection, POST /admin/gc?dry_run=true reports
+// what would be removed without removing it
+func (s *Server) GCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid dry_run "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := s.collectGarbage(dryRun)
+	if errors.Is(err, errGCRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// scheduleGC runs a garbage collection of each keyspace every interval until
+// done is closed, the versions older than the maximum age are pruned before
+// each one
+func (s *Server) scheduleGC(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			keyspaces, err := s.keyspaces()
+			if err != nil {
+				s.conf.Logger.Error("Garbage collection error: " + err.Error())
+				continue
+			}
+			for _, ks := range keyspaces {
+				ks.scheduledGC()
+			}
+		}
+	}
+}
+
+// scheduledGC prunes the histories and collects the garbage of the keyspace
+func (s *Server) scheduledGC() {
+	pruned, err := s.pruneHistories()
+	if err != nil {
+		s.conf.Logger.Error("History pruning error: " + err.Error())
+	} else if pruned > 0 {
+		s.conf.Logger.Info("History pruning removed " + strconv.Itoa(pruned) + " versions" + s.tenantSuffix())
+	}
+
+	report, err := s.collectGarbage(false)
+	if err != nil {
+		s.conf.Logger.Error("Garbage collection error: " + err.Error())
+		return
+	}
+	s.conf.Logger.Info("Garbage collection removed " + strconv.Itoa(report.Keys) + " keys and " + strconv.FormatInt(report.Bytes, 10) + " bytes" + s.tenantSuffix())
+}
+
+// tenantSuffix names the tenant of the keyspace in the logs
+func (s *Server) tenantSuffix() string {
+	if s.tenant == "" {
+		return ""
+	}
+	return " of the tenant " + s.tenant
+}
+
+// collectGarbage removes the keys not reachable from the live roots: the
+// blobs and chunks without refs, the proofs, indexes and metadata of roots
+// that no longer exist and the indexes beyond the leaves of a root. The
+// mark runs without blocking the requests, the sweep only holds the commits
+func (s *Server) collectGarbage(dryRun bool) (gcReport, error) {
+	if !s.gc.run.TryLock() {
+		return gcReport{}, errGCRunning
+	}
+	defer s.gc.run.Unlock()
+
+	start := time.Now()
+	s.gc.mu.Lock()
+	s.gc.running = true
+	s.gc.written = make(map[string]bool)
+	s.gc.mu.Unlock()
+
+	defer func() {
+		s.gc.mu.Lock()
+		s.gc.running = false
+		s.gc.written = nil
+		if s.gc.staging == 0 {
+			s.gc.chunks = nil
+		}
+		s.gc.mu.Unlock()
+	}()
+
+	live, err := s.mark()
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	report, err := s.sweep(live, dryRun)
+	if err != nil {
+		return gcReport{}, err
+	}
+	if !dryRun {
+		err = s.repairUsage()
+		if err != nil {
+			return gcReport{}, err
+		}
+	}
+	report.Duration = time.Since(start).String()
+	return report, nil
+}
+
+// liveSet is the result of the mark, the keys of the live roots with the
+// reference counts of their blobs and the chunks of the blobs
+type liveSet struct {
+	roots  int
+	keys   map[string]bool
+	blobs  map[string]int
+	chunks map[string]bool
+}
+
+// mark walks the live roots, a root is live while it has its index or its
+// root directory
+func (s *Server) mark() (*liveSet, error) {
+	live := &liveSet{keys: make(map[string]bool), blobs: make(map[string]int), chunks: make(map[string]bool)}
+
+	roots, err := s.storedRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]bool)
+	for _, root := range roots {
+		typ, err := s.getCollectionType(root)
+		if errors.Is(err, errCollectionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		live.roots++
+		live.keys[modeKey+root] = true
+		live.keys[commitMetaKey+root] = true
+		live.keys[collectionOfKey+root] = true
+		live.keys[versionsKey+root] = true
+
+		if typ == collectionTree {
+			err = s.markTree(live, refs, root)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		leaves, err := s.getLeaves(root)
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range leaves {
+			live.keys[root+strconv.Itoa(i)] = true
+			live.keys[proofKey+root+h] = true
+			live.keys[metaKey+root+h] = true
+			refs[refKey+root+h] = true
+		}
+	}
+
+	for key := range refs {
+		live.keys[key] = true
+		id, err := s.db.Get(key)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		live.blobs[string(id)]++
+	}
+
+	for id := range live.blobs {
+		data, err := s.db.Get(blobManifestKey + id)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m manifest
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range m.Chunks {
+			live.chunks[h] = true
+		}
+	}
+	return live, nil
+}
+
+// markTree adds the directories and the refs of the files of a tree
+func (s *Server) markTree(live *liveSet, refs map[string]bool, root string) error {
+	pending := []string{root}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+		live.keys[dirKey+root+dir] = true
+
+		entries, err := s.getEntries(root, dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Type == mkt.EntryDir {
+				pending = append(pending, e.Hash)
+				continue
+			}
+			refs[refKey+root+e.Hash] = true
+		}
+	}
+	return nil
+}
+
+// sweep removes the keys that are not live and repairs the reference
+// counts, the keys and blobs committed during the mark are kept. A
+// reference count that can not be read is rewritten
+func (s *Server) sweep(live *liveSet, dryRun bool) (gcReport, error) {
+	report := gcReport{DryRun: dryRun, LiveRoots: live.roots, Removed: make(map[string]int)}
+
+	keys, err := s.db.KeysByPrefix("")
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	s.refs.Lock()
+	defer s.refs.Unlock()
+
+	var garbage []string
+	for _, k := range keys {
+		if !s.isLive(live, k) {
+			garbage = append(garbage, k)
+		}
+	}
+
+	b := s.db.NewBatch()
+	for id, n := range live.blobs {
+		if s.gc.written[id] {
+			continue
+		}
+		count, err := s.getRefCount(id)
+		if err == nil && count == n {
+			continue
+		}
+		report.RefCounts++
+		b.Put(refCountKey+id, []byte(strconv.Itoa(n)))
+	}
+
+	for len(garbage) > 0 {
+		n := min(gcBatchSize, len(garbage))
+		err = s.sweepBatch(b, garbage[:n], &report, dryRun)
+		if err != nil {
+			return gcReport{}, err
+		}
+		garbage = garbage[n:]
+		b = s.db.NewBatch()
+	}
+
+	if !dryRun && b.Len() > 0 {
+		err = s.db.Write(b)
+		if err != nil {
+			return gcReport{}, err
+		}
+	}
+	return report, nil
+}
+
+// sweepBatch deletes the keys with the batch, the chunks used by the
+// uploads in progress are checked while holding the state so they can not
+// be reused while they are deleted
+func (s *Server) sweepBatch(b db.Batch, keys []string, report *gcReport, dryRun bool) error {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+
+	for _, k := range keys {
+		if strings.HasPrefix(k, chunkKey) && s.gc.chunks[strings.TrimPrefix(k, chunkKey)] {
+			continue
+		}
+
+		value, err := s.db.Get(k)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		report.Removed[gcKind(k)]++
+		report.Keys++
+		report.Bytes += int64(len(k) + len(value))
+		b.Delete(k)
+	}
+
+	if dryRun || b.Len() == 0 {
+		return nil
+	}
+	return s.db.Write(b)
+}
+
+// isLive returns if a key is kept
+func (s *Server) isLive(live *liveSet, k string) bool {
+	for _, p := range gcProtected {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+	if s.gc.written[k] {
+		return true
+	}
+
+	if strings.HasPrefix(k, chunkKey) {
+		return live.chunks[strings.TrimPrefix(k, chunkKey)]
+	}
+
+	for _, p := range []string{blobKey, blobManifestKey, refCountKey} {
+		if !strings.HasPrefix(k, p) {
+			continue
+		}
+		id := strings.TrimPrefix(k, p)
+		_, ok := live.blobs[id]
+		return ok || s.gc.written[id]
+	}
+
+	return live.keys[k]
+}
+
+// gcKind returns the kind of a key for the reports
+func gcKind(k string) string {
+	for _, p := range gcKinds {
+		if strings.HasPrefix(k, p) {
+			return strings.TrimSuffix(p, "_")
+		}
+	}
+	return "index"
+}
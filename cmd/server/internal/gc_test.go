@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	files := [][]byte{make([]byte, 5000), []byte("file2")}
+	first := uploadJSON(t, server, "/upload", files)
+	second := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("file3")})
+
+	treeBody, _ := json.Marshal([]treeFile{{Path: "src/a.go", Mode: 0o644, File: []byte("package a")}})
+	req := httptest.NewRequest(http.MethodPost, "/tree", bytes.NewBuffer(treeBody))
+	w := httptest.NewRecorder()
+	server.TreeUploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tree treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tree))
+
+	// The garbage left by crashes
+	dead := mkt.SHA256.HashLeaf([]byte("dead"))
+	orphan := blobID([]byte("orphan"))
+	garbage := map[string][]byte{
+		proofKey + dead + second.Leaves[0]: []byte("{}"),
+		modeKey + dead:                     []byte(mkt.SHA256),
+		refKey + dead + second.Leaves[0]:   []byte(orphan),
+		metaKey + second.RootHash + dead:   []byte("{}"),
+		second.RootHash + "4":              []byte(dead),
+		chunkKey + orphan:                  []byte("orphan"),
+		blobKey + orphan:                   []byte("orphan"),
+		refCountKey + orphan:               []byte("1"),
+	}
+	maps.Copy(mockDB.data, garbage)
+	mockDB.data[refCountKey+blobID([]byte("file2"))] = []byte("7")
+	mockDB.data[sessionKey+"id"] = []byte("{}")
+
+	before := maps.Clone(mockDB.data)
+	report, err := server.collectGarbage(true)
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	// The first version is kept by the history
+	assert.Equal(t, 3, report.LiveRoots)
+	assert.Equal(t, len(garbage), report.Keys)
+	assert.Equal(t, map[string]int{"proof": 1, "mode": 1, "ref": 1, "meta": 1, "index": 1, "chunk": 1, "blob": 1, "refs": 1}, report.Removed)
+	assert.Equal(t, 1, report.RefCounts)
+	assert.Equal(t, before, mockDB.data)
+
+	report, err = server.collectGarbage(false)
+	require.NoError(t, err)
+	assert.Equal(t, len(garbage), report.Keys)
+	assert.Greater(t, report.Bytes, int64(0))
+	for k := range garbage {
+		assert.NotContains(t, mockDB.data, k)
+	}
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+blobID([]byte("file2"))])
+	assert.Contains(t, mockDB.data, sessionKey+"id")
+
+	// The live roots are intact
+	for i, expected := range [][]byte{files[0], files[1], []byte("file3")} {
+		content, err := server.getFile(second.RootHash, second.Leaves[i])
+		require.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/tree/"+tree.RootHash+"/src/a.go", nil)
+	w = httptest.NewRecorder()
+	server.TreeDownloadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	report, err = server.collectGarbage(false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Keys)
+	assert.Equal(t, 0, report.RefCounts)
+}
+
+func TestCollectGarbageKeepsStagedChunks(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	// A chunk of an upload in progress is not referenced yet
+	server.gc.beginStaging()
+	require.NoError(t, server.putChunk("staged", []byte("staged")))
+
+	report, err := server.collectGarbage(false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Keys)
+	assert.Contains(t, mockDB.data, chunkKey+"staged")
+
+	// The chunks of the abandoned uploads are removed
+	server.gc.endStaging()
+	report, err = server.collectGarbage(false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Keys)
+	assert.NotContains(t, mockDB.data, chunkKey+"staged")
+}
+
+// waitGC waits for the deferred collections of the server and its tenants
+func waitGC(server *Server) {
+	server.gc.deferred.Wait()
+	server.tenants.mu.Lock()
+	defer server.tenants.mu.Unlock()
+	for _, ts := range server.tenants.servers {
+		ts.gc.deferred.Wait()
+	}
+}
+
+func TestCollectRefused(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	server.gc.beginStaging()
+	require.NoError(t, server.putChunk("refused", []byte("refused")))
+	server.gc.endStaging()
+
+	// The refusals while a collection is running share a deferred one
+	server.gc.run.Lock()
+	for i := 0; i < 3; i++ {
+		server.collectRefused()
+	}
+	server.gc.mu.Lock()
+	assert.True(t, server.gc.deferring)
+	server.gc.mu.Unlock()
+	assert.Contains(t, mockDB.data, chunkKey+"refused")
+
+	server.gc.run.Unlock()
+	waitGC(server)
+	assert.NotContains(t, mockDB.data, chunkKey+"refused")
+	assert.False(t, server.gc.deferring)
+}
+
+func TestCollectGarbageKeepsCommitted(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	// The commits of the mark are not swept
+	server.gc.running = true
+	server.gc.written = make(map[string]bool)
+	result := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+
+	live := &liveSet{keys: make(map[string]bool), blobs: make(map[string]int), chunks: make(map[string]bool)}
+	for k := range mockDB.data {
+		if strings.HasPrefix(k, chunkKey) {
+			live.chunks[strings.TrimPrefix(k, chunkKey)] = true
+		}
+	}
+	report, err := server.sweep(live, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Keys)
+
+	content, err := server.getFile(result.RootHash, result.Leaves[0])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file1"), content)
+}
+
+func TestGCHandler(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	mockDB.data[modeKey+"dead"] = []byte(mkt.SHA256)
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/admin/gc", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/gc?dry_run=maybe", http.StatusBadRequest},
+		{http.MethodPost, "/admin/gc?dry_run=true", http.StatusOK},
+		{http.MethodPost, "/admin/gc", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		w := httptest.NewRecorder()
+		server.routes().ServeHTTP(w, req)
+		require.Equal(t, tt.status, w.Code, tt.url)
+
+		if w.Code == http.StatusOK {
+			var report gcReport
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+			assert.Equal(t, 1, report.Keys, tt.url)
+		}
+	}
+	assert.NotContains(t, mockDB.data, modeKey+"dead")
+
+	// One collection at a time
+	server.gc.run.Lock()
+	req := httptest.NewRequest(http.MethodPost, "/admin/gc", nil)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	server.gc.run.Unlock()
+}
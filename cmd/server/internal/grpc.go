@@ -0,0 +1,607 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/jmsilvadev/zc/pkg/zcpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcChunkSize is the size of the data messages of the downloads
+const grpcChunkSize = 64 << 10
+
+// storageService serves the gRPC api with the keyspaces, the storage and
+// the access control of the HTTP api
+type storageService struct {
+	zcpb.UnimplementedStorageServer
+	s *Server
+}
+
+// uploadServer is the stream of the uploads and of the updates
+type uploadServer interface {
+	SendAndClose(*zcpb.TreeResult) error
+	Recv() (*zcpb.UploadRequest, error)
+	grpc.ServerStream
+}
+
+// newGRPCServer returns the gRPC server, the calls are authenticated by the
+// authenticators of the HTTP api and use its TLS config
+func (s *Server) newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(grpcTLS(tlsConfig))))
+	}
+
+	g := grpc.NewServer(opts...)
+	zcpb.RegisterStorageServer(g, &storageService{s: s})
+	return g
+}
+
+// serveGRPC serves the gRPC api on its port until it is stopped
+func (s *Server) serveGRPC(tlsConfig *tls.Config) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", s.conf.GRPCPort)
+	if err != nil {
+		return nil, err
+	}
+
+	g := s.newGRPCServer(tlsConfig)
+	go func() {
+		if err := g.Serve(listener); err != nil {
+			s.conf.Logger.Error("gRPC server error: " + err.Error())
+		}
+	}()
+	s.conf.Logger.Info("gRPC server is running on port " + s.conf.GRPCPort)
+	return g, nil
+}
+
+// stopGRPC waits for the calls in progress until the context is done, the
+// remaining ones are closed
+func stopGRPC(ctx context.Context, g *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		g.Stop()
+	}
+}
+
+// grpcTLS returns the TLS config of the gRPC server, the configs of the
+// reloaded certificates also negotiate HTTP/2
+func grpcTLS(c *tls.Config) *tls.Config {
+	c = c.Clone()
+	get := c.GetConfigForClient
+	if get == nil {
+		return c
+	}
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := get(hello)
+		if config == nil || err != nil {
+			return config, err
+		}
+		config = config.Clone()
+		config.NextProtos = []string{"h2"}
+		return config, nil
+	}
+	return c
+}
+
+// grpcAuthenticate returns the context of a call with its principal. The
+// metadata of the call are the headers of a POST to its full method, so the
+// tokens are sent as bearer tokens and the signed calls sign the method with
+// UNSIGNED-PAYLOAD
+func (s *Server) grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	if len(s.auth) == 0 {
+		return ctx, nil
+	}
+
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, unsignedKey{}, true), http.MethodPost, method, http.NoBody)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		return nil, status.Error(codes.Internal, errInternal)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, values := range md {
+		for _, v := range values {
+			r.Header.Add(k, v)
+		}
+	}
+
+	principal, err := s.authenticateRequest(r)
+	if errors.Is(err, ErrNoCredentials) {
+		return nil, status.Error(codes.Unauthenticated, errUnauthorized.Error())
+	}
+	if errors.Is(err, errUnauthorized) {
+		s.conf.Logger.Warn("Authentication failed: " + err.Error())
+		return nil, status.Error(codes.Unauthenticated, errUnauthorized.Error())
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		return nil, status.Error(codes.Internal, errInternal)
+	}
+	return context.WithValue(ctx, principalKey{}, principal), nil
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+}
+
+// authStream is a stream with the context of its principal
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authStream) Context() context.Context {
+	return a.ctx
+}
+
+// keyspace returns the server of the keyspace of a call and its principal,
+// the admins without a tenant choose it with the x-zc-tenant metadata
+func (g *storageService) keyspace(ctx context.Context) (*Server, *Principal, error) {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	if !g.s.conf.Tenants {
+		return g.s, p, nil
+	}
+
+	var name string
+	if values := metadata.ValueFromIncomingContext(ctx, tenantHeader); len(values) > 0 {
+		name = values[0]
+	}
+	ts, err := g.s.tenantOf(p, name)
+	if err != nil {
+		return nil, nil, g.s.grpcError(err)
+	}
+	return ts, p, nil
+}
+
+func (g *storageService) Upload(stream zcpb.Storage_UploadServer) error {
+	return g.upload(stream, false)
+}
+
+func (g *storageService) Update(stream zcpb.Storage_UpdateServer) error {
+	return g.upload(stream, true)
+}
+
+// upload stores the files of an upload or of an update of the root of the
+// options, as the HTTP uploads the keyspaces at their limits are refused
+// before the files are read and the chunks of the refused uploads are
+// collected
+func (g *storageService) upload(stream uploadServer, update bool) error {
+	s, p, err := g.keyspace(stream.Context())
+	if err != nil {
+		return err
+	}
+	err = s.checkQuota("")
+	if err != nil {
+		return s.grpcError(err)
+	}
+
+	err = g.stageUpload(s, p, stream, update)
+	if status.Code(err) == codes.ResourceExhausted {
+		s.collectRefused()
+	}
+	return err
+}
+
+// stageUpload stages and commits the files of an upload stream
+func (g *storageService) stageUpload(s *Server, p *Principal, stream uploadServer, update bool) error {
+	s.gc.beginStaging()
+	defer s.gc.endStaging()
+
+	u := s.newUploadStream(stream.Recv)
+	opts, err := u.options()
+	if err != nil {
+		return s.grpcError(err)
+	}
+
+	order, err := parseOrder(opts.Order)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var mode mkt.Mode
+	var commit bool
+	if update {
+		err = s.checkRootAccess(p, opts.Root, accessWrite)
+		if err == nil {
+			mode, err = s.getMode(opts.Root)
+		}
+		if err == nil {
+			commit, err = s.getCommitMeta(opts.Root)
+		}
+		if err != nil {
+			return s.grpcError(err)
+		}
+	} else {
+		if opts.Root != "" {
+			return status.Error(codes.InvalidArgument, "the root is only sent to Update")
+		}
+		mode, err = mkt.ParseMode(opts.Mode)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		commit = opts.CommitMeta
+	}
+
+	hashes, files, err := s.receiveFiles(u, mode, commit)
+	if err != nil {
+		return s.grpcError(err)
+	}
+
+	var result treeResult
+	if update {
+		result, err = s.storeUpdate(s.newOwnedBatch(p), opts.Root, opts.Message, mode, order, commit, hashes, files)
+	} else {
+		result, err = s.storeUpload(s.newOwnedBatch(p), "", opts.Message, mode, order, commit, hashes, files)
+	}
+	if err != nil {
+		return s.grpcError(err)
+	}
+
+	indexes := make([]int64, len(result.Indexes))
+	for i, index := range result.Indexes {
+		indexes[i] = int64(index)
+	}
+	return stream.SendAndClose(&zcpb.TreeResult{
+		RootHash: result.RootHash,
+		Leaves:   result.Leaves,
+		Indexes:  indexes,
+	})
+}
+
+func (g *storageService) Download(req *zcpb.FileRequest, stream zcpb.Storage_DownloadServer) error {
+	s, p, err := g.keyspace(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	hash, err := s.leafOf(p, req)
+	if err != nil {
+		return s.grpcError(err)
+	}
+	proof, err := s.proofOf(req.Root, hash)
+	if err != nil {
+		return s.grpcError(err)
+	}
+	file, _, err := s.openFile(req.Root, hash)
+	if err != nil {
+		return s.grpcError(err)
+	}
+
+	err = stream.Send(&zcpb.DownloadResponse{Part: &zcpb.DownloadResponse_Proof{Proof: proof}})
+	if err != nil {
+		return err
+	}
+
+	// The chunks are read and checked as they are sent
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			err := stream.Send(&zcpb.DownloadResponse{Part: &zcpb.DownloadResponse_Data{Data: buf[:n]}})
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return s.grpcError(err)
+		}
+	}
+}
+
+func (g *storageService) Proof(ctx context.Context, req *zcpb.FileRequest) (*zcpb.ProofResponse, error) {
+	s, p, err := g.keyspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := s.leafOf(p, req)
+	if err != nil {
+		return nil, s.grpcError(err)
+	}
+	proof, err := s.proofOf(req.Root, hash)
+	if err != nil {
+		return nil, s.grpcError(err)
+	}
+	return proof, nil
+}
+
+func (g *storageService) List(ctx context.Context, req *zcpb.ListRequest) (*zcpb.ListResponse, error) {
+	s, p, err := g.keyspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+	if req.Offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid offset %d", req.Offset)
+	}
+	if limit < 0 || limit > maxPageLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid limit %d, valid values: 1 to %d", limit, maxPageLimit)
+	}
+
+	total, roots, err := s.listCollections(p, int(req.Offset), int(limit))
+	if err != nil {
+		return nil, s.grpcError(err)
+	}
+
+	result := &zcpb.ListResponse{
+		Total:  int64(total),
+		Offset: req.Offset,
+		Limit:  limit,
+		Roots:  make([]*zcpb.Collection, len(roots)),
+	}
+	for i, c := range roots {
+		result.Roots[i] = &zcpb.Collection{RootHash: c.RootHash, Type: c.Type}
+	}
+	return result, nil
+}
+
+// checkRootAccess checks that the root is valid and exists and that the
+// principal has the access needed to its collection
+func (s *Server) checkRootAccess(p *Principal, root string, need int) error {
+	err := validRoot(root)
+	if err != nil {
+		return err
+	}
+	_, err = s.getCollectionType(root)
+	if err != nil {
+		return err
+	}
+	return s.checkAccess(p, root, need)
+}
+
+// leafOf returns the leaf hash of the file of the request, the principal
+// must be able to read its collection
+func (s *Server) leafOf(p *Principal, req *zcpb.FileRequest) (string, error) {
+	err := s.checkRootAccess(p, req.Root, accessRead)
+	if err != nil {
+		return "", err
+	}
+	if req.Index < 0 {
+		return "", fmt.Errorf("%w %d", errInvalidIndex, req.Index)
+	}
+
+	hash, err := s.db.Get(req.Root + strconv.FormatInt(req.Index, 10))
+	if errors.Is(err, db.ErrNotFound) {
+		return "", status.Errorf(codes.NotFound, "the index %d is out of the leaves of the root", req.Index)
+	}
+	return string(hash), err
+}
+
+// proofOf returns the proof of a leaf of the root with its mode and its
+// metadata
+func (s *Server) proofOf(root, hash string) (*zcpb.ProofResponse, error) {
+	data, err := s.db.Get(proofKey + root + hash)
+	if err != nil {
+		return nil, err
+	}
+	var proof mkt.Proof
+	err = json.Unmarshal(data, &proof)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := s.getMode(root)
+	if err != nil {
+		return nil, err
+	}
+	meta, commit, err := s.getLeafMeta(root, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &zcpb.ProofResponse{
+		Hash:       hash,
+		Proof:      &zcpb.Proof{Hashes: proof.Hashes, Positions: proof.Positions},
+		Mode:       string(mode),
+		CommitMeta: commit,
+	}
+	if meta != nil {
+		result.Meta = &zcpb.Metadata{
+			Name:        meta.Name,
+			Size:        meta.Size,
+			Mode:        meta.Mode,
+			Mtime:       meta.ModTime,
+			ContentType: meta.ContentType,
+		}
+	}
+	return result, nil
+}
+
+// uploadStream reads the messages of an upload, each file is a header
+// followed by its data. The data is limited to the maximum size of the
+// bodies of the HTTP api
+type uploadStream struct {
+	recv func() (*zcpb.UploadRequest, error)
+	// next is the message read but not used yet, err the error of the
+	// stream once it ended
+	next *zcpb.UploadRequest
+	err  error
+	// data is what remains of the data message being read
+	data  []byte
+	size  int64
+	limit int64
+}
+
+func (s *Server) newUploadStream(recv func() (*zcpb.UploadRequest, error)) *uploadStream {
+	return &uploadStream{recv: recv, limit: s.maxBodySize()}
+}
+
+// peek returns the next message without using it, io.EOF at the end of the
+// stream
+func (u *uploadStream) peek() (*zcpb.UploadRequest, error) {
+	if u.next == nil && u.err == nil {
+		u.next, u.err = u.recv()
+	}
+	return u.next, u.err
+}
+
+// options returns the options of the first message, the defaults when it
+// does not have them
+func (u *uploadStream) options() (*zcpb.UploadOptions, error) {
+	msg, err := u.peek()
+	if err == io.EOF {
+		return &zcpb.UploadOptions{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts := msg.GetOptions(); opts != nil {
+		u.next = nil
+		return opts, nil
+	}
+	return &zcpb.UploadOptions{}, nil
+}
+
+// Read reads the data of the current file, it ends at the header of the
+// next file or at the end of the stream
+func (u *uploadStream) Read(p []byte) (int, error) {
+	for len(u.data) == 0 {
+		msg, err := u.peek()
+		if err != nil {
+			return 0, err
+		}
+		data, ok := msg.Part.(*zcpb.UploadRequest_Data)
+		if !ok {
+			return 0, io.EOF
+		}
+		u.next = nil
+
+		u.size += int64(len(data.Data))
+		if u.size > u.limit {
+			return 0, &http.MaxBytesError{Limit: u.limit}
+		}
+		u.data = data.Data
+	}
+
+	n := copy(p, u.data)
+	u.data = u.data[n:]
+	return n, nil
+}
+
+// receiveFiles stages the files of an upload stream as they arrive, the
+// leaf hashes are returned in the upload order. The leaves commit to the
+// metadata of the headers when commit is set, the files must fit in the
+// quota before they are staged
+func (s *Server) receiveFiles(u *uploadStream, mode mkt.Mode, commit bool) ([]string, map[string]stagedFile, error) {
+	budget, err := s.stagingBudget()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var hashes []string
+	staged := make(map[string]stagedFile)
+	for {
+		msg, err := u.peek()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		u.next = nil
+
+		header := msg.GetFile()
+		if msg.GetOptions() != nil {
+			return nil, nil, fmt.Errorf("%w: the options must be the first message", errInvalidUpload)
+		}
+		if header == nil {
+			return nil, nil, fmt.Errorf("%w: the data of a file must follow its header", errInvalidUpload)
+		}
+
+		meta := mkt.Metadata{Name: header.Name, Mode: header.Mode, ModTime: header.Mtime, ContentType: header.ContentType}
+		err = meta.Validate()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", errInvalidUpload, err)
+		}
+
+		h := mode.NewLeafHash()
+		f, err := s.stageStream(s.streamChunker(), io.TeeReader(budget.reader(u), h))
+		if err != nil {
+			return nil, nil, err
+		}
+		f = f.withMeta(meta)
+
+		hash := leafHash(mode, commit, hex.EncodeToString(h.Sum(nil)), f.meta)
+		hashes = append(hashes, hash)
+		staged[hash] = f
+	}
+
+	if len(hashes) == 0 {
+		return nil, nil, fmt.Errorf("%w: the stream has no files", errInvalidUpload)
+	}
+	return hashes, staged, nil
+}
+
+// grpcError returns the status of an error, the errors of the clients keep
+// their messages and the others are logged
+func (s *Server) grpcError(err error) error {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errInvalidUpload), errors.Is(err, errInvalidRoot), errors.Is(err, errInvalidIndex):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errCollectionNotFound):
+		return status.Error(codes.NotFound, errNotFound)
+	case errors.Is(err, errInvalidTenant):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errUnknownTenant):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, errRootExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.As(err, &maxErr):
+		return status.Errorf(codes.ResourceExhausted, "the body is limited to %d bytes", maxErr.Limit)
+	}
+
+	// The errors of the streams and of leafOf are already statuses
+	if st, ok := status.FromError(err); ok {
+		return st.Err()
+	}
+	s.conf.Logger.Error(err.Error())
+	return status.Error(codes.Internal, errInternal)
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/auth"
+	"github.com/jmsilvadev/zc/pkg/certs"
+	"github.com/jmsilvadev/zc/pkg/certs/certstest"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/jmsilvadev/zc/pkg/zcpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCClient serves the gRPC api of the server in memory
+func newGRPCClient(t *testing.T, server *Server) zcpb.StorageClient {
+	listener := bufconn.Listen(1 << 20)
+	g := server.newGRPCServer(nil)
+	go g.Serve(listener)
+	t.Cleanup(g.Stop)
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return zcpb.NewStorageClient(conn)
+}
+
+// withToken returns a context that sends the token and the tenant, when
+// they are not empty
+func withToken(token, tenant string) context.Context {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	if tenant != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, tenantHeader, tenant)
+	}
+	return ctx
+}
+
+// grpcFile is a file of an upload stream
+type grpcFile struct {
+	header  *zcpb.FileHeader
+	content []byte
+}
+
+// sendGRPC streams the files after the options, the data of each file is
+// split in messages of 3 bytes
+func sendGRPC(stream grpc.ClientStream, opts *zcpb.UploadOptions, files []grpcFile) error {
+	if opts != nil {
+		err := stream.SendMsg(&zcpb.UploadRequest{Part: &zcpb.UploadRequest_Options{Options: opts}})
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		header := f.header
+		if header == nil {
+			header = &zcpb.FileHeader{}
+		}
+		err := stream.SendMsg(&zcpb.UploadRequest{Part: &zcpb.UploadRequest_File{File: header}})
+		if err != nil {
+			return err
+		}
+		for data := f.content; len(data) > 0; {
+			n := min(3, len(data))
+			err = stream.SendMsg(&zcpb.UploadRequest{Part: &zcpb.UploadRequest_Data{Data: data[:n]}})
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	}
+	return stream.CloseSend()
+}
+
+func uploadGRPC(ctx context.Context, client zcpb.StorageClient, opts *zcpb.UploadOptions, files ...grpcFile) (*zcpb.TreeResult, error) {
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = sendGRPC(stream, opts, files)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+func updateGRPC(ctx context.Context, client zcpb.StorageClient, opts *zcpb.UploadOptions, files ...grpcFile) (*zcpb.TreeResult, error) {
+	stream, err := client.Update(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = sendGRPC(stream, opts, files)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+// downloadGRPC returns the proof and the content of a file
+func downloadGRPC(ctx context.Context, client zcpb.StorageClient, root string, index int64) (*zcpb.ProofResponse, []byte, error) {
+	stream, err := client.Download(ctx, &zcpb.FileRequest{Root: root, Index: index})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var proof *zcpb.ProofResponse
+	var content bytes.Buffer
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return proof, content.Bytes(), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if p := msg.GetProof(); p != nil {
+			proof = p
+			continue
+		}
+		content.Write(msg.GetData())
+	}
+}
+
+func assertCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	require.Error(t, err)
+	assert.Equal(t, code, status.Code(err), err.Error())
+}
+
+func TestGRPCUploadAndDownload(t *testing.T) {
+	server, _ := newChunkingServer()
+	client := newGRPCClient(t, server)
+	ctx := context.Background()
+
+	large := bytes.Repeat([]byte("0123456789"), 20000)
+	files := []grpcFile{
+		{header: &zcpb.FileHeader{Name: "docs/a.txt", ContentType: "text/plain", Mtime: 1700000000}, content: []byte("file1")},
+		{content: large},
+		{content: []byte{}},
+	}
+	result, err := uploadGRPC(ctx, client, &zcpb.UploadOptions{Mode: string(mkt.Keccak256Sorted), CommitMeta: true, Message: "first"}, files...)
+	require.NoError(t, err)
+	require.Len(t, result.Leaves, 3)
+	assert.Equal(t, []int64{0, 1, 2}, result.Indexes)
+
+	for i, f := range files {
+		proof, content, err := downloadGRPC(ctx, client, result.RootHash, int64(i))
+		require.NoError(t, err)
+		assert.Equal(t, f.content, append([]byte{}, content...))
+		assert.Equal(t, result.Leaves[i], proof.Hash)
+		assert.Equal(t, string(mkt.Keccak256Sorted), proof.Mode)
+		assert.True(t, proof.CommitMeta)
+
+		p := &mkt.Proof{Hashes: proof.Proof.Hashes, Positions: proof.Proof.Positions}
+		assert.True(t, mkt.VerifyProofWithMode(proof.Hash, result.RootHash, p, mkt.Mode(proof.Mode)))
+	}
+
+	proof, err := client.Proof(ctx, &zcpb.FileRequest{Root: result.RootHash, Index: 0})
+	require.NoError(t, err)
+	assert.Equal(t, "docs/a.txt", proof.Meta.Name)
+	assert.Equal(t, int64(5), proof.Meta.Size)
+	assert.Equal(t, "text/plain", proof.Meta.ContentType)
+
+	// The files uploaded over gRPC are served by the HTTP api
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/v1/raw/"+result.RootHash+"/1", nil), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, large, w.Body.Bytes())
+
+	updated, err := updateGRPC(ctx, client, &zcpb.UploadOptions{Root: result.RootHash, Message: "second"}, grpcFile{content: []byte("file1")}, grpcFile{content: []byte("file4")})
+	require.NoError(t, err)
+	assert.Len(t, updated.Leaves, 5)
+	assert.Equal(t, []int64{3, 4}, updated.Indexes)
+
+	_, content, err := downloadGRPC(ctx, client, updated.RootHash, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file4"), content)
+
+	list, err := client.List(ctx, &zcpb.ListRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), list.Total)
+	assert.Equal(t, int64(defaultPageLimit), list.Limit)
+	assert.Len(t, list.Roots, 2)
+	assert.Equal(t, collectionFlat, list.Roots[0].Type)
+
+	list, err = client.List(ctx, &zcpb.ListRequest{Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), list.Total)
+	assert.Len(t, list.Roots, 1)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	server, _ := newChunkingServer()
+	client := newGRPCClient(t, server)
+	ctx := context.Background()
+
+	result, err := uploadGRPC(ctx, client, nil, grpcFile{content: []byte("file1")})
+	require.NoError(t, err)
+	root := result.RootHash
+
+	_, _, err = downloadGRPC(ctx, client, root[:10], 0)
+	assertCode(t, codes.InvalidArgument, err)
+	_, _, err = downloadGRPC(ctx, client, unknownRoot, 0)
+	assertCode(t, codes.NotFound, err)
+	_, _, err = downloadGRPC(ctx, client, root, 1)
+	assertCode(t, codes.NotFound, err)
+	assert.Contains(t, err.Error(), "the index 1 is out of the leaves of the root")
+	_, err = client.Proof(ctx, &zcpb.FileRequest{Root: root, Index: -1})
+	assertCode(t, codes.InvalidArgument, err)
+
+	_, err = client.List(ctx, &zcpb.ListRequest{Limit: maxPageLimit + 1})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = client.List(ctx, &zcpb.ListRequest{Offset: -1})
+	assertCode(t, codes.InvalidArgument, err)
+
+	options := func(opts *zcpb.UploadOptions) *zcpb.UploadRequest {
+		return &zcpb.UploadRequest{Part: &zcpb.UploadRequest_Options{Options: opts}}
+	}
+	header := func(name string) *zcpb.UploadRequest {
+		return &zcpb.UploadRequest{Part: &zcpb.UploadRequest_File{File: &zcpb.FileHeader{Name: name}}}
+	}
+	data := &zcpb.UploadRequest{Part: &zcpb.UploadRequest_Data{Data: []byte("file1")}}
+
+	tests := []struct {
+		name string
+		msgs []*zcpb.UploadRequest
+	}{
+		{"no files", []*zcpb.UploadRequest{options(&zcpb.UploadOptions{})}},
+		{"data without header", []*zcpb.UploadRequest{data}},
+		{"late options", []*zcpb.UploadRequest{header(""), data, options(&zcpb.UploadOptions{})}},
+		{"invalid name", []*zcpb.UploadRequest{header("../a"), data}},
+		{"invalid mode", []*zcpb.UploadRequest{options(&zcpb.UploadOptions{Mode: "md5"}), header(""), data}},
+		{"invalid order", []*zcpb.UploadRequest{options(&zcpb.UploadOptions{Order: "size"}), header(""), data}},
+		{"root of an upload", []*zcpb.UploadRequest{options(&zcpb.UploadOptions{Root: root}), header(""), data}},
+	}
+	for _, tt := range tests {
+		stream, err := client.Upload(ctx)
+		require.NoError(t, err)
+		for _, msg := range tt.msgs {
+			stream.Send(msg)
+		}
+		_, err = stream.CloseAndRecv()
+		assertCode(t, codes.InvalidArgument, err)
+	}
+
+	_, err = updateGRPC(ctx, client, &zcpb.UploadOptions{Root: unknownRoot}, grpcFile{content: []byte("file1")})
+	assertCode(t, codes.NotFound, err)
+	_, err = updateGRPC(ctx, client, nil, grpcFile{content: []byte("file1")})
+	assertCode(t, codes.InvalidArgument, err)
+
+	// The streams are limited as the bodies of the HTTP api
+	server.conf.MaxBodySize = 8
+	_, err = uploadGRPC(ctx, client, nil, grpcFile{content: []byte("file1")}, grpcFile{content: []byte("file2")})
+	assertCode(t, codes.ResourceExhausted, err)
+	assert.Contains(t, err.Error(), "the body is limited to 8 bytes")
+	waitGC(server)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	server, _ := newAuthServer(authToken, authHMAC)
+	client := newGRPCClient(t, server)
+	_, owner := createCredential(t, server, credentialRequest{Name: "owner", Kind: authToken})
+	_, other := createCredential(t, server, credentialRequest{Name: "other", Kind: authToken})
+
+	_, err := client.List(context.Background(), &zcpb.ListRequest{})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = client.List(withToken("zc_unknown", ""), &zcpb.ListRequest{})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = uploadGRPC(context.Background(), client, nil, grpcFile{content: []byte("file1")})
+	assertCode(t, codes.Unauthenticated, err)
+
+	result, err := uploadGRPC(withToken(owner, ""), client, nil, grpcFile{content: []byte("file1")})
+	require.NoError(t, err)
+
+	// The collections are owned by the credential of the upload
+	_, _, err = downloadGRPC(withToken(other, ""), client, result.RootHash, 0)
+	assertCode(t, codes.NotFound, err)
+	list, err := client.List(withToken(other, ""), &zcpb.ListRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.Roots)
+
+	w := serveAs(server, httptest.NewRequest(http.MethodPut, "/v1/acl/"+result.RootHash+"/"+mustCredentialID(t, server, other)+"?access=read", nil), owner)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, _, err = downloadGRPC(withToken(other, ""), client, result.RootHash, 0)
+	require.NoError(t, err)
+	_, err = updateGRPC(withToken(other, ""), client, &zcpb.UploadOptions{Root: result.RootHash}, grpcFile{content: []byte("file2")})
+	assertCode(t, codes.PermissionDenied, err)
+
+	// The signed calls sign a POST to the method without the payload
+	keyID, secret := createCredential(t, server, credentialRequest{Name: "signer", Kind: authHMAC, Admin: true})
+	signed := func() context.Context {
+		req := httptest.NewRequest(http.MethodPost, zcpb.Storage_List_FullMethodName, nil)
+		require.NoError(t, auth.SignRequest(req, keyID, secret, time.Now(), auth.UnsignedPayload))
+		md := metadata.MD{}
+		for k, v := range req.Header {
+			md.Set(strings.ToLower(k), v...)
+		}
+		return metadata.NewOutgoingContext(context.Background(), md)
+	}
+	list, err = client.List(signed(), &zcpb.ListRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), list.Total)
+	_, err = client.Proof(signed(), &zcpb.FileRequest{Root: result.RootHash})
+	assertCode(t, codes.Unauthenticated, err)
+}
+
+// mustCredentialID returns the id of the credential of a token
+func mustCredentialID(t *testing.T, server *Server, token string) string {
+	id, err := server.db.Get(tokenKey + auth.ContentHash([]byte(token)))
+	require.NoError(t, err)
+	return string(id)
+}
+
+func TestGRPCTenants(t *testing.T) {
+	server, _ := newTenantServer(t, tenant{Name: "a"}, tenant{Name: "b", quota: quota{MaxFiles: 1}})
+	client := newGRPCClient(t, server)
+	_, tokenA := createCredential(t, server, credentialRequest{Name: "team a", Kind: authToken, Tenant: "a"})
+	_, tokenB := createCredential(t, server, credentialRequest{Name: "team b", Kind: authToken, Tenant: "b"})
+
+	result, err := uploadGRPC(withToken(tokenA, ""), client, nil, grpcFile{content: []byte("file1")})
+	require.NoError(t, err)
+
+	list, err := client.List(withToken("admin-token", ""), &zcpb.ListRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.Roots)
+	list, err = client.List(withToken("admin-token", "a"), &zcpb.ListRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Roots, 1)
+	assert.Equal(t, result.RootHash, list.Roots[0].RootHash)
+
+	_, err = client.List(withToken(tokenA, "b"), &zcpb.ListRequest{})
+	assertCode(t, codes.PermissionDenied, err)
+	_, err = client.List(withToken("admin-token", "c"), &zcpb.ListRequest{})
+	assertCode(t, codes.NotFound, err)
+	_, _, err = downloadGRPC(withToken(tokenB, ""), client, result.RootHash, 0)
+	assertCode(t, codes.NotFound, err)
+
+	// The quotas of the tenants apply to the streams
+	_, err = uploadGRPC(withToken(tokenB, ""), client, nil, grpcFile{content: []byte("file1")}, grpcFile{content: []byte("file2")})
+	assertCode(t, codes.ResourceExhausted, err)
+	waitGC(server)
+}
+
+func TestGRPCMutualTLS(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+	server, _ := newChunkingServer()
+	server.conf.TLSCert = files.ServerCert
+	server.conf.TLSKey = files.ServerKey
+	server.conf.TLSClientCA = files.CA
+	server.conf.GRPCPort = "127.0.0.1:0"
+
+	config, err := server.tlsConfig()
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	g := server.newGRPCServer(config)
+	go g.Serve(listener)
+	defer g.Stop()
+
+	pool, err := certs.LoadPool(files.CA)
+	require.NoError(t, err)
+	cert, err := tls.LoadX509KeyPair(files.ClientCert, files.ClientKey)
+	require.NoError(t, err)
+
+	dial := func(c *tls.Config) zcpb.StorageClient {
+		conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(c)))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return zcpb.NewStorageClient(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = dial(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}).List(ctx, &zcpb.ListRequest{})
+	require.NoError(t, err)
+
+	// The clients without a certificate are refused in the handshake
+	_, err = dial(&tls.Config{RootCAs: pool}).List(ctx, &zcpb.ListRequest{})
+	assertCode(t, codes.Unavailable, err)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+// dirKey stores the entries of the directories of a hierarchical tree,
+// the root directory of a tree is stored with the root hash
+const dirKey = "dir_"
+
+// treeFile is a file of a hierarchy sent in the upload
+type treeFile struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	File []byte `json:"file"`
+}
+
+// treeEntryResult is the response of the download of a path, the file is
+// sent for the files and the entries for the directories
+type treeEntryResult struct {
+	Entry   mkt.Entry      `json:"entry"`
+	File    []byte         `json:"file,omitempty"`
+	Entries []mkt.Entry    `json:"entries,omitempty"`
+	Proof   *mkt.PathProof `json:"proof"`
+	Mode    mkt.Mode       `json:"mode"`
+}
+
+// TreeUploadHandler creates a hierarchical tree where each directory is a
+// subtree, so the root commits to the files and to the paths layout
+func (s *Server) TreeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := mkt.ParseMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var files []treeFile
+	err = json.NewDecoder(r.Body).Decode(&files)
+	if tooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	budget, err := s.stagingBudget()
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	contents := make(map[string][]byte, len(files))
+	mktFiles := make([]mkt.File, len(files))
+	for i, f := range files {
+		err = budget.take(int64(len(f.File)))
+		if err != nil {
+			s.commitError(w, err)
+			return
+		}
+		hash := mode.HashLeaf(f.File)
+		contents[hash] = f.File
+		mktFiles[i] = mkt.File{Path: f.Path, Mode: f.Mode, Hash: hash}
+	}
+
+	dir, err := mkt.NewDirectory(mktFiles, mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	root := dir.Hash
+
+	b := s.newOwnedBatch(principalOf(r))
+	stored, err := s.storedTree(b, root)
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+	if !stored {
+		err = s.putDirTree(b, mode, dir, contents)
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.commitVersion(b, "tree upload", "", root, r.URL.Query().Get("message"))
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	result := struct {
+		RootHash string `json:"root_hash"`
+	}{
+		RootHash: root,
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// putDirTree adds to the batch the directories and the files of a new
+// hierarchical tree
+func (s *Server) putDirTree(b *intentBatch, mode mkt.Mode, dir *mkt.Directory, contents map[string][]byte) error {
+	root := dir.Hash
+	b.Put(modeKey+root, []byte(mode))
+
+	err := dir.Walk(func(_ string, d *mkt.Directory) error {
+		entries, err := json.Marshal(d.Entries)
+		if err != nil {
+			return err
+		}
+		b.Put(dirKey+root+d.Hash, entries)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for hash, content := range contents {
+		err = s.putFile(b, root, hash, content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TreeDownloadHandler returns the file or the directory listing of a path
+// with the proof that walks through each directory from the root
+func (s *Server) TreeDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	// NOTE: /tree/root/path/to/file
+	root, p, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tree/"), "/")
+	if root == "" {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	parts, err := mkt.SplitPath(p)
+	if err != nil {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	mode, err := s.getMode(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	entry := mkt.Entry{Type: mkt.EntryDir, Mode: 0o755, Hash: root}
+	entries, err := s.getEntries(root, root)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	proof := &mkt.PathProof{}
+	for i, name := range parts {
+		if entry.Type != mkt.EntryDir {
+			http.Error(w, errNotFound, http.StatusNotFound)
+			return
+		}
+		if i > 0 {
+			entries, err = s.getEntries(root, entry.Hash)
+			if err != nil {
+				s.conf.Logger.Error(err.Error())
+				http.Error(w, errInternal, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		e, step, err := mkt.GetEntryProof(entries, name, mode)
+		if err != nil {
+			http.Error(w, errNotFound, http.StatusNotFound)
+			return
+		}
+		entry = *e
+		proof.Steps = append(proof.Steps, mkt.PathStep{Entry: entry, Proof: step})
+	}
+
+	result := treeEntryResult{
+		Entry: entry,
+		Proof: proof,
+		Mode:  mode,
+	}
+
+	if entry.Type == mkt.EntryDir {
+		if len(parts) > 0 {
+			entries, err = s.getEntries(root, entry.Hash)
+		}
+		result.Entries = entries
+	} else {
+		result.File, err = s.getFile(root, entry.Hash)
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// getEntries returns the entries of a directory of the hierarchy of root
+func (s *Server) getEntries(root, hash string) ([]mkt.Entry, error) {
+	data, err := s.db.Get(dirKey + root + hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []mkt.Entry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
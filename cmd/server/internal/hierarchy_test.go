@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTreeHandlers(t *testing.T) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort: ":5005",
+		Logger:     c.Logger,
+	}
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	server := NewServer(conf, mockDB)
+
+	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+
+	files := []treeFile{
+		{Path: "a/b/c.txt", Mode: 0o644, File: []byte("c")},
+		{Path: "a/d.txt", Mode: 0o600, File: []byte("d")},
+		{Path: "e.txt", Mode: 0o644, File: []byte("e")},
+	}
+	filesJSON, _ := json.Marshal(files)
+
+	req := httptest.NewRequest(http.MethodPost, "/tree", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.TreeUploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var upload struct {
+		RootHash string `json:"root_hash"`
+	}
+	err := json.NewDecoder(w.Result().Body).Decode(&upload)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, upload.RootHash)
+
+	download := func(p string) (int, treeEntryResult) {
+		req := httptest.NewRequest(http.MethodGet, "/tree/"+upload.RootHash+"/"+p, nil)
+		w := httptest.NewRecorder()
+		server.TreeDownloadHandler(w, req)
+
+		var result treeEntryResult
+		if w.Result().StatusCode == http.StatusOK {
+			err := json.NewDecoder(w.Result().Body).Decode(&result)
+			assert.NoError(t, err)
+		}
+		return w.Result().StatusCode, result
+	}
+
+	for _, f := range files {
+		status, result := download(f.Path)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, f.File, result.File)
+		assert.Equal(t, f.Mode, result.Entry.Mode)
+		assert.Equal(t, mkt.SHA256, result.Mode)
+		assert.True(t, mkt.VerifyPathProof(f.Path, mkt.SHA256.HashLeaf(result.File), upload.RootHash, result.Proof, mkt.SHA256))
+	}
+
+	status, result := download("a")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, mkt.EntryDir, result.Entry.Type)
+	assert.Len(t, result.Entries, 2)
+	hash, err := mkt.DirectoryHash(result.Entries, mkt.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Entry.Hash, hash)
+	assert.True(t, mkt.VerifyPathProof("a", result.Entry.Hash, upload.RootHash, result.Proof, mkt.SHA256))
+
+	status, result = download("")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, result.Entries, 2)
+	assert.Equal(t, upload.RootHash, result.Entry.Hash)
+
+	status, _ = download("a/x.txt")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = download("e.txt/x")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = download("../e.txt")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	req = httptest.NewRequest(http.MethodGet, "/tree/unknown/e.txt", nil)
+	w = httptest.NewRecorder()
+	server.TreeDownloadHandler(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/tree", bytes.NewBuffer([]byte(`[{"path":"../a","file":""}]`)))
+	w = httptest.NewRecorder()
+	server.TreeUploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
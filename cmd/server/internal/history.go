@@ -0,0 +1,473 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+const (
+	// historyKey stores the versions of a collection, oldest first, by the
+	// id of the collection, the root of its first upload
+	historyKey = "history_"
+	// collectionOfKey links a root to the collection of its last version
+	collectionOfKey = "collectionof_"
+	// versionsKey stores how many versions of all the histories have the
+	// root, the root is deleted with its last version
+	versionsKey = "versions_"
+	// migratedKey records the migrations that ran once, by their names
+	migratedKey = "migrated_"
+
+	// defaultHistoryKeep is used when the versions kept are not configured
+	defaultHistoryKeep = 10
+
+	historyRollback = "rollback"
+)
+
+var (
+	// errVersionNotFound is returned when a rollback targets a root or a
+	// time that is not retained in the history
+	errVersionNotFound = errors.New("version not found")
+	// errInvalidRollback is returned when the target of a rollback is not
+	// valid
+	errInvalidRollback = errors.New("invalid rollback")
+)
+
+// version is a root of the history of a collection, the roots stored
+// before the history have no time
+type version struct {
+	Root    string    `json:"root_hash"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Message string    `json:"message,omitempty"`
+}
+
+// historyResult is the history of a collection, the head is its current
+// root
+type historyResult struct {
+	Collection string    `json:"collection"`
+	Head       string    `json:"head"`
+	Versions   []version `json:"versions"`
+}
+
+// HistoryHandler serves the history of the collection of a root:
+// GET /history/<root> lists the retained versions and
+// POST /history/<root>/rollback?to=<root>|at=<time> makes a retained version
+// the head again
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/history/"), "/"), "/")
+	root := parts[0]
+	if root == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != historyRollback) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	var result historyResult
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		result.Collection, result.Versions, err = s.getHistory(root)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		result, err = s.rollback(r, root)
+	default:
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, errCollectionNotFound) || errors.Is(err, errVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidRollback) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	result.Head = result.Versions[len(result.Versions)-1].Root
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// rollback appends to the history of the collection of the root a version
+// with the root retained given by to, or with the last one at the time
+// given by at. The files of the root are not copied, the version links to
+// them
+func (s *Server) rollback(r *http.Request, root string) (historyResult, error) {
+	to := r.URL.Query().Get("to")
+	at := r.URL.Query().Get("at")
+	if (to == "") == (at == "") {
+		return historyResult{}, fmt.Errorf("%w: one of to or at is required", errInvalidRollback)
+	}
+	if to != "" {
+		err := validRoot(to)
+		if err != nil {
+			return historyResult{}, fmt.Errorf("%w: %w", errInvalidRollback, err)
+		}
+	}
+
+	var when time.Time
+	if at != "" {
+		var err error
+		when, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			return historyResult{}, fmt.Errorf("%w: the time %s is not RFC3339", errInvalidRollback, at)
+		}
+	}
+
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	id, versions, err := s.getHistory(root)
+	if err != nil {
+		return historyResult{}, err
+	}
+
+	target := ""
+	for _, v := range versions {
+		if (to != "" && v.Root == to) || (at != "" && !v.Time.After(when)) {
+			target = v.Root
+		}
+	}
+	if target == "" {
+		return historyResult{}, errVersionNotFound
+	}
+
+	b := s.newBatch()
+	err = s.addVersion(b, root, target, historyRollback, r.URL.Query().Get("message"))
+	if err != nil {
+		return historyResult{}, err
+	}
+	err = s.commit(historyRollback, target, b)
+	if err != nil {
+		return historyResult{}, err
+	}
+
+	versions, err = s.getVersions(id)
+	return historyResult{Collection: id, Versions: versions}, err
+}
+
+// commitVersion commits the batch of an operation that changed the
+// collection of prev to root, the new root is appended to the history and
+// the versions out of the retention are deleted in the same commit. An
+// empty prev starts a new collection
+func (s *Server) commitVersion(b *intentBatch, op, prev, root, message string) error {
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	err := s.addVersion(b, prev, root, op, message)
+	if err != nil {
+		return err
+	}
+	return s.commit(op, root, b)
+}
+
+// addVersion adds to the batch a version of the collection of prev with the
+// root and the pruning of the history. It must be called with the history
+// lock held until the batch is written
+func (s *Server) addVersion(b *intentBatch, prev, root, op, message string) error {
+	counts := make(map[string]int)
+	id := root
+	var versions []version
+	if prev != "" {
+		stored, err := s.db.Get(collectionOfKey + prev)
+		if err == nil {
+			id = string(stored)
+			versions, err = s.getVersions(id)
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			_, err = s.getCollectionType(prev)
+			if err == nil {
+				// A root stored before the history is the first version
+				// of its collection
+				id = prev
+				versions = []version{{Root: prev, Op: sessionUpload}}
+				counts[prev] = 1
+				b.Put(collectionOfKey+prev, []byte(id))
+				b.legacyRoots++
+			}
+		}
+		if err != nil && !errors.Is(err, errCollectionNotFound) {
+			return err
+		}
+	} else {
+		_, err := s.db.Get(collectionOfKey + root)
+		if err == nil {
+			// The root is already retained by a collection
+			return nil
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+	}
+
+	if prev != "" {
+		// A root is retained by one collection, a change of another
+		// collection does not take it
+		stored, err := s.db.Get(collectionOfKey + root)
+		if err == nil && string(stored) != id {
+			return fmt.Errorf("%w: %s", errRootExists, root)
+		}
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+	}
+
+	if len(versions) != 0 && versions[len(versions)-1].Root == root {
+		return nil
+	}
+	if len(versions) == 0 && b.owner != "" {
+		data, err := json.Marshal(acl{Owner: b.owner})
+		if err != nil {
+			return err
+		}
+		b.Put(aclKey+id, data)
+	}
+	versions = append(versions, version{Root: root, Time: time.Now().UTC(), Op: op, Message: message})
+	counts[root]++
+	b.Put(collectionOfKey+root, []byte(id))
+
+	return s.putHistory(b, id, versions, counts)
+}
+
+// putHistory adds to the batch the versions retained of a collection, the
+// counts have the versions added by root. The roots left without versions
+// are deleted
+func (s *Server) putHistory(b *intentBatch, id string, versions []version, counts map[string]int) error {
+	kept, pruned := s.pruneVersions(versions, time.Now())
+	for _, v := range pruned {
+		counts[v.Root]--
+	}
+
+	err := s.putVersionCounts(b, counts)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	b.Put(historyKey+id, data)
+	return nil
+}
+
+// putVersionCounts adds to the batch the counts of versions changed by
+// root, the roots left without versions are deleted
+func (s *Server) putVersionCounts(b *intentBatch, counts map[string]int) error {
+	for root, delta := range counts {
+		if delta == 0 {
+			continue
+		}
+		n, err := s.getVersionCount(root)
+		if err != nil {
+			return err
+		}
+		n += delta
+		if n > 0 {
+			b.Put(versionsKey+root, []byte(strconv.Itoa(n)))
+			continue
+		}
+
+		b.Delete(versionsKey + root)
+		b.Delete(collectionOfKey + root)
+		err = s.deleteRoot(b, root)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneVersions splits the versions in the ones retained and the ones
+// pruned, the last ones are kept up to the configured number while they are
+// not older than the maximum age. The head is always kept
+func (s *Server) pruneVersions(versions []version, now time.Time) ([]version, []version) {
+	keep := s.conf.HistoryKeep
+	if keep <= 0 {
+		keep = defaultHistoryKeep
+	}
+
+	var kept, pruned []version
+	for i, v := range versions {
+		head := i == len(versions)-1
+		recent := s.conf.HistoryMaxAge <= 0 || now.Sub(v.Time) <= s.conf.HistoryMaxAge
+		if head || (i >= len(versions)-keep && recent) {
+			kept = append(kept, v)
+			continue
+		}
+		pruned = append(pruned, v)
+	}
+	return kept, pruned
+}
+
+// pruneHistories removes from the histories the versions older than the
+// maximum age, the histories are pruned on each change but the age must
+// also be checked while they do not change
+func (s *Server) pruneHistories() (int, error) {
+	if s.conf.HistoryMaxAge <= 0 {
+		return 0, nil
+	}
+
+	keys, err := s.db.KeysByPrefix(historyKey)
+	if err != nil {
+		return 0, err
+	}
+
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	removed := 0
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, historyKey)
+		versions, err := s.getVersions(id)
+		if err != nil {
+			return removed, err
+		}
+		_, pruned := s.pruneVersions(versions, time.Now())
+		if len(pruned) == 0 {
+			continue
+		}
+
+		b := s.newBatch()
+		err = s.putHistory(b, id, versions, make(map[string]int))
+		if err != nil {
+			return removed, err
+		}
+		err = s.commit("history pruning", id, b)
+		if err != nil {
+			return removed, err
+		}
+		removed += len(pruned)
+	}
+	return removed, nil
+}
+
+// getHistory returns the id and the versions of the collection of a root,
+// a root stored before the history is the only version of its collection
+func (s *Server) getHistory(root string) (string, []version, error) {
+	id, err := s.db.Get(collectionOfKey + root)
+	if err == nil {
+		versions, err := s.getVersions(string(id))
+		return string(id), versions, err
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return "", nil, err
+	}
+
+	_, err = s.getCollectionType(root)
+	if err != nil {
+		return "", nil, err
+	}
+	return root, []version{{Root: root, Op: sessionUpload}}, nil
+}
+
+// getVersions returns the versions of a collection by its id
+func (s *Server) getVersions(id string) ([]version, error) {
+	data, err := s.db.Get(historyKey + id)
+	if err != nil {
+		return nil, err
+	}
+	var versions []version
+	err = json.Unmarshal(data, &versions)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// getVersionCount returns how many versions have the root
+func (s *Server) getVersionCount(root string) (int, error) {
+	data, err := s.db.Get(versionsKey + root)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+// deleteRoot adds to the batch the deletion of a flat or hierarchical root
+func (s *Server) deleteRoot(b *intentBatch, root string) error {
+	typ, err := s.getCollectionType(root)
+	if errors.Is(err, errCollectionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if typ == collectionTree {
+		err = s.deleteFiles(b, root)
+		if err != nil {
+			return err
+		}
+		b.Delete(modeKey + root)
+		return s.deletePrefix(b, dirKey+root)
+	}
+
+	leaves, err := s.getLeaves(root)
+	if err != nil {
+		return err
+	}
+	return s.deleteTree(b, root, len(leaves))
+}
+
+// indexLegacyRoots adds the roots stored before the histories as the first
+// version of their collections, so the roots are listed from their versions.
+// Each root is added in its own commit and the migration is recorded once
+// it ends, so an interrupted one continues on the next start
+func (s *Server) indexLegacyRoots() error {
+	_, err := s.db.Get(migratedKey + "history")
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	roots, err := s.storedRoots()
+	if err != nil {
+		return err
+	}
+
+	indexed := 0
+	for _, root := range roots {
+		_, err := s.db.Get(collectionOfKey + root)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+
+		b := s.newBatch()
+		b.Put(collectionOfKey+root, []byte(root))
+		b.legacyRoots++
+		err = s.putHistory(b, root, []version{{Root: root, Op: sessionUpload}}, map[string]int{root: 1})
+		if err != nil {
+			return err
+		}
+		err = s.commit("history migration", root, b)
+		if err != nil {
+			return err
+		}
+		indexed++
+	}
+
+	if indexed > 0 {
+		s.conf.Logger.Info(fmt.Sprintf("Added %d roots to the histories%s", indexed, s.tenantSuffix()))
+	}
+	return s.db.Put(migratedKey+"history", []byte(time.Now().UTC().Format(time.RFC3339)))
+}
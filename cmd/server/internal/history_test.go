@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func requestHistory(t *testing.T, server *Server, method, url string, status int) historyResult {
+	req := httptest.NewRequest(method, url, nil)
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	require.Equal(t, status, w.Code, w.Body.String())
+
+	var result historyResult
+	if status == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	}
+	return result
+}
+
+func TestHistoryKeepsVersions(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	second := uploadJSON(t, server, "/update/"+first.RootHash+"?message=second", [][]byte{[]byte("file2")})
+	third := uploadJSON(t, server, "/update/"+second.RootHash, [][]byte{[]byte("file3")})
+
+	history := requestHistory(t, server, http.MethodGet, "/history/"+third.RootHash, http.StatusOK)
+	assert.Equal(t, first.RootHash, history.Collection)
+	assert.Equal(t, third.RootHash, history.Head)
+	require.Len(t, history.Versions, 3)
+	for i, root := range []string{first.RootHash, second.RootHash, third.RootHash} {
+		assert.Equal(t, root, history.Versions[i].Root)
+		assert.False(t, history.Versions[i].Time.IsZero())
+	}
+	assert.Equal(t, []string{"upload", "update", "update"}, []string{history.Versions[0].Op, history.Versions[1].Op, history.Versions[2].Op})
+	assert.Equal(t, "second", history.Versions[1].Message)
+
+	// Any root of the history has the same history
+	assert.Equal(t, history, requestHistory(t, server, http.MethodGet, "/history/"+first.RootHash, http.StatusOK))
+
+	// The files of the old versions are still downloadable
+	content, err := server.getFile(first.RootHash, first.Leaves[0])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file1"), content)
+	assert.Len(t, second.Leaves, 2)
+
+	requestHistory(t, server, http.MethodGet, "/history/unknown", http.StatusBadRequest)
+	requestHistory(t, server, http.MethodGet, "/history/"+unknownRoot, http.StatusNotFound)
+	requestHistory(t, server, http.MethodDelete, "/history/"+first.RootHash, http.StatusMethodNotAllowed)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	server.conf.HistoryKeep = 2
+
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	second := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("file2")})
+	third := uploadJSON(t, server, "/update/"+second.RootHash, [][]byte{[]byte("file3")})
+
+	// The oldest version is deleted with its root, the blobs shared with
+	// the versions kept are not
+	history := requestHistory(t, server, http.MethodGet, "/history/"+third.RootHash, http.StatusOK)
+	require.Len(t, history.Versions, 2)
+	assert.Equal(t, second.RootHash, history.Versions[0].Root)
+	assert.NotContains(t, mockDB.data, first.RootHash+"0")
+	assert.NotContains(t, mockDB.data, modeKey+first.RootHash)
+	assert.NotContains(t, mockDB.data, collectionOfKey+first.RootHash)
+	assert.Equal(t, []byte("2"), mockDB.data[refCountKey+blobID([]byte("file1"))])
+
+	// The versions older than the maximum age are pruned, but not the head
+	server.conf.HistoryMaxAge = time.Hour
+	history.Versions[0].Time = time.Now().Add(-2 * time.Hour)
+	history.Versions[1].Time = time.Now().Add(-2 * time.Hour)
+	data, _ := json.Marshal(history.Versions)
+	mockDB.data[historyKey+history.Collection] = data
+
+	pruned, err := server.pruneHistories()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.NotContains(t, mockDB.data, second.RootHash+"0")
+
+	history = requestHistory(t, server, http.MethodGet, "/history/"+third.RootHash, http.StatusOK)
+	require.Len(t, history.Versions, 1)
+	assert.Equal(t, third.RootHash, history.Head)
+
+	content, err := server.getFile(third.RootHash, third.Leaves[0])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file1"), content)
+}
+
+func TestHistoryRollback(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	before := time.Now().UTC().Add(time.Second).Format(time.RFC3339)
+	time.Sleep(time.Second)
+	second := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("file2")})
+
+	history := requestHistory(t, server, http.MethodPost, "/history/"+second.RootHash+"/rollback?to="+first.RootHash+"&message=undo", http.StatusOK)
+	assert.Equal(t, first.RootHash, history.Head)
+	require.Len(t, history.Versions, 3)
+	assert.Equal(t, historyRollback, history.Versions[2].Op)
+	assert.Equal(t, "undo", history.Versions[2].Message)
+
+	// An update of the head continues the history
+	third := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("file3")})
+	history = requestHistory(t, server, http.MethodGet, "/history/"+third.RootHash, http.StatusOK)
+	assert.Len(t, history.Versions, 4)
+
+	history = requestHistory(t, server, http.MethodPost, "/history/"+third.RootHash+"/rollback?at="+before, http.StatusOK)
+	assert.Equal(t, first.RootHash, history.Head)
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/history/" + third.RootHash + "/rollback", http.StatusBadRequest},
+		{"/history/" + third.RootHash + "/rollback?to=a&at=b", http.StatusBadRequest},
+		{"/history/" + third.RootHash + "/rollback?at=yesterday", http.StatusBadRequest},
+		{"/history/" + third.RootHash + "/rollback?to=unknown", http.StatusBadRequest},
+		{"/history/" + third.RootHash + "/rollback?to=" + unknownRoot, http.StatusNotFound},
+		{"/history/" + third.RootHash + "/rollback?at=2000-01-01T00:00:00Z", http.StatusNotFound},
+		{"/history/" + third.RootHash + "/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		requestHistory(t, server, http.MethodPost, tt.url, tt.status)
+	}
+}
+
+func TestHistoryOfRootsBeforeHistory(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	delete(mockDB.data, historyKey+first.RootHash)
+	delete(mockDB.data, collectionOfKey+first.RootHash)
+	delete(mockDB.data, versionsKey+first.RootHash)
+
+	history := requestHistory(t, server, http.MethodGet, "/history/"+first.RootHash, http.StatusOK)
+	require.Len(t, history.Versions, 1)
+	assert.True(t, history.Versions[0].Time.IsZero())
+
+	// The old root is the first version of its collection
+	second := uploadJSON(t, server, "/update/"+first.RootHash, [][]byte{[]byte("file2")})
+	history = requestHistory(t, server, http.MethodGet, "/history/"+second.RootHash, http.StatusOK)
+	assert.Equal(t, first.RootHash, history.Collection)
+	require.Len(t, history.Versions, 2)
+	assert.Equal(t, []byte("1"), mockDB.data[versionsKey+first.RootHash])
+
+	// Only the head is kept when the old versions are out of the age
+	server.conf.HistoryMaxAge = time.Hour
+	pruned, err := server.pruneHistories()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.NotContains(t, mockDB.data, first.RootHash+"0")
+}
+
+func TestIndexLegacyRoots(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	second := uploadJSON(t, server, "/upload", [][]byte{[]byte("file2")})
+	delete(mockDB.data, historyKey+first.RootHash)
+	delete(mockDB.data, collectionOfKey+first.RootHash)
+	delete(mockDB.data, versionsKey+first.RootHash)
+	require.NoError(t, server.repairUsage())
+	before, err := server.getUsage()
+	require.NoError(t, err)
+
+	// The roots are listed from their versions
+	roots, err := server.getRoots()
+	require.NoError(t, err)
+	assert.Equal(t, []string{second.RootHash}, roots)
+
+	// The roots stored before the histories are their first version
+	require.NoError(t, server.indexLegacyRoots())
+	roots, err = server.getRoots()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{first.RootHash, second.RootHash}, roots)
+	history := requestHistory(t, server, http.MethodGet, "/history/"+first.RootHash, http.StatusOK)
+	assert.Equal(t, first.RootHash, history.Collection)
+	require.Len(t, history.Versions, 1)
+	after, err := server.getUsage()
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// The migration runs once and its record is not collected
+	_, err = server.collectGarbage(false)
+	require.NoError(t, err)
+	delete(mockDB.data, collectionOfKey+second.RootHash)
+	delete(mockDB.data, versionsKey+second.RootHash)
+	require.NoError(t, server.indexLegacyRoots())
+	assert.NotContains(t, mockDB.data, versionsKey+second.RootHash)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+// intentKey stores the writes of the operations in progress, an intent is
+// written before the batch of the operation and deleted after it, so the
+// intents found on start are of operations interrupted by a crash. The
+// contents of the blobs are not in the intents, they are written before
+const intentKey = "intent_"
+
+// intentOp is a write of an intent, a put or a delete of the key
+type intentOp struct {
+	Key    string `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// intent is the record of an operation, it has all the writes of its batch
+// so the operation can be replayed
+type intent struct {
+	Op   string     `json:"op"`
+	Root string     `json:"root,omitempty"`
+	Ops  []intentOp `json:"ops"`
+}
+
+// intentBatch is a batch that also records its writes for the intent
+type intentBatch struct {
+	db.Batch
+	ops []intentOp
+	// blobs has the staged files linked by the batch by their ids, only
+	// the ones not stored yet are written
+	blobs map[string]stagedFile
+	// legacyRoots is the number of roots stored before the histories that
+	// the batch adds to one
+	legacyRoots int
+	// owner is the principal of the collections created by the batch
+	owner string
+	// principal changes the collections of the batch, nil without
+	// authentication
+	principal *Principal
+	// content has the values stored by their content, the blobs, they are
+	// not in the batch nor in the intent
+	content []intentOp
+}
+
+func (b *intentBatch) Put(key string, value []byte) {
+	b.Batch.Put(key, value)
+	b.ops = append(b.ops, intentOp{Key: key, Value: value})
+}
+
+func (b *intentBatch) Delete(key string) {
+	b.Batch.Delete(key)
+	b.ops = append(b.ops, intentOp{Key: key, Delete: true})
+}
+
+// putContent adds a value stored by its content, the same key always has
+// the same value so it is written by commit before the intent and a failed
+// commit only leaves a value without refs for the garbage collection
+func (b *intentBatch) putContent(key string, value []byte) {
+	b.content = append(b.content, intentOp{Key: key, Value: value})
+}
+
+// newBatch returns a batch to be committed with commit
+func (s *Server) newBatch() *intentBatch {
+	return &intentBatch{Batch: s.db.NewBatch(), blobs: make(map[string]stagedFile)}
+}
+
+// commit writes the contents of the new blobs, the intent of the operation,
+// the batch and then deletes the intent. If the batch fails the intent is
+// deleted since the batch is all or nothing, if the server crashes before
+// deleting it the operation is rolled forward on the next start, its blobs
+// are already stored. The reference counts of the blobs and the
+// usage are computed here so the commits are serialized, a commit over the
+// quota fails with errQuotaExceeded
+func (s *Server) commit(op, root string, b *intentBatch) error {
+	s.refs.Lock()
+	defer s.refs.Unlock()
+
+	delta, err := s.putBlobs(b)
+	if err != nil {
+		return err
+	}
+	delta.Collections, err = s.collectionsDelta(b)
+	if err != nil {
+		return err
+	}
+	err = s.putUsage(b, delta)
+	if err != nil {
+		return err
+	}
+	s.gc.committed(b.ops)
+	s.gc.committed(b.content)
+
+	for _, op := range b.content {
+		err = s.db.Put(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := newIntentID()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(intent{Op: op, Root: root, Ops: b.ops})
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Put(intentKey+id, data)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Write(b.Batch)
+	if err != nil {
+		if delErr := s.db.Delete(intentKey + id); delErr != nil {
+			s.conf.Logger.Error(delErr.Error())
+		}
+		return err
+	}
+
+	return s.db.Delete(intentKey + id)
+}
+
+// recoverIntents finishes the operations interrupted by a crash in the
+// order they were started. An intent is only visible once it is fully
+// written, so it is rolled forward by replaying its writes; an intent that
+// can not be read is rolled back by deleting it, its batch was never written
+func (s *Server) recoverIntents() error {
+	intents, err := s.db.GetByPrefix(intentKey)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(intents))
+	for k := range intents {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var in intent
+		err := json.Unmarshal(intents[k], &in)
+		if err != nil {
+			s.conf.Logger.Warn(fmt.Sprintf("rolling back the invalid intent %s: %s", k, err.Error()))
+			err = s.db.Delete(k)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		s.conf.Logger.Warn(fmt.Sprintf("rolling forward the %s of the root %s", in.Op, in.Root))
+		b := s.db.NewBatch()
+		for _, op := range in.Ops {
+			if op.Delete {
+				b.Delete(op.Key)
+				continue
+			}
+			b.Put(op.Key, op.Value)
+		}
+		b.Delete(k)
+
+		err = s.db.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newIntentID returns an id ordered by the start of the operations
+func newIntentID() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d", time.Now().UnixNano()) + hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/require"
+)
+
+var errCrash = errors.New("crash")
+
+// faultyDB crashes in the failAt write, a crashed write of a batch applies
+// only a random part of it as a store without atomic batches would do
+type faultyDB struct {
+	db.Database
+	rnd     *rand.Rand
+	writes  int
+	failAt  int
+	crashed bool
+}
+
+type faultyBatch struct {
+	ops []intentOp
+}
+
+func (b *faultyBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, intentOp{Key: key, Value: value})
+}
+
+func (b *faultyBatch) Delete(key string) {
+	b.ops = append(b.ops, intentOp{Key: key, Delete: true})
+}
+
+func (b *faultyBatch) Len() int {
+	return len(b.ops)
+}
+
+func (d *faultyDB) fail() bool {
+	if d.crashed {
+		return true
+	}
+	d.writes++
+	d.crashed = d.writes == d.failAt
+	return d.crashed
+}
+
+func (d *faultyDB) Put(key string, value []byte) error {
+	if d.fail() {
+		return errCrash
+	}
+	return d.Database.Put(key, value)
+}
+
+func (d *faultyDB) Delete(key string) error {
+	if d.fail() {
+		return errCrash
+	}
+	return d.Database.Delete(key)
+}
+
+func (d *faultyDB) NewBatch() db.Batch {
+	return &faultyBatch{}
+}
+
+func (d *faultyDB) Write(b db.Batch) error {
+	ops := b.(*faultyBatch).ops
+	if d.fail() {
+		ops = ops[:d.rnd.Intn(len(ops)+1)]
+	}
+
+	batch := d.Database.NewBatch()
+	for _, op := range ops {
+		if op.Delete {
+			batch.Delete(op.Key)
+			continue
+		}
+		batch.Put(op.Key, op.Value)
+	}
+	err := d.Database.Write(batch)
+	if err != nil {
+		return err
+	}
+
+	if d.crashed {
+		return errCrash
+	}
+	return nil
+}
+
+func newFaultConfig() *config.Config {
+	c := config.GetDefaultConfig()
+	return &config.Config{
+		ServerPort:   ":5005",
+		Logger:       c.Logger,
+		Chunking:     true,
+		ChunkMinSize: 256,
+		ChunkAvgSize: 1024,
+		ChunkMaxSize: 4096,
+		// The old roots are deleted with the new ones
+		HistoryKeep: 1,
+	}
+}
+
+func postFiles(server *Server, handler http.HandlerFunc, url string, files [][]byte) (treeResult, int) {
+	filesJSON, _ := json.Marshal(files)
+	req := httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var result treeResult
+	json.NewDecoder(w.Result().Body).Decode(&result)
+	return result, w.Result().StatusCode
+}
+
+// replaceFiles uploads the files as the next version of the collection of
+// the root, as the upload sessions with a root
+func replaceFiles(server *Server, root string, files [][]byte) (treeResult, error) {
+	filesJSON, _ := json.Marshal(files)
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	hashes, staged, err := server.readFiles(req, mkt.SHA256, false)
+	if err != nil {
+		return treeResult{}, err
+	}
+	return server.storeUpload(server.newBatch(), root, "", mkt.SHA256, orderAppend, false, hashes, staged)
+}
+
+// requireOneRoot checks that the store has only the tree of the root and
+// that all its files and proofs are valid
+func requireOneRoot(t *testing.T, server *Server, root string, files [][]byte) {
+	keys, err := server.db.KeysByPrefix("")
+	require.NoError(t, err)
+	refs := make(map[string]int)
+	for _, k := range keys {
+		// The chunks and the blobs are shared by content, the history is
+		// kept by the first root of the collection
+		if strings.HasPrefix(k, chunkKey) || strings.HasPrefix(k, blobKey) || strings.HasPrefix(k, blobManifestKey) || strings.HasPrefix(k, refCountKey) || strings.HasPrefix(k, historyKey) || k == usageKey {
+			continue
+		}
+		require.False(t, strings.HasPrefix(k, intentKey), k)
+		require.Contains(t, k, root)
+		if strings.HasPrefix(k, refKey) {
+			id, err := server.db.Get(k)
+			require.NoError(t, err)
+			refs[string(id)]++
+		}
+	}
+
+	// The reference counts match the refs
+	counts, err := server.db.KeysByPrefix(refCountKey)
+	require.NoError(t, err)
+	require.Len(t, counts, len(refs))
+	for id, n := range refs {
+		count, err := server.getRefCount(id)
+		require.NoError(t, err)
+		require.Equal(t, n, count)
+	}
+
+	// The usage matches the stored keys
+	u, err := server.getUsage()
+	require.NoError(t, err)
+	counted, err := server.computeUsage()
+	require.NoError(t, err)
+	require.Equal(t, counted, u)
+
+	leaves, err := server.getLeaves(root)
+	require.NoError(t, err)
+	require.Len(t, leaves, len(files))
+
+	for i, h := range leaves {
+		content, err := server.getFile(root, h)
+		require.NoError(t, err)
+		require.Equal(t, files[i], content)
+
+		data, err := server.db.Get(proofKey + root + h)
+		require.NoError(t, err)
+		var proof mkt.Proof
+		require.NoError(t, json.Unmarshal(data, &proof))
+		require.True(t, mkt.VerifyProof(h, root, &proof))
+	}
+}
+
+func TestRecoverIntentsFaultInjection(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(size int) []byte {
+		data := make([]byte, size)
+		rnd.Read(data)
+		return data
+	}
+
+	oldFiles := [][]byte{random(8 * 1024), random(3 * 1024)}
+	newFiles := [][]byte{random(6 * 1024), random(100)}
+	allFiles := append(append([][]byte{}, oldFiles...), newFiles...)
+
+	run := func(t *testing.T, failAt int, replace bool) (*faultyDB, string, string) {
+		ldb, err := leveldb.New(filepath.Join(t.TempDir(), "db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { ldb.Close() })
+
+		fdb := &faultyDB{Database: ldb, rnd: rnd}
+		server := NewServer(newFaultConfig(), fdb)
+
+		first, status := postFiles(server, server.UploadHandler, "/upload", oldFiles)
+		require.Equal(t, http.StatusOK, status)
+
+		fdb.writes = 0
+		fdb.failAt = failAt
+		var second treeResult
+		if replace {
+			second, _ = replaceFiles(server, first.RootHash, newFiles)
+		} else {
+			second, _ = postFiles(server, server.UpdatedHandler, "/update/"+first.RootHash, newFiles)
+		}
+		return fdb, first.RootHash, second.RootHash
+	}
+
+	for _, replace := range []bool{false, true} {
+		expected := allFiles
+		if replace {
+			expected = newFiles
+		}
+
+		// A run without faults counts the writes of the operation
+		fdb, _, newRoot := run(t, 0, replace)
+		writes := fdb.writes
+		require.Greater(t, writes, 3)
+
+		for failAt := 1; failAt <= writes; failAt++ {
+			t.Run(strconv.FormatBool(replace)+"_"+strconv.Itoa(failAt), func(t *testing.T) {
+				fdb, oldRoot, _ := run(t, failAt, replace)
+				require.True(t, fdb.crashed)
+
+				// The server restarts with a healthy store
+				server := NewServer(newFaultConfig(), fdb.Database)
+				require.NoError(t, server.recoverIntents())
+
+				mode, err := server.db.KeysByPrefix(modeKey)
+				require.NoError(t, err)
+				require.Len(t, mode, 1)
+
+				if mode[0] == modeKey+oldRoot {
+					requireOneRoot(t, server, oldRoot, oldFiles)
+					return
+				}
+				requireOneRoot(t, server, newRoot, expected)
+			})
+		}
+	}
+}
+
+func TestRecoverInvalidIntent(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	mockDB.data[intentKey+"1"] = []byte("invalid")
+
+	intent, _ := json.Marshal(intent{Op: "update", Ops: []intentOp{
+		{Key: "key1", Value: []byte("value1")},
+		{Key: "key2", Delete: true},
+	}})
+	mockDB.data[intentKey+"2"] = intent
+	mockDB.data["key2"] = []byte("value2")
+
+	require.NoError(t, server.recoverIntents())
+	require.Equal(t, map[string][]byte{"key1": []byte("value1")}, mockDB.data)
+}
+
+func TestIntentWithoutContent(t *testing.T) {
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	conf := newFaultConfig()
+	conf.Chunking = false
+
+	// The server crashes in each write until one leaves an intent
+	for failAt := 1; failAt < 10; failAt++ {
+		ldb, err := leveldb.New(filepath.Join(t.TempDir(), "db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { ldb.Close() })
+
+		fdb := &faultyDB{Database: ldb, rnd: rand.New(rand.NewSource(1)), failAt: failAt}
+		server := NewServer(conf, fdb)
+		result, _ := postFiles(server, server.UploadHandler, "/upload", [][]byte{content})
+		require.True(t, fdb.crashed)
+
+		intents, err := ldb.GetByPrefix(intentKey)
+		require.NoError(t, err)
+		if len(intents) == 0 {
+			continue
+		}
+
+		// The blob is written before the intent, which only has the keys
+		// and the metadata of the operation
+		for _, data := range intents {
+			require.Less(t, len(data), len(content)/8)
+		}
+		server = NewServer(conf, ldb)
+		require.NoError(t, server.recoverIntents())
+		hashes := []string{mkt.SHA256.HashLeaf(content)}
+		root := mkt.NewMerkleTree(hashes).Root.Hash
+		requireOneRoot(t, server, root, [][]byte{content})
+		require.Empty(t, result.RootHash)
+		return
+	}
+	t.Fatal("no write left an intent")
+}
+
+// batchSizeDB records the largest value written by a batch
+type batchSizeDB struct {
+	db.Database
+	largest int
+}
+
+type sizedBatch struct {
+	db.Batch
+	db *batchSizeDB
+}
+
+func (b *sizedBatch) Put(key string, value []byte) {
+	b.db.largest = max(b.db.largest, len(value))
+	b.Batch.Put(key, value)
+}
+
+func (d *batchSizeDB) NewBatch() db.Batch {
+	return &sizedBatch{Batch: d.Database.NewBatch(), db: d}
+}
+
+func (d *batchSizeDB) Write(b db.Batch) error {
+	return d.Database.Write(b.(*sizedBatch).Batch)
+}
+
+func TestBatchesWithoutContent(t *testing.T) {
+	ldb, err := leveldb.New(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { ldb.Close() })
+
+	conf := newFaultConfig()
+	conf.Chunking = false
+	sdb := &batchSizeDB{Database: ldb}
+	server := NewServer(conf, sdb)
+
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	first, status := postFiles(server, server.UploadHandler, "/upload", [][]byte{content})
+	require.Equal(t, http.StatusOK, status)
+
+	// The parts of the sessions are written before their offsets
+	body, _ := json.Marshal(sessionRequest{Op: sessionUpload, Sizes: []int64{int64(len(content))}})
+	w := serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(body)), "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var sess session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/sessions/"+sess.ID+"/0?offset=0", bytes.NewReader(content[:32*1024])), "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/sessions/"+sess.ID+"/0?offset=32768", bytes.NewReader(content[32*1024:])), "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil), "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The values of the keys moved to the default tenant are copied first
+	server.conf.Tenants = true
+	require.NoError(t, server.migrateTenants())
+	got, err := server.tenantServer(defaultTenant).getFile(first.RootHash, first.Leaves[0])
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	// The batches only have the metadata, the contents are written by Put
+	require.Less(t, sdb.largest, 4096)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// metaKey stores the metadata of a file of a root
+	metaKey = "meta_"
+	// commitMetaKey marks the roots whose leaves commit to the metadata
+	commitMetaKey = "commitmeta_"
+)
+
+// parseCommitMeta validates if the leaves commit to the metadata, empty
+// means they do not
+func parseCommitMeta(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	commit, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid commit_meta %s, valid values: true, false", value)
+	}
+	return commit, nil
+}
+
+// leafHash returns the leaf of a file with the given content hash, it
+// commits to the metadata when commit is set
+func leafHash(mode mkt.Mode, commit bool, hash string, meta mkt.Metadata) string {
+	if !commit {
+		return hash
+	}
+	return meta.LeafHash(hash, mode)
+}
+
+// getCommitMeta returns if the leaves of the root commit to the metadata
+func (s *Server) getCommitMeta(root string) (bool, error) {
+	_, err := s.db.Get(commitMetaKey + root)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getMeta returns the metadata of a file of a root, nil is returned for the
+// files stored before the metadata
+func (s *Server) getMeta(root, hash string) (*mkt.Metadata, error) {
+	data, err := s.db.Get(metaKey + root + hash)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta mkt.Metadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// getLeafMeta returns the metadata of a file of a root and if the leaf
+// commits to it
+func (s *Server) getLeafMeta(root, hash string) (*mkt.Metadata, bool, error) {
+	meta, err := s.getMeta(root, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	commit, err := s.getCommitMeta(root)
+	if err != nil {
+		return nil, false, err
+	}
+	return meta, commit, nil
+}
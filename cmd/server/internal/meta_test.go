@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/delta"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func multipartMetaBody(t *testing.T, files [][]byte, metas []mkt.Metadata) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i, f := range files {
+		meta, _ := json.Marshal(metas[i])
+		require.NoError(t, writer.WriteField(metaPart, string(meta)))
+		part, err := writer.CreateFormFile(filePart, "file")
+		require.NoError(t, err)
+		_, err = part.Write(f)
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+func TestUploadWithMetadata(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	files := [][]byte{[]byte("hello"), []byte("<html></html>")}
+	metas := []mkt.Metadata{
+		{Name: "docs/hello.txt", Mode: 0o600, ModTime: 1700000000, ContentType: "text/plain"},
+		{Name: "index.html", Mode: 0o644, ModTime: 1700000001, ContentType: "text/html"},
+	}
+
+	for _, commit := range []bool{false, true} {
+		body, contentType := multipartMetaBody(t, files, metas)
+		url := "/upload"
+		if commit {
+			url += "?commit_meta=true"
+		}
+		req := httptest.NewRequest(http.MethodPost, url, body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		server.UploadHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var result treeResult
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&result))
+
+		for i, f := range files {
+			meta := metas[i]
+			meta.Size = int64(len(f))
+			leaf := mkt.SHA256.HashLeaf(f)
+			if commit {
+				leaf = meta.LeafHash(leaf, mkt.SHA256)
+			}
+			assert.Equal(t, leaf, result.Leaves[i])
+
+			req = httptest.NewRequest(http.MethodGet, "/download/"+result.RootHash+"/"+strconv.Itoa(i), nil)
+			w = httptest.NewRecorder()
+			server.DownloadHandler(w, req)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			var download struct {
+				File       []byte        `json:"file"`
+				Proof      *mkt.Proof    `json:"proof"`
+				Meta       *mkt.Metadata `json:"meta"`
+				CommitMeta bool          `json:"commit_meta"`
+			}
+			require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&download))
+			assert.Equal(t, f, download.File)
+			assert.Equal(t, &meta, download.Meta)
+			assert.Equal(t, commit, download.CommitMeta)
+			assert.True(t, mkt.VerifyProof(leaf, result.RootHash, download.Proof))
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/raw/"+result.RootHash+"/0", nil)
+		w = httptest.NewRecorder()
+		server.RawDownloadHandler(w, req)
+
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `attachment; filename=hello.txt`, resp.Header.Get("Content-Disposition"))
+		assert.Equal(t, time.Unix(1700000000, 0).UTC().Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+
+		data, err := base64.StdEncoding.DecodeString(resp.Header.Get(metaHeader))
+		require.NoError(t, err)
+		var meta mkt.Metadata
+		require.NoError(t, json.Unmarshal(data, &meta))
+		assert.Equal(t, "docs/hello.txt", meta.Name)
+		assert.Equal(t, commit, resp.Header.Get(commitMetaHeader) == "true")
+	}
+}
+
+func TestUploadWithoutMetadataPart(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	body, contentType := multipartBody(t, [][]byte{[]byte("file1")})
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var result treeResult
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&result))
+
+	// The name and the type come from the headers of the part
+	meta, err := server.getMeta(result.RootHash, result.Leaves[0])
+	require.NoError(t, err)
+	assert.Equal(t, &mkt.Metadata{Name: "file", Size: 5, ContentType: "application/octet-stream"}, meta)
+
+	// The files stored before the metadata have none
+	delete(mockDB.data, metaKey+result.RootHash+result.Leaves[0])
+	meta, err = server.getMeta(result.RootHash, result.Leaves[0])
+	require.NoError(t, err)
+	assert.Nil(t, meta)
+}
+
+func TestUploadInvalidMetadata(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	body, contentType := multipartMetaBody(t, [][]byte{[]byte("file1")}, []mkt.Metadata{{Name: "../etc/passwd"}})
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?commit_meta=maybe", bytes.NewBufferString("[]"))
+	w = httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestCommittedMetadataKeptByUpdates(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	files := [][]byte{[]byte("file1"), make([]byte, 4096)}
+	metas := []mkt.Metadata{{Name: "a.txt"}, {Name: "b.bin"}}
+	body, contentType := multipartMetaBody(t, files, metas)
+	req := httptest.NewRequest(http.MethodPost, "/upload?commit_meta=true", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var first treeResult
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&first))
+
+	// The files of the update without metadata commit to their size
+	filesJSON, _ := json.Marshal([][]byte{[]byte("file2")})
+	req = httptest.NewRequest(http.MethodPost, "/update/"+first.RootHash, bytes.NewBuffer(filesJSON))
+	w = httptest.NewRecorder()
+	server.UpdatedHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var second treeResult
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&second))
+	leaf := mkt.Metadata{Size: 5}.LeafHash(mkt.SHA256.HashLeaf([]byte("file2")), mkt.SHA256)
+	assert.Equal(t, []string{first.Leaves[0], first.Leaves[1], leaf}, second.Leaves)
+
+	meta, commit, err := server.getLeafMeta(second.RootHash, first.Leaves[0])
+	require.NoError(t, err)
+	assert.True(t, commit)
+	assert.Equal(t, "a.txt", meta.Name)
+
+	// A patched file keeps its metadata with the new size
+	changed := append([]byte{}, files[1]...)
+	copy(changed[2000:], "changed")
+	ops := delta.Compute(&delta.Signature{BlockSize: delta.MinBlockSize}, changed)
+	deltaBody, _ := json.Marshal(deltaRequest{Hash: mkt.SHA256.HashLeaf(changed), BlockSize: delta.MinBlockSize, Ops: ops})
+	req = httptest.NewRequest(http.MethodPost, "/delta/"+second.RootHash+"/1", bytes.NewBuffer(deltaBody))
+	w = httptest.NewRecorder()
+	server.DeltaHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode, w.Body.String())
+
+	var third treeResult
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&third))
+	leaf = mkt.Metadata{Name: "b.bin", Size: 4096}.LeafHash(mkt.SHA256.HashLeaf(changed), mkt.SHA256)
+	assert.Equal(t, leaf, third.Leaves[1])
+
+	commit, err = server.getCommitMeta(third.RootHash)
+	require.NoError(t, err)
+	assert.True(t, commit)
+	// The previous version is kept by the history
+	commit, err = server.getCommitMeta(second.RootHash)
+	require.NoError(t, err)
+	assert.True(t, commit)
+}
+
+func TestResumableUploadWithMetadata(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	sess := createSession(t, server, sessionRequest{
+		Op:         sessionUpload,
+		CommitMeta: true,
+		Sizes:      []int64{5},
+		Meta:       []mkt.Metadata{{Name: "dir/a.txt", ContentType: "text/plain", Size: 100}},
+	})
+	assert.True(t, sess.CommitMeta)
+
+	w := putPart(server, sess.ID, 0, 0, []byte("file1"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+
+	meta := mkt.Metadata{Name: "dir/a.txt", ContentType: "text/plain", Size: 5}
+	assert.Equal(t, []string{meta.LeafHash(mkt.SHA256.HashLeaf([]byte("file1")), mkt.SHA256)}, result.Leaves)
+
+	body, _ := json.Marshal(sessionRequest{Op: sessionUpload, Sizes: []int64{5}, Meta: []mkt.Metadata{{}, {}}})
+	w = sessionRequestDo(server, http.MethodPost, "/sessions", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPI is the OpenAPI document of the versioned api, the conformance
+// test exercises each of its operations so it follows the routes
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// OpenAPIHandler serves the OpenAPI document, it is public so the clients
+// can be generated before having credentials
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
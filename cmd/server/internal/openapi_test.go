@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/delta"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openAPISpec checks the responses of the api against the OpenAPI document
+// and records the operations exercised
+type openAPISpec struct {
+	t   *testing.T
+	doc map[string]any
+	// covered has the operations exercised as "method path"
+	covered map[string]bool
+}
+
+func newOpenAPISpec(t *testing.T) *openAPISpec {
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(openAPI, &doc))
+	return &openAPISpec{t: t, doc: doc, covered: map[string]bool{}}
+}
+
+func (s *openAPISpec) paths() map[string]any {
+	return s.doc["paths"].(map[string]any)
+}
+
+// operations returns the operations of the document as "method path"
+func (s *openAPISpec) operations() []string {
+	var ops []string
+	for path, item := range s.paths() {
+		for method := range item.(map[string]any) {
+			if method != "servers" && method != "parameters" {
+				ops = append(ops, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// resolve follows the references of a node of the document
+func (s *openAPISpec) resolve(node map[string]any) map[string]any {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		node = s.doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node[part].(map[string]any)
+		}
+	}
+}
+
+// match returns the path of the document of a request path without the
+// prefix, the path parameters match a segment and {path} the rest of the
+// path. As in the mux the literal segments win over the parameters
+func (s *openAPISpec) match(path string) (string, bool) {
+	param := regexp.MustCompile(`\{[a-z_]+\}`)
+	best := ""
+	for p := range s.paths() {
+		// QuoteMeta escapes the braces of the parameters
+		pattern := strings.NewReplacer(`\{`, "{", `\}`, "}").Replace(regexp.QuoteMeta(p))
+		pattern = param.ReplaceAllStringFunc(pattern, func(name string) string {
+			if name == "{path}" {
+				return ".+"
+			}
+			return "[^/]+"
+		})
+		if !regexp.MustCompile("^" + pattern + "$").MatchString(path) {
+			continue
+		}
+		if best == "" || strings.Count(p, "{") < strings.Count(best, "{") {
+			best = p
+		}
+	}
+	return best, best != ""
+}
+
+// check asserts that the response is a documented status of the operation
+// and that its JSON body follows the schema of the status
+func (s *openAPISpec) check(req *http.Request, w *httptest.ResponseRecorder) {
+	t := s.t
+	t.Helper()
+	name := req.Method + " " + req.URL.Path
+
+	path := req.URL.Path
+	if path != "/openapi.json" {
+		require.True(t, strings.HasPrefix(path, apiPrefix+"/"), name)
+		path = strings.TrimPrefix(path, apiPrefix)
+	}
+	specPath, ok := s.match(path)
+	require.True(t, ok, "the path of %s is not documented", name)
+	op, ok := s.paths()[specPath].(map[string]any)[strings.ToLower(req.Method)].(map[string]any)
+	require.True(t, ok, "the method of %s is not documented", name)
+	s.covered[req.Method+" "+specPath] = true
+
+	response, ok := op["responses"].(map[string]any)[fmt.Sprint(w.Code)].(map[string]any)
+	require.True(t, ok, "the status %d of %s is not documented: %s", w.Code, name, w.Body.String())
+	content, _ := s.resolve(response)["content"].(map[string]any)
+	media, ok := content["application/json"].(map[string]any)
+	if !ok || req.Method == http.MethodHead {
+		return
+	}
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), name)
+	var body any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), name)
+	assert.NoError(t, s.validate(media["schema"].(map[string]any), body, "body"), name)
+}
+
+// validate checks the value against the schema, the objects can not have
+// properties out of their schema unless it has additionalProperties
+func (s *openAPISpec) validate(schema map[string]any, v any, at string) error {
+	schema = s.resolve(schema)
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s is null", at)
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s is %v, not one of %v", at, v, enum)
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s is not an object", at)
+		}
+		required, _ := schema["required"].([]any)
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				return fmt.Errorf("%s.%s is required", at, r)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		additional, _ := schema["additionalProperties"].(map[string]any)
+		for k, fv := range obj {
+			var err error
+			switch p, ok := properties[k].(map[string]any); {
+			case ok:
+				err = s.validate(p, fv, at+"."+k)
+			case additional != nil:
+				err = s.validate(additional, fv, at+"."+k)
+			case properties != nil:
+				err = fmt.Errorf("%s.%s is not documented", at, k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s is not an array", at)
+		}
+		for i, item := range arr {
+			err := s.validate(schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s is not a string", at)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			return fmt.Errorf("%s %q does not match %s", at, str, pattern)
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s is not an integer", at)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s is not a boolean", at)
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := newOpenAPISpec(t)
+	server, _ := newTenantServer(t)
+
+	// Each route is documented and each operation is a route
+	var routes []string
+	for _, rt := range append(server.adminRoutes(), server.dataRoutes()...) {
+		for _, pattern := range rt.patterns {
+			routes = append(routes, strings.Replace(pattern, "{path...}", "{path}", 1))
+		}
+	}
+	routes = append(routes, "GET /openapi.json")
+	sort.Strings(routes)
+	assert.Equal(t, routes, spec.operations())
+}
+
+func TestOpenAPIConformance(t *testing.T) {
+	spec := newOpenAPISpec(t)
+	server, _ := newTenantServer(t)
+
+	serve := func(method, url, body, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.routes().ServeHTTP(w, req)
+		waitGC(server)
+		spec.check(req, w)
+		return w
+	}
+	const admin = "admin-token"
+	decode := func(w *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		require.NoError(t, json.NewDecoder(w.Body).Decode(v))
+	}
+
+	w := serve(http.MethodGet, "/openapi.json", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// files
+	var upload treeResult
+	w = serve(http.MethodPost, "/v1/upload?message=first", `["ZmlsZTE=","ZmlsZTI="]`, admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	decode(w, &upload)
+	var update treeResult
+	w = serve(http.MethodPost, "/v1/update/"+upload.RootHash, `["ZmlsZTM="]`, admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	decode(w, &update)
+	root := update.RootHash
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/download/"+root+"/0", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/raw/"+root+"/0", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodHead, "/v1/raw/"+root+"/0", "", admin).Code)
+
+	w = serve(http.MethodGet, "/v1/signature/"+root+"/0", "", admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	var sig delta.Signature
+	decode(w, &sig)
+	file := []byte("file1 changed")
+	body, _ := json.Marshal(deltaRequest{Hash: mkt.SHA256.HashLeaf(file), BlockSize: sig.BlockSize, Ops: delta.Compute(&sig, file)})
+	w = serve(http.MethodPost, "/v1/delta/"+root+"/0", string(body), admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	decode(w, &update)
+	root = update.RootHash
+
+	// trees
+	var tree treeResult
+	w = serve(http.MethodPost, "/v1/tree", `[{"path":"a/b.txt","mode":420,"file":"ZmlsZTE="}]`, admin)
+	require.Equal(t, http.StatusOK, w.Code)
+	decode(w, &tree)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/tree/"+tree.RootHash+"/a/b.txt", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/tree/"+tree.RootHash+"/a", "", admin).Code)
+
+	// sessions
+	var sess session
+	w = serve(http.MethodPost, "/v1/sessions", `{"op":"upload","sizes":[5]}`, admin)
+	require.Equal(t, http.StatusCreated, w.Code)
+	decode(w, &sess)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/v1/sessions/"+sess.ID+"/0?offset=0", "file9", admin).Code)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPut, "/v1/sessions/"+sess.ID+"/0?offset=0", "file9", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/sessions/"+sess.ID, "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "/v1/sessions/"+sess.ID+"/finalize", "", admin).Code)
+	w = serve(http.MethodPost, "/v1/sessions", `{"op":"upload","sizes":[5]}`, admin)
+	decode(w, &sess)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/v1/sessions/"+sess.ID, "", admin).Code)
+
+	// collections
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/collections?limit=1", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/collections/"+root, "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/collections/"+root+"/leaves", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/history/"+root, "", admin).Code)
+	w = serve(http.MethodPost, "/v1/history/"+root+"/rollback?to="+upload.RootHash, "", admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history historyResult
+	decode(w, &history)
+	root = history.Head
+
+	// admin
+	w = serve(http.MethodPost, "/v1/admin/tokens", `{"name":"auditor","kind":"token"}`, admin)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var cred credential
+	decode(w, &cred)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v1/admin/tokens", `{"name":"backup","kind":"hmac"}`, admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/admin/tokens", "", admin).Code)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/v1/acl/"+root+"/"+cred.ID+"?access=read", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/acl/"+root, "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/v1/acl/"+root+"/"+cred.ID, "", admin).Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/v1/admin/tokens/"+cred.ID, "", admin).Code)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/usage", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, "/v1/admin/gc?dry_run=true", "", admin).Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/v1/admin/tenants", `{"name":"b","max_files":10}`, admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/admin/tenants", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/admin/tenants/b", "", admin).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/v1/admin/tenants/b", `{"max_bytes":100}`, admin).Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/v1/collections/"+tree.RootHash, "", admin).Code)
+
+	// errors
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/v1/upload", "x", admin).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/v1/download/"+root[:8]+"/0", "", admin).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/v1/download/"+root+"/9", "", admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/v1/collections", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/v1/admin/tenants/c", "", admin).Code)
+	server.conf.MaxBodySize = 4
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(http.MethodPost, "/v1/upload", `["ZmlsZTE="]`, admin).Code)
+
+	// Each operation of the document is exercised
+	for _, op := range spec.operations() {
+		assert.True(t, spec.covered[op], "%s is not exercised", op)
+	}
+}
+
+func TestOpenAPIValidate(t *testing.T) {
+	spec := newOpenAPISpec(t)
+	schema := map[string]any{"$ref": "#/components/schemas/TreeResult"}
+	valid := func(body string) error {
+		var v any
+		require.NoError(t, json.Unmarshal([]byte(body), &v))
+		return spec.validate(schema, v, "body")
+	}
+
+	assert.NoError(t, valid(`{"root_hash":"`+unknownRoot+`","leaves":["a"],"indexes":[0]}`))
+	assert.Error(t, valid(`{"root_hash":"`+unknownRoot+`","leaves":["a"]}`))
+	assert.Error(t, valid(`{"root_hash":"root","leaves":["a"],"indexes":[0]}`))
+	assert.Error(t, valid(`{"root_hash":"`+unknownRoot+`","leaves":["a"],"indexes":[0.5]}`))
+	assert.Error(t, valid(`{"root_hash":"`+unknownRoot+`","leaves":null,"indexes":[0]}`))
+	assert.Error(t, valid(`{"root_hash":"`+unknownRoot+`","leaves":[],"indexes":[],"extra":1}`))
+}
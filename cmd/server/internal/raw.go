@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The headers of the raw downloads with the data to verify the file
+	proofHeader = "X-Merkle-Proof"
+	modeHeader  = "X-Merkle-Mode"
+	leafHeader  = "X-Merkle-Leaf"
+	// metaHeader has the base64 encoded JSON metadata of the file
+	metaHeader       = "X-Merkle-Meta"
+	commitMetaHeader = "X-Merkle-Commit-Meta"
+)
+
+// RawDownloadHandler streams the raw bytes of a file, the proof, the mode,
+// the leaf hash and the metadata are sent in the headers. The ETag is the
+// leaf hash and the Range and If-None-Match requests are supported
+func (s *Server) RawDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	// NOTE: /raw/root/index
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	root := pathParts[2]
+	i, err := strconv.Atoi(pathParts[3])
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	hash, err := s.db.Get(root + strconv.Itoa(i))
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	// The proofs are stored as compact JSON, they are sent as they are
+	proof, err := s.db.Get(proofKey + root + string(hash))
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	mode, err := s.getMode(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	meta, commit, err := s.getLeafMeta(root, string(hash))
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	file, _, err := s.openFile(root, string(hash))
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	contentType := "application/octet-stream"
+	var modTime time.Time
+	if meta != nil {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(metaHeader, base64.StdEncoding.EncodeToString(data))
+
+		if meta.ContentType != "" {
+			contentType = meta.ContentType
+		}
+		if meta.Name != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(meta.Name)}))
+		}
+		if meta.ModTime != 0 {
+			modTime = time.Unix(meta.ModTime, 0)
+		}
+	}
+	if commit {
+		w.Header().Set(commitMetaHeader, "true")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+string(hash)+`"`)
+	w.Header().Set(proofHeader, string(proof))
+	w.Header().Set(modeHeader, string(mode))
+	w.Header().Set(leafHeader, string(hash))
+
+	// ServeContent sets the Content-Length and handles the conditional and
+	// the range requests, only the chunks of the range are read
+	http.ServeContent(w, r, "", modTime, file)
+}
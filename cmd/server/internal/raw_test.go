@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawDownloadHandler(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	file := make([]byte, 20*1024)
+	rand.New(rand.NewSource(1)).Read(file)
+
+	filesJSON, _ := json.Marshal([][]byte{[]byte("other file"), file})
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var upload treeResult
+	json.NewDecoder(w.Result().Body).Decode(&upload)
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/"+upload.RootHash+"/1", nil)
+	w = httptest.NewRecorder()
+	server.RawDownloadHandler(w, req)
+
+	resp := w.Result()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(file)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, `"`+upload.Leaves[1]+`"`, resp.Header.Get("ETag"))
+	assert.Equal(t, upload.Leaves[1], resp.Header.Get(leafHeader))
+	assert.Equal(t, string(mkt.SHA256), resp.Header.Get(modeHeader))
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, file, body)
+
+	var proof *mkt.Proof
+	err := json.Unmarshal([]byte(resp.Header.Get(proofHeader)), &proof)
+	assert.NoError(t, err)
+	assert.True(t, mkt.VerifyProof(mkt.SHA256.HashLeaf(body), upload.RootHash, proof))
+
+	// Range across the chunks
+	req = httptest.NewRequest(http.MethodGet, "/raw/"+upload.RootHash+"/1", nil)
+	req.Header.Set("Range", "bytes=1000-9999")
+	w = httptest.NewRecorder()
+	server.RawDownloadHandler(w, req)
+
+	resp = w.Result()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 1000-9999/"+strconv.Itoa(len(file)), resp.Header.Get("Content-Range"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, file[1000:10000], body)
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/"+upload.RootHash+"/1", nil)
+	req.Header.Set("If-None-Match", `"`+upload.Leaves[1]+`"`)
+	w = httptest.NewRecorder()
+	server.RawDownloadHandler(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/"+upload.RootHash+"/x", nil)
+	w = httptest.NewRecorder()
+	server.RawDownloadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	req = httptest.NewRequest(http.MethodGet, "/raw/", nil)
+	w = httptest.NewRecorder()
+	server.RawDownloadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -2,50 +2,212 @@ package server
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/jmsilvadev/zc/pkg/cdc"
 	"github.com/jmsilvadev/zc/pkg/config"
 	"github.com/jmsilvadev/zc/pkg/db"
 	"github.com/jmsilvadev/zc/pkg/mkt"
+	"google.golang.org/grpc"
 )
 
 const (
+	// orderAppend keeps the existent leaves in their positions and
+	// appends the new files in the upload order
+	orderAppend = "append"
+	// orderHash sorts all the leaves by hash
+	orderHash = "hash"
+
+	// fileKey stored the content of a file of a root before the blobs, the
+	// files are moved to the blobs on start
 	fileKey  = "file_"
 	proofKey = "proof_"
+	modeKey  = "mode_"
 
 	errInternal   = "internal error, try again"
 	errBadRequest = "invalid data sent"
 	errNotFound   = "not found"
 )
 
+// treeResult is the response of the uploads and updates with the
+// mapping between the indexes and the leaves of the new tree
+type treeResult struct {
+	RootHash string   `json:"root_hash"`
+	Leaves   []string `json:"leaves"`
+	// Indexes has the position in the tree of each sent file
+	Indexes []int `json:"indexes"`
+}
+
+func newTreeResult(root string, leaves, uploaded []string) treeResult {
+	positions := make(map[string]int, len(leaves))
+	for i := len(leaves) - 1; i >= 0; i-- {
+		positions[leaves[i]] = i
+	}
+
+	indexes := make([]int, len(uploaded))
+	for i, h := range uploaded {
+		indexes[i] = positions[h]
+	}
+
+	return treeResult{
+		RootHash: root,
+		Leaves:   leaves,
+		Indexes:  indexes,
+	}
+}
+
+// parseOrder validates the order of the leaves, empty means append
+func parseOrder(order string) (string, error) {
+	switch order {
+	case "", orderAppend:
+		return orderAppend, nil
+	case orderHash:
+		return orderHash, nil
+	}
+	return "", fmt.Errorf("invalid order %s, valid values: %s, %s", order, orderAppend, orderHash)
+}
+
 type Server struct {
-	conf *config.Config
-	db   db.Database
+	conf    *config.Config
+	db      db.Database
+	chunker *cdc.Chunker
+	// sessions serializes the changes of the upload sessions
+	sessions sync.Mutex
+	// finalizing has the ids of the sessions being finalized, it is
+	// guarded by sessions
+	finalizing map[string]bool
+	// refs serializes the commits that change the reference counts
+	refs sync.Mutex
+	// history serializes the changes of the histories of the collections
+	history sync.Mutex
+	gc      gcState
+	// auth has the authenticators tried for each request, the server is
+	// open without them
+	auth   []Authenticator
+	nonces nonceState
+	// global has the tenants, the server of a tenant only sees its
+	// keyspace in db
+	global  db.Database
+	tenant  string
+	tenants tenantSet
+	// mux serves the endpoints of the keyspace of a tenant
+	mux http.Handler
 }
 
 func NewServer(c *config.Config, db db.Database) *Server {
-	return &Server{
-		db:   db,
-		conf: c,
+	s := &Server{
+		db:     db,
+		global: db,
+		conf:   c,
 	}
+
+	if c.Chunking {
+		chunker, err := cdc.New(c.ChunkMinSize, c.ChunkAvgSize, c.ChunkMaxSize)
+		if err != nil {
+			c.Logger.Error(err.Error() + ", using the default chunk sizes")
+			chunker, _ = cdc.New(0, 0, 0)
+		}
+		s.chunker = chunker
+	}
+	s.useAuthMethods(c.Auth)
+
+	return s
+}
+
+// Handler returns the handler of the endpoints without starting the server,
+// the tests of the clients serve it
+func (s *Server) Handler() http.Handler {
+	return s.routes()
 }
 
 func (s *Server) Start() {
 	defer s.db.Close()
 
+	if err := s.checkAuth(); err != nil {
+		s.conf.Logger.Error("Authentication error: " + err.Error())
+		return
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		s.conf.Logger.Error("TLS error: " + err.Error())
+		return
+	}
+
+	if s.conf.Tenants {
+		if err := s.migrateTenants(); err != nil {
+			s.conf.Logger.Error("Migration error: " + err.Error())
+			return
+		}
+	} else if err := s.db.Delete(migratedKey + "tenants"); err != nil {
+		s.conf.Logger.Error("Migration error: " + err.Error())
+		return
+	}
+	keyspaces, err := s.keyspaces()
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		return
+	}
+
+	// Finish the operations interrupted by a crash before serving
+	for _, ks := range keyspaces {
+		if err := ks.recoverIntents(); err != nil {
+			s.conf.Logger.Error("Recovery error: " + err.Error())
+			return
+		}
+		if err := ks.migrateBlobs(); err != nil {
+			s.conf.Logger.Error("Migration error: " + err.Error())
+			return
+		}
+		if err := ks.indexLegacyRoots(); err != nil {
+			s.conf.Logger.Error("Migration error: " + err.Error())
+			return
+		}
+		if err := ks.initUsage(); err != nil {
+			s.conf.Logger.Error("Usage error: " + err.Error())
+			return
+		}
+		if err := ks.deleteExpiredSessions(); err != nil {
+			s.conf.Logger.Error(err.Error())
+		}
+	}
+	if err := s.deleteExpiredNonces(); err != nil {
+		s.conf.Logger.Error(err.Error())
+	}
+
 	server := &http.Server{
-		Addr:    s.conf.ServerPort,
-		Handler: s.routes(),
+		Addr:      s.conf.ServerPort,
+		Handler:   s.routes(),
+		TLSConfig: tlsConfig,
+	}
+
+	var grpcServer *grpc.Server
+	if s.conf.GRPCPort != "" {
+		grpcServer, err = s.serveGRPC(tlsConfig)
+		if err != nil {
+			s.conf.Logger.Error("gRPC error: " + err.Error())
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.conf.GCInterval > 0 {
+		go s.scheduleGC(s.conf.GCInterval, done)
+	}
+	if e, ok := encryptedOf(s.db); ok {
+		go s.reencrypt(e, done)
 	}
 
 	listener := make(chan os.Signal, 1)
@@ -65,12 +227,19 @@ func (s *Server) Start() {
 		if err := server.Shutdown(ctx); err != nil {
 			s.conf.Logger.Error("Server forced to shutdown: " + err.Error())
 		}
+		if grpcServer != nil {
+			stopGRPC(ctx, grpcServer)
+		}
 
 		wg.Done()
 	}()
 
-	s.conf.Logger.Info("Server is running on port " + s.conf.ServerPort)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if tlsConfig != nil {
+		s.conf.Logger.Info("Server is running with TLS on port " + s.conf.ServerPort)
+	} else {
+		s.conf.Logger.Info("Server is running on port " + s.conf.ServerPort)
+	}
+	if err := listen(server); err != http.ErrServerClosed {
 		s.conf.Logger.Error("Server error: " + err.Error())
 	}
 
@@ -78,81 +247,98 @@ func (s *Server) Start() {
 	s.conf.Logger.Warn("Server gracefully stopped")
 }
 
-// TODO: create a streaming to transfer faster, but the text says
-// that the files are small so maybe dont do it now
+// encryptedOf returns the encrypted view of the database under the views
+// that wrap it, such as the compression
+func encryptedOf(d db.Database) (*db.Encrypted, bool) {
+	for {
+		switch v := d.(type) {
+		case *db.Encrypted:
+			return v, true
+		case interface{ Unwrap() db.Database }:
+			d = v.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// reencrypt encrypts with the current key the values of the other keys and
+// the ones stored before the encryption, it stops on shutdown
+func (s *Server) reencrypt(e *db.Encrypted, done <-chan struct{}) {
+	n, err := e.Reencrypt(done)
+	if err != nil {
+		s.conf.Logger.Error("Re-encryption error: " + err.Error())
+	}
+	if n > 0 {
+		s.conf.Logger.Info(fmt.Sprintf("Re-encrypted %d values with the key %s", n, e.Keys().Current()))
+	}
+}
+
+// UploadHandler stores a new collection, the files are sent as a JSON array
+// or streamed as multipart/form-data
 func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
-	var files [][]byte
-	err := json.NewDecoder(r.Body).Decode(&files)
+	mode, err := mkt.ParseMode(r.URL.Query().Get("mode"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) == 3 {
-		root := pathParts[2]
-		// Delete the oldFiles if they exist
-		err = s.db.DeleteByPrefix(fileKey + root)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
-		// delete the old proof
-		err = s.db.DeleteByPrefix(proofKey + root)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
+	order, err := parseOrder(r.URL.Query().Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// TODO: This is not atomic, transform to atomic
-	hashes := make([]string, len(files))
-	for i, v := range files {
-		hash := sha256.Sum256(v)
-		hashStr := hex.EncodeToString(hash[:])
-		hashes[i] = hashStr
+	commit, err := parseCommitMeta(r.URL.Query().Get("commit_meta"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	m := mkt.NewMerkleTree(hashes)
-
-	for i, h := range hashes {
-		proof, err := m.GetProof(h)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
-		proofByte, err := json.Marshal(proof)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
+	hashes, files, err := s.readFiles(r, mode, commit)
+	if err != nil {
+		s.uploadError(w, err)
+		return
+	}
 
-		err = s.db.Put(proofKey+m.Root.Hash+h, proofByte)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
-		err = s.db.Put(m.Root.Hash+strconv.Itoa(i), []byte(h))
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
-		err = s.db.Put(fileKey+m.Root.Hash+h, files[i])
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
-		}
+	result, err := s.storeUpload(s.newOwnedBatch(principalOf(r)), "", r.URL.Query().Get("message"), mode, order, commit, hashes, files)
+	if err != nil {
+		s.commitError(w, err)
+		return
 	}
 
 	// TODO: improve the responses with a helper
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// storeUpload stores a new collection with the staged files, when the
+// replace root is given the new root is its next version with the message.
+// All the writes are committed at once with the ones already in the batch,
+// so a failure does not leave a partial tree
+func (s *Server) storeUpload(b *intentBatch, replace, message string, mode mkt.Mode, order string, commit bool, hashes []string, files map[string]stagedFile) (treeResult, error) {
+	uploaded := make([]string, len(hashes))
+	copy(uploaded, hashes)
+	if order == orderHash {
+		sort.Strings(hashes)
+	}
+
+	m, err := mkt.NewMerkleTreeWithMode(hashes, mode)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	err = s.putTree(b, m, commit, hashes, files)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	err = s.commitVersion(b, "upload", replace, m.Root.Hash, message)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	return newTreeResult(m.Root.Hash, hashes, uploaded), nil
 }
 
 func (s *Server) DownloadHandler(w http.ResponseWriter, r *http.Request) {
@@ -187,7 +373,7 @@ func (s *Server) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := s.db.Get(fileKey + root + string(hash))
+	file, err := s.getFile(root, string(hash))
 	if err != nil {
 		s.conf.Logger.Error(err.Error())
 		http.Error(w, errNotFound, http.StatusNotFound)
@@ -202,13 +388,33 @@ func (s *Server) DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mode, err := s.getMode(root)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	meta, commit, err := s.getLeafMeta(root, string(hash))
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
 	// TODO: create an entity
 	result := struct {
-		File  []byte     `json:"file"`
-		Proof *mkt.Proof `json:"proof"`
+		File       []byte        `json:"file"`
+		Proof      *mkt.Proof    `json:"proof"`
+		Mode       mkt.Mode      `json:"mode"`
+		Meta       *mkt.Metadata `json:"meta,omitempty"`
+		CommitMeta bool          `json:"commit_meta,omitempty"`
 	}{
-		File:  file,
-		Proof: mktProof,
+		File:       file,
+		Proof:      mktProof,
+		Mode:       mode,
+		Meta:       meta,
+		CommitMeta: commit,
 	}
 
 	// TODO: improve the responses with a helper
@@ -225,120 +431,219 @@ func (s *Server) UpdatedHandler(w http.ResponseWriter, r *http.Request) {
 
 	root := pathParts[2]
 
-	var files [][]byte
-	err := json.NewDecoder(r.Body).Decode(&files)
+	order, err := parseOrder(r.URL.Query().Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode, err := s.getMode(root)
 	if err != nil {
 		s.conf.Logger.Error(err.Error())
-		http.Error(w, errBadRequest, http.StatusBadRequest)
+		http.Error(w, errInternal, http.StatusInternalServerError)
 		return
 	}
 
-	oldFiles, err := s.db.GetByPrefix(fileKey + root)
+	commit, err := s.getCommitMeta(root)
 	if err != nil {
 		s.conf.Logger.Error(err.Error())
-		http.Error(w, errBadRequest, http.StatusBadRequest)
+		http.Error(w, errInternal, http.StatusInternalServerError)
 		return
 	}
 
-	for _, v := range files {
-		hash := sha256.Sum256(v)
-		hashStr := hex.EncodeToString(hash[:])
-		oldFiles[hashStr] = v
+	uploaded, files, err := s.readFiles(r, mode, commit)
+	if err != nil {
+		s.uploadError(w, err)
+		return
 	}
 
-	i := 0
-	hashes := make([]string, len(oldFiles))
-	newFiles := make([][]byte, len(oldFiles))
-	for _, v := range oldFiles {
-		hash := sha256.Sum256(v)
-		hashes[i] = hex.EncodeToString(hash[:])
-		newFiles[i] = v
-		i++
+	result, err := s.storeUpdate(s.newOwnedBatch(principalOf(r)), root, r.URL.Query().Get("message"), mode, order, commit, uploaded, files)
+	if err != nil {
+		s.commitError(w, err)
+		return
 	}
 
-	m := mkt.NewMerkleTree(hashes)
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	for i, h := range hashes {
-		proof, err := m.GetProof(h)
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+// storeUpdate adds the staged files to the collection of the root, the
+// uploaded hashes are in the upload order. The new root is the next version
+// of the collection with the message, the writes are committed with the ones
+// already in the batch
+func (s *Server) storeUpdate(b *intentBatch, root, message string, mode mkt.Mode, order string, commit bool, uploaded []string, files map[string]stagedFile) (treeResult, error) {
+	oldHashes, err := s.getLeaves(root)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	// The existent leaves keep their positions and the new files are
+	// appended in the upload order, a file already in the tree is not
+	// duplicated
+	positions := make(map[string]bool, len(oldHashes)+len(files))
+	hashes := make([]string, 0, len(oldHashes)+len(files))
+	for _, h := range oldHashes {
+		positions[h] = true
+		hashes = append(hashes, h)
+	}
+
+	for _, h := range uploaded {
+		if positions[h] {
+			continue
 		}
-		proofByte, err := json.Marshal(proof)
+		positions[h] = true
+		hashes = append(hashes, h)
+	}
+
+	if order == orderHash {
+		sort.Strings(hashes)
+	}
+
+	m, err := mkt.NewMerkleTreeWithMode(hashes, mode)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	err = s.replaceTree(b, root, oldHashes, m, commit, hashes, files)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	err = s.commitVersion(b, "update", root, m.Root.Hash, message)
+	if err != nil {
+		return treeResult{}, err
+	}
+
+	return newTreeResult(m.Root.Hash, hashes, uploaded), nil
+}
+
+// replaceTree adds to the batch the new tree of a collection, the old files
+// still in the tree are linked to the new root without being rewritten and
+// the new ones are taken from files. The old tree is kept by the history
+func (s *Server) replaceTree(b *intentBatch, root string, oldHashes []string, m *mkt.MerkleTree, commit bool, hashes []string, files map[string]stagedFile) error {
+	stored, err := s.storedTree(b, m.Root.Hash)
+	if stored || err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		kept[h] = true
+	}
+
+	for _, h := range oldHashes {
+		if !kept[h] {
+			continue
+		}
+		if _, ok := files[h]; ok {
+			continue
+		}
+		err := s.copyFile(b, root, m.Root.Hash, h)
 		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+			return err
 		}
+	}
+
+	return s.putTree(b, m, commit, hashes, files)
+}
+
+// putTree adds to the batch the mode, the index, the proofs and the files
+// of the tree, only the given files are written. Commit marks the leaves
+// that commit to the metadata
+func (s *Server) putTree(b *intentBatch, m *mkt.MerkleTree, commit bool, hashes []string, files map[string]stagedFile) error {
+	stored, err := s.storedTree(b, m.Root.Hash)
+	if stored || err != nil {
+		return err
+	}
+
+	b.Put(modeKey+m.Root.Hash, []byte(m.Mode))
+	if commit {
+		b.Put(commitMetaKey+m.Root.Hash, []byte("true"))
+	}
 
-		err = s.db.Put(proofKey+m.Root.Hash+h, proofByte)
+	for i, h := range hashes {
+		proof, err := m.GetProof(h)
 		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+			return err
 		}
-		err = s.db.Put(m.Root.Hash+strconv.Itoa(i), []byte(h))
+		proofByte, err := json.Marshal(proof)
 		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+			return err
 		}
-		err = s.db.Put(fileKey+m.Root.Hash+h, newFiles[i])
-		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+
+		b.Put(proofKey+m.Root.Hash+h, proofByte)
+		b.Put(m.Root.Hash+strconv.Itoa(i), []byte(h))
+		if f, ok := files[h]; ok {
+			f.put(b, m.Root.Hash, h)
 		}
 	}
+	return nil
+}
 
-	// Delete the oldFiles
-	err = s.db.DeleteByPrefix(fileKey + root)
+// deleteTree adds to the batch the deletion of the files, the proofs, the
+// mode and the index of a root
+func (s *Server) deleteTree(b db.Batch, root string, leaves int) error {
+	err := s.deleteFiles(b, root)
 	if err != nil {
-		s.conf.Logger.Error(err.Error())
-		http.Error(w, errInternal, http.StatusInternalServerError)
-		return
+		return err
 	}
-	// delete the old proof
-	err = s.db.DeleteByPrefix(proofKey + root)
+	err = s.deletePrefix(b, proofKey+root)
 	if err != nil {
-		s.conf.Logger.Error(err.Error())
-		http.Error(w, errInternal, http.StatusInternalServerError)
-		return
+		return err
+	}
+	b.Delete(modeKey + root)
+	b.Delete(commitMetaKey + root)
+	for i := 0; i < leaves; i++ {
+		b.Delete(root + strconv.Itoa(i))
 	}
+	return nil
+}
 
-	i = 0
-	// Delete old index
-	for range oldFiles {
-		err = s.db.Delete(root + strconv.Itoa(i))
+// getLeaves returns the leaves hashes of the root ordered by index
+func (s *Server) getLeaves(root string) ([]string, error) {
+	var leaves []string
+	for i := 0; ; i++ {
+		hash, err := s.db.Get(root + strconv.Itoa(i))
+		if errors.Is(err, db.ErrNotFound) {
+			return leaves, nil
+		}
 		if err != nil {
-			s.conf.Logger.Error(err.Error())
-			http.Error(w, errInternal, http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		i++
+		leaves = append(leaves, string(hash))
 	}
+}
 
-	// TODO: create an entity
-	result := struct {
-		RootHash string `json:"root_hash"`
-	}{
-		RootHash: m.Root.Hash,
+// getMode returns the tree mode of the given root, the roots created
+// before the modes were introduced use the default one
+func (s *Server) getMode(root string) (mkt.Mode, error) {
+	mode, err := s.db.Get(modeKey + root)
+	if errors.Is(err, db.ErrNotFound) {
+		return mkt.SHA256, nil
 	}
-
-	// TODO: improve the responses with a helper
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return "", err
+	}
+	return mkt.ParseMode(string(mode))
 }
 
-func (s *Server) routes() *http.ServeMux {
-	// TODO: create an OAS if I have time
+// routes returns the handlers of the endpoints behind the authentication,
+// with the tenants the endpoints of the data are served by the server of the
+// tenant of each request. The bodies of all the requests are limited and the
+// errors of the versioned api are sent as JSON, the OpenAPI document is
+// public
+func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
+	register(mux, s.adminRoutes())
+	if !s.conf.Tenants {
+		register(mux, s.dataRoutes())
+	} else {
+		mux.HandleFunc("/", s.serveTenant)
+	}
 
-	// uploads creates a new merkle tree
-	mux.HandleFunc("/upload", s.UploadHandler)
-	// uploads creates a new merkle tree but uses the existent one
-	mux.HandleFunc("/update/", s.UpdatedHandler)
-	mux.HandleFunc("/download/", s.DownloadHandler)
-	return mux
+	public := http.NewServeMux()
+	public.HandleFunc("GET /openapi.json", OpenAPIHandler)
+	public.Handle("/", s.authenticate(mux))
+	return s.limitBody(jsonErrors(public))
 }
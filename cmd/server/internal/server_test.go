@@ -2,12 +2,18 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/jmsilvadev/zc/pkg/db"
 	"github.com/jmsilvadev/zc/pkg/mkt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -17,6 +23,49 @@ import (
 type MockDatabase struct {
 	mock.Mock
 	data map[string][]byte
+	// writeErr makes Write fail without applying the batch
+	writeErr error
+}
+
+// mockBatch records the writes and applies them with Put and Delete
+type mockBatch struct {
+	ops []func(m *MockDatabase)
+}
+
+func (b *mockBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, func(m *MockDatabase) { m.Put(key, value) })
+}
+
+func (b *mockBatch) Delete(key string) {
+	b.ops = append(b.ops, func(m *MockDatabase) { m.Delete(key) })
+}
+
+func (b *mockBatch) Len() int {
+	return len(b.ops)
+}
+
+func (m *MockDatabase) NewBatch() db.Batch {
+	return &mockBatch{}
+}
+
+func (m *MockDatabase) Write(b db.Batch) error {
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	for _, op := range b.(*mockBatch).ops {
+		op(m)
+	}
+	return nil
+}
+
+func (m *MockDatabase) KeysByPrefix(prefix string) ([]string, error) {
+	var keys []string
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
 }
 
 func (m *MockDatabase) Put(key string, value []byte) error {
@@ -30,7 +79,10 @@ func (m *MockDatabase) Get(key string) ([]byte, error) {
 	if value, ok := m.data[key]; ok {
 		return value, args.Error(1)
 	}
-	return nil, args.Error(1)
+	if args.Error(1) != nil {
+		return nil, args.Error(1)
+	}
+	return nil, db.ErrNotFound
 }
 
 func (m *MockDatabase) GetByPrefix(prefix string) (map[string][]byte, error) {
@@ -65,6 +117,18 @@ func (m *MockDatabase) Close() error {
 	return nil
 }
 
+// isCommitKey matches the keys read by the commits to find the stored
+// roots, to count the refs and to record the versions and the usage
+func isCommitKey(key string) bool {
+	for _, p := range []string{dirKey, refKey, refCountKey, collectionOfKey, historyKey, versionsKey, usageKey} {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	// The first leaf of a flat root
+	return len(key) == 65 && strings.HasSuffix(key, "0")
+}
+
 func TestUploadHandler(t *testing.T) {
 	c := config.GetDefaultConfig()
 	conf := &config.Config{
@@ -81,23 +145,135 @@ func TestUploadHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	mockDB.On("Get", mock.MatchedBy(isCommitKey)).Return(nil, nil)
 
 	server.UploadHandler(w, req)
 
 	resp := w.Result()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-	req = httptest.NewRequest(http.MethodPost, "/upload/root", bytes.NewBuffer(filesJSON))
+	// An upload without files has no tree
+	for _, body := range []string{"[]", "null"} {
+		req = httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString(body))
+		w = httptest.NewRecorder()
+		server.UploadHandler(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, body)
+	}
+
+	// The collections are replaced by the upload sessions with a root
+	req = httptest.NewRequest(http.MethodPost, "/upload/"+unknownRoot, bytes.NewBuffer(filesJSON))
 	w = httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestUploadHandlerWithMode(t *testing.T) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort: ":5005",
+		Logger:     c.Logger,
+	}
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	server := NewServer(conf, mockDB)
+
+	files := [][]byte{[]byte("file1"), []byte("file2"), []byte("file3")}
+	filesJSON, _ := json.Marshal(files)
 
 	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
-	mockDB.On("DeleteByPrefix", fileKey+"root").Return(nil)
-	mockDB.On("DeleteByPrefix", proofKey+"root").Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	mockDB.On("Get", mock.MatchedBy(isCommitKey)).Return(nil, nil)
 
+	req := httptest.NewRequest(http.MethodPost, "/upload?mode="+string(mkt.Keccak256Sorted), bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
 	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
 
-	resp = w.Result()
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = mkt.Keccak256Sorted.HashLeaf(f)
+	}
+	m, err := mkt.NewMerkleTreeWithMode(hashes, mkt.Keccak256Sorted)
+	assert.NoError(t, err)
+	root := m.Root.Hash
+	assert.Equal(t, []byte(mkt.Keccak256Sorted), mockDB.data[modeKey+root])
+
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+
+	req = httptest.NewRequest(http.MethodGet, "/download/"+root+"/2", nil)
+	w = httptest.NewRecorder()
+	server.DownloadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var result struct {
+		File  []byte     `json:"file"`
+		Proof *mkt.Proof `json:"proof"`
+		Mode  mkt.Mode   `json:"mode"`
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, mkt.Keccak256Sorted, result.Mode)
+	assert.True(t, mkt.VerifyProofWithMode(hashes[2], root, result.Proof, mkt.Keccak256Sorted))
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?mode=md5", bytes.NewBuffer(filesJSON))
+	w = httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort: ":5005",
+		Logger:     c.Logger,
+	}
+	keyring, err := db.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	assert.NoError(t, err)
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+	mockDB.On("GetByPrefix", mock.Anything).Return(nil, nil)
+	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	server := NewServer(conf, db.NewEncrypted(mockDB, keyring))
+
+	files := [][]byte{[]byte("secret file1"), []byte("secret file2"), []byte("secret file3")}
+	filesJSON, _ := json.Marshal(files)
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Nothing of the files is stored in plaintext
+	for k, v := range mockDB.data {
+		assert.NotContains(t, string(v), "secret", k)
+	}
+
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = mkt.SHA256.HashLeaf(f)
+	}
+	root := mkt.NewMerkleTree(hashes).Root.Hash
+
+	req = httptest.NewRequest(http.MethodGet, "/download/"+root+"/1", nil)
+	w = httptest.NewRecorder()
+	server.DownloadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var result struct {
+		File  []byte     `json:"file"`
+		Proof *mkt.Proof `json:"proof"`
+	}
+	err = json.NewDecoder(w.Result().Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, files[1], result.File)
+	assert.True(t, mkt.VerifyProof(hashes[1], root, result.Proof))
+
+	// The re-encryption finds the encryption under the compression
+	encrypted, ok := encryptedOf(db.NewCompressed(server.db, db.Snappy))
+	assert.True(t, ok)
+	assert.Same(t, server.db, encrypted)
+	_, ok = encryptedOf(mockDB)
+	assert.False(t, ok)
 }
 
 func TestDownloadHandler(t *testing.T) {
@@ -115,7 +291,8 @@ func TestDownloadHandler(t *testing.T) {
 	proof := &mkt.Proof{}
 	proofJSON, _ := json.Marshal(proof)
 
-	mockDB.data[fileKey+root+hash] = file
+	mockDB.data[refKey+root+hash] = []byte(blobID(file))
+	mockDB.data[blobKey+blobID(file)] = file
 	mockDB.data[proofKey+root+hash] = proofJSON
 	mockDB.data[root+"0"] = []byte(hash)
 
@@ -124,7 +301,12 @@ func TestDownloadHandler(t *testing.T) {
 
 	mockDB.On("Get", root+"0").Return([]byte(hash), nil)
 	mockDB.On("Get", proofKey+root+hash).Return(proofJSON, nil)
-	mockDB.On("Get", fileKey+root+hash).Return(file, nil)
+	mockDB.On("Get", refKey+root+hash).Return([]byte(blobID(file)), nil)
+	mockDB.On("Get", blobManifestKey+blobID(file)).Return(nil, db.ErrNotFound)
+	mockDB.On("Get", blobKey+blobID(file)).Return(file, nil)
+	mockDB.On("Get", modeKey+root).Return(nil, db.ErrNotFound)
+	mockDB.On("Get", metaKey+root+hash).Return(nil, db.ErrNotFound)
+	mockDB.On("Get", commitMetaKey+root).Return(nil, db.ErrNotFound)
 
 	server.DownloadHandler(w, req)
 
@@ -166,10 +348,9 @@ func TestUpdatedHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/update/"+root, bytes.NewBuffer(filesJSON))
 	w := httptest.NewRecorder()
 
-	mockDB.On("GetByPrefix", fileKey+root).Return(map[string][]byte{}, nil)
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
 	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
 	mockDB.On("Delete", mock.Anything).Return(nil)
-	mockDB.On("DeleteByPrefix", fileKey+root).Return(nil)
 	mockDB.On("DeleteByPrefix", proofKey+root).Return(nil)
 
 	server.UpdatedHandler(w, req)
@@ -185,6 +366,130 @@ func TestUpdatedHandler(t *testing.T) {
 	assert.NotEmpty(t, result.RootHash)
 }
 
+func TestUpdatedHandlerKeepsPositions(t *testing.T) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort: ":5005",
+		Logger:     c.Logger,
+	}
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	server := NewServer(conf, mockDB)
+
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+	mockDB.On("GetByPrefix", mock.Anything).Return(nil, nil)
+	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	mockDB.On("DeleteByPrefix", mock.Anything).Return(nil)
+
+	upload := func(url string, files ...string) treeResult {
+		data := make([][]byte, len(files))
+		for i, f := range files {
+			data[i] = []byte(f)
+		}
+		filesJSON, _ := json.Marshal(data)
+
+		req := httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(filesJSON))
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(url, "/update/") {
+			server.UpdatedHandler(w, req)
+		} else {
+			server.UploadHandler(w, req)
+		}
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var result treeResult
+		err := json.NewDecoder(w.Result().Body).Decode(&result)
+		assert.NoError(t, err)
+		return result
+	}
+
+	hash := func(f string) string {
+		return mkt.SHA256.HashLeaf([]byte(f))
+	}
+
+	first := upload("/upload", "c", "a", "b")
+	assert.Equal(t, []string{hash("c"), hash("a"), hash("b")}, first.Leaves)
+	assert.Equal(t, []int{0, 1, 2}, first.Indexes)
+
+	// The existent files keep their indexes many times in a row
+	second := upload("/update/"+first.RootHash, "e", "a", "d")
+	assert.Equal(t, []string{hash("c"), hash("a"), hash("b"), hash("e"), hash("d")}, second.Leaves)
+	assert.Equal(t, []int{3, 1, 4}, second.Indexes)
+
+	for i, h := range second.Leaves {
+		assert.Equal(t, []byte(h), mockDB.data[second.RootHash+strconv.Itoa(i)])
+	}
+	// The previous version is kept
+	assert.Equal(t, []byte(hash("c")), mockDB.data[first.RootHash+"0"])
+	assert.Equal(t, []byte(blobID([]byte("a"))), mockDB.data[refKey+first.RootHash+hash("a")])
+
+	// Sending only existent files does not change the root
+	third := upload("/update/"+second.RootHash, "a")
+	assert.Equal(t, second.RootHash, third.RootHash)
+	assert.Equal(t, []int{1}, third.Indexes)
+	assert.Equal(t, []byte(blobID([]byte("a"))), mockDB.data[refKey+second.RootHash+hash("a")])
+	assert.Equal(t, []byte("a"), mockDB.data[blobKey+blobID([]byte("a"))])
+
+	sorted := upload("/update/"+third.RootHash+"?order=hash", "f")
+	assert.True(t, sort.StringsAreSorted(sorted.Leaves))
+	assert.Len(t, sorted.Leaves, 6)
+
+	req := httptest.NewRequest(http.MethodPost, "/update/"+sorted.RootHash+"?order=name", bytes.NewBuffer([]byte("[]")))
+	w := httptest.NewRecorder()
+	server.UpdatedHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestUpdatedHandlerAtomic(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	filesJSON, _ := json.Marshal([][]byte{[]byte("file1"), []byte("file2")})
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var first treeResult
+	json.NewDecoder(w.Result().Body).Decode(&first)
+
+	before := make(map[string][]byte, len(mockDB.data))
+	for k, v := range mockDB.data {
+		before[k] = v
+	}
+
+	// A failed commit does not leave the old tree half deleted nor the new
+	// one half written
+	mockDB.writeErr = errors.New("write failed")
+	filesJSON, _ = json.Marshal([][]byte{[]byte("file3")})
+	req = httptest.NewRequest(http.MethodPost, "/update/"+first.RootHash, bytes.NewBuffer(filesJSON))
+	w = httptest.NewRecorder()
+	server.UpdatedHandler(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+
+	// The chunks and the contents of the new blobs are left without refs
+	// for the garbage collection
+	isContent := func(k string) bool {
+		return strings.HasPrefix(k, chunkKey) || strings.HasPrefix(k, blobKey) || strings.HasPrefix(k, blobManifestKey)
+	}
+	for k, v := range mockDB.data {
+		if isContent(k) {
+			continue
+		}
+		assert.Equal(t, before[k], v, k)
+	}
+	for k := range before {
+		if !isContent(k) {
+			assert.Contains(t, mockDB.data, k)
+		}
+	}
+
+	for i, h := range first.Leaves {
+		content, err := server.getFile(first.RootHash, h)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("file"+strconv.Itoa(i+1)), content)
+	}
+}
+
 func TestRoutes(t *testing.T) {
 	c := config.GetDefaultConfig()
 	conf := &config.Config{
@@ -0,0 +1,606 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// sessionKey stores the resumable upload sessions by id
+	sessionKey = "session_"
+	// sessionPartKey stores the data received by the sessions, the parts
+	// of a file are ordered by their offset
+	sessionPartKey = "sessionpart_"
+	// maxSessionPart is the maximum size of the data of a PUT
+	maxSessionPart = 16 << 20
+
+	// defaultSessionExpiry is used when the expiry is not configured
+	defaultSessionExpiry = 24 * time.Hour
+
+	sessionUpload = "upload"
+	sessionUpdate = "update"
+)
+
+var (
+	// errSessionNotFound is returned for unknown or expired sessions
+	errSessionNotFound = errors.New("session not found")
+	// errSessionFinalizing is returned for the changes of a session while
+	// it is finalized
+	errSessionFinalizing = errors.New("the session is being finalized")
+
+	// sessionIndexPattern matches the index of a file of a session, only
+	// digits so the signs and the spaces are rejected
+	sessionIndexPattern = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+// sessionFile is the progress of a file of a session
+type sessionFile struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+}
+
+// session is a resumable upload, the files are sent in parts at increasing
+// offsets and the tree is built when the session is finalized. For an
+// upload the root is the collection replaced, for an update the collection
+// updated, the message is kept in the history of the collection
+type session struct {
+	ID         string         `json:"id"`
+	Op         string         `json:"op"`
+	Root       string         `json:"root,omitempty"`
+	Mode       mkt.Mode       `json:"mode"`
+	Order      string         `json:"order"`
+	CommitMeta bool           `json:"commit_meta,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Files      []sessionFile  `json:"files"`
+	Meta       []mkt.Metadata `json:"meta,omitempty"`
+	Expires    time.Time      `json:"expires"`
+	// Owner is the principal that created the session, the collection it
+	// creates is owned by it
+	Owner string `json:"owner,omitempty"`
+}
+
+// sessionRequest creates a session with the sizes of the files to send and
+// optionally their metadata
+type sessionRequest struct {
+	Op         string         `json:"op"`
+	Root       string         `json:"root"`
+	Mode       string         `json:"mode"`
+	Order      string         `json:"order"`
+	CommitMeta bool           `json:"commit_meta"`
+	Message    string         `json:"message"`
+	Sizes      []int64        `json:"sizes"`
+	Meta       []mkt.Metadata `json:"meta"`
+}
+
+// SessionCreateHandler creates a resumable upload session
+func (s *Server) SessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req sessionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	p := principalOf(r)
+	if req.Root != "" && (!s.checkRoot(w, req.Root) || !s.allow(w, p, req.Root, accessWrite)) {
+		return
+	}
+
+	sess := session{Op: req.Op, Root: req.Root, CommitMeta: req.CommitMeta, Message: req.Message}
+	if p != nil {
+		sess.Owner = p.ID
+	}
+	sess.Order, err = parseOrder(req.Order)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Op {
+	case sessionUpload:
+		sess.Mode, err = mkt.ParseMode(req.Mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case sessionUpdate:
+		if req.Root == "" {
+			http.Error(w, "the root of the update is required", http.StatusBadRequest)
+			return
+		}
+		sess.Mode, err = s.getMode(req.Root)
+		if err == nil {
+			// The update keeps the leaves of the collection
+			sess.CommitMeta, err = s.getCommitMeta(req.Root)
+		}
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("invalid op %s, valid values: %s, %s", req.Op, sessionUpload, sessionUpdate), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Sizes) == 0 {
+		http.Error(w, "invalid files", http.StatusBadRequest)
+		return
+	}
+	sess.Files = make([]sessionFile, len(req.Sizes))
+	for i, size := range req.Sizes {
+		if size < 0 {
+			http.Error(w, "invalid files", http.StatusBadRequest)
+			return
+		}
+		sess.Files[i].Size = size
+	}
+
+	// The session reserves the sizes of its files in the quota, its parts
+	// are stored before the commit checks it
+	budget, err := s.stagingBudget()
+	for _, size := range req.Sizes {
+		if err == nil {
+			err = budget.take(size)
+		}
+	}
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	if len(req.Meta) != 0 && len(req.Meta) != len(req.Sizes) {
+		http.Error(w, "the metadata must have an entry per file", http.StatusBadRequest)
+		return
+	}
+	for i, meta := range req.Meta {
+		err = meta.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Meta[i].Size = req.Sizes[i]
+	}
+	sess.Meta = req.Meta
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	sess.ID = hex.EncodeToString(id)
+	sess.Expires = time.Now().Add(s.sessionExpiry())
+
+	// The expired sessions are removed while the new ones are created
+	err = s.deleteExpiredSessions()
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+	}
+
+	data, err := json.Marshal(sess)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	err = s.db.Put(sessionKey+sess.ID, data)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sess)
+}
+
+// SessionHandler handles a session: GET /sessions/id returns its progress,
+// PUT /sessions/id/index?offset=n adds data to a file, POST
+// /sessions/id/finalize builds the tree and DELETE /sessions/id cancels it
+func (s *Server) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 3 || pathParts[2] == "" {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+	id := pathParts[2]
+	if !sessionIDPattern.MatchString(id) {
+		s.sessionError(w, errSessionNotFound)
+		return
+	}
+	if !s.sessionAllowed(w, r, id) {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(pathParts) == 3:
+		s.sessionStatus(w, id)
+	case r.Method == http.MethodPut && len(pathParts) == 4:
+		if !sessionIndexPattern.MatchString(pathParts[3]) {
+			http.Error(w, errBadRequest, http.StatusBadRequest)
+			return
+		}
+		index, _ := strconv.Atoi(pathParts[3])
+		s.sessionPut(w, r, id, index)
+	case r.Method == http.MethodPost && len(pathParts) == 4 && pathParts[3] == "finalize":
+		s.sessionFinalize(w, r, id)
+	case r.Method == http.MethodDelete && len(pathParts) == 3:
+		s.sessionCancel(w, id)
+	default:
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+	}
+}
+
+// sessionAllowed reports if the principal of the request can use the
+// session, the sessions of the others are not found and the changes of a
+// collection need write access to it until the session is finalized
+func (s *Server) sessionAllowed(w http.ResponseWriter, r *http.Request, id string) bool {
+	p := principalOf(r)
+	if p == nil || p.Admin {
+		return true
+	}
+
+	sess, err := s.getSession(id)
+	if err != nil {
+		s.sessionError(w, err)
+		return false
+	}
+	if sess.Owner != p.ID {
+		s.sessionError(w, errSessionNotFound)
+		return false
+	}
+	if sess.Root != "" && r.Method != http.MethodGet {
+		return s.allow(w, p, sess.Root, accessWrite)
+	}
+	return true
+}
+
+func (s *Server) sessionStatus(w http.ResponseWriter, id string) {
+	sess, err := s.getSession(id)
+	if err != nil {
+		s.sessionError(w, err)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess)
+}
+
+// sessionPut stores the data of a file at the offset, the offset must be the
+// current one of the file so a part sent twice is rejected with a conflict
+// and the progress of the session
+func (s *Server) sessionPut(w http.ResponseWriter, r *http.Request, id string, index int) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSessionPart+1))
+	if err != nil {
+		// The connection dropped, the client resumes from the last offset
+		http.Error(w, errBadRequest, http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxSessionPart {
+		http.Error(w, fmt.Sprintf("the parts are limited to %d bytes", maxSessionPart), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+
+	sess, err := s.getSession(id)
+	if err == nil && s.finalizing[id] {
+		err = errSessionFinalizing
+	}
+	if err != nil {
+		s.sessionError(w, err)
+		return
+	}
+	if index >= len(sess.Files) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+
+	f := &sess.Files[index]
+	if offset != f.Offset {
+		// TODO: improve the responses with a helper
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(sess)
+		return
+	}
+	if offset+int64(len(data)) > f.Size {
+		http.Error(w, "the data exceeds the size of the file", http.StatusBadRequest)
+		return
+	}
+
+	f.Offset += int64(len(data))
+	sess.Expires = time.Now().Add(s.sessionExpiry())
+	sessData, err := json.Marshal(sess)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// The data is written before the new offset, a part written without
+	// its offset is written again by the retry of the same offset
+	if len(data) > 0 {
+		err = s.db.Put(sessionPartPrefix(id, index)+fmt.Sprintf("%020d", offset), data)
+	}
+	if err == nil {
+		err = s.db.Put(sessionKey+id, sessData)
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess)
+}
+
+// sessionFinalize stores the files of a complete session as an upload or an
+// update, the session is deleted in the same commit of the tree. The session
+// is marked until the commit ends, so it is committed only once and its
+// parts are not changed meanwhile
+func (s *Server) sessionFinalize(w http.ResponseWriter, r *http.Request, id string) {
+	sess, err := s.markFinalizing(id)
+	if err != nil {
+		s.sessionError(w, err)
+		return
+	}
+	defer s.unmarkFinalizing(id)
+
+	for i, f := range sess.Files {
+		if f.Offset != f.Size {
+			http.Error(w, fmt.Sprintf("the file %d is incomplete, %d of %d bytes received", i, f.Offset, f.Size), http.StatusConflict)
+			return
+		}
+	}
+
+	hashes := make([]string, len(sess.Files))
+	files := make(map[string]stagedFile, len(sess.Files))
+	for i := range sess.Files {
+		keys, err := s.sessionParts(id, i)
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+
+		h := sess.Mode.NewLeafHash()
+		f, err := s.stageStream(s.streamChunker(), io.TeeReader(&partsReader{db: s.db, keys: keys}, h))
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+		if len(sess.Meta) != 0 {
+			f = f.withMeta(sess.Meta[i])
+		}
+		hashes[i] = leafHash(sess.Mode, sess.CommitMeta, hex.EncodeToString(h.Sum(nil)), f.meta)
+		files[hashes[i]] = f
+	}
+
+	b := s.newOwnedBatch(principalOf(r))
+	b.owner = sess.Owner
+	err = s.deleteSession(b, id)
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	var result treeResult
+	if sess.Op == sessionUpdate {
+		result, err = s.storeUpdate(b, sess.Root, sess.Message, sess.Mode, sess.Order, sess.CommitMeta, hashes, files)
+	} else {
+		result, err = s.storeUpload(b, sess.Root, sess.Message, sess.Mode, sess.Order, sess.CommitMeta, hashes, files)
+	}
+	if err != nil {
+		s.commitError(w, err)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) sessionCancel(w http.ResponseWriter, id string) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+
+	_, err := s.getSession(id)
+	if err == nil && s.finalizing[id] {
+		err = errSessionFinalizing
+	}
+	if err != nil {
+		s.sessionError(w, err)
+		return
+	}
+
+	b := s.db.NewBatch()
+	err = s.deleteSession(b, id)
+	if err == nil {
+		err = s.db.Write(b)
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// markFinalizing returns the session and marks it as finalized, a session
+// already marked is not returned
+func (s *Server) markFinalizing(id string) (*session, error) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+
+	if s.finalizing[id] {
+		return nil, errSessionFinalizing
+	}
+	sess, err := s.getSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if s.finalizing == nil {
+		s.finalizing = make(map[string]bool)
+	}
+	s.finalizing[id] = true
+	return sess, nil
+}
+
+// unmarkFinalizing ends the finalization of the session, it was deleted by
+// the commit or it can be finalized again
+func (s *Server) unmarkFinalizing(id string) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	delete(s.finalizing, id)
+}
+
+// getSession returns a session that did not expire
+func (s *Server) getSession(id string) (*session, error) {
+	data, err := s.db.Get(sessionKey + id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sess session
+	err = json.Unmarshal(data, &sess)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(sess.Expires) {
+		return nil, errSessionNotFound
+	}
+	return &sess, nil
+}
+
+// sessionParts returns the keys of the parts of a file ordered by offset
+func (s *Server) sessionParts(id string, index int) ([]string, error) {
+	keys, err := s.db.KeysByPrefix(sessionPartPrefix(id, index))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// deleteSession adds to the batch the deletion of a session and its parts
+func (s *Server) deleteSession(b db.Batch, id string) error {
+	err := s.deletePrefix(b, sessionPartKey+id+"_")
+	if err != nil {
+		return err
+	}
+	b.Delete(sessionKey + id)
+	return nil
+}
+
+// deleteExpiredSessions deletes the sessions that expired with their parts
+func (s *Server) deleteExpiredSessions() error {
+	sessions, err := s.db.GetByPrefix(sessionKey)
+	if err != nil {
+		return err
+	}
+
+	b := s.db.NewBatch()
+	for k, data := range sessions {
+		var sess session
+		err := json.Unmarshal(data, &sess)
+		if err == nil && time.Now().Before(sess.Expires) {
+			continue
+		}
+		err = s.deleteSession(b, strings.TrimPrefix(k, sessionKey))
+		if err != nil {
+			return err
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.db.Write(b)
+}
+
+func (s *Server) sessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errSessionFinalizing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.conf.Logger.Error(err.Error())
+	http.Error(w, errInternal, http.StatusInternalServerError)
+}
+
+// sessionExpiry returns the time a session is kept without receiving data
+func (s *Server) sessionExpiry() time.Duration {
+	if s.conf.SessionExpiry <= 0 {
+		return defaultSessionExpiry
+	}
+	return s.conf.SessionExpiry
+}
+
+// sessionPartPrefix returns the prefix of the parts of a file of a session
+func sessionPartPrefix(id string, index int) string {
+	return fmt.Sprintf("%s%s_%06d_", sessionPartKey, id, index)
+}
+
+// partsReader reads the parts of a file loading one part at a time
+type partsReader struct {
+	db   db.Database
+	keys []string
+	buf  []byte
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.keys) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.db.Get(r.keys[0])
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+		r.keys = r.keys[1:]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionRequestDo(server *Server, method, url string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	server.routes().ServeHTTP(w, req)
+	return w
+}
+
+func createSession(t *testing.T, server *Server, req sessionRequest) session {
+	body, _ := json.Marshal(req)
+	w := sessionRequestDo(server, http.MethodPost, "/sessions", body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var sess session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	return sess
+}
+
+func putPart(server *Server, id string, index int, offset int64, data []byte) *httptest.ResponseRecorder {
+	url := "/sessions/" + id + "/" + strconv.Itoa(index) + "?offset=" + strconv.FormatInt(offset, 10)
+	return sessionRequestDo(server, http.MethodPut, url, data)
+}
+
+func TestResumableUpload(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	big := make([]byte, 20*1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := [][]byte{big, []byte("small file")}
+
+	sess := createSession(t, server, sessionRequest{
+		Op:    sessionUpload,
+		Sizes: []int64{int64(len(files[0])), int64(len(files[1]))},
+	})
+	assert.Equal(t, mkt.SHA256, sess.Mode)
+	assert.Equal(t, orderAppend, sess.Order)
+
+	w := putPart(server, sess.ID, 0, 0, big[:5000])
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// A part sent again after a dropped response is rejected with the
+	// progress of the session
+	w = putPart(server, sess.ID, 0, 0, big[:5000])
+	require.Equal(t, http.StatusConflict, w.Code)
+	var status session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, int64(5000), status.Files[0].Offset)
+
+	w = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = putPart(server, sess.ID, 0, 5000, big[5000:])
+	require.Equal(t, http.StatusOK, w.Code)
+	w = putPart(server, sess.ID, 1, 0, append(files[1], 'x'))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = putPart(server, sess.ID, 1, 0, files[1])
+	require.Equal(t, http.StatusOK, w.Code)
+	w = putPart(server, sess.ID, 2, 0, files[1])
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = sessionRequestDo(server, http.MethodGet, "/sessions/"+sess.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, []sessionFile{{Size: 20 * 1024, Offset: 20 * 1024}, {Size: 10, Offset: 10}}, status.Files)
+
+	w = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var first treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&first))
+
+	hashes := []string{mkt.SHA256.HashLeaf(files[0]), mkt.SHA256.HashLeaf(files[1])}
+	assert.Equal(t, mkt.NewMerkleTree(hashes).Root.Hash, first.RootHash)
+	for i, h := range hashes {
+		content, err := server.getFile(first.RootHash, h)
+		assert.NoError(t, err)
+		assert.Equal(t, files[i], content)
+	}
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionKey))
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionPartKey))
+
+	w = sessionRequestDo(server, http.MethodGet, "/sessions/"+sess.ID, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// An update session appends the files to the collection
+	sess = createSession(t, server, sessionRequest{Op: sessionUpdate, Root: first.RootHash, Sizes: []int64{3}})
+	w = putPart(server, sess.ID, 0, 0, []byte("new"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var second treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&second))
+	assert.Equal(t, []int{2}, second.Indexes)
+	assert.Equal(t, append(hashes, mkt.SHA256.HashLeaf([]byte("new"))), second.Leaves)
+}
+
+func TestSessionExpiryAndCancel(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	server.conf.SessionExpiry = time.Hour
+
+	sess := createSession(t, server, sessionRequest{Op: sessionUpload, Sizes: []int64{10}})
+	w := putPart(server, sess.ID, 0, 0, []byte("12345"))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, countKeys(mockDB.data, sessionPartKey))
+
+	// The session expires without writes
+	expired, err := server.getSession(sess.ID)
+	require.NoError(t, err)
+	expired.Expires = time.Now().Add(-time.Minute)
+	data, _ := json.Marshal(expired)
+	mockDB.data[sessionKey+sess.ID] = data
+
+	w = sessionRequestDo(server, http.MethodGet, "/sessions/"+sess.ID, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = putPart(server, sess.ID, 0, 5, []byte("67890"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	require.NoError(t, server.deleteExpiredSessions())
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionKey))
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionPartKey))
+
+	sess = createSession(t, server, sessionRequest{Op: sessionUpload, Sizes: []int64{10}})
+	w = putPart(server, sess.ID, 0, 0, []byte("12345"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = sessionRequestDo(server, http.MethodDelete, "/sessions/"+sess.ID, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionKey))
+	assert.Equal(t, 0, countKeys(mockDB.data, sessionPartKey))
+}
+
+func TestSessionFinalizeOnce(t *testing.T) {
+	ldb, err := leveldb.New(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { ldb.Close() })
+	server := NewServer(newFaultConfig(), ldb)
+
+	sess := createSession(t, server, sessionRequest{Op: sessionUpload, Sizes: []int64{10}})
+	for _, index := range []string{"+0", "-0", "%200", "0x0"} {
+		w := sessionRequestDo(server, http.MethodPut, "/sessions/"+sess.ID+"/"+index+"?offset=0", []byte("0123456789"))
+		assert.Equal(t, http.StatusBadRequest, w.Code, index)
+	}
+	w := putPart(server, sess.ID, 0, 0, []byte("0123456789"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// While a session is finalized it can not be changed or finalized again
+	_, err = server.markFinalizing(sess.ID)
+	require.NoError(t, err)
+	w = putPart(server, sess.ID, 0, 10, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = sessionRequestDo(server, http.MethodDelete, "/sessions/"+sess.ID, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	server.unmarkFinalizing(sess.ID)
+
+	// Only one of the concurrent finalizations commits the session
+	responses := make([]*httptest.ResponseRecorder, 8)
+	wg := sync.WaitGroup{}
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = sessionRequestDo(server, http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil)
+		}()
+	}
+	wg.Wait()
+
+	var results []treeResult
+	for _, w := range responses {
+		if w.Code != http.StatusOK {
+			assert.Contains(t, []int{http.StatusConflict, http.StatusNotFound}, w.Code)
+			continue
+		}
+		var result treeResult
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+		results = append(results, result)
+	}
+	require.Len(t, results, 1)
+	requireOneRoot(t, server, results[0].RootHash, [][]byte{[]byte("0123456789")})
+	_, versions, err := server.getHistory(results[0].RootHash)
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestSessionCreateInvalid(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	for _, req := range []sessionRequest{
+		{Op: "delete", Sizes: []int64{1}},
+		{Op: sessionUpdate, Sizes: []int64{1}},
+		{Op: sessionUpload},
+		{Op: sessionUpload, Sizes: []int64{-1}},
+		{Op: sessionUpload, Mode: "md5", Sizes: []int64{1}},
+		{Op: sessionUpload, Order: "name", Sizes: []int64{1}},
+	} {
+		body, _ := json.Marshal(req)
+		w := sessionRequestDo(server, http.MethodPost, "/sessions", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, req)
+	}
+
+	w := sessionRequestDo(server, http.MethodGet, "/sessions", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jmsilvadev/zc/pkg/cdc"
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// chunkKey stores the content defined chunks by their sha256, the
+	// chunks are shared between files, versions and collections so they
+	// are not deleted with the collections
+	chunkKey = "chunk_"
+	// manifestKey stored the list of chunks of a file of a root before the
+	// blobs, the manifests are moved to the blobs on start
+	manifestKey = "manifest_"
+)
+
+// manifest is a file stored in chunks, the root is the Merkle root of the
+// chunk tree so the file links to its chunks as the collection to its files
+type manifest struct {
+	Size   int      `json:"size"`
+	Root   string   `json:"root"`
+	Chunks []string `json:"chunks"`
+	// Sizes has the size of each chunk to seek without reading the chunks,
+	// the manifests created before it have only the chunks
+	Sizes []int `json:"sizes,omitempty"`
+}
+
+// stagedFile is a file ready to be linked to a root, its chunks are already
+// stored and only its manifest is kept, or its content when the chunking is
+// disabled. The id is the sha256 of the content, the blob of the file. The
+// size of the metadata is the one of the staged content
+type stagedFile struct {
+	content  []byte
+	manifest []byte
+	id       string
+	meta     mkt.Metadata
+}
+
+// withMeta returns the staged file with the given metadata, the size is kept
+func (f stagedFile) withMeta(meta mkt.Metadata) stagedFile {
+	meta.Size = f.meta.Size
+	f.meta = meta
+	return f
+}
+
+// size returns the size of the content of the staged file
+func (f stagedFile) size() (int64, error) {
+	if f.manifest == nil {
+		return int64(len(f.content)), nil
+	}
+	var m manifest
+	err := json.Unmarshal(f.manifest, &m)
+	if err != nil {
+		return 0, err
+	}
+	return int64(m.Size), nil
+}
+
+// stageFile stores the chunks of a file when the chunking is enabled
+func (s *Server) stageFile(content []byte) (stagedFile, error) {
+	if s.chunker == nil {
+		return stagedFile{content: content, id: blobID(content), meta: mkt.Metadata{Size: int64(len(content))}}, nil
+	}
+	return s.stageStream(s.chunker, bytes.NewReader(content))
+}
+
+// stageStream stores the chunks of a file as they are read, so the file is
+// never fully in memory. The chunks are written directly and not in the
+// batch to keep the batches small, they are immutable and only reachable by
+// the manifests in the batch, so a failed batch just leaves unreferenced
+// chunks
+func (s *Server) stageStream(c *cdc.Chunker, r io.Reader) (stagedFile, error) {
+	var m manifest
+	content := sha256.New()
+	chunks := c.NewReader(r)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stagedFile{}, err
+		}
+
+		content.Write(chunk)
+		sum := sha256.Sum256(chunk)
+		h := hex.EncodeToString(sum[:])
+		m.Chunks = append(m.Chunks, h)
+		m.Sizes = append(m.Sizes, len(chunk))
+		m.Size += len(chunk)
+
+		err = s.putChunk(h, chunk)
+		if err != nil {
+			return stagedFile{}, err
+		}
+	}
+	m.Root = chunksRoot(m.Chunks)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return stagedFile{}, err
+	}
+	return stagedFile{manifest: data, id: hex.EncodeToString(content.Sum(nil)), meta: mkt.Metadata{Size: int64(m.Size)}}, nil
+}
+
+// put adds the file of a root and its metadata to the batch
+func (f stagedFile) put(b *intentBatch, root, hash string) {
+	// NOTE: a Metadata always marshals
+	meta, _ := json.Marshal(f.meta)
+	b.Put(metaKey+root+hash, meta)
+	b.putRef(root, hash, f)
+}
+
+// putChunk stores a chunk if it is not stored yet
+func (s *Server) putChunk(hash string, chunk []byte) error {
+	// NOTE: the chunk is recorded before it is checked so a running
+	// collection does not delete it after the check
+	s.gc.useChunk(hash)
+	_, err := s.db.Get(chunkKey + hash)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	return s.db.Put(chunkKey+hash, chunk)
+}
+
+// putFile adds the content of a file of a root to the batch without its
+// metadata, the content is split in chunks when the chunking is enabled and
+// only the new chunks and blobs are written
+func (s *Server) putFile(b *intentBatch, root, hash string, content []byte) error {
+	f, err := s.stageFile(content)
+	if err != nil {
+		return err
+	}
+	b.putRef(root, hash, f)
+	return nil
+}
+
+// getFile returns the content of a file of a root, the chunked files are
+// rebuilt and checked against their manifest
+func (s *Server) getFile(root, hash string) ([]byte, error) {
+	r, size, err := s.openFile(root, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, size)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// openFile returns a reader of the content of a file of a root and its
+// size, the chunks are read and checked only when they are reached
+func (s *Server) openFile(root, hash string) (io.ReadSeeker, int64, error) {
+	id, err := s.getRef(root, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.openBlob(id)
+}
+
+// chunkedFile reads a chunked file loading one chunk at a time
+type chunkedFile struct {
+	s      *Server
+	hash   string
+	chunks []string
+	// offsets has the start of each chunk and the size of the file
+	offsets []int64
+	pos     int64
+	cur     int
+	data    []byte
+}
+
+func (f *chunkedFile) Read(p []byte) (int, error) {
+	size := f.offsets[len(f.chunks)]
+	if f.pos >= size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(f.chunks), func(i int) bool { return f.offsets[i+1] > f.pos })
+	if i != f.cur {
+		chunk, err := f.getChunk(f.chunks[i])
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(chunk)) != f.offsets[i+1]-f.offsets[i] {
+			return 0, fmt.Errorf("invalid size of the chunk %s of the file %s", f.chunks[i], f.hash)
+		}
+		f.cur, f.data = i, chunk
+	}
+
+	n := copy(p, f.data[f.pos-f.offsets[i]:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *chunkedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.offsets[len(f.chunks)]
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// getChunk returns a chunk checked against its hash
+func (f *chunkedFile) getChunk(h string) ([]byte, error) {
+	chunk, err := f.s.db.Get(chunkKey + h)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != h {
+		return nil, fmt.Errorf("corrupted chunk %s of the file %s", h, f.hash)
+	}
+	return chunk, nil
+}
+
+// copyFile adds to the batch the link of a file of a root to another one
+// with its metadata, only the ref to the blob is copied
+func (s *Server) copyFile(b *intentBatch, from, to, hash string) error {
+	if from == to {
+		return nil
+	}
+
+	meta, err := s.db.Get(metaKey + from + hash)
+	if err == nil {
+		b.Put(metaKey+to+hash, meta)
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	id, err := s.getRef(from, hash)
+	if err != nil {
+		return err
+	}
+	b.Put(refKey+to+hash, []byte(id))
+	return nil
+}
+
+// deleteFiles adds to the batch the deletion of the refs of a root and the
+// metadata of its files, the blobs are deleted by commit with their last ref
+func (s *Server) deleteFiles(b db.Batch, root string) error {
+	for _, prefix := range []string{refKey, metaKey} {
+		err := s.deletePrefix(b, prefix+root)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix adds to the batch the deletion of the keys with the prefix
+func (s *Server) deletePrefix(b db.Batch, prefix string) error {
+	keys, err := s.db.KeysByPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		b.Delete(k)
+	}
+	return nil
+}
+
+// chunksRoot returns the root of the chunk tree of a file
+func chunksRoot(chunks []string) string {
+	if len(chunks) == 0 {
+		return ""
+	}
+	return mkt.NewMerkleTree(chunks).Root.Hash
+}
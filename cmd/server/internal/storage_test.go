@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newChunkingServer() (*Server, *MockDatabase) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort:   ":5005",
+		Logger:       c.Logger,
+		Chunking:     true,
+		ChunkMinSize: 256,
+		ChunkAvgSize: 1024,
+		ChunkMaxSize: 4096,
+	}
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+	mockDB.On("GetByPrefix", mock.Anything).Return(nil, nil)
+	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	mockDB.On("DeleteByPrefix", mock.Anything).Return(nil)
+
+	return NewServer(conf, mockDB), mockDB
+}
+
+func countKeys(data map[string][]byte, prefix string) int {
+	count := 0
+	for k := range data {
+		if strings.HasPrefix(k, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestChunkedStorage(t *testing.T) {
+	server, mockDB := newChunkingServer()
+
+	image := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(image)
+	// a new version of the image with a few changed bytes in the middle
+	newImage := append([]byte{}, image...)
+	copy(newImage[32*1024:], []byte("a few changed bytes"))
+
+	filesJSON, _ := json.Marshal([][]byte{image})
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var first treeResult
+	json.NewDecoder(w.Result().Body).Decode(&first)
+	chunks := countKeys(mockDB.data, chunkKey)
+	assert.Greater(t, chunks, 1)
+	assert.Equal(t, 0, countKeys(mockDB.data, blobKey))
+	assert.Equal(t, 1, countKeys(mockDB.data, blobManifestKey))
+
+	filesJSON, _ = json.Marshal([][]byte{newImage})
+	req = httptest.NewRequest(http.MethodPost, "/update/"+first.RootHash, bytes.NewBuffer(filesJSON))
+	w = httptest.NewRecorder()
+	server.UpdatedHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var second treeResult
+	json.NewDecoder(w.Result().Body).Decode(&second)
+
+	// Only the chunks around the change are new
+	assert.LessOrEqual(t, countKeys(mockDB.data, chunkKey), chunks+3)
+
+	for i, expected := range [][]byte{image, newImage} {
+		content, err := server.getFile(second.RootHash, second.Leaves[i])
+		assert.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+
+	// Corrupted chunks are detected
+	for k := range mockDB.data {
+		if strings.HasPrefix(k, chunkKey) {
+			mockDB.data[k] = []byte("corrupted")
+		}
+	}
+	_, err := server.getFile(second.RootHash, second.Leaves[0])
+	assert.Error(t, err)
+}
@@ -0,0 +1,781 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+const (
+	// tenantKey stores the tenants by name with their quotas
+	tenantKey = "tenant_"
+	// namespaceKey is the prefix of the keyspaces of the tenants: namespaceKey
+	// + tenant + "/" + key, the server of a tenant only sees its keyspace
+	namespaceKey = "ns_"
+	// usageKey stores the usage of a keyspace, it is updated by the commits
+	// and repaired by the garbage collection
+	usageKey = "usage_"
+	// defaultTenant has the data stored before the tenants, the requests
+	// without a tenant use it
+	defaultTenant = "default"
+	// tenantHeader selects the tenant of the requests of the admins and of
+	// the requests without authentication
+	tenantHeader = "X-Zc-Tenant"
+)
+
+var (
+	// errInvalidTenant is returned when a tenant can not be created
+	errInvalidTenant = errors.New("invalid tenant")
+	// errQuotaExceeded is returned when a commit exceeds the quota of the
+	// tenant, nothing is written
+	errQuotaExceeded = errors.New("quota exceeded")
+	// errUnknownTenant is returned when a request selects a tenant that
+	// does not exist
+	errUnknownTenant = errors.New("unknown tenant")
+
+	tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+// globalKeys are the prefixes of the keys shared by the tenants, the other
+// keys are moved to the default tenant when the tenants are enabled
+var globalKeys = []string{namespaceKey, tenantKey, credentialKey, tokenKey, nonceKey, migratedKey}
+
+// quota has the limits of a tenant, zero is unlimited
+type quota struct {
+	MaxBytes       int64 `json:"max_bytes,omitempty"`
+	MaxFiles       int64 `json:"max_files,omitempty"`
+	MaxCollections int64 `json:"max_collections,omitempty"`
+}
+
+// tenant is a keyspace with its own collections, blobs and quota
+type tenant struct {
+	Name string `json:"name"`
+	quota
+	Created time.Time `json:"created"`
+}
+
+// usage is what a keyspace stores, the files are counted once by content.
+// The sessions are not stored with the usage, they are counted from the
+// sessions in progress
+type usage struct {
+	Bytes       int64 `json:"bytes"`
+	Files       int64 `json:"files"`
+	Collections int64 `json:"collections"`
+	// SessionBytes are the bytes reserved by the sessions in progress
+	SessionBytes int64 `json:"session_bytes,omitempty"`
+}
+
+// tenantInfo is a tenant with its usage
+type tenantInfo struct {
+	tenant
+	Usage usage `json:"usage"`
+}
+
+// tenantSet has the servers of the keyspaces of the tenants
+type tenantSet struct {
+	mu      sync.Mutex
+	servers map[string]*Server
+}
+
+func (u *usage) add(d usage) {
+	u.Bytes += d.Bytes
+	u.Files += d.Files
+	u.Collections += d.Collections
+}
+
+// exceeded returns errQuotaExceeded when the usage is over a limit that
+// the delta increased, the changes that only free space are always accepted
+func (q quota) exceeded(u, d usage) error {
+	if d.Bytes > 0 && q.MaxBytes > 0 && u.Bytes > q.MaxBytes {
+		return fmt.Errorf("%w: %d bytes of a maximum of %d", errQuotaExceeded, u.Bytes, q.MaxBytes)
+	}
+	if d.Files > 0 && q.MaxFiles > 0 && u.Files > q.MaxFiles {
+		return fmt.Errorf("%w: %d files of a maximum of %d", errQuotaExceeded, u.Files, q.MaxFiles)
+	}
+	if d.Collections > 0 && q.MaxCollections > 0 && u.Collections > q.MaxCollections {
+		return fmt.Errorf("%w: %d collections of a maximum of %d", errQuotaExceeded, u.Collections, q.MaxCollections)
+	}
+	return nil
+}
+
+// tenantServer returns the server of the keyspace of the tenant, the
+// servers share the configuration but not their locks, the keyspaces are
+// disjoint
+func (s *Server) tenantServer(name string) *Server {
+	s.tenants.mu.Lock()
+	defer s.tenants.mu.Unlock()
+
+	if ts, ok := s.tenants.servers[name]; ok {
+		return ts
+	}
+	if s.tenants.servers == nil {
+		s.tenants.servers = make(map[string]*Server)
+	}
+
+	ts := &Server{
+		conf:    s.conf,
+		db:      db.NewPrefixed(s.db, namespaceKey+name+"/"),
+		global:  s.db,
+		chunker: s.chunker,
+		tenant:  name,
+	}
+	mux := http.NewServeMux()
+	register(mux, ts.dataRoutes())
+	ts.mux = mux
+	s.tenants.servers[name] = ts
+	return ts
+}
+
+// keyspaces returns the servers of the keyspaces of the data, the server
+// itself when the tenants are disabled
+func (s *Server) keyspaces() ([]*Server, error) {
+	if !s.conf.Tenants {
+		return []*Server{s}, nil
+	}
+
+	keys, err := s.db.KeysByPrefix(tenantKey)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	servers := make([]*Server, 0, len(keys))
+	for _, k := range keys {
+		servers = append(servers, s.tenantServer(strings.TrimPrefix(k, tenantKey)))
+	}
+	return servers, nil
+}
+
+// serveTenant serves a request with the server of its tenant
+func (s *Server) serveTenant(w http.ResponseWriter, r *http.Request) {
+	ts, err := s.tenantOf(principalOf(r), r.Header.Get(tenantHeader))
+	if errors.Is(err, errForbidden) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errInvalidTenant) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errUnknownTenant) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+	ts.mux.ServeHTTP(w, r)
+}
+
+// tenantOf returns the server of the tenant of a principal, the tenant of a
+// credential is fixed, even for the admins of a tenant, the other admins
+// choose it by name. The names are checked before the tenant is read
+func (s *Server) tenantOf(p *Principal, name string) (*Server, error) {
+	if name != "" && !tenantName.MatchString(name) {
+		return nil, fmt.Errorf("%w %q", errInvalidTenant, name)
+	}
+	if p != nil && (!p.Admin || p.Tenant != "") {
+		tenant := p.Tenant
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+		if name != "" && name != tenant {
+			return nil, errForbidden
+		}
+		name = tenant
+	}
+	if name == "" {
+		name = defaultTenant
+	}
+
+	_, err := s.getTenant(name)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, fmt.Errorf("%w %s", errUnknownTenant, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.tenantServer(name), nil
+}
+
+// getTenant returns the tenant of the name
+func (s *Server) getTenant(name string) (tenant, error) {
+	data, err := s.global.Get(tenantKey + name)
+	if err != nil {
+		return tenant{}, err
+	}
+	var t tenant
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+func (s *Server) putTenant(t tenant) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return s.global.Put(tenantKey+t.Name, data)
+}
+
+// getQuota returns the quota of the keyspace, the server without tenants
+// has no limits
+func (s *Server) getQuota() (quota, error) {
+	if s.tenant == "" {
+		return quota{}, nil
+	}
+	t, err := s.getTenant(s.tenant)
+	if err != nil {
+		return quota{}, err
+	}
+	return t.quota, nil
+}
+
+// getUsage returns the usage of the keyspace
+func (s *Server) getUsage() (usage, error) {
+	data, err := s.db.Get(usageKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return usage{}, nil
+	}
+	if err != nil {
+		return usage{}, err
+	}
+	var u usage
+	err = json.Unmarshal(data, &u)
+	return u, err
+}
+
+// putUsage adds to the batch the usage changed by the delta, it fails when
+// the delta exceeds the quota. It must be called with the refs lock held
+// until the batch is written
+func (s *Server) putUsage(b *intentBatch, d usage) error {
+	if d == (usage{}) {
+		return nil
+	}
+
+	u, err := s.getUsage()
+	if err != nil {
+		return err
+	}
+	u.add(d)
+
+	q, err := s.getQuota()
+	if err != nil {
+		return err
+	}
+	err = q.exceeded(u, d)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	b.Put(usageKey, data)
+	return nil
+}
+
+// collectionsDelta returns how many collections the batch adds, a new
+// history is a new collection and a deleted one is removed but the roots
+// stored before the histories were already counted as one
+func (s *Server) collectionsDelta(b *intentBatch) (int64, error) {
+	n := -int64(b.legacyRoots)
+	last := make(map[string]bool)
+	for _, op := range b.ops {
+		if strings.HasPrefix(op.Key, historyKey) {
+			last[op.Key] = op.Delete
+		}
+	}
+
+	for k, deleted := range last {
+		_, err := s.db.Get(k)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return 0, err
+		}
+		exists := err == nil
+		if !exists && !deleted {
+			n++
+		}
+		if exists && deleted {
+			n--
+		}
+	}
+	return n, nil
+}
+
+// computeUsage counts the usage of the keyspace from the stored keys: the
+// blobs with refs, the histories and the roots stored before them
+func (s *Server) computeUsage() (usage, error) {
+	var u usage
+
+	keys, err := s.db.KeysByPrefix(refCountKey)
+	if err != nil {
+		return u, err
+	}
+	for _, k := range keys {
+		size, err := s.blobSize(strings.TrimPrefix(k, refCountKey))
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return u, err
+		}
+		u.Bytes += size
+		u.Files++
+	}
+
+	keys, err = s.db.KeysByPrefix(historyKey)
+	if err != nil {
+		return u, err
+	}
+	u.Collections = int64(len(keys))
+
+	roots, err := s.storedRoots()
+	if err != nil {
+		return u, err
+	}
+	for _, root := range roots {
+		_, err := s.db.Get(collectionOfKey + root)
+		if errors.Is(err, db.ErrNotFound) {
+			u.Collections++
+		} else if err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// repairUsage stores the usage counted from the keys, the commits are held
+// while it is counted
+func (s *Server) repairUsage() error {
+	s.refs.Lock()
+	defer s.refs.Unlock()
+
+	u, err := s.computeUsage()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(usageKey, data)
+}
+
+// initUsage counts the usage of a keyspace stored before the usage
+func (s *Server) initUsage() error {
+	_, err := s.db.Get(usageKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return s.repairUsage()
+	}
+	return err
+}
+
+// limited refuses the writes of a keyspace that is already over its limit
+// of bytes or files before their files are read, the commits check the
+// quota again with the files
+func (s *Server) limited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			// NOTE: the parts of a session are already counted by the
+			// reservation of the session
+			id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+			if id == r.URL.Path {
+				id = ""
+			}
+			err := s.checkQuota(id)
+			if err != nil {
+				s.commitError(w, err)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// checkQuota returns errQuotaExceeded when the keyspace is over its limit
+// of bytes or files, the bytes of the sessions but the excluded one are
+// counted
+func (s *Server) checkQuota(exclude string) error {
+	q, err := s.getQuota()
+	if err != nil || q == (quota{}) {
+		return err
+	}
+	u, err := s.getUsage()
+	if err != nil {
+		return err
+	}
+	if q.MaxBytes > 0 {
+		n, err := s.sessionBytes(exclude)
+		if err != nil {
+			return err
+		}
+		u.Bytes += n
+	}
+	return q.exceeded(u, usage{Bytes: 1, Files: 1})
+}
+
+// sessionBytes returns the bytes of the sessions but the excluded one, the
+// sessions in progress reserve the sizes of their files and the expired
+// ones count the parts they keep until they are deleted
+func (s *Server) sessionBytes(exclude string) (int64, error) {
+	sessions, err := s.db.GetByPrefix(sessionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for k, data := range sessions {
+		if exclude != "" && k == sessionKey+exclude {
+			continue
+		}
+		var sess session
+		err := json.Unmarshal(data, &sess)
+		if err != nil {
+			return 0, err
+		}
+		expired := time.Now().After(sess.Expires)
+		for _, f := range sess.Files {
+			if expired {
+				n += f.Offset
+			} else {
+				n += f.Size
+			}
+		}
+	}
+	return n, nil
+}
+
+// byteBudget is the number of bytes an operation can still stage in the
+// keyspace, a nil budget is unlimited
+type byteBudget struct {
+	left int64
+}
+
+// stagingBudget returns the bytes left in the quota of the keyspace once
+// the stored files and the sessions are counted, the chunks are staged
+// before the commit checks the quota so they must fit in it
+func (s *Server) stagingBudget() (*byteBudget, error) {
+	q, err := s.getQuota()
+	if err != nil || q.MaxBytes == 0 {
+		return nil, err
+	}
+	u, err := s.getUsage()
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.sessionBytes("")
+	if err != nil {
+		return nil, err
+	}
+	return &byteBudget{left: q.MaxBytes - u.Bytes - n}, nil
+}
+
+// take uses n bytes of the budget, it fails with errQuotaExceeded when they
+// are not left
+func (b *byteBudget) take(n int64) error {
+	if b == nil {
+		return nil
+	}
+	if n > b.left {
+		return fmt.Errorf("%w: %d bytes to store with %d left", errQuotaExceeded, n, max(b.left, 0))
+	}
+	b.left -= n
+	return nil
+}
+
+// reader returns a reader that takes the bytes read from the budget, the
+// read that exceeds it fails so its bytes are never staged
+func (b *byteBudget) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *byteBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if err := r.budget.take(int64(n)); err != nil {
+			return 0, err
+		}
+	}
+	return n, err
+}
+
+// commitError reports an error of a commit, the quota errors and the roots
+// of the other collections are sent to the client
+func (s *Server) commitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, errRootExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.conf.Logger.Error(err.Error())
+	http.Error(w, errInternal, http.StatusInternalServerError)
+}
+
+// UsageHandler returns the usage of the keyspace of the request with its
+// quota, GET /usage
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := s.tenantInfo()
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// tenantInfo returns the tenant of the keyspace with its usage
+func (s *Server) tenantInfo() (tenantInfo, error) {
+	info := tenantInfo{tenant: tenant{Name: s.tenant}}
+	if s.tenant != "" {
+		t, err := s.getTenant(s.tenant)
+		if err != nil {
+			return info, err
+		}
+		info.tenant = t
+	}
+
+	u, err := s.getUsage()
+	if err != nil {
+		return info, err
+	}
+	u.SessionBytes, err = s.sessionBytes("")
+	info.Usage = u
+	return info, err
+}
+
+// TenantsHandler manages the tenants: GET /admin/tenants lists them with
+// their usage, POST /admin/tenants creates one, GET /admin/tenants/<name>
+// returns one and PUT /admin/tenants/<name> changes its quota
+func (s *Server) TenantsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/")
+
+	var result interface{}
+	var err error
+	status := http.StatusOK
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		result, err = s.listTenants()
+	case r.Method == http.MethodPost && name == "":
+		result, err = s.createTenant(r)
+		status = http.StatusCreated
+	case r.Method == http.MethodGet:
+		result, err = s.getTenantInfo(name)
+	case r.Method == http.MethodPut:
+		result, err = s.updateTenant(r, name)
+	default:
+		http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvalidTenant) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return
+	}
+
+	// TODO: improve the responses with a helper
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) listTenants() ([]tenantInfo, error) {
+	servers, err := s.keyspaces()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]tenantInfo, 0, len(servers))
+	for _, ts := range servers {
+		info, err := ts.tenantInfo()
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, info)
+	}
+	return tenants, nil
+}
+
+func (s *Server) getTenantInfo(name string) (tenantInfo, error) {
+	_, err := s.getTenant(name)
+	if err != nil {
+		return tenantInfo{}, err
+	}
+	return s.tenantServer(name).tenantInfo()
+}
+
+// decodeQuota reads a quota from the body of a request
+func decodeQuota(r *http.Request, t *tenant) error {
+	err := json.NewDecoder(r.Body).Decode(t)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidTenant, err)
+	}
+	if t.MaxBytes < 0 || t.MaxFiles < 0 || t.MaxCollections < 0 {
+		return fmt.Errorf("%w: the limits can not be negative", errInvalidTenant)
+	}
+	return nil
+}
+
+func (s *Server) createTenant(r *http.Request) (tenantInfo, error) {
+	var t tenant
+	err := decodeQuota(r, &t)
+	if err != nil {
+		return tenantInfo{}, err
+	}
+	if !tenantName.MatchString(t.Name) {
+		return tenantInfo{}, fmt.Errorf("%w: the name must have up to 63 lowercase letters, digits or dashes", errInvalidTenant)
+	}
+
+	s.tenants.mu.Lock()
+	defer s.tenants.mu.Unlock()
+
+	_, err = s.getTenant(t.Name)
+	if err == nil {
+		return tenantInfo{}, fmt.Errorf("%w: the tenant %s already exists", errInvalidTenant, t.Name)
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return tenantInfo{}, err
+	}
+
+	t.Created = time.Now().UTC()
+	return tenantInfo{tenant: t}, s.putTenant(t)
+}
+
+func (s *Server) updateTenant(r *http.Request, name string) (tenantInfo, error) {
+	t, err := s.getTenant(name)
+	if err != nil {
+		return tenantInfo{}, err
+	}
+
+	var req tenant
+	err = decodeQuota(r, &req)
+	if err != nil {
+		return tenantInfo{}, err
+	}
+	t.quota = req.quota
+
+	err = s.putTenant(t)
+	if err != nil {
+		return tenantInfo{}, err
+	}
+	return s.tenantServer(name).tenantInfo()
+}
+
+// migrateTenants creates the default tenant and moves the keys stored
+// before the tenants to its keyspace, the global keys stay. The keys are
+// copied one by one and deleted in batches, so the batches are small and an
+// interrupted migration continues on the next start. The end of the
+// migration is recorded, the starts without the tenants remove the record
+// so the keys they store are moved by the next start with them
+func (s *Server) migrateTenants() error {
+	_, err := s.getTenant(defaultTenant)
+	if errors.Is(err, db.ErrNotFound) {
+		err = s.putTenant(tenant{Name: defaultTenant, Created: time.Now().UTC()})
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Get(migratedKey + "tenants")
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	keys, err := s.db.KeysByPrefix("")
+	if err != nil {
+		return err
+	}
+
+	dst := namespaceKey + defaultTenant + "/"
+	moved := 0
+	b := s.db.NewBatch()
+	for _, k := range keys {
+		if isGlobalKey(k) {
+			continue
+		}
+		value, err := s.db.Get(k)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The value is copied before the batch, a key copied and not
+		// deleted is copied again on the next start
+		err = s.db.Put(dst+k, value)
+		if err != nil {
+			return err
+		}
+		b.Delete(k)
+		moved++
+
+		if b.Len() >= gcBatchSize {
+			err = s.db.Write(b)
+			if err != nil {
+				return err
+			}
+			b = s.db.NewBatch()
+		}
+	}
+	if b.Len() != 0 {
+		err = s.db.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if moved > 0 {
+		s.conf.Logger.Info(fmt.Sprintf("Moved %d keys to the tenant %s", moved, defaultTenant))
+	}
+	return s.db.Put(migratedKey+"tenants", []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+func isGlobalKey(k string) bool {
+	for _, p := range globalKeys {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTenantServer(t *testing.T, tenants ...tenant) (*Server, *MockDatabase) {
+	server, mockDB := newAuthServer(authToken)
+	server.conf.Tenants = true
+	require.NoError(t, server.migrateTenants())
+
+	for _, tn := range tenants {
+		body, _ := json.Marshal(tn)
+		w := serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/tenants", bytes.NewBuffer(body)), "admin-token")
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	return server, mockDB
+}
+
+// sendFiles posts the files as a JSON array with the token
+func sendFiles(server *Server, url, token string, files [][]byte) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(files)
+	return serveAs(server, httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(body)), token)
+}
+
+func decodeTree(t *testing.T, w *httptest.ResponseRecorder) treeResult {
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result treeResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	return result
+}
+
+func getUsageOf(t *testing.T, server *Server, token string) tenantInfo {
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/usage", nil), token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var info tenantInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	return info
+}
+
+func keysOf(data map[string][]byte, prefix string) map[string]string {
+	keys := make(map[string]string)
+	for k, v := range data {
+		if strings.HasPrefix(k, prefix) {
+			keys[k] = string(v)
+		}
+	}
+	return keys
+}
+
+func TestTenantIsolation(t *testing.T) {
+	server, mockDB := newTenantServer(t, tenant{Name: "a"}, tenant{Name: "b"})
+	_, tokenA := createCredential(t, server, credentialRequest{Name: "team a", Kind: authToken, Tenant: "a"})
+	idB, tokenB := createCredential(t, server, credentialRequest{Name: "team b", Kind: authToken, Tenant: "b"})
+
+	content := []byte("the secret of a")
+	rootA := decodeTree(t, sendFiles(server, "/upload", tokenA, [][]byte{content}))
+	keysA := keysOf(mockDB.data, namespaceKey+"a/")
+	require.NotEmpty(t, keysA)
+
+	// The roots of a tenant do not exist for the others
+	w := serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+rootA.RootHash+"/0", nil), tokenB)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), string(content))
+	for _, url := range []string{"/collections/" + rootA.RootHash, "/history/" + rootA.RootHash, "/raw/" + rootA.RootHash + "/0"} {
+		w = serveAs(server, httptest.NewRequest(http.MethodGet, url, nil), tokenB)
+		assert.NotEqual(t, http.StatusOK, w.Code, url)
+		assert.NotContains(t, w.Body.String(), string(content), url)
+	}
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/collections", nil), tokenB)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), rootA.RootHash)
+
+	// The collections are not shared with the principals of other tenants
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/acl/"+rootA.RootHash+"/"+idB+"?access=read", nil), tokenA)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A credential can not choose another tenant
+	req := httptest.NewRequest(http.MethodGet, "/collections", nil)
+	req.Header.Set(tenantHeader, "a")
+	assert.Equal(t, http.StatusForbidden, serveAs(server, req, tokenB).Code)
+
+	// The same content is stored again in the keyspace of b and the changes
+	// and the collections of b do not touch the keys of a
+	rootB := decodeTree(t, sendFiles(server, "/upload", tokenB, [][]byte{content}))
+	assert.Equal(t, rootA.RootHash, rootB.RootHash)
+	assert.Contains(t, mockDB.data, namespaceKey+"b/"+blobManifestKey+blobID(content))
+	decodeTree(t, sendFiles(server, "/update/"+rootB.RootHash, tokenB, [][]byte{[]byte("b2")}))
+	decodeTree(t, sendFiles(server, "/update/"+rootA.RootHash+"?message=again", tokenB, [][]byte{[]byte("b3")}))
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/gc", nil)
+	req.Header.Set(tenantHeader, "b")
+	w = serveAs(server, req, "admin-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, keysA, keysOf(mockDB.data, namespaceKey+"a/"))
+
+	// The data keys are in the keyspaces of the tenants
+	for k := range mockDB.data {
+		assert.True(t, isGlobalKey(k), k)
+	}
+
+	// The admins choose the tenant
+	req = httptest.NewRequest(http.MethodGet, "/download/"+rootA.RootHash+"/0", nil)
+	req.Header.Set(tenantHeader, "a")
+	w = serveAs(server, req, "admin-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "dGhlIHNlY3JldCBvZiBh")
+
+	req = httptest.NewRequest(http.MethodGet, "/collections", nil)
+	req.Header.Set(tenantHeader, "unknown")
+	assert.Equal(t, http.StatusNotFound, serveAs(server, req, "admin-token").Code)
+	req = httptest.NewRequest(http.MethodGet, "/collections", nil)
+	req.Header.Set(tenantHeader, "../a")
+	assert.Equal(t, http.StatusBadRequest, serveAs(server, req, "admin-token").Code)
+
+	// The admins of a tenant only act on it
+	_, adminB := createCredential(t, server, credentialRequest{Name: "admin b", Kind: authToken, Admin: true, Tenant: "b"})
+	req = httptest.NewRequest(http.MethodGet, "/download/"+rootA.RootHash+"/0", nil)
+	req.Header.Set(tenantHeader, "a")
+	assert.Equal(t, http.StatusForbidden, serveAs(server, req, adminB).Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/download/"+rootB.RootHash+"/0", nil), adminB)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body, _ := json.Marshal(credentialRequest{Name: "x", Kind: authToken, Tenant: "unknown"})
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/admin/tokens", bytes.NewBuffer(body)), "admin-token")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTenantQuotas(t *testing.T) {
+	server, mockDB := newTenantServer(t, tenant{Name: "q", quota: quota{MaxFiles: 2, MaxCollections: 1}})
+	_, token := createCredential(t, server, credentialRequest{Name: "q", Kind: authToken, Tenant: "q"})
+
+	first := decodeTree(t, sendFiles(server, "/upload", token, [][]byte{[]byte("file1")}))
+	assert.Equal(t, usage{Bytes: 5, Files: 1, Collections: 1}, getUsageOf(t, server, token).Usage)
+
+	// The collections are limited
+	w := sendFiles(server, "/upload", token, [][]byte{[]byte("other")})
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Contains(t, w.Body.String(), "2 collections of a maximum of 1")
+
+	// The same content is counted once
+	second := decodeTree(t, sendFiles(server, "/update/"+first.RootHash, token, [][]byte{[]byte("file2"), []byte("file1")}))
+	info := getUsageOf(t, server, token)
+	assert.Equal(t, usage{Bytes: 10, Files: 2, Collections: 1}, info.Usage)
+	assert.Equal(t, int64(2), info.MaxFiles)
+
+	// The writes of a full tenant are refused
+	w = sendFiles(server, "/update/"+second.RootHash, token, [][]byte{[]byte("file3")})
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// A commit over the quota writes nothing
+	body, _ := json.Marshal(quota{MaxBytes: 12})
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/admin/tenants/q", bytes.NewBuffer(body)), "admin-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	keys := keysOf(mockDB.data, namespaceKey+"q/")
+	w = sendFiles(server, "/update/"+second.RootHash, token, [][]byte{[]byte("too large")})
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Contains(t, w.Body.String(), "9 bytes to store with 2 left")
+	assert.Equal(t, keys, keysOf(mockDB.data, namespaceKey+"q/"))
+
+	// The usage freed by the pruning of the history is available again
+	server.tenantServer("q").conf.HistoryKeep = 1
+	decodeTree(t, sendFiles(server, "/update/"+second.RootHash, token, [][]byte{[]byte("ok")}))
+	assert.Equal(t, usage{Bytes: 12, Files: 3, Collections: 1}, getUsageOf(t, server, token).Usage)
+
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/admin/tenants", nil), "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	var tenants []tenantInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tenants))
+	require.Len(t, tenants, 2)
+	assert.Equal(t, defaultTenant, tenants[0].Name)
+	assert.Equal(t, "q", tenants[1].Name)
+	assert.Equal(t, int64(12), tenants[1].Usage.Bytes)
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/admin/tenants", `{"name":"Not Valid"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/tenants", `{"name":"q"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/tenants", `{"name":"n","max_files":-1}`, http.StatusBadRequest},
+		{http.MethodGet, "/admin/tenants/unknown", "", http.StatusNotFound},
+		{http.MethodPut, "/admin/tenants/unknown", `{}`, http.StatusNotFound},
+		{http.MethodDelete, "/admin/tenants/q", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w = serveAs(server, httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body)), "admin-token")
+		assert.Equal(t, tt.status, w.Code, tt.url+" "+tt.body)
+	}
+	w = serveAs(server, httptest.NewRequest(http.MethodGet, "/admin/tenants", nil), token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestTenantQuotaStaging(t *testing.T) {
+	server, mockDB := newTenantServer(t, tenant{Name: "q", quota: quota{MaxBytes: 4096}})
+	_, token := createCredential(t, server, credentialRequest{Name: "q", Kind: authToken, Tenant: "q"})
+
+	// A streamed file over the quota is refused before its chunks are stored
+	large := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(large)
+	body, contentType := multipartBody(t, [][]byte{large})
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := serveAs(server, req, token)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Empty(t, keysOf(mockDB.data, namespaceKey+"q/"+chunkKey))
+
+	// The sessions reserve the sizes of their files
+	createSession := func(sizes ...int64) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(sessionRequest{Op: sessionUpload, Sizes: sizes})
+		return serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(body)), token)
+	}
+	assert.Equal(t, http.StatusInsufficientStorage, createSession(5000).Code)
+	w = createSession(1000, 2000)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var sess session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	assert.Equal(t, usage{SessionBytes: 3000}, getUsageOf(t, server, token).Usage)
+
+	assert.Equal(t, http.StatusInsufficientStorage, createSession(2000).Code)
+	w = sendFiles(server, "/upload", token, [][]byte{large[:2000]})
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+
+	// The space of a cancelled session is available again
+	w = serveAs(server, httptest.NewRequest(http.MethodDelete, "/sessions/"+sess.ID, nil), token)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	decodeTree(t, sendFiles(server, "/upload", token, [][]byte{large[:2000]}))
+	assert.Equal(t, usage{Bytes: 2000, Files: 1, Collections: 1}, getUsageOf(t, server, token).Usage)
+}
+
+func TestTenantQuotaBoundary(t *testing.T) {
+	server, _ := newTenantServer(t, tenant{Name: "q", quota: quota{MaxBytes: 10}})
+	_, token := createCredential(t, server, credentialRequest{Name: "q", Kind: authToken, Tenant: "q"})
+
+	// A session that reserves all the quota stores its own parts
+	body, _ := json.Marshal(sessionRequest{Op: sessionUpload, Sizes: []int64{10}})
+	w := serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions", bytes.NewBuffer(body)), token)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var sess session
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&sess))
+	setQuota := func(q quota) {
+		body, _ := json.Marshal(q)
+		w := serveAs(server, httptest.NewRequest(http.MethodPut, "/admin/tenants/q", bytes.NewBuffer(body)), "admin-token")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The reservation of a session only refuses the other writes
+	setQuota(quota{MaxBytes: 9})
+	assert.Equal(t, http.StatusInsufficientStorage, sendFiles(server, "/upload", token, [][]byte{[]byte("x")}).Code)
+	w = serveAs(server, httptest.NewRequest(http.MethodPut, "/sessions/"+sess.ID+"/0?offset=0", strings.NewReader("0123456789")), token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	setQuota(quota{MaxBytes: 10})
+	w = serveAs(server, httptest.NewRequest(http.MethodPost, "/sessions/"+sess.ID+"/finalize", nil), token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	first := decodeTree(t, w)
+	assert.Equal(t, usage{Bytes: 10, Files: 1, Collections: 1}, getUsageOf(t, server, token).Usage)
+
+	// A keyspace at its limit of files stores the files it already has
+	setQuota(quota{MaxFiles: 1})
+	second := decodeTree(t, sendFiles(server, "/update/"+first.RootHash, token, [][]byte{[]byte("0123456789")}))
+	assert.Equal(t, usage{Bytes: 10, Files: 1, Collections: 1}, getUsageOf(t, server, token).Usage)
+	w = sendFiles(server, "/update/"+second.RootHash, token, [][]byte{[]byte("x")})
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+}
+
+func TestTenantMigration(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	first := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1")})
+	_, _, err := server.newCredential(credentialRequest{Name: "ci", Kind: authToken})
+	require.NoError(t, err)
+	legacy := keysOf(mockDB.data, "")
+
+	// The data stored before the tenants is moved to the default tenant
+	server.conf.Tenants = true
+	require.NoError(t, server.migrateTenants())
+	for k, v := range legacy {
+		if isGlobalKey(k) {
+			assert.Equal(t, v, string(mockDB.data[k]))
+			continue
+		}
+		assert.NotContains(t, mockDB.data, k)
+		assert.Equal(t, v, string(mockDB.data[namespaceKey+defaultTenant+"/"+k]), k)
+	}
+
+	ts := server.tenantServer(defaultTenant)
+	content, err := ts.getFile(first.RootHash, first.Leaves[0])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("file1"), content)
+
+	u, err := ts.getUsage()
+	require.NoError(t, err)
+	assert.Equal(t, usage{Bytes: 5, Files: 1, Collections: 1}, u)
+
+	// The next starts do not read the keys again
+	mockDB.data["left"] = []byte("left")
+	moved := keysOf(mockDB.data, "")
+	require.NoError(t, server.migrateTenants())
+	assert.Equal(t, moved, keysOf(mockDB.data, ""))
+
+	// Unless a start without the tenants stored keys
+	delete(mockDB.data, migratedKey+"tenants")
+	require.NoError(t, server.migrateTenants())
+	assert.NotContains(t, mockDB.data, "left")
+	assert.Contains(t, mockDB.data, namespaceKey+defaultTenant+"/left")
+}
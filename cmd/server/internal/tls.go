@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/jmsilvadev/zc/pkg/certs"
+)
+
+// tlsConfig returns the TLS config of the server, nil without a
+// certificate. The certificate, the key and the CAs of the clients are
+// read again when their files change
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.conf.TLSCert == "" && s.conf.TLSKey == "" {
+		if s.conf.TLSClientCA != "" {
+			return nil, fmt.Errorf("the CAs of the clients require the certificate and the key of the server")
+		}
+		return nil, nil
+	}
+
+	r, err := certs.NewReloader(s.conf.TLSCert, s.conf.TLSKey, s.conf.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	return r.TLSConfig(), nil
+}
+
+// listen serves the requests with TLS when the server has a config for it
+func listen(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// The certificates are served by the config
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
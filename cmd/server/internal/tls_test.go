@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/certs"
+	"github.com/jmsilvadev/zc/pkg/certs/certstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+	server, _ := newChunkingServer()
+	server.conf.TLSCert = files.ServerCert
+	server.conf.TLSKey = files.ServerKey
+	server.conf.TLSClientCA = files.CA
+
+	config, err := server.tlsConfig()
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(server.routes())
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool, err := certs.LoadPool(files.CA)
+	require.NoError(t, err)
+	cert, err := tls.LoadX509KeyPair(files.ClientCert, files.ClientKey)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+
+	body, _ := json.Marshal([][]byte{[]byte("file1")})
+	resp, err := client.Post(ts.URL+"/upload", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The clients without a certificate are refused in the handshake
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = anonymous.Get(ts.URL + "/collections")
+	assert.Error(t, err)
+
+	// The clients only trust the CA of the server
+	_, err = http.Get(ts.URL + "/collections")
+	assert.Error(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+	server, _ := newChunkingServer()
+
+	config, err := server.tlsConfig()
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	server.conf.TLSClientCA = files.CA
+	_, err = server.tlsConfig()
+	assert.Error(t, err)
+
+	server.conf.TLSCert = files.ServerCert
+	_, err = server.tlsConfig()
+	assert.Error(t, err)
+
+	server.conf.TLSKey = files.ServerKey
+	config, err = server.tlsConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, config)
+}
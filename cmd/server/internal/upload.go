@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/jmsilvadev/zc/pkg/cdc"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+)
+
+const (
+	// filePart is the name of the multipart parts with the files
+	filePart = "file"
+	// metaPart is the name of the optional multipart parts with the JSON
+	// metadata of the next file
+	metaPart = "meta"
+	// maxMetaPart is the maximum size of a metadata part
+	maxMetaPart = 64 << 10
+)
+
+// errInvalidUpload is returned when the body of an upload can not be read
+var errInvalidUpload = errors.New("invalid upload")
+
+// readFiles reads the files of an upload and stages them, the leaf hashes
+// are returned in the upload order. The body is a JSON array of files or a
+// multipart/form-data stream with a "file" part per file, the parts are
+// hashed and stored as they arrive so the files are never fully in memory.
+// The leaves commit to the metadata when commit is set. The files must fit
+// in the quota before they are staged
+func (s *Server) readFiles(r *http.Request, mode mkt.Mode, commit bool) ([]string, map[string]stagedFile, error) {
+	budget, err := s.stagingBudget()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		return s.readParts(r, mode, commit, budget)
+	}
+
+	var files [][]byte
+	err = json.NewDecoder(r.Body).Decode(&files)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("%w: the body has no files", errInvalidUpload)
+	}
+	for _, v := range files {
+		err = budget.take(int64(len(v)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	hashes := make([]string, len(files))
+	staged := make(map[string]stagedFile, len(files))
+	for i, v := range files {
+		f, err := s.stageFile(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = leafHash(mode, commit, mode.HashLeaf(v), f.meta)
+		staged[hashes[i]] = f
+	}
+	return hashes, staged, nil
+}
+
+// readParts reads the files of a multipart upload, a "meta" part has the
+// metadata of the next file. Without it the name and the content type are
+// taken from the headers of the file part. The files are read from the
+// budget so the parts over the quota are not staged
+func (s *Server) readParts(r *http.Request, mode mkt.Mode, commit bool, budget *byteBudget) ([]string, map[string]stagedFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+
+	var hashes []string
+	var meta *mkt.Metadata
+	staged := make(map[string]stagedFile)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF && len(hashes) == 0 {
+			return nil, nil, fmt.Errorf("%w: the body has no file parts", errInvalidUpload)
+		}
+		if err == io.EOF {
+			return hashes, staged, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errInvalidUpload, err)
+		}
+
+		switch part.FormName() {
+		case metaPart:
+			meta, err = readMeta(part)
+			part.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		case filePart:
+		default:
+			part.Close()
+			continue
+		}
+
+		if meta == nil {
+			meta = &mkt.Metadata{Name: part.FileName(), ContentType: part.Header.Get("Content-Type")}
+			if meta.Validate() != nil {
+				meta.Name = ""
+			}
+		}
+
+		h := mode.NewLeafHash()
+		f, err := s.stageStream(s.streamChunker(), io.TeeReader(budget.reader(part), h))
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		f = f.withMeta(*meta)
+		meta = nil
+
+		hash := leafHash(mode, commit, hex.EncodeToString(h.Sum(nil)), f.meta)
+		hashes = append(hashes, hash)
+		staged[hash] = f
+	}
+}
+
+// readMeta reads the metadata of a "meta" part
+func readMeta(r io.Reader) (*mkt.Metadata, error) {
+	var meta mkt.Metadata
+	err := json.NewDecoder(io.LimitReader(r, maxMetaPart)).Decode(&meta)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid metadata: %s", errInvalidUpload, err)
+	}
+	err = meta.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidUpload, err)
+	}
+	return &meta, nil
+}
+
+// streamChunker returns the chunker of the streamed files, they are always
+// stored in chunks since they are written before the root is known
+func (s *Server) streamChunker() *cdc.Chunker {
+	if s.chunker != nil {
+		return s.chunker
+	}
+	c, _ := cdc.New(0, 0, 0)
+	return c
+}
+
+// uploadError responds the error of readFiles
+func (s *Server) uploadError(w http.ResponseWriter, err error) {
+	if tooLarge(w, err) {
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		s.commitError(w, err)
+		return
+	}
+	if errors.Is(err, errInvalidUpload) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.conf.Logger.Error(err.Error())
+	http.Error(w, errInternal, http.StatusInternalServerError)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/jmsilvadev/zc/pkg/mkt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func multipartBody(t *testing.T, files [][]byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, f := range files {
+		part, err := writer.CreateFormFile(filePart, "file")
+		require.NoError(t, err)
+		_, err = part.Write(f)
+		require.NoError(t, err)
+	}
+	// Other fields are ignored
+	require.NoError(t, writer.WriteField("other", "value"))
+	require.NoError(t, writer.Close())
+	return body, writer.FormDataContentType()
+}
+
+func TestMultipartUpload(t *testing.T) {
+	c := config.GetDefaultConfig()
+	conf := &config.Config{
+		ServerPort: ":5005",
+		Logger:     c.Logger,
+	}
+	mockDB := &MockDatabase{data: make(map[string][]byte)}
+	mockDB.On("Get", mock.Anything).Return(nil, nil)
+	mockDB.On("Put", mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("Delete", mock.Anything).Return(nil)
+	server := NewServer(conf, mockDB)
+
+	big := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	files := [][]byte{big, []byte("small file")}
+
+	for _, mode := range []mkt.Mode{mkt.SHA256, mkt.Keccak256Sorted} {
+		body, contentType := multipartBody(t, files)
+		req := httptest.NewRequest(http.MethodPost, "/upload?mode="+string(mode), body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		server.UploadHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var result treeResult
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&result))
+
+		hashes := []string{mode.HashLeaf(files[0]), mode.HashLeaf(files[1])}
+		assert.Equal(t, hashes, result.Leaves)
+		m, err := mkt.NewMerkleTreeWithMode(hashes, mode)
+		require.NoError(t, err)
+		assert.Equal(t, m.Root.Hash, result.RootHash)
+
+		// The streamed files are stored in chunks even without the chunking
+		for i, h := range hashes {
+			assert.NotEmpty(t, mockDB.data[blobManifestKey+blobID(files[i])])
+			content, err := server.getFile(result.RootHash, h)
+			assert.NoError(t, err)
+			assert.Equal(t, files[i], content)
+		}
+	}
+}
+
+func TestMultipartUpdate(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	filesJSON, _ := json.Marshal([][]byte{[]byte("file1")})
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBuffer(filesJSON))
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var first treeResult
+	json.NewDecoder(w.Result().Body).Decode(&first)
+
+	body, contentType := multipartBody(t, [][]byte{[]byte("file2"), []byte("file1")})
+	req = httptest.NewRequest(http.MethodPost, "/update/"+first.RootHash, body)
+	req.Header.Set("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	server.UpdatedHandler(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var second treeResult
+	json.NewDecoder(w.Result().Body).Decode(&second)
+	assert.Equal(t, []int{1, 0}, second.Indexes)
+
+	for i, f := range []string{"file1", "file2"} {
+		content, err := server.getFile(second.RootHash, second.Leaves[i])
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(f), content)
+	}
+}
+
+func TestMultipartUploadInvalid(t *testing.T) {
+	server, _ := newChunkingServer()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString("not multipart"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	w := httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	// A body with only the other fields has no files
+	body, contentType := multipartBody(t, nil)
+	req = httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	server.UploadHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "the body has no file parts")
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+)
+
+// defaultMaxBodySize is the maximum size of the body of a request when the
+// config does not set one
+const defaultMaxBodySize = 1 << 30
+
+var (
+	// rootPattern matches the roots, the hex encoded 32 bytes hashes of both
+	// tree modes. The roots are used in the prefixes of the keys so a short
+	// root would match the keys of the other roots
+	rootPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	// sessionIDPattern matches the ids of the upload sessions
+	sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	// errInvalidRoot is returned when a root is not a hash
+	errInvalidRoot = errors.New("invalid root")
+	// errInvalidIndex is returned when an index is not a position of a leaf
+	errInvalidIndex = errors.New("invalid index")
+)
+
+// validRoot checks that the root is a hash of the tree modes
+func validRoot(root string) error {
+	if !rootPattern.MatchString(root) {
+		return fmt.Errorf("%w %q, it must be a hex encoded 32 bytes hash", errInvalidRoot, root)
+	}
+	return nil
+}
+
+// parseIndex returns the index of a leaf, the indexes are written without
+// signs or leading zeros
+func parseIndex(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || strconv.Itoa(i) != s {
+		return 0, fmt.Errorf("%w %q", errInvalidIndex, s)
+	}
+	return i, nil
+}
+
+// checkRoot reports if the root is valid and exists, the error is sent when
+// it is not: 400 for the roots that are not hashes and 404 for the unknown
+// ones
+func (s *Server) checkRoot(w http.ResponseWriter, root string) bool {
+	err := validRoot(root)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	_, err = s.getCollectionType(root)
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, errNotFound, http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		s.conf.Logger.Error(err.Error())
+		http.Error(w, errInternal, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// rooted checks the root of the paths /action/<root>/... before the handler
+func (s *Server) rooted(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pathParts := strings.Split(r.URL.Path, "/")
+		if len(pathParts) < 3 || pathParts[2] == "" {
+			http.Error(w, "the root is required", http.StatusBadRequest)
+			return
+		}
+		if !s.checkRoot(w, pathParts[2]) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// indexed checks the index of the paths /action/<root>/<index> before the
+// handler, it must be below the leaf count of the root. The leaves are
+// stored from zero without gaps so the index is below the count when its
+// leaf exists
+func (s *Server) indexed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pathParts := strings.Split(r.URL.Path, "/")
+		if len(pathParts) != 4 {
+			http.Error(w, "the path must be the root and the index", http.StatusBadRequest)
+			return
+		}
+
+		i, err := parseIndex(pathParts[3])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = s.db.Get(pathParts[2] + strconv.Itoa(i))
+		if errors.Is(err, db.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("the index %d is out of the leaves of the root", i), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.conf.Logger.Error(err.Error())
+			http.Error(w, errInternal, http.StatusInternalServerError)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// allowed refuses with 405 the methods the route does not serve
+func allowed(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, errBadRequest, http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// maxBodySize returns the maximum size of the body of a request
+func (s *Server) maxBodySize() int64 {
+	if s.conf.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return int64(s.conf.MaxBodySize)
+}
+
+// limitBody limits the body of the requests to the maximum size, the
+// handlers reading more fail with an *http.MaxBytesError
+func (s *Server) limitBody(h http.Handler) http.Handler {
+	limit := s.maxBodySize()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge reports if the error is a body over the maximum size, the error
+// is sent with 413 when it is
+func tooLarge(w http.ResponseWriter, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("the body is limited to %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
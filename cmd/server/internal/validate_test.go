@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unknownRoot is a valid root that is not stored
+var unknownRoot = strings.Repeat("ab", 32)
+
+func TestValidRoot(t *testing.T) {
+	assert.NoError(t, validRoot(unknownRoot))
+	for _, root := range []string{"", "root", unknownRoot[:62], unknownRoot + "ab", strings.ToUpper(unknownRoot), "0x" + unknownRoot[2:]} {
+		assert.ErrorIs(t, validRoot(root), errInvalidRoot, root)
+	}
+
+	i, err := parseIndex("12")
+	require.NoError(t, err)
+	assert.Equal(t, 12, i)
+	for _, s := range []string{"", "-1", "+1", "01", "1e3", "x"} {
+		_, err = parseIndex(s)
+		assert.ErrorIs(t, err, errInvalidIndex, s)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	server, mockDB := newChunkingServer()
+	upload := uploadJSON(t, server, "/upload", [][]byte{[]byte("file1"), []byte("file2")})
+	root := upload.RootHash
+	keys := keysOf(mockDB.data, "")
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/download/" + root + "/1", http.StatusOK},
+		{http.MethodHead, "/raw/" + root + "/0", http.StatusOK},
+		{http.MethodGet, "/download/" + root + "/2", http.StatusNotFound},
+		{http.MethodGet, "/download/" + root + "/-1", http.StatusBadRequest},
+		{http.MethodGet, "/download/" + root + "/01", http.StatusBadRequest},
+		{http.MethodGet, "/download/" + root + "/0/x", http.StatusBadRequest},
+		{http.MethodGet, "/download/" + root, http.StatusBadRequest},
+		{http.MethodGet, "/download/" + root[:10] + "/0", http.StatusBadRequest},
+		{http.MethodGet, "/download/" + unknownRoot + "/0", http.StatusNotFound},
+		{http.MethodGet, "/signature/" + root + "/9", http.StatusNotFound},
+		{http.MethodGet, "/tree/" + unknownRoot + "/a.txt", http.StatusNotFound},
+		{http.MethodPost, "/update/", http.StatusBadRequest},
+		{http.MethodPost, "/update/" + root[:2], http.StatusBadRequest},
+		{http.MethodPost, "/update/" + unknownRoot, http.StatusNotFound},
+		{http.MethodPost, "/delta/" + root + "/5", http.StatusNotFound},
+		{http.MethodGet, "/sessions/x_", http.StatusNotFound},
+		{http.MethodGet, "/sessions/" + root, http.StatusNotFound},
+		{http.MethodPost, "/sessions", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serveAs(server, httptest.NewRequest(tt.method, tt.url, strings.NewReader(`[""]`)), "")
+		assert.Equal(t, tt.status, w.Code, tt.method+" "+tt.url+" "+w.Body.String())
+	}
+
+	// The invalid requests do not change the stored keys
+	assert.Equal(t, keys, keysOf(mockDB.data, ""))
+
+	// The methods are enforced by route
+	methods := []struct {
+		method string
+		url    string
+		allow  string
+	}{
+		{http.MethodGet, "/upload", "POST"},
+		{http.MethodGet, "/update/" + root, "POST"},
+		{http.MethodPost, "/download/" + root + "/0", "GET"},
+		{http.MethodPut, "/history/" + root, "GET, POST"},
+		{http.MethodPatch, "/sessions/" + strings.Repeat("a", 32), "GET, PUT, POST, DELETE"},
+		{http.MethodGet, "/admin/gc", "POST"},
+	}
+	for _, tt := range methods {
+		w := serveAs(server, httptest.NewRequest(tt.method, tt.url, nil), "")
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code, tt.method+" "+tt.url)
+		assert.Equal(t, tt.allow, w.Header().Get("Allow"), tt.method+" "+tt.url)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	server, _ := newChunkingServer()
+	server.conf.MaxBodySize = 64
+	body := []byte(`["` + strings.Repeat("a", 100) + `"]`)
+
+	for _, url := range []string{"/upload", "/tree"} {
+		w := serveAs(server, httptest.NewRequest(http.MethodPost, url, bytes.NewBuffer(body)), "")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, url)
+	}
+
+	w := serveAs(server, httptest.NewRequest(http.MethodPost, "/upload", bytes.NewBufferString(`["ZmlsZTE="]`)), "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -23,19 +23,39 @@ func run(c *config.Config) error {
 		return fmt.Errorf("invalid db engine, valid values: leveldb, scylladb")
 	}
 
-	var db db.Database
+	var database db.Database
 	var err error
 
-	db, err = leveldb.New(c.DbPath)
+	database, err = leveldb.New(c.DbPath)
 	if strings.ToLower(c.DbEngine) == "scylladb" {
-		db, err = scylladb.New(c.ScyllaHosts, defaultScyllaKS)
+		database, err = scylladb.New(c.ScyllaHosts, defaultScyllaKS)
 	}
 
 	if err != nil {
 		return fmt.Errorf("DB ERROR: %s", err.Error())
 	}
 
-	s := server.NewServer(c, db)
+	if c.EncryptionKeys != "" || c.EncryptionKeyFile != "" {
+		keys, err := db.LoadKeyring(c.EncryptionKeys, c.EncryptionKeyFile)
+		if err != nil {
+			database.Close()
+			return fmt.Errorf("ENCRYPTION ERROR: %s", err.Error())
+		}
+		database = db.NewEncrypted(database, keys)
+	}
+
+	// The compressed values are read even when the new ones are not
+	// compressed, so the compression can be disabled after it was used. The
+	// values are only read as compressed ones once the view marked the
+	// database
+	algorithm, err := db.ParseCompression(c.Compression)
+	if err != nil {
+		database.Close()
+		return fmt.Errorf("COMPRESSION ERROR: %s", err.Error())
+	}
+	database = db.NewCompressed(database, algorithm)
+
+	s := server.NewServer(c, database)
 	s.Start()
 	return nil
 }
@@ -0,0 +1,33 @@
+package servertest
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	server "github.com/jmsilvadev/zc/cmd/server/internal"
+	"github.com/jmsilvadev/zc/pkg/config"
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+)
+
+// New serves a server without authentication nor tenants over a LevelDB
+// database in a temporary directory, both are closed with the test
+func New(t testing.TB) *httptest.Server {
+	t.Helper()
+
+	database, err := leveldb.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.GetDefaultConfig()
+	c.Auth = nil
+	c.Tenants = false
+	c.GCInterval = 0
+	ts := httptest.NewServer(server.NewServer(c, database).Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		database.Close()
+	})
+	return ts
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SchemeBearer is the scheme of the static tokens
+	SchemeBearer = "Bearer"
+	// SchemeHMAC is the scheme of the signed requests, the authorization
+	// has the key and the signature: ZC-HMAC-SHA256 Key=<id>,Signature=<hex>
+	SchemeHMAC = "ZC-HMAC-SHA256"
+
+	// HeaderDate has the unix time of a signed request
+	HeaderDate = "X-Zc-Date"
+	// HeaderNonce has the random value that makes each signed request unique
+	HeaderNonce = "X-Zc-Nonce"
+	// HeaderContentSHA256 has the hex sha256 of the body or UnsignedPayload
+	HeaderContentSHA256 = "X-Zc-Content-Sha256"
+
+	// UnsignedPayload is the content hash of the bodies that are not
+	// signed, the streamed uploads are verified by the proofs of the files
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// MaxSignedBody is the maximum size of a signed body, the server reads
+	// it to check the hash before the request is served
+	MaxSignedBody = 16 << 20
+)
+
+// StringToSign returns the canonical form of a signed request: the method,
+// the escaped path, the sorted query, the date, the nonce and the hash of the
+// body, one per line
+func StringToSign(method, path string, query url.Values, date, nonce, contentHash string) string {
+	return strings.Join([]string{method, path, query.Encode(), date, nonce, contentHash}, "\n")
+}
+
+// Sign returns the hex HMAC-SHA256 of the string to sign with the secret
+func Sign(secret, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns if the signature is the one of the string to sign, in
+// constant time
+func Verify(secret, stringToSign, signature string) bool {
+	expected, err := hex.DecodeString(Sign(secret, stringToSign))
+	if err != nil {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, got)
+}
+
+// ContentHash returns the hex sha256 of a body
+func ContentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// SignRequest adds to the request the date, a new nonce, the content hash
+// and the authorization with the signature of the key
+func SignRequest(req *http.Request, keyID, secret string, now time.Time, contentHash string) error {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	date := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(HeaderDate, date)
+	req.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+	req.Header.Set(HeaderContentSHA256, contentHash)
+
+	signature := Sign(secret, StringToSign(req.Method, req.URL.EscapedPath(), req.URL.Query(), date, req.Header.Get(HeaderNonce), contentHash))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Key=%s,Signature=%s", SchemeHMAC, keyID, signature))
+	return nil
+}
+
+// ParseHMAC returns the key and the signature of a signed authorization,
+// ok is false when the authorization is not signed
+func ParseHMAC(authorization string) (keyID, signature string, ok bool) {
+	params, found := strings.CutPrefix(authorization, SchemeHMAC+" ")
+	if !found {
+		return "", "", false
+	}
+
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch k {
+		case "Key":
+			keyID = v
+		case "Signature":
+			signature = v
+		}
+	}
+	return keyID, signature, keyID != "" && signature != ""
+}
+
+// ParseBearer returns the token of a bearer authorization, ok is false when
+// the authorization is not a token
+func ParseBearer(authorization string) (string, bool) {
+	token, found := strings.CutPrefix(authorization, SchemeBearer+" ")
+	token = strings.TrimSpace(token)
+	return token, found && token != ""
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/update/root?order=hash&message=a%20b", nil)
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, SignRequest(req, "key", "secret", now, ContentHash([]byte("body"))))
+
+	assert.Equal(t, "1700000000", req.Header.Get(HeaderDate))
+	assert.Len(t, req.Header.Get(HeaderNonce), 32)
+	assert.Equal(t, ContentHash([]byte("body")), req.Header.Get(HeaderContentSHA256))
+
+	keyID, signature, ok := ParseHMAC(req.Header.Get("Authorization"))
+	require.True(t, ok)
+	assert.Equal(t, "key", keyID)
+
+	// The query is signed in its sorted form
+	query := url.Values{"message": {"a b"}, "order": {"hash"}}
+	toSign := StringToSign(http.MethodPost, "/update/root", query, "1700000000", req.Header.Get(HeaderNonce), ContentHash([]byte("body")))
+	assert.True(t, Verify("secret", toSign, signature))
+	assert.False(t, Verify("other", toSign, signature))
+	assert.False(t, Verify("secret", toSign, "invalid"))
+
+	toSign = StringToSign(http.MethodPost, "/update/other", query, "1700000000", req.Header.Get(HeaderNonce), ContentHash([]byte("body")))
+	assert.False(t, Verify("secret", toSign, signature))
+}
+
+func TestParseAuthorization(t *testing.T) {
+	_, _, ok := ParseHMAC("ZC-HMAC-SHA256 Key=key")
+	assert.False(t, ok)
+	_, _, ok = ParseHMAC("Bearer token")
+	assert.False(t, ok)
+	keyID, signature, ok := ParseHMAC("ZC-HMAC-SHA256 Key=key, Signature=abc")
+	assert.True(t, ok)
+	assert.Equal(t, "key", keyID)
+	assert.Equal(t, "abc", signature)
+
+	token, ok := ParseBearer("Bearer token")
+	assert.True(t, ok)
+	assert.Equal(t, "token", token)
+	_, ok = ParseBearer("Bearer ")
+	assert.False(t, ok)
+	_, ok = ParseBearer("ZC-HMAC-SHA256 Key=key,Signature=abc")
+	assert.False(t, ok)
+}
@@ -0,0 +1,163 @@
+package cdc
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes, the average must be a power of two
+const (
+	DefaultMinSize = 16 * 1024
+	DefaultAvgSize = 64 * 1024
+	DefaultMaxSize = 256 * 1024
+)
+
+// gear is the table of random values used by the rolling hash, it is
+// generated with a fixed seed so the boundaries never change between
+// versions or machines
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x5a43_4344_435f_6765) // "ZCCDC_ge"
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits data in content defined chunks using FastCDC, so an
+// insertion or a deletion only changes the chunks around it
+type Chunker struct {
+	min   int
+	avg   int
+	max   int
+	maskS uint64
+	maskL uint64
+}
+
+// New creates a Chunker, zero values use the defaults
+func New(min, avg, max int) (*Chunker, error) {
+	if min == 0 {
+		min = DefaultMinSize
+	}
+	if avg == 0 {
+		avg = DefaultAvgSize
+	}
+	if max == 0 {
+		max = DefaultMaxSize
+	}
+
+	if min < 64 || min > avg || avg > max {
+		return nil, errors.New("invalid chunk sizes, expected 64 <= min <= avg <= max")
+	}
+	if bits.OnesCount(uint(avg)) != 1 {
+		return nil, errors.New("invalid chunk sizes, the average must be a power of two")
+	}
+
+	// NOTE: normalized chunking, before the average size the mask has more
+	// bits to make a cut less likely and after it has less bits
+	b := bits.TrailingZeros(uint(avg))
+	return &Chunker{
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: topBits(b + 2),
+		maskL: topBits(b - 2),
+	}, nil
+}
+
+// Split returns the chunks of data, the chunks share the data memory
+func (c *Chunker) Split(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := c.cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// Reader reads content defined chunks from a stream
+type Reader struct {
+	c   *Chunker
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+// NewReader returns a Reader of the chunks of r
+func (c *Chunker) NewReader(r io.Reader) *Reader {
+	return &Reader{c: c, r: r}
+}
+
+// Next returns the next chunk or io.EOF at the end of the stream, the chunk
+// is a new slice that can be retained by the caller
+func (r *Reader) Next() ([]byte, error) {
+	for !r.eof && len(r.buf) < r.c.max {
+		buf := make([]byte, r.c.max)
+		n, err := r.r.Read(buf)
+		r.buf = append(r.buf, buf[:n]...)
+		if err == io.EOF {
+			r.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	n := r.c.cut(r.buf)
+	chunk := make([]byte, n)
+	copy(chunk, r.buf[:n])
+	r.buf = r.buf[n:]
+	return chunk, nil
+}
+
+// cut returns the size of the first chunk of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask with the n most significant bits set, the gear
+// hash mixes the last 64 bytes in the high bits
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
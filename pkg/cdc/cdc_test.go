@@ -0,0 +1,91 @@
+package cdc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(42)).Read(data)
+	return data
+}
+
+func TestSplit(t *testing.T) {
+	c, err := New(1024, 4096, 16384)
+	require.NoError(t, err)
+
+	data := randomData(1 << 20)
+	chunks := c.Split(data)
+	require.Greater(t, len(chunks), 1)
+	require.Equal(t, data, bytes.Join(chunks, nil))
+
+	for _, chunk := range chunks[:len(chunks)-1] {
+		require.GreaterOrEqual(t, len(chunk), 1024)
+		require.LessOrEqual(t, len(chunk), 16384)
+	}
+
+	require.Empty(t, c.Split(nil))
+	require.Len(t, c.Split([]byte("small")), 1)
+}
+
+func TestSplitIsContentDefined(t *testing.T) {
+	c, err := New(1024, 4096, 16384)
+	require.NoError(t, err)
+
+	data := randomData(1 << 20)
+	changed := append([]byte("a few inserted bytes"), data...)
+
+	hashes := map[[32]byte]bool{}
+	for _, chunk := range c.Split(data) {
+		hashes[sha256.Sum256(chunk)] = true
+	}
+
+	chunks := c.Split(changed)
+	shared := 0
+	for _, chunk := range chunks {
+		if hashes[sha256.Sum256(chunk)] {
+			shared++
+		}
+	}
+
+	// Only the chunks around the insertion change
+	require.GreaterOrEqual(t, shared, len(chunks)-2)
+}
+
+func TestReader(t *testing.T) {
+	c, err := New(0, 0, 0)
+	require.NoError(t, err)
+
+	data := randomData(3 << 20)
+	expected := c.Split(data)
+
+	r := c.NewReader(bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+
+	require.Equal(t, expected, chunks)
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(2048, 1024, 4096)
+	require.Error(t, err)
+
+	_, err = New(1024, 3000, 4096)
+	require.Error(t, err)
+
+	_, err = New(32, 64, 128)
+	require.Error(t, err)
+}
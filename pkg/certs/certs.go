@@ -0,0 +1,142 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultCheckInterval is the minimum time between the checks of the files
+// of a Reloader
+const defaultCheckInterval = time.Second
+
+// LoadPool reads a bundle of PEM certificates
+func LoadPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Reloader serves the certificate and the key of its files, with a CA
+// bundle the clients must present a certificate signed by it. The files are
+// read again when they change so the renewed certificates are served
+// without a restart, a change that can not be loaded keeps the previous
+// ones until the files are fixed
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	// interval is the minimum time between the checks of the files
+	interval time.Duration
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime time.Time
+	checked time.Time
+}
+
+// NewReloader loads the certificate, the key and the optional CA bundle of
+// the clients
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("the certificate and the key are required")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile, interval: defaultCheckInterval}
+	modTime, err := r.lastChange()
+	if err != nil {
+		return nil, err
+	}
+	r.config, err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.modTime = modTime
+	r.checked = time.Now()
+	return r, nil
+}
+
+// TLSConfig returns the config of a server, each connection uses the
+// certificates of the files at the time of its handshake
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}
+}
+
+// current returns the config of the files, they are checked at most once
+// per interval
+func (r *Reloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < r.interval {
+		return r.config
+	}
+	r.checked = time.Now()
+
+	modTime, err := r.lastChange()
+	if err != nil || modTime.Equal(r.modTime) {
+		return r.config
+	}
+	config, err := r.load()
+	if err != nil {
+		// The files may be in the middle of a renewal, they are checked
+		// again on the next interval
+		return r.config
+	}
+	r.config = config
+	r.modTime = modTime
+	return r.config
+}
+
+// load reads the files
+func (r *Reloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.caFile != "" {
+		config.ClientCAs, err = LoadPool(r.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// lastChange returns the latest modification time of the files
+func (r *Reloader) lastChange() (time.Time, error) {
+	var last time.Time
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,96 @@
+package certs
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmsilvadev/zc/pkg/certs/certstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsClient trusts only the CA and presents the client certificate when
+// it is given
+func tlsClient(t *testing.T, caFile, certFile, keyFile string) *http.Client {
+	pool, err := LoadPool(caFile)
+	require.NoError(t, err)
+	config := &tls.Config{RootCAs: pool}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func copyFile(t *testing.T, from, to string, modTime time.Time) {
+	data, err := os.ReadFile(from)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(to, data, 0600))
+	require.NoError(t, os.Chtimes(to, modTime, modTime))
+}
+
+func TestReloader(t *testing.T) {
+	first := certstest.Generate(t, t.TempDir())
+	r, err := NewReloader(first.ServerCert, first.ServerKey, first.CA)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = r.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := tlsClient(t, first.CA, first.ClientCert, first.ClientKey).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The clients without a certificate of the CA are refused
+	_, err = tlsClient(t, first.CA, "", "").Get(server.URL)
+	assert.Error(t, err)
+	other := certstest.Generate(t, t.TempDir())
+	_, err = tlsClient(t, first.CA, other.ClientCert, other.ClientKey).Get(server.URL)
+	assert.Error(t, err)
+
+	// A renewed certificate is served without a restart, a broken one keeps
+	// the previous
+	r.interval = 0
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.WriteFile(first.ServerKey, []byte("broken"), 0600))
+	require.NoError(t, os.Chtimes(first.ServerKey, later, later))
+	_, err = tlsClient(t, first.CA, first.ClientCert, first.ClientKey).Get(server.URL)
+	require.NoError(t, err)
+
+	copyFile(t, other.ServerCert, first.ServerCert, later.Add(time.Minute))
+	copyFile(t, other.ServerKey, first.ServerKey, later.Add(time.Minute))
+	_, err = tlsClient(t, first.CA, first.ClientCert, first.ClientKey).Get(server.URL)
+	assert.Error(t, err)
+	resp, err = tlsClient(t, other.CA, first.ClientCert, first.ClientKey).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLoadErrors(t *testing.T) {
+	files := certstest.Generate(t, t.TempDir())
+
+	_, err := NewReloader("", files.ServerKey, "")
+	assert.Error(t, err)
+	_, err = NewReloader(files.ServerCert, files.ClientKey, "")
+	assert.Error(t, err)
+	_, err = NewReloader(files.ServerCert, files.ServerKey, filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+
+	_, err = LoadPool(files.ServerKey)
+	assert.Error(t, err)
+	pool, err := LoadPool(files.CA)
+	require.NoError(t, err)
+	assert.NotNil(t, pool)
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"context"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmsilvadev/zc/pkg/logger"
 )
@@ -15,6 +17,43 @@ var (
 	serverPort  = ":5000"
 	loggerLevel = "INFO"
 	scyllaHosts = "localhost"
+	// Content defined chunking of the stored files, zero sizes use the
+	// defaults of the cdc package
+	chunking     = "true"
+	chunkMinSize = 0
+	chunkAvgSize = 0
+	chunkMaxSize = 0
+	// Resumable upload sessions expire after this time without writes
+	sessionExpiry = 24 * time.Hour
+	// The garbage collection runs every interval, zero disables it
+	gcInterval time.Duration
+	// The versions kept by collection and their maximum age, zero keeps
+	// them forever
+	historyKeep   = 10
+	historyMaxAge time.Duration
+	// The authentication methods, empty disables the authentication
+	authMethods    = ""
+	authAdminToken = ""
+	authMaxSkew    = 5 * time.Minute
+	// Each tenant has its own keyspace and quotas
+	tenants = "false"
+	// The bodies of the requests are limited to this size, zero uses the
+	// default of the server
+	maxBodySize = 0
+	// The server uses TLS with a certificate and a key, with a CA bundle the
+	// clients must present a certificate signed by it
+	tlsCert     = ""
+	tlsKey      = ""
+	tlsClientCA = ""
+	// The gRPC api is served on its own port, empty disables it
+	grpcPort = ""
+	// The values are encrypted with the keys, the first one encrypts the
+	// new values
+	encryptionKeys    = ""
+	encryptionKeyFile = ""
+	// The new values are compressed with the algorithm when it saves
+	// space, empty is none
+	compression = ""
 )
 
 type Config struct {
@@ -23,6 +62,61 @@ type Config struct {
 	ServerPort  string
 	ScyllaHosts []string
 	Logger      logger.Logger
+	// Chunking stores the files split in content defined chunks, the
+	// chunks are deduplicated between files, versions and collections
+	Chunking     bool
+	ChunkMinSize int
+	ChunkAvgSize int
+	ChunkMaxSize int
+	// SessionExpiry is the time a resumable upload session is kept without
+	// receiving data
+	SessionExpiry time.Duration
+	// GCInterval is the time between the scheduled garbage collections,
+	// zero disables them
+	GCInterval time.Duration
+	// HistoryKeep is the number of versions kept by collection, the older
+	// ones are deleted with their roots
+	HistoryKeep int
+	// HistoryMaxAge is the time a version is kept, zero keeps them until
+	// they are out of HistoryKeep. The current version is always kept
+	HistoryMaxAge time.Duration
+	// Auth has the authentication methods accepted: token and hmac, the
+	// server is open without them
+	Auth []string
+	// AuthAdminToken is a token with access to the admin endpoints, it
+	// creates the other credentials
+	AuthAdminToken string
+	// AuthMaxSkew is the maximum difference between the date of a signed
+	// request and the server clock, the nonces are kept for this time
+	AuthMaxSkew time.Duration
+	// Tenants stores the data of each tenant under its own prefix, the
+	// credentials are bound to a tenant and the tenants have quotas
+	Tenants bool
+	// MaxBodySize is the maximum size in bytes of the body of a request,
+	// the larger ones are refused with 413
+	MaxBodySize int
+	// TLSCert and TLSKey are the PEM files of the certificate of the
+	// server, it uses TLS when they are set and serves the renewed files
+	// without a restart
+	TLSCert string
+	TLSKey  string
+	// TLSClientCA is the PEM bundle of the CAs of the client certificates,
+	// when it is set the clients must present one (mutual TLS)
+	TLSClientCA string
+	// GRPCPort is the address of the gRPC api, it is served with the same
+	// storage, credentials and TLS config as the HTTP api. Empty disables it
+	GRPCPort string
+	// EncryptionKeys are the AES-256 keys of the encryption at rest written
+	// as id:base64 and separated by commas, the keys of EncryptionKeyFile
+	// follow them one per line. The first key encrypts the new values and
+	// the values of the other keys are encrypted with it in the background,
+	// the values are stored in plaintext without keys
+	EncryptionKeys    string
+	EncryptionKeyFile string
+	// Compression is the algorithm of the new values, none, snappy or gzip,
+	// each value is compressed only when it saves space and is encrypted
+	// after it. The compressed values are always read, empty is none
+	Compression string
 }
 
 func New(ctx context.Context, port, dbEngine, dbPath string, scyllaHosts []string, logger logger.Logger) *Config {
@@ -41,6 +135,26 @@ func GetDefaultConfig() *Config {
 	dbPath = getEnv("DB_PATH", dbPath)
 	dbEngine = getEnv("DB_ENGINE", dbEngine)
 	scyllaHosts = getEnv("SCYLLA_HOSTS", scyllaHosts)
+	chunking = getEnv("CHUNKING", chunking)
+	chunkMinSize = getEnvInt("CHUNK_MIN_SIZE", chunkMinSize)
+	chunkAvgSize = getEnvInt("CHUNK_AVG_SIZE", chunkAvgSize)
+	chunkMaxSize = getEnvInt("CHUNK_MAX_SIZE", chunkMaxSize)
+	sessionExpiry = getEnvDuration("SESSION_EXPIRY", sessionExpiry)
+	gcInterval = getEnvDuration("GC_INTERVAL", gcInterval)
+	historyKeep = getEnvInt("HISTORY_KEEP", historyKeep)
+	historyMaxAge = getEnvDuration("HISTORY_MAX_AGE", historyMaxAge)
+	authMethods = getEnv("AUTH", authMethods)
+	authAdminToken = getEnv("AUTH_ADMIN_TOKEN", authAdminToken)
+	authMaxSkew = getEnvDuration("AUTH_MAX_SKEW", authMaxSkew)
+	tenants = getEnv("TENANTS", tenants)
+	maxBodySize = getEnvInt("MAX_BODY_SIZE", maxBodySize)
+	tlsCert = getEnv("TLS_CERT", tlsCert)
+	tlsKey = getEnv("TLS_KEY", tlsKey)
+	tlsClientCA = getEnv("TLS_CLIENT_CA", tlsClientCA)
+	grpcPort = getEnv("GRPC_PORT", grpcPort)
+	encryptionKeys = getEnv("ENCRYPTION_KEYS", encryptionKeys)
+	encryptionKeyFile = getEnv("ENCRYPTION_KEY_FILE", encryptionKeyFile)
+	compression = getEnv("COMPRESSION", compression)
 
 	level := logger.LEVEL_ERROR
 	if loggerLevel == "INFO" {
@@ -59,6 +173,30 @@ func GetDefaultConfig() *Config {
 	hosts := strings.Split(scyllaHosts, ",")
 
 	config := New(ctx, serverPort, dbEngine, dbPath, hosts, log)
+	config.Chunking = strings.ToLower(chunking) == "true"
+	config.ChunkMinSize = chunkMinSize
+	config.ChunkAvgSize = chunkAvgSize
+	config.ChunkMaxSize = chunkMaxSize
+	config.SessionExpiry = sessionExpiry
+	config.GCInterval = gcInterval
+	config.HistoryKeep = historyKeep
+	config.HistoryMaxAge = historyMaxAge
+	config.AuthAdminToken = authAdminToken
+	config.AuthMaxSkew = authMaxSkew
+	config.Tenants = strings.ToLower(tenants) == "true"
+	config.MaxBodySize = maxBodySize
+	config.TLSCert = tlsCert
+	config.TLSKey = tlsKey
+	config.TLSClientCA = tlsClientCA
+	config.GRPCPort = grpcPort
+	config.EncryptionKeys = encryptionKeys
+	config.EncryptionKeyFile = encryptionKeyFile
+	config.Compression = compression
+	for _, m := range strings.Split(authMethods, ",") {
+		if m = strings.TrimSpace(strings.ToLower(m)); m != "" {
+			config.Auth = append(config.Auth, m)
+		}
+	}
 
 	return config
 }
@@ -69,3 +207,21 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -26,3 +27,21 @@ func TestGetEnv(t *testing.T) {
 	v := getEnv("a", "b")
 	require.Equal(t, "b", v)
 }
+
+func TestGetEnvInt(t *testing.T) {
+	t.Setenv("ZC_TEST_INT", "10")
+	require.Equal(t, 10, getEnvInt("ZC_TEST_INT", 1))
+
+	t.Setenv("ZC_TEST_INT", "invalid")
+	require.Equal(t, 1, getEnvInt("ZC_TEST_INT", 1))
+	require.Equal(t, 2, getEnvInt("ZC_TEST_NOT_SET", 2))
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	t.Setenv("ZC_TEST_DURATION", "90m")
+	require.Equal(t, 90*time.Minute, getEnvDuration("ZC_TEST_DURATION", time.Hour))
+
+	t.Setenv("ZC_TEST_DURATION", "invalid")
+	require.Equal(t, time.Hour, getEnvDuration("ZC_TEST_DURATION", time.Hour))
+	require.Equal(t, time.Minute, getEnvDuration("ZC_TEST_NOT_SET", time.Minute))
+}
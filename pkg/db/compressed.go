@@ -0,0 +1,358 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is the algorithm of the compressed values
+type Compression byte
+
+const (
+	// NoCompression stores the new values as they are, the compressed
+	// values are still read
+	NoCompression Compression = iota
+	Snappy
+	Gzip
+)
+
+// compressedMagic starts the compressed values, it is followed by the
+// algorithm and the compressed value. The values without it are stored as
+// they are
+var compressedMagic = []byte{0, 'z', 'c', 'z', 1}
+
+// compressedKey is the key of the database that records the first value
+// written with the header, the values are only read as compressed ones after
+// it. It is hidden from the view so it is not moved or collected as the
+// other keys
+const compressedKey = "\x00zcc_compressed"
+
+const (
+	// compressMinSize is the size of the smallest value compressed, the
+	// smaller ones hardly shrink
+	compressMinSize = 64
+	// compressMinSaving is the fraction of the value that the compression
+	// must save to be stored, 1/8
+	compressMinSaving = 8
+)
+
+var (
+	// ErrUnknownCompression is returned for a name or a header of an
+	// algorithm that is not supported
+	ErrUnknownCompression = errors.New("unknown compression")
+	// ErrDecompress is returned when a compressed value can not be read
+	ErrDecompress = errors.New("the value can not be decompressed")
+)
+
+// ParseCompression returns the algorithm of the name: none, snappy or gzip,
+// empty is none
+func ParseCompression(name string) (Compression, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return NoCompression, nil
+	case "snappy":
+		return Snappy, nil
+	case "gzip":
+		return Gzip, nil
+	}
+	return NoCompression, fmt.Errorf("%w %q, valid values: none, snappy, gzip", ErrUnknownCompression, name)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Gzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// compress returns the value compressed with the algorithm and its header
+func (c Compression) compress(value []byte) ([]byte, error) {
+	out := append(append([]byte{}, compressedMagic...), byte(c))
+	switch c {
+	case Snappy:
+		return append(out, snappy.Encode(nil, value)...), nil
+	case Gzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(value)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return append(out, value...), nil
+}
+
+// encode returns the value to store, compressed when it saves enough space.
+// A value that starts with the header is stored after a header without
+// compression so it is not read as a compressed value
+func (c Compression) encode(value []byte) ([]byte, error) {
+	if c != NoCompression && len(value) >= compressMinSize {
+		compressed, err := c.compress(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) <= len(value)-len(value)/compressMinSaving {
+			return compressed, nil
+		}
+	}
+	if bytes.HasPrefix(value, compressedMagic) {
+		return NoCompression.compress(value)
+	}
+	return value, nil
+}
+
+// decode returns the value as it was written, with any of the algorithms
+func decode(key string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressedMagic) {
+		return value, nil
+	}
+
+	rest := value[len(compressedMagic):]
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrDecompress, key)
+	}
+	data := rest[1:]
+	switch Compression(rest[0]) {
+	case NoCompression:
+		return data, nil
+	case Snappy:
+		plain, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDecompress, key)
+		}
+		return plain, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDecompress, key)
+		}
+		plain, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDecompress, key)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w %d: %s", ErrUnknownCompression, rest[0], key)
+}
+
+// Compressed is a view of a database where each value is compressed when it
+// saves space, the keys are stored as they are. The values of any algorithm
+// are read, so the algorithm can be changed without rewriting them. It owns
+// the database, closing it closes the database
+type Compressed struct {
+	db        Database
+	algorithm Compression
+	// mu holds the writes of the header while the marker is written
+	mu sync.Mutex
+	// marked is set once the marker is read or written, the values that
+	// start with the header are compressed ones
+	marked atomic.Bool
+}
+
+// NewCompressed returns the view of the database that compresses the new
+// values with the algorithm
+func NewCompressed(d Database, algorithm Compression) *Compressed {
+	return &Compressed{db: d, algorithm: algorithm}
+}
+
+// Unwrap returns the database of the view
+func (c *Compressed) Unwrap() Database {
+	return c.db
+}
+
+// decode returns the value as it was written. Until the marker is written
+// the values are the ones stored before the compression, even when they
+// start as a compressed one
+func (c *Compressed) decode(key string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, compressedMagic) {
+		return value, nil
+	}
+	if !c.marked.Load() {
+		_, err := c.db.Get(compressedKey)
+		if errors.Is(err, ErrNotFound) {
+			return value, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.marked.Store(true)
+	}
+	return decode(key, value)
+}
+
+// mark writes the marker before the first value with the header, the values
+// stored before it that start as a compressed one are escaped so they are
+// still read as they are
+func (c *Compressed) mark() error {
+	if c.marked.Load() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.marked.Load() {
+		return nil
+	}
+
+	_, err := c.db.Get(compressedKey)
+	if err == nil {
+		c.marked.Store(true)
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	keys, err := c.db.KeysByPrefix("")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		value, err := c.db.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(value, compressedMagic) {
+			continue
+		}
+		// NOTE: a value stored as it is never fails to be encoded
+		escaped, _ := NoCompression.compress(value)
+		err = c.db.Put(k, escaped)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.db.Put(compressedKey, []byte(c.algorithm.String()))
+	if err != nil {
+		return err
+	}
+	c.marked.Store(true)
+	return nil
+}
+
+func (c *Compressed) Get(key string) ([]byte, error) {
+	if key == compressedKey {
+		return nil, ErrNotFound
+	}
+	value, err := c.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(key, value)
+}
+
+func (c *Compressed) Put(key string, value []byte) error {
+	encoded, err := c.algorithm.encode(value)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(encoded, compressedMagic) {
+		err = c.mark()
+		if err != nil {
+			return err
+		}
+	}
+	return c.db.Put(key, encoded)
+}
+
+func (c *Compressed) Delete(key string) error {
+	return c.db.Delete(key)
+}
+
+func (c *Compressed) DeleteByPrefix(prefix string) error {
+	return c.db.DeleteByPrefix(prefix)
+}
+
+func (c *Compressed) GetByPrefix(prefix string) (map[string][]byte, error) {
+	values, err := c.db.GetByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	delete(values, compressedKey)
+	for k, v := range values {
+		values[k], err = c.decode(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (c *Compressed) KeysByPrefix(prefix string) ([]string, error) {
+	keys, err := c.db.KeysByPrefix(prefix)
+	if err != nil || !strings.HasPrefix(compressedKey, prefix) {
+		return keys, err
+	}
+	for i, k := range keys {
+		if k == compressedKey {
+			return append(keys[:i], keys[i+1:]...), nil
+		}
+	}
+	return keys, nil
+}
+
+// compressedBatch compresses the values of the batch of the database, a
+// value that can not be compressed fails the write of the batch
+type compressedBatch struct {
+	Batch
+	view *Compressed
+	err  error
+	// header is set when a value of the batch starts with the header
+	header bool
+}
+
+func (b *compressedBatch) Put(key string, value []byte) {
+	encoded, err := b.view.algorithm.encode(value)
+	if err != nil {
+		b.err = err
+		return
+	}
+	b.header = b.header || bytes.HasPrefix(encoded, compressedMagic)
+	b.Batch.Put(key, encoded)
+}
+
+func (c *Compressed) NewBatch() Batch {
+	return &compressedBatch{Batch: c.db.NewBatch(), view: c}
+}
+
+func (c *Compressed) Write(b Batch) error {
+	cb, ok := b.(*compressedBatch)
+	if !ok || cb.view != c {
+		return ErrInvalidBatch
+	}
+	if cb.err != nil {
+		return cb.err
+	}
+	if cb.header {
+		err := c.mark()
+		if err != nil {
+			return err
+		}
+	}
+	return c.db.Write(cb.Batch)
+}
+
+func (c *Compressed) Close() error {
+	return c.db.Close()
+}
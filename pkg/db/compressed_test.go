@@ -0,0 +1,160 @@
+package db_test
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBase(t *testing.T) db.Database {
+	base, err := leveldb.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { base.Close() })
+	return base
+}
+
+func TestCompressed(t *testing.T) {
+	logs := []byte(strings.Repeat("2024-01-01T00:00:00Z INFO request served status=200\n", 200))
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	// a value that starts as a compressed value but is not one
+	header := append([]byte{0, 'z', 'c', 'z', 1, 2}, "not gzip"...)
+
+	for _, algorithm := range []db.Compression{db.Snappy, db.Gzip} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			base := newBase(t)
+			c := db.NewCompressed(base, algorithm)
+
+			values := map[string][]byte{"logs": logs, "random": random, "small": []byte("small"), "header": header, "empty": {}}
+			for k, v := range values {
+				require.NoError(t, c.Put(k, v))
+			}
+			for k, v := range values {
+				value, err := c.Get(k)
+				require.NoError(t, err, k)
+				assert.Equal(t, len(v), len(value), k)
+				assert.True(t, bytes.Equal(v, value), k)
+			}
+
+			// Only the values that shrink are compressed
+			raw, err := base.Get("logs")
+			require.NoError(t, err)
+			assert.Less(t, len(raw), len(logs)/10)
+			raw, err = base.Get("random")
+			require.NoError(t, err)
+			assert.Equal(t, random, raw)
+			raw, err = base.Get("small")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("small"), raw)
+
+			b := c.NewBatch()
+			b.Put("batch_logs", logs)
+			b.Delete("logs")
+			require.NoError(t, c.Write(b))
+			assert.ErrorIs(t, c.Write(base.NewBatch()), db.ErrInvalidBatch)
+			assert.ErrorIs(t, db.NewCompressed(base, algorithm).Write(b), db.ErrInvalidBatch)
+
+			raw, err = base.Get("batch_logs")
+			require.NoError(t, err)
+			assert.Less(t, len(raw), len(logs)/10)
+			prefixed, err := c.GetByPrefix("batch_")
+			require.NoError(t, err)
+			assert.Equal(t, map[string][]byte{"batch_logs": logs}, prefixed)
+			_, err = c.Get("logs")
+			assert.ErrorIs(t, err, db.ErrNotFound)
+		})
+	}
+}
+
+func TestCompressedChanges(t *testing.T) {
+	logs := []byte(strings.Repeat("a line of the logs\n", 100))
+	base := newBase(t)
+	require.NoError(t, base.Put("plain", logs))
+	require.NoError(t, db.NewCompressed(base, db.Snappy).Put("snappy", logs))
+	require.NoError(t, db.NewCompressed(base, db.Gzip).Put("gzip", logs))
+
+	// The values of the other algorithms and the plain ones are read
+	for _, algorithm := range []db.Compression{db.NoCompression, db.Snappy, db.Gzip} {
+		c := db.NewCompressed(base, algorithm)
+		for _, k := range []string{"plain", "snappy", "gzip"} {
+			value, err := c.Get(k)
+			require.NoError(t, err)
+			assert.Equal(t, logs, value, k)
+		}
+	}
+
+	// Without compression the new values are stored as they are
+	require.NoError(t, db.NewCompressed(base, db.NoCompression).Put("none", logs))
+	raw, err := base.Get("none")
+	require.NoError(t, err)
+	assert.Equal(t, logs, raw)
+
+	require.NoError(t, base.Put("broken", []byte{0, 'z', 'c', 'z', 1, byte(db.Snappy), 0xff}))
+	_, err = db.NewCompressed(base, db.Snappy).Get("broken")
+	assert.ErrorIs(t, err, db.ErrDecompress)
+	require.NoError(t, base.Put("unknown", []byte{0, 'z', 'c', 'z', 1, 9}))
+	_, err = db.NewCompressed(base, db.Snappy).Get("unknown")
+	assert.ErrorIs(t, err, db.ErrUnknownCompression)
+
+	// Over the encryption the values are compressed before they are
+	// encrypted
+	keyring, err := db.ParseKeyring(testKey("k1", 1))
+	require.NoError(t, err)
+	c := db.NewCompressed(db.NewEncrypted(base, keyring), db.Snappy)
+	require.NoError(t, c.Put("encrypted", logs))
+	raw, err = base.Get("encrypted")
+	require.NoError(t, err)
+	assert.Less(t, len(raw), len(logs)/4)
+	value, err := c.Get("encrypted")
+	require.NoError(t, err)
+	assert.Equal(t, logs, value)
+}
+
+func TestCompressedLegacy(t *testing.T) {
+	logs := []byte(strings.Repeat("a line of the logs\n", 100))
+	legacy := append([]byte{0, 'z', 'c', 'z', 1, byte(db.Snappy)}, "raw bytes"...)
+	base := newBase(t)
+	require.NoError(t, base.Put("legacy", legacy))
+
+	// The values stored before the compression are read as they are
+	for _, algorithm := range []db.Compression{db.NoCompression, db.Snappy} {
+		value, err := db.NewCompressed(base, algorithm).Get("legacy")
+		require.NoError(t, err)
+		assert.Equal(t, legacy, value)
+	}
+
+	// The first compressed value marks the database and keeps them
+	c := db.NewCompressed(base, db.Gzip)
+	require.NoError(t, c.Put("logs", logs))
+	for _, algorithm := range []db.Compression{db.NoCompression, db.Snappy} {
+		view := db.NewCompressed(base, algorithm)
+		for k, v := range map[string][]byte{"legacy": legacy, "logs": logs} {
+			value, err := view.Get(k)
+			require.NoError(t, err)
+			assert.Equal(t, v, value, k)
+		}
+		keys, err := view.KeysByPrefix("")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"legacy", "logs"}, keys)
+		values, err := view.GetByPrefix("")
+		require.NoError(t, err)
+		assert.Len(t, values, 2)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, want := range map[string]db.Compression{"": db.NoCompression, "none": db.NoCompression, "snappy": db.Snappy, " GZIP ": db.Gzip} {
+		algorithm, err := db.ParseCompression(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, algorithm)
+	}
+	_, err := db.ParseCompression("zstd")
+	assert.ErrorIs(t, err, db.ErrUnknownCompression)
+}
@@ -1,7 +1,12 @@
 package db
 
+import "errors"
+
+// ErrNotFound is returned by the implementations when the key does not exist
+var ErrNotFound = errors.New("key not found")
+
 type Database interface {
-	// Get returns the value associated with the given key
+	// Get returns the value associated with the given key or ErrNotFound
 	Get(key string) ([]byte, error)
 	// Put inserts a key-value pair into the database
 	Put(key string, value []byte) error
@@ -11,6 +16,27 @@ type Database interface {
 	DeleteByPrefix(prefix string) error
 	// GetByPrefix returns all key-value pairs that have the given prefix
 	GetByPrefix(prefix string) (map[string][]byte, error)
+	// KeysByPrefix returns the keys that have the given prefix without
+	// reading their values
+	KeysByPrefix(prefix string) ([]string, error)
+	// NewBatch returns an empty batch of writes of this database
+	NewBatch() Batch
+	// Write commits all the writes of the batch or none of them
+	Write(b Batch) error
 	// Close closes the database
 	Close() error
 }
+
+// Batch groups writes to be committed all-or-nothing by Database.Write,
+// the writes are applied in the order they were added
+type Batch interface {
+	// Put adds the insertion of a key-value pair to the batch
+	Put(key string, value []byte)
+	// Delete adds the deletion of a key to the batch
+	Delete(key string)
+	// Len returns the number of writes in the batch
+	Len() int
+}
+
+// ErrInvalidBatch is returned when a batch of another database is written
+var ErrInvalidBatch = errors.New("invalid batch for this database")
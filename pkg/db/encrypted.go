@@ -0,0 +1,404 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// encryptedMagic starts the encrypted values, it is followed by the length
+// of the key id, the key id, the nonce and the sealed value. The values
+// without it were stored before the encryption
+var encryptedMagic = []byte{0, 'z', 'c', 'e', 1}
+
+// encryptedKey is the key of the database that records the end of the first
+// re-encryption, after it every value must be encrypted. It is hidden from
+// the views so it is not moved or collected as the other keys
+const encryptedKey = "\x00zce_encrypted"
+
+// reencryptBatchSize is the number of values rewritten by each batch of the
+// re-encryption
+const reencryptBatchSize = 100
+
+var (
+	// ErrUnknownKey is returned when a value is encrypted with a key that
+	// is not in the keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrDecrypt is returned when a value can not be decrypted, it was
+	// changed, stored under another key or stored without encryption after
+	// the re-encryption of the database
+	ErrDecrypt = errors.New("the value can not be decrypted")
+	// ErrInvalidKey is returned when a key of the keyring is not valid
+	ErrInvalidKey = errors.New("invalid encryption key")
+
+	keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+)
+
+// Keyring has the AES-256 keys by id, the values are encrypted with the
+// current key and decrypted with the key of their id
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns the keyring of the 32 bytes keys, the current one must
+// be one of them
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{current: current, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("%w: the id %q must have up to 32 letters, digits, dashes or underscores", ErrInvalidKey, id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%w: the key %s must have 32 bytes", ErrInvalidKey, id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("%w: the current key %s is not in the keyring", ErrInvalidKey, current)
+	}
+	return k, nil
+}
+
+// ParseKeyring reads the keys written as id:base64 and separated by commas
+// or new lines, the first one is the current key
+func ParseKeyring(text string) (*Keyring, error) {
+	var current string
+	keys := make(map[string][]byte)
+	for _, entry := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: the keys must be written as id:base64", ErrInvalidKey)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("%w: the id %s is repeated", ErrInvalidKey, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: the key %s is not base64", ErrInvalidKey, id)
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+	if current == "" {
+		return nil, fmt.Errorf("%w: the keyring has no keys", ErrInvalidKey)
+	}
+	return NewKeyring(current, keys)
+}
+
+// LoadKeyring reads the keys of the text and of the file, the keys of the
+// text come first
+func LoadKeyring(text, file string) (*Keyring, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text += "\n" + string(data)
+	}
+	return ParseKeyring(text)
+}
+
+// Current returns the id of the key of the new values
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// seal encrypts the value with the current key, the key of the database is
+// authenticated so a value can not be moved to another key
+func (k *Keyring) seal(key string, value []byte) ([]byte, error) {
+	aead := k.keys[k.current]
+	out := make([]byte, 0, len(encryptedMagic)+1+len(k.current)+aead.NonceSize()+len(value)+aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, byte(len(k.current)))
+	out = append(out, k.current...)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// open returns the plain value and the id of its key, it fails for the
+// values that are not encrypted
+func (k *Keyring) open(key string, value []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(value, encryptedMagic) {
+		return nil, "", fmt.Errorf("%w: %s is not encrypted", ErrDecrypt, key)
+	}
+
+	rest := value[len(encryptedMagic):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return nil, "", fmt.Errorf("%w: %s", ErrDecrypt, key)
+	}
+	id := string(rest[1 : 1+rest[0]])
+	rest = rest[1+rest[0]:]
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, "", fmt.Errorf("%w %s: %s", ErrUnknownKey, id, key)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, "", fmt.Errorf("%w: %s", ErrDecrypt, key)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrDecrypt, key)
+	}
+	return plain, id, nil
+}
+
+// Encrypted is a view of a database where every value is encrypted with
+// AES-256-GCM, the keys are stored as they are. It owns the database, closing
+// it closes the database
+type Encrypted struct {
+	db   Database
+	keys *Keyring
+	// mu holds the writes while the re-encryption rewrites a batch, so a
+	// value written in the meantime is not replaced by its older version
+	mu     sync.RWMutex
+	closed bool
+	// encrypted is set once the marker of the re-encryption is read, the
+	// values stored before the encryption are no longer accepted
+	encrypted atomic.Bool
+}
+
+// NewEncrypted returns the encrypted view of the database
+func NewEncrypted(d Database, keys *Keyring) *Encrypted {
+	return &Encrypted{db: d, keys: keys}
+}
+
+// Keys returns the keyring of the view
+func (e *Encrypted) Keys() *Keyring {
+	return e.keys
+}
+
+// open returns the plain value and the id of its key. Until the first
+// re-encryption ends the values without the header are the ones stored
+// before the encryption and are returned as they are with an empty id, the
+// values with it are always decrypted
+func (e *Encrypted) open(key string, value []byte) ([]byte, string, error) {
+	plain, id, err := e.keys.open(key, value)
+	if err == nil || e.encrypted.Load() || bytes.HasPrefix(value, encryptedMagic) {
+		return plain, id, err
+	}
+
+	_, merr := e.db.Get(encryptedKey)
+	if merr == nil {
+		e.encrypted.Store(true)
+		return nil, "", err
+	}
+	if !errors.Is(merr, ErrNotFound) {
+		return nil, "", merr
+	}
+	return value, "", nil
+}
+
+func (e *Encrypted) Get(key string) ([]byte, error) {
+	if key == encryptedKey {
+		return nil, ErrNotFound
+	}
+	value, err := e.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := e.open(key, value)
+	return plain, err
+}
+
+func (e *Encrypted) Put(key string, value []byte) error {
+	sealed, err := e.keys.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.db.Put(key, sealed)
+}
+
+func (e *Encrypted) Delete(key string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.db.Delete(key)
+}
+
+func (e *Encrypted) DeleteByPrefix(prefix string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.db.DeleteByPrefix(prefix)
+}
+
+func (e *Encrypted) GetByPrefix(prefix string) (map[string][]byte, error) {
+	values, err := e.db.GetByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	delete(values, encryptedKey)
+	for k, v := range values {
+		values[k], _, err = e.open(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (e *Encrypted) KeysByPrefix(prefix string) ([]string, error) {
+	keys, err := e.db.KeysByPrefix(prefix)
+	if err != nil || !strings.HasPrefix(encryptedKey, prefix) {
+		return keys, err
+	}
+	for i, k := range keys {
+		if k == encryptedKey {
+			return append(keys[:i], keys[i+1:]...), nil
+		}
+	}
+	return keys, nil
+}
+
+// encryptedBatch encrypts the values of the batch of the database, a value
+// that can not be encrypted fails the write of the batch
+type encryptedBatch struct {
+	Batch
+	keys *Keyring
+	err  error
+}
+
+func (b *encryptedBatch) Put(key string, value []byte) {
+	sealed, err := b.keys.seal(key, value)
+	if err != nil {
+		b.err = err
+		return
+	}
+	b.Batch.Put(key, sealed)
+}
+
+func (e *Encrypted) NewBatch() Batch {
+	return &encryptedBatch{Batch: e.db.NewBatch(), keys: e.keys}
+}
+
+func (e *Encrypted) Write(b Batch) error {
+	eb, ok := b.(*encryptedBatch)
+	if !ok || eb.keys != e.keys {
+		return ErrInvalidBatch
+	}
+	if eb.err != nil {
+		return eb.err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.db.Write(eb.Batch)
+}
+
+// Close closes the database once the batch of the re-encryption in progress
+// is written
+func (e *Encrypted) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	return e.db.Close()
+}
+
+// Reencrypt rewrites with the current key the values encrypted with the
+// other keys and the ones stored before the encryption, after it the old
+// keys can be removed from the keyring and the values that are not encrypted
+// are rejected. It stops when stop is closed and returns the number of
+// values rewritten
+func (e *Encrypted) Reencrypt(stop <-chan struct{}) (int, error) {
+	keys, err := e.KeysByPrefix("")
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for len(keys) > 0 {
+		select {
+		case <-stop:
+			return rewritten, nil
+		default:
+		}
+
+		n := min(reencryptBatchSize, len(keys))
+		count, err := e.reencryptBatch(keys[:n])
+		rewritten += count
+		if err != nil {
+			return rewritten, err
+		}
+		keys = keys[n:]
+	}
+
+	if !e.encrypted.Load() {
+		err = e.db.Put(encryptedKey, []byte(e.keys.current))
+		if err != nil {
+			return rewritten, err
+		}
+		e.encrypted.Store(true)
+	}
+	return rewritten, nil
+}
+
+// reencryptBatch rewrites the values of the keys that are not encrypted with
+// the current key, the writes are held until the values are written. Each
+// value is put on its own, as a batch of large values does not fit in the
+// batches of some databases
+func (e *Encrypted) reencryptBatch(keys []string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0, nil
+	}
+
+	rewritten := 0
+	for _, k := range keys {
+		value, err := e.db.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		plain, id, err := e.open(k, value)
+		if err != nil {
+			return rewritten, err
+		}
+		if id == e.keys.current {
+			continue
+		}
+		sealed, err := e.keys.seal(k, plain)
+		if err != nil {
+			return rewritten, err
+		}
+		err = e.db.Put(k, sealed)
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,194 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey returns a key of 32 bytes as id:base64
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newEncrypted(t *testing.T, keys string) (*db.Encrypted, db.Database) {
+	base, err := leveldb.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { base.Close() })
+
+	keyring, err := db.ParseKeyring(keys)
+	require.NoError(t, err)
+	return db.NewEncrypted(base, keyring), base
+}
+
+func TestEncrypted(t *testing.T) {
+	e, base := newEncrypted(t, testKey("k1", 1))
+
+	require.NoError(t, e.Put("file_1", []byte("secret content")))
+	value, err := e.Get("file_1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret content"), value)
+
+	// The values are stored encrypted and the keys as they are
+	raw, err := base.Get("file_1")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "secret")
+	keys, err := e.KeysByPrefix("file_")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file_1"}, keys)
+
+	b := e.NewBatch()
+	b.Put("file_2", []byte("second"))
+	b.Put("file_3", []byte{})
+	b.Delete("file_1")
+	require.NoError(t, e.Write(b))
+	assert.ErrorIs(t, e.Write(base.NewBatch()), db.ErrInvalidBatch)
+
+	values, err := e.GetByPrefix("file_")
+	require.NoError(t, err)
+	assert.Len(t, values, 2)
+	assert.Equal(t, []byte("second"), values["file_2"])
+	assert.Empty(t, values["file_3"])
+	_, err = e.Get("file_1")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	// After the re-encryption a value moved to another key, changed or not
+	// encrypted is not read
+	_, err = e.Reencrypt(nil)
+	require.NoError(t, err)
+	require.NoError(t, base.Put("file_5", []byte("injected")))
+	_, err = e.Get("file_5")
+	assert.ErrorIs(t, err, db.ErrDecrypt)
+	raw, err = base.Get("file_2")
+	require.NoError(t, err)
+	require.NoError(t, base.Put("file_4", raw))
+	_, err = e.Get("file_4")
+	assert.ErrorIs(t, err, db.ErrDecrypt)
+	raw[len(raw)-1] ^= 1
+	require.NoError(t, base.Put("file_2", raw))
+	_, err = e.Get("file_2")
+	assert.ErrorIs(t, err, db.ErrDecrypt)
+
+	// The prefixed views of the tenants are encrypted too
+	view := db.NewPrefixed(e, "ns_a/")
+	require.NoError(t, view.Put("file_1", []byte("tenant")))
+	raw, err = base.Get("ns_a/file_1")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "tenant")
+	value, err = view.Get("file_1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("tenant"), value)
+}
+
+func TestEncryptedRotation(t *testing.T) {
+	e, base := newEncrypted(t, testKey("k1", 1))
+	require.NoError(t, base.Put("legacy", []byte("plaintext")))
+	for i := 0; i < 250; i++ {
+		require.NoError(t, e.Put("key_"+strings.Repeat("a", i), []byte("value")))
+	}
+
+	// The values stored before the encryption are read as they are, the
+	// ones that start as an encrypted value must be decrypted
+	value, err := e.Get("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plaintext"), value)
+	require.NoError(t, base.Put("forged", []byte("\x00zce\x01legacy")))
+	_, err = e.Get("forged")
+	assert.ErrorIs(t, err, db.ErrDecrypt)
+	require.NoError(t, base.Put("forged", append([]byte("\x00zce\x01\x02k9"), make([]byte, 40)...)))
+	_, err = e.Get("forged")
+	assert.ErrorIs(t, err, db.ErrUnknownKey)
+	require.NoError(t, base.Delete("forged"))
+
+	// The new key is the first one, the old values are still read
+	keyring, err := db.ParseKeyring(testKey("k2", 2) + "," + testKey("k1", 1))
+	require.NoError(t, err)
+	rotated := db.NewEncrypted(base, keyring)
+	value, err = rotated.Get("key_a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	n, err := rotated.Reencrypt(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 251, n)
+	n, err = rotated.Reencrypt(nil)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	raw, err := base.Get("legacy")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "plaintext")
+
+	// The marker of the re-encryption is hidden and the values stored
+	// without encryption after it are rejected
+	keys, err := rotated.KeysByPrefix("")
+	require.NoError(t, err)
+	assert.Len(t, keys, 251)
+	values, err := rotated.GetByPrefix("")
+	require.NoError(t, err)
+	assert.Len(t, values, 251)
+	require.NoError(t, base.Put("legacy", []byte("injected")))
+	_, err = db.NewEncrypted(base, keyring).Get("legacy")
+	assert.ErrorIs(t, err, db.ErrDecrypt)
+	require.NoError(t, rotated.Put("legacy", []byte("plaintext")))
+
+	// Once re-encrypted the old key is no longer needed
+	keyring, err = db.ParseKeyring(testKey("k2", 2))
+	require.NoError(t, err)
+	current := db.NewEncrypted(base, keyring)
+	value, err = current.Get("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plaintext"), value)
+
+	_, err = e.Get("legacy")
+	assert.ErrorIs(t, err, db.ErrUnknownKey)
+
+	// The re-encryption stops when asked
+	stop := make(chan struct{})
+	close(stop)
+	n, err = e.Reencrypt(stop)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := db.ParseKeyring(" " + testKey("k2", 2) + " ,\n" + testKey("k1", 1) + "\n# old keys\n")
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyring.Current())
+
+	tests := []struct {
+		keys string
+		err  string
+	}{
+		{"", "the keyring has no keys"},
+		{"k1", "the keys must be written as id:base64"},
+		{"k1:???", "the key k1 is not base64"},
+		{"k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "the key k1 must have 32 bytes"},
+		{testKey("k/1", 1), `the id "k/1" must have`},
+		{testKey("k1", 1) + "," + testKey("k1", 2), "the id k1 is repeated"},
+	}
+	for _, tt := range tests {
+		_, err := db.ParseKeyring(tt.keys)
+		assert.ErrorIs(t, err, db.ErrInvalidKey, tt.keys)
+		assert.ErrorContains(t, err, tt.err, tt.keys)
+	}
+
+	file := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(file, []byte(testKey("k1", 1)+"\n"), 0o600))
+	keyring, err = db.LoadKeyring(testKey("k2", 2), file)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keyring.Current())
+	keyring, err = db.LoadKeyring("", file)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", keyring.Current())
+	_, err = db.LoadKeyring("", filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
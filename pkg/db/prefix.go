@@ -0,0 +1,87 @@
+package db
+
+import "strings"
+
+// prefixed is a view of a database where every key is stored with the
+// prefix, the keys are given and returned without it so the view can not
+// reach the keys outside its prefix
+type prefixed struct {
+	db     Database
+	prefix string
+}
+
+// NewPrefixed returns a view of the database with every key under the
+// prefix, closing the view does not close the database
+func NewPrefixed(d Database, prefix string) Database {
+	return &prefixed{db: d, prefix: prefix}
+}
+
+func (p *prefixed) Get(key string) ([]byte, error) {
+	return p.db.Get(p.prefix + key)
+}
+
+func (p *prefixed) Put(key string, value []byte) error {
+	return p.db.Put(p.prefix+key, value)
+}
+
+func (p *prefixed) Delete(key string) error {
+	return p.db.Delete(p.prefix + key)
+}
+
+func (p *prefixed) DeleteByPrefix(prefix string) error {
+	return p.db.DeleteByPrefix(p.prefix + prefix)
+}
+
+func (p *prefixed) GetByPrefix(prefix string) (map[string][]byte, error) {
+	values, err := p.db.GetByPrefix(p.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]byte, len(values))
+	for k, v := range values {
+		result[strings.TrimPrefix(k, p.prefix)] = v
+	}
+	return result, nil
+}
+
+func (p *prefixed) KeysByPrefix(prefix string) ([]string, error) {
+	keys, err := p.db.KeysByPrefix(p.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, p.prefix)
+	}
+	return keys, nil
+}
+
+// prefixedBatch adds the prefix to the keys of the batch of the database
+type prefixedBatch struct {
+	Batch
+	prefix string
+}
+
+func (b *prefixedBatch) Put(key string, value []byte) {
+	b.Batch.Put(b.prefix+key, value)
+}
+
+func (b *prefixedBatch) Delete(key string) {
+	b.Batch.Delete(b.prefix + key)
+}
+
+func (p *prefixed) NewBatch() Batch {
+	return &prefixedBatch{Batch: p.db.NewBatch(), prefix: p.prefix}
+}
+
+func (p *prefixed) Write(b Batch) error {
+	pb, ok := b.(*prefixedBatch)
+	if !ok || pb.prefix != p.prefix {
+		return ErrInvalidBatch
+	}
+	return p.db.Write(pb.Batch)
+}
+
+// Close does nothing, the database is closed by its owner
+func (p *prefixed) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmsilvadev/zc/pkg/db"
+	"github.com/jmsilvadev/zc/pkg/leveldb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixed(t *testing.T) {
+	base, err := leveldb.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer base.Close()
+
+	a := db.NewPrefixed(base, "ns_a/")
+	b := db.NewPrefixed(base, "ns_b/")
+
+	require.NoError(t, a.Put("key1", []byte("a1")))
+	require.NoError(t, b.Put("key1", []byte("b1")))
+	require.NoError(t, base.Put("key2", []byte("global")))
+
+	value, err := a.Get("key1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a1"), value)
+	value, err = base.Get("ns_b/key1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b1"), value)
+
+	// The keys outside the prefix are not visible
+	_, err = a.Get("key2")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	keys, err := a.KeysByPrefix("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key1"}, keys)
+	values, err := b.GetByPrefix("key")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"key1": []byte("b1")}, values)
+
+	batch := a.NewBatch()
+	batch.Put("key3", []byte("a3"))
+	batch.Delete("key1")
+	assert.Equal(t, 2, batch.Len())
+	require.NoError(t, a.Write(batch))
+	assert.ErrorIs(t, b.Write(batch), db.ErrInvalidBatch)
+	assert.ErrorIs(t, a.Write(base.NewBatch()), db.ErrInvalidBatch)
+
+	require.NoError(t, a.DeleteByPrefix(""))
+	keys, err = base.KeysByPrefix("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key2", "ns_b/key1"}, keys)
+
+	// Closing a view keeps the database open
+	require.NoError(t, a.Close())
+	_, err = base.Get("key2")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,252 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block size chosen by
+	// DefaultBlockSize
+	MinBlockSize = 512
+	MaxBlockSize = 64 * 1024
+	// strongSize is the size of the truncated sha256 of the blocks, the
+	// whole file is checked against its hash after the reconstruction
+	strongSize = 16
+)
+
+// BlockSignature identifies a block of the base file
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// Signature has the checksums of the blocks of the base file
+type Signature struct {
+	BlockSize int              `json:"block_size"`
+	Size      int              `json:"size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// Op is an operation of a delta, it copies Count blocks of the base from
+// Block or, when Count is zero, adds the literal Data
+type Op struct {
+	Block int    `json:"block,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// DefaultBlockSize returns a block size of about the square root of the size
+// as rsync does
+func DefaultBlockSize(size int) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return blockSize
+}
+
+// NewSignature returns the signature of the blocks of base
+func NewSignature(base []byte, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("invalid block size")
+	}
+
+	sig := &Signature{BlockSize: blockSize, Size: len(base)}
+	for start := 0; start < len(base); start += blockSize {
+		end := start + blockSize
+		if end > len(base) {
+			end = len(base)
+		}
+		block := base[start:end]
+		sig.Blocks = append(sig.Blocks, BlockSignature{
+			Weak:   weakSum(block),
+			Strong: strongSum(block),
+		})
+	}
+	return sig, nil
+}
+
+// Compute returns the operations that transform the base described by the
+// signature in data, only the bytes not found in the base are sent
+func Compute(sig *Signature, data []byte) []Op {
+	var ops []Op
+	addLiteral := func(literal []byte) {
+		if len(literal) == 0 {
+			return
+		}
+		if n := len(ops); n > 0 && ops[n-1].Count == 0 {
+			ops[n-1].Data = append(ops[n-1].Data, literal...)
+			return
+		}
+		ops = append(ops, Op{Data: append([]byte{}, literal...)})
+	}
+	addCopy := func(block int) {
+		if n := len(ops); n > 0 && ops[n-1].Count > 0 && ops[n-1].Block+ops[n-1].Count == block {
+			ops[n-1].Count++
+			return
+		}
+		ops = append(ops, Op{Block: block, Count: 1})
+	}
+
+	bs := sig.BlockSize
+	weaks := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		// the last block can be shorter and it is checked at the end
+		if i == len(sig.Blocks)-1 && sig.Size%bs != 0 {
+			continue
+		}
+		weaks[b.Weak] = append(weaks[b.Weak], i)
+	}
+
+	literal := 0
+	i := 0
+	var a, b uint32
+	rolling := false
+	for i+bs <= len(data) {
+		if !rolling {
+			a, b = sums(data[i : i+bs])
+			rolling = true
+		}
+
+		if block, ok := findBlock(sig, weaks, a|b<<16, data[i:i+bs]); ok {
+			addLiteral(data[literal:i])
+			addCopy(block)
+			i += bs
+			literal = i
+			rolling = false
+			continue
+		}
+
+		if i+bs < len(data) {
+			out, in := uint32(data[i]), uint32(data[i+bs])
+			a = (a - out + in) & 0xffff
+			b = (b - uint32(bs)*out + a) & 0xffff
+		}
+		i++
+	}
+
+	// the tail can match the last short block of the base
+	if n := len(sig.Blocks); n > 0 && sig.Size%bs != 0 {
+		last := sig.Blocks[n-1]
+		tail := sig.Size % bs
+		if len(data)-literal >= tail {
+			candidate := data[len(data)-tail:]
+			if weakSum(candidate) == last.Weak && bytes.Equal(strongSum(candidate), last.Strong) {
+				addLiteral(data[literal : len(data)-tail])
+				addCopy(n - 1)
+				return ops
+			}
+		}
+	}
+
+	addLiteral(data[literal:])
+	return ops
+}
+
+// ErrTooLarge is returned when the file rebuilt by a delta is larger than
+// the maximum size
+var ErrTooLarge = errors.New("the delta rebuilds a file over the maximum size")
+
+// Apply rebuilds the new file from the base and the operations, the file is
+// limited to maxSize bytes, zero is unlimited. The operations are checked
+// and the size of the file counted before it is built
+func Apply(base []byte, blockSize int, ops []Op, maxSize int) ([]byte, error) {
+	if blockSize <= 0 {
+		return nil, errors.New("invalid block size")
+	}
+	if maxSize <= 0 {
+		maxSize = math.MaxInt
+	}
+
+	blocks := len(base) / blockSize
+	if len(base)%blockSize != 0 {
+		blocks++
+	}
+
+	size := 0
+	for _, op := range ops {
+		n := len(op.Data)
+		if op.Count != 0 {
+			// NOTE: the bounds are compared without adding them so a large
+			// count does not overflow
+			if op.Block < 0 || op.Count < 0 || op.Block > blocks || op.Count > blocks-op.Block {
+				return nil, fmt.Errorf("invalid blocks %d+%d, the base has %d blocks", op.Block, op.Count, blocks)
+			}
+			n = blockEnd(len(base), blockSize, blocks, op.Block+op.Count) - op.Block*blockSize
+		}
+		if n > maxSize-size {
+			return nil, fmt.Errorf("%w of %d bytes", ErrTooLarge, maxSize)
+		}
+		size += n
+	}
+
+	result := make([]byte, 0, size)
+	for _, op := range ops {
+		if op.Count == 0 {
+			result = append(result, op.Data...)
+			continue
+		}
+		result = append(result, base[op.Block*blockSize:blockEnd(len(base), blockSize, blocks, op.Block+op.Count)]...)
+	}
+	return result, nil
+}
+
+// blockEnd returns the offset of the end of the block before block, the last
+// block ends with the base
+func blockEnd(size, blockSize, blocks, block int) int {
+	if block >= blocks {
+		return size
+	}
+	return block * blockSize
+}
+
+// Size returns the bytes of literal data of the operations
+func Size(ops []Op) int {
+	size := 0
+	for _, op := range ops {
+		size += len(op.Data)
+	}
+	return size
+}
+
+func findBlock(sig *Signature, weaks map[uint32][]int, weak uint32, block []byte) (int, bool) {
+	candidates, ok := weaks[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(block)
+	for _, i := range candidates {
+		if bytes.Equal(sig.Blocks[i].Strong, strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// sums returns the two parts of the rsync rolling checksum
+func sums(block []byte) (uint32, uint32) {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, x := range block {
+		a += uint32(x)
+		b += (l - uint32(i)) * uint32(x)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func weakSum(block []byte) uint32 {
+	a, b := sums(block)
+	return a | b<<16
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:strongSize]
+}
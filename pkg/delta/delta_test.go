@@ -0,0 +1,106 @@
+package delta
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestDelta(t *testing.T) {
+	base := randomData(1<<20+123, 1)
+
+	changed := append([]byte{}, base[:1000]...)
+	changed = append(changed, []byte("inserted in the beginning")...)
+	changed = append(changed, base[1000:500000]...)
+	changed = append(changed, randomData(3000, 2)...)
+	changed = append(changed, base[510000:]...)
+
+	cases := map[string][]byte{
+		"unchanged": base,
+		"changed":   changed,
+		"empty":     {},
+		"new":       randomData(5000, 3),
+		"truncated": base[:len(base)/2],
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			sig, err := NewSignature(base, DefaultBlockSize(len(base)))
+			require.NoError(t, err)
+
+			ops := Compute(sig, data)
+			result, err := Apply(base, sig.BlockSize, ops, 0)
+			require.NoError(t, err)
+			require.Equal(t, len(data), len(result))
+			require.Equal(t, data, result)
+		})
+	}
+
+	sig, err := NewSignature(base, DefaultBlockSize(len(base)))
+	require.NoError(t, err)
+
+	require.Equal(t, 0, Size(Compute(sig, base)))
+	// only the changed blocks are sent
+	require.Less(t, Size(Compute(sig, changed)), 3000+4*sig.BlockSize)
+}
+
+func TestDeltaEmptyBase(t *testing.T) {
+	sig, err := NewSignature(nil, 512)
+	require.NoError(t, err)
+
+	data := randomData(2000, 4)
+	ops := Compute(sig, data)
+	require.Equal(t, len(data), Size(ops))
+
+	result, err := Apply(nil, 512, ops, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, result)
+}
+
+func TestApplyInvalid(t *testing.T) {
+	_, err := Apply([]byte("base"), 2, []Op{{Block: 1, Count: 2}}, 0)
+	require.Error(t, err)
+
+	_, err = Apply([]byte("base"), 0, nil, 0)
+	require.Error(t, err)
+
+	// The bounds do not overflow with large counts or block sizes
+	base := make([]byte, 1000)
+	for _, op := range []Op{{Block: 1, Count: math.MaxInt}, {Block: math.MaxInt, Count: 1}, {Block: -1, Count: 1}, {Block: 0, Count: -1}} {
+		_, err = Apply(base, 512, []Op{op}, 0)
+		require.Error(t, err)
+	}
+	result, err := Apply(base, math.MaxInt, []Op{{Block: 0, Count: 1}}, 0)
+	require.NoError(t, err)
+	require.Equal(t, base, result)
+
+	// The copies of the base can not amplify the delta over the maximum
+	ops := make([]Op, 100)
+	for i := range ops {
+		ops[i] = Op{Block: 0, Count: 2}
+	}
+	_, err = Apply(base, 512, ops, 10*len(base))
+	require.ErrorIs(t, err, ErrTooLarge)
+	result, err = Apply(base, 512, ops, 100*len(base))
+	require.NoError(t, err)
+	require.Len(t, result, 100*len(base))
+	_, err = Apply(base, 512, []Op{{Data: make([]byte, 11)}}, 10)
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	_, err = NewSignature([]byte("base"), 0)
+	require.Error(t, err)
+}
+
+func TestDefaultBlockSize(t *testing.T) {
+	require.Equal(t, MinBlockSize, DefaultBlockSize(10))
+	require.Equal(t, 1024, DefaultBlockSize(1024*1024))
+	require.Equal(t, MaxBlockSize, DefaultBlockSize(1<<40))
+}
@@ -1,6 +1,9 @@
 package leveldb
 
 import (
+	"errors"
+
+	"github.com/jmsilvadev/zc/pkg/db"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -25,6 +28,9 @@ func New(path string) (*DB, error) {
 // Get returns the value associated with the given key
 func (d *DB) Get(key string) ([]byte, error) {
 	data, err := d.db.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, db.ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +65,54 @@ func (d *DB) GetByPrefix(prefix string) (map[string][]byte, error) {
 	return result, nil
 }
 
+// KeysByPrefix returns the keys that have the given prefix
+func (d *DB) KeysByPrefix(prefix string) ([]string, error) {
+	var keys []string
+	iter := d.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// batch wraps leveldb.Batch to implement the db.Batch interface
+type batch struct {
+	b *leveldb.Batch
+}
+
+func (b *batch) Put(key string, value []byte) {
+	b.b.Put([]byte(key), value)
+}
+
+func (b *batch) Delete(key string) {
+	b.b.Delete([]byte(key))
+}
+
+func (b *batch) Len() int {
+	return b.b.Len()
+}
+
+// NewBatch returns an empty batch of writes
+func (d *DB) NewBatch() db.Batch {
+	return &batch{b: new(leveldb.Batch)}
+}
+
+// Write commits the batch atomically, leveldb writes the whole batch in
+// the journal before applying it
+func (d *DB) Write(b db.Batch) error {
+	lb, ok := b.(*batch)
+	if !ok {
+		return db.ErrInvalidBatch
+	}
+	return d.db.Write(lb.b, &opt.WriteOptions{Sync: true})
+}
+
 // Delete deletes a key-value pair from the database
 func (d *DB) Delete(key string) error {
 	err := d.db.Delete([]byte(key), nil)
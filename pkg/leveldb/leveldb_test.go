@@ -3,6 +3,7 @@ package leveldb
 import (
 	"testing"
 
+	dbi "github.com/jmsilvadev/zc/pkg/db"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,6 +28,11 @@ func TestHappyPath(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("GetNotFound", func(t *testing.T) {
+		_, err := db.Get(key)
+		require.ErrorIs(t, err, dbi.ErrNotFound)
+	})
+
 	t.Run("DeleteByPrefix", func(t *testing.T) {
 		err := db.DeleteByPrefix(key)
 		require.NoError(t, err)
@@ -51,6 +57,38 @@ func TestHappyPath(t *testing.T) {
 		}
 	})
 
+	t.Run("KeysByPrefix", func(t *testing.T) {
+		keys, err := db.KeysByPrefix("prefix_")
+		require.NoError(t, err)
+		require.Equal(t, []string{"prefix_key1", "prefix_key2", "prefix_key3"}, keys)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		b := db.NewBatch()
+		b.Put("batch_key1", []byte("value1"))
+		b.Put("batch_key2", []byte("value2"))
+		b.Delete("batch_key1")
+		require.Equal(t, 3, b.Len())
+
+		_, err := db.Get("batch_key2")
+		require.ErrorIs(t, err, dbi.ErrNotFound)
+
+		err = db.Write(b)
+		require.NoError(t, err)
+
+		_, err = db.Get("batch_key1")
+		require.ErrorIs(t, err, dbi.ErrNotFound)
+		r, err := db.Get("batch_key2")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), r)
+
+		err = db.Write(nil)
+		require.ErrorIs(t, err, dbi.ErrInvalidBatch)
+
+		err = db.Delete("batch_key2")
+		require.NoError(t, err)
+	})
+
 	err = db.Close()
 	require.NoError(t, err)
 
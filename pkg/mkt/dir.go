@@ -0,0 +1,251 @@
+package mkt
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EntryType is the type of an entry of a directory
+type EntryType string
+
+const (
+	EntryFile EntryType = "file"
+	EntryDir  EntryType = "dir"
+)
+
+// Entry is a leaf of a directory tree, like a git tree entry it commits to
+// the name, the type, the permissions and the hash of the child
+type Entry struct {
+	Name string    `json:"name"`
+	Type EntryType `json:"type"`
+	Mode uint32    `json:"mode"`
+	Hash string    `json:"hash"`
+}
+
+// File is a file of a hierarchy identified by its slash separated path
+type File struct {
+	Path string
+	Mode uint32
+	Hash string
+}
+
+// Directory is a node of a hierarchical tree, its hash is the root of the
+// Merkle Tree built with the leaf hashes of its entries sorted by name
+type Directory struct {
+	Hash     string
+	Entries  []Entry
+	Children map[string]*Directory
+}
+
+// PathStep is the entry of a directory in a path and the proof that the
+// entry belongs to the directory
+type PathStep struct {
+	Entry Entry  `json:"entry"`
+	Proof *Proof `json:"proof"`
+}
+
+// PathProof proves that a path leads to an entry, the steps go from the
+// root directory to the entry
+type PathProof struct {
+	Steps []PathStep `json:"steps"`
+}
+
+// LeafHash returns the leaf hash of the entry in the directory tree
+func (e Entry) LeafHash(mode Mode) string {
+	// NOTE: the name cannot have \x00 or / so the encoding is not ambiguous
+	return mode.HashLeaf([]byte(string(e.Type) + " " + strconv.FormatUint(uint64(e.Mode), 8) + " " + e.Name + "\x00" + e.Hash))
+}
+
+// DirectoryHash returns the hash of a directory with the given entries, a
+// directory has at least one entry
+func DirectoryHash(entries []Entry, mode Mode) (string, error) {
+	tree, err := newEntriesTree(entries, mode)
+	if err != nil {
+		return "", err
+	}
+	return tree.Root.Hash, nil
+}
+
+// GetEntryProof returns the entry with the given name and its proof in the
+// tree of the directory
+func GetEntryProof(entries []Entry, name string, mode Mode) (*Entry, *Proof, error) {
+	for i := range entries {
+		if entries[i].Name != name {
+			continue
+		}
+		tree, err := newEntriesTree(entries, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		proof, err := tree.GetProof(entries[i].LeafHash(mode))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &entries[i], proof, nil
+	}
+	return nil, nil, fmt.Errorf("entry %s not found in the directory", name)
+}
+
+// NewDirectory builds the hierarchy of directories with the given files
+func NewDirectory(files []File, mode Mode) (*Directory, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files to build the directory")
+	}
+
+	root := &Directory{Children: map[string]*Directory{}}
+	names := map[*Directory]map[string]EntryType{root: {}}
+
+	for _, f := range files {
+		parts, err := SplitPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("invalid path %s", f.Path)
+		}
+
+		dir := root
+		for _, name := range parts[:len(parts)-1] {
+			if t, ok := names[dir][name]; ok && t != EntryDir {
+				return nil, fmt.Errorf("%s is a file and a directory", f.Path)
+			}
+			child, ok := dir.Children[name]
+			if !ok {
+				child = &Directory{Children: map[string]*Directory{}}
+				dir.Children[name] = child
+				names[dir][name] = EntryDir
+				names[child] = map[string]EntryType{}
+			}
+			dir = child
+		}
+
+		name := parts[len(parts)-1]
+		if _, ok := names[dir][name]; ok {
+			return nil, fmt.Errorf("duplicated path %s", f.Path)
+		}
+		names[dir][name] = EntryFile
+		dir.Entries = append(dir.Entries, Entry{Name: name, Type: EntryFile, Mode: f.Mode, Hash: f.Hash})
+	}
+
+	root.hash(mode)
+	return root, nil
+}
+
+// Walk calls fn for the directory and all its descendants, the parents
+// are visited before the children
+func (d *Directory) Walk(fn func(dirPath string, dir *Directory) error) error {
+	return d.walk("", fn)
+}
+
+// GetPathProof returns the entry of the path and the proof that it belongs
+// to the hierarchy
+func (d *Directory) GetPathProof(p string, mode Mode) (*Entry, *PathProof, error) {
+	parts, err := SplitPath(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &Entry{Type: EntryDir, Mode: 0o755, Hash: d.Hash}
+	proof := &PathProof{}
+	dir := d
+	for i, name := range parts {
+		if dir == nil {
+			return nil, nil, fmt.Errorf("%s is not a directory", path.Join(parts[:i]...))
+		}
+		var step *Proof
+		entry, step, err = GetEntryProof(dir.Entries, name, mode)
+		if err != nil {
+			return nil, nil, err
+		}
+		proof.Steps = append(proof.Steps, PathStep{Entry: *entry, Proof: step})
+		dir = dir.Children[name]
+	}
+
+	return entry, proof, nil
+}
+
+// VerifyPathProof verifies that the path leads to an entry with the given
+// hash in the hierarchy of the rootHash
+func VerifyPathProof(p, hash, rootHash string, proof *PathProof, mode Mode) bool {
+	parts, err := SplitPath(p)
+	if err != nil || proof == nil || len(parts) != len(proof.Steps) {
+		return false
+	}
+
+	for i := len(proof.Steps) - 1; i >= 0; i-- {
+		step := proof.Steps[i]
+		if step.Entry.Name != parts[i] || step.Entry.Hash != hash || step.Proof == nil {
+			return false
+		}
+		if i < len(proof.Steps)-1 && step.Entry.Type != EntryDir {
+			return false
+		}
+		hash = GetProofHashWithMode(step.Entry.LeafHash(mode), step.Proof, mode)
+	}
+
+	return hash == rootHash
+}
+
+// SplitPath returns the names of a slash separated relative path, the
+// empty path and "." are the root directory
+func SplitPath(p string) ([]string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		return nil, nil
+	}
+	if path.Clean(p) != p {
+		return nil, fmt.Errorf("invalid path %s", p)
+	}
+
+	parts := strings.Split(p, "/")
+	for _, name := range parts {
+		if name == ".." || name == "." || strings.ContainsRune(name, 0) {
+			return nil, fmt.Errorf("invalid path %s", p)
+		}
+	}
+	return parts, nil
+}
+
+// hash computes the hashes of the children and then the directory one
+func (d *Directory) hash(mode Mode) {
+	for name, child := range d.Children {
+		child.hash(mode)
+		d.Entries = append(d.Entries, Entry{Name: name, Type: EntryDir, Mode: 0o755, Hash: child.Hash})
+	}
+	sort.Slice(d.Entries, func(i, j int) bool {
+		return d.Entries[i].Name < d.Entries[j].Name
+	})
+	// NOTE: the directories are built from the paths of the files, so
+	// each one has at least one entry
+	d.Hash, _ = DirectoryHash(d.Entries, mode)
+}
+
+func (d *Directory) walk(dirPath string, fn func(dirPath string, dir *Directory) error) error {
+	err := fn(dirPath, d)
+	if err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		if e.Type != EntryDir {
+			continue
+		}
+		err = d.Children[e.Name].walk(path.Join(dirPath, e.Name), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newEntriesTree builds the Merkle Tree of the entries of a directory
+func newEntriesTree(entries []Entry, mode Mode) (*MerkleTree, error) {
+	hashes := make([]string, len(entries))
+	for i, e := range entries {
+		hashes[i] = e.LeafHash(mode)
+	}
+	return NewMerkleTreeWithMode(hashes, mode)
+}
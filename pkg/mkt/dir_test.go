@@ -0,0 +1,85 @@
+package mkt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectory(t *testing.T) {
+	files := []File{
+		{Path: "a/b/c.txt", Mode: 0o644, Hash: SHA256.HashLeaf([]byte("c"))},
+		{Path: "a/d.txt", Mode: 0o600, Hash: SHA256.HashLeaf([]byte("d"))},
+		{Path: "e.txt", Mode: 0o644, Hash: SHA256.HashLeaf([]byte("e"))},
+		{Path: "a/b/f.txt", Mode: 0o755, Hash: SHA256.HashLeaf([]byte("f"))},
+	}
+
+	for _, mode := range []Mode{SHA256, Keccak256Sorted} {
+		d, err := NewDirectory(files, mode)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "e.txt"}, []string{d.Entries[0].Name, d.Entries[1].Name})
+		require.Equal(t, EntryDir, d.Entries[0].Type)
+
+		for _, f := range files {
+			entry, proof, err := d.GetPathProof(f.Path, mode)
+			require.NoError(t, err)
+			require.Equal(t, f.Hash, entry.Hash)
+			require.Equal(t, f.Mode, entry.Mode)
+			require.True(t, VerifyPathProof(f.Path, f.Hash, d.Hash, proof, mode))
+
+			// The path is part of the proof
+			require.False(t, VerifyPathProof("a/x.txt", f.Hash, d.Hash, proof, mode))
+		}
+
+		entry, proof, err := d.GetPathProof("a/b", mode)
+		require.NoError(t, err)
+		require.Equal(t, EntryDir, entry.Type)
+		require.True(t, VerifyPathProof("a/b", entry.Hash, d.Hash, proof, mode))
+		require.Equal(t, entry.Hash, d.Children["a"].Children["b"].Hash)
+
+		_, _, err = d.GetPathProof("a/b/c.txt/x", mode)
+		require.Error(t, err)
+		_, _, err = d.GetPathProof("a/z", mode)
+		require.Error(t, err)
+
+		var dirs []string
+		err = d.Walk(func(dirPath string, dir *Directory) error {
+			dirs = append(dirs, dirPath)
+			hash, err := DirectoryHash(dir.Entries, mode)
+			require.NoError(t, err)
+			require.Equal(t, hash, dir.Hash)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"", "a", "a/b"}, dirs)
+	}
+}
+
+func TestDirectoryCommitsToLayout(t *testing.T) {
+	hash := SHA256.HashLeaf([]byte("c"))
+	d1, err := NewDirectory([]File{{Path: "a/c.txt", Mode: 0o644, Hash: hash}}, SHA256)
+	require.NoError(t, err)
+	d2, err := NewDirectory([]File{{Path: "b/c.txt", Mode: 0o644, Hash: hash}}, SHA256)
+	require.NoError(t, err)
+	d3, err := NewDirectory([]File{{Path: "a/c.txt", Mode: 0o600, Hash: hash}}, SHA256)
+	require.NoError(t, err)
+
+	require.NotEqual(t, d1.Hash, d2.Hash)
+	require.NotEqual(t, d1.Hash, d3.Hash)
+}
+
+func TestDirectoryInvalid(t *testing.T) {
+	_, err := NewDirectory(nil, SHA256)
+	require.Error(t, err)
+
+	for _, p := range []string{"", "../a", "a/../../b", "a//b", "./a"} {
+		_, err = NewDirectory([]File{{Path: p}}, SHA256)
+		require.Error(t, err, p)
+	}
+
+	_, err = NewDirectory([]File{{Path: "a/b"}, {Path: "a/b"}}, SHA256)
+	require.Error(t, err)
+
+	_, err = NewDirectory([]File{{Path: "a"}, {Path: "a/b"}}, SHA256)
+	require.Error(t, err)
+}
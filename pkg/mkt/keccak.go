@@ -0,0 +1,148 @@
+package mkt
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// NOTE: this is the original Keccak-256 used by Ethereum (padding 0x01), not
+// the NIST SHA3-256 (padding 0x06). It is implemented here to avoid pulling
+// an extra dependency only for the keccak256 opcode compatibility.
+
+const keccakRate = 136 // 1088 bits for a 256 bits output
+
+var keccakRoundConstants = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808A, 0x8000000080008000,
+	0x000000000000808B, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008A, 0x0000000000000088, 0x0000000080008009, 0x000000008000000A,
+	0x000000008000808B, 0x800000000000008B, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800A, 0x800000008000000A,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+var keccakRotations = [25]int{
+	0, 1, 62, 28, 27,
+	36, 44, 6, 55, 20,
+	3, 10, 43, 25, 39,
+	41, 45, 15, 21, 8,
+	18, 2, 61, 56, 14,
+}
+
+// Keccak256 returns the Ethereum flavour of the keccak256 digest of data
+func Keccak256(data []byte) [32]byte {
+	var out [32]byte
+	h := NewKeccak256()
+	h.Write(data)
+	h.Sum(out[:0])
+	return out
+}
+
+// keccak256 is the streaming version of Keccak256
+type keccak256 struct {
+	state [25]uint64
+	buf   []byte
+}
+
+// NewKeccak256 returns a hash.Hash computing the Ethereum keccak256, so big
+// files can be hashed while they are read
+func NewKeccak256() hash.Hash {
+	return &keccak256{buf: make([]byte, 0, keccakRate)}
+}
+
+func (k *keccak256) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(k.buf) > 0 {
+		m := copy(k.buf[len(k.buf):keccakRate], p)
+		k.buf = k.buf[:len(k.buf)+m]
+		p = p[m:]
+		if len(k.buf) < keccakRate {
+			return n, nil
+		}
+		absorb(&k.state, k.buf)
+		keccakF1600(&k.state)
+		k.buf = k.buf[:0]
+	}
+
+	for len(p) >= keccakRate {
+		absorb(&k.state, p[:keccakRate])
+		keccakF1600(&k.state)
+		p = p[keccakRate:]
+	}
+	k.buf = append(k.buf, p...)
+	return n, nil
+}
+
+// Sum appends the digest to b without changing the state
+func (k *keccak256) Sum(b []byte) []byte {
+	state := k.state
+
+	block := make([]byte, keccakRate)
+	copy(block, k.buf)
+	block[len(k.buf)] ^= 0x01
+	block[keccakRate-1] ^= 0x80
+	absorb(&state, block)
+	keccakF1600(&state)
+
+	var out [32]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(out[i*8:], state[i])
+	}
+	return append(b, out[:]...)
+}
+
+func (k *keccak256) Reset() {
+	k.state = [25]uint64{}
+	k.buf = k.buf[:0]
+}
+
+func (k *keccak256) Size() int {
+	return 32
+}
+
+func (k *keccak256) BlockSize() int {
+	return keccakRate
+}
+
+// absorb xors a full block into the state
+func absorb(state *[25]uint64, block []byte) {
+	for i := 0; i < keccakRate/8; i++ {
+		state[i] ^= binary.LittleEndian.Uint64(block[i*8:])
+	}
+}
+
+// keccakF1600 applies the 24 rounds of the Keccak-f[1600] permutation
+func keccakF1600(a *[25]uint64) {
+	var c [5]uint64
+	var b [25]uint64
+
+	for round := 0; round < 24; round++ {
+		// theta
+		for x := 0; x < 5; x++ {
+			c[x] = a[x] ^ a[x+5] ^ a[x+10] ^ a[x+15] ^ a[x+20]
+		}
+		for x := 0; x < 5; x++ {
+			d := c[(x+4)%5] ^ bits.RotateLeft64(c[(x+1)%5], 1)
+			for y := 0; y < 25; y += 5 {
+				a[y+x] ^= d
+			}
+		}
+
+		// rho and pi
+		for x := 0; x < 5; x++ {
+			for y := 0; y < 5; y++ {
+				b[y+5*((2*x+3*y)%5)] = bits.RotateLeft64(a[x+5*y], keccakRotations[x+5*y])
+			}
+		}
+
+		// chi
+		for y := 0; y < 25; y += 5 {
+			for x := 0; x < 5; x++ {
+				a[y+x] = b[y+x] ^ (^b[y+(x+1)%5] & b[y+(x+2)%5])
+			}
+		}
+
+		// iota
+		a[0] ^= keccakRoundConstants[round]
+	}
+}
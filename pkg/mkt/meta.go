@@ -0,0 +1,44 @@
+package mkt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Metadata describes a file of a collection, the name is its slash
+// separated path relative to the uploaded directory
+type Metadata struct {
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size"`
+	Mode        uint32 `json:"mode,omitempty"`
+	ModTime     int64  `json:"mtime,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Validate checks that the name is a relative path and that the fields can
+// be committed without ambiguity
+func (m Metadata) Validate() error {
+	if m.Name != "" {
+		parts, err := SplitPath(m.Name)
+		if err != nil || strings.Join(parts, "/") != m.Name {
+			return fmt.Errorf("invalid name %s", m.Name)
+		}
+	}
+	if strings.ContainsRune(m.ContentType, 0) {
+		return fmt.Errorf("invalid content type %s", m.ContentType)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("invalid size %d", m.Size)
+	}
+	return nil
+}
+
+// LeafHash returns the leaf hash that commits to the metadata and to the
+// content of the file with the given leaf hash
+func (m Metadata) LeafHash(hash string, mode Mode) string {
+	// NOTE: the name and the content type cannot have \x00 so the encoding
+	// is not ambiguous
+	return mode.HashLeaf([]byte("meta " + strconv.FormatInt(m.Size, 10) + " " + strconv.FormatUint(uint64(m.Mode), 8) + " " +
+		strconv.FormatInt(m.ModTime, 10) + " " + m.Name + "\x00" + m.ContentType + "\x00" + hash))
+}
@@ -0,0 +1,41 @@
+package mkt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataLeafHash(t *testing.T) {
+	hash := SHA256.HashLeaf([]byte("content"))
+	meta := Metadata{Name: "docs/a.txt", Size: 7, Mode: 0o644, ModTime: 1700000000, ContentType: "text/plain"}
+	require.NoError(t, meta.Validate())
+
+	for _, mode := range []Mode{SHA256, Keccak256Sorted} {
+		leaf := meta.LeafHash(hash, mode)
+		require.Equal(t, leaf, meta.LeafHash(hash, mode))
+		require.NotEqual(t, hash, leaf)
+
+		// Every field is committed
+		changed := []Metadata{meta, meta, meta, meta, meta}
+		changed[0].Name = "docs/b.txt"
+		changed[1].Size = 8
+		changed[2].Mode = 0o600
+		changed[3].ModTime++
+		changed[4].ContentType = "text/html"
+		for _, c := range changed {
+			require.NotEqual(t, leaf, c.LeafHash(hash, mode))
+		}
+		require.NotEqual(t, leaf, meta.LeafHash(SHA256.HashLeaf([]byte("other")), mode))
+	}
+}
+
+func TestMetadataValidate(t *testing.T) {
+	require.NoError(t, Metadata{}.Validate())
+
+	for _, name := range []string{"/a", "a/", "../a", "a//b", "./a", "a\x00b"} {
+		require.Error(t, Metadata{Name: name}.Validate(), name)
+	}
+	require.Error(t, Metadata{ContentType: "text\x00"}.Validate())
+	require.Error(t, Metadata{Size: -1}.Validate())
+}
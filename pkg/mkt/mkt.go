@@ -1,12 +1,76 @@
 package mkt
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
+	"strings"
 )
 
+// ErrNoLeaves is returned for a tree without leaves, it has no root
+var ErrNoLeaves = errors.New("the tree has no leaves")
+
+// Mode defines how leaves and pairs of nodes are hashed
+type Mode string
+
+const (
+	// SHA256 is the default mode: sha256 over the hex strings of the
+	// children, the order of the pair is kept in the proof positions
+	SHA256 Mode = "sha256"
+	// Keccak256Sorted is compatible with the OpenZeppelin MerkleProof
+	// contract: keccak256 over the sorted raw bytes of the pair and no
+	// position bits in the proof
+	Keccak256Sorted Mode = "keccak256-sorted"
+)
+
+// ParseMode returns the Mode for the given name, empty means the default one
+func ParseMode(name string) (Mode, error) {
+	switch Mode(strings.ToLower(name)) {
+	case "", SHA256:
+		return SHA256, nil
+	case Keccak256Sorted:
+		return Keccak256Sorted, nil
+	}
+	return "", fmt.Errorf("invalid mode %s, valid values: %s, %s", name, SHA256, Keccak256Sorted)
+}
+
+// HashLeaf returns the hex encoded hash of a file content for the mode
+func (m Mode) HashLeaf(data []byte) string {
+	if m == Keccak256Sorted {
+		hash := Keccak256(data)
+		return hex.EncodeToString(hash[:])
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// NewLeafHash returns a hash.Hash of the leaves of the mode, the hex encoded
+// sum is the same returned by HashLeaf
+func (m Mode) NewLeafHash() hash.Hash {
+	if m == Keccak256Sorted {
+		return NewKeccak256()
+	}
+	return sha256.New()
+}
+
+// hashPair returns the hash of the parent of the given children
+func (m Mode) hashPair(left, right string) string {
+	if m == Keccak256Sorted {
+		l, _ := hex.DecodeString(left)
+		r, _ := hex.DecodeString(right)
+		if bytes.Compare(l, r) > 0 {
+			l, r = r, l
+		}
+		hash := Keccak256(append(l, r...))
+		return hex.EncodeToString(hash[:])
+	}
+	hash := sha256.Sum256([]byte(left + right))
+	return hex.EncodeToString(hash[:])
+}
+
 // Node represents a node in the Merkle Tree
 type Node struct {
 	Hash  string
@@ -18,6 +82,7 @@ type Node struct {
 type MerkleTree struct {
 	Root  *Node
 	Nodes []*Node
+	Mode  Mode
 }
 
 // Proof represents a Merkle proof
@@ -28,14 +93,29 @@ type Proof struct {
 
 // NewMerkleTree creates a new Merkle Tree from a list of hashes
 func NewMerkleTree(hashes []string) *MerkleTree {
+	// NOTE: a tree without leaves has no root
+	tree, err := NewMerkleTreeWithMode(hashes, SHA256)
+	if err != nil {
+		return &MerkleTree{Mode: SHA256}
+	}
+	return tree
+}
+
+// NewMerkleTreeWithMode creates a new Merkle Tree from a list of hashes
+// combining the nodes as defined by the mode, it fails without hashes
+func NewMerkleTreeWithMode(hashes []string, mode Mode) (*MerkleTree, error) {
+	if len(hashes) == 0 {
+		return nil, ErrNoLeaves
+	}
+
 	var nodes []*Node
 	for _, h := range hashes {
 		nodes = append(nodes, &Node{Hash: h})
 	}
 
-	tree := &MerkleTree{Nodes: nodes}
-	tree.Root = buildTree(nodes)
-	return tree
+	tree := &MerkleTree{Nodes: nodes, Mode: mode}
+	tree.Root = buildTree(nodes, mode)
+	return tree, nil
 }
 
 // GetProof generates a Merkle proof for the given hash
@@ -55,7 +135,9 @@ func (mt *MerkleTree) GetProof(hash string) (*Proof, error) {
 		sibling := getSibling(node, parent)
 		if sibling != nil {
 			proof.Hashes = append(proof.Hashes, sibling.Hash)
-			proof.Positions = append(proof.Positions, parent.Left == node)
+			if mt.Mode != Keccak256Sorted {
+				proof.Positions = append(proof.Positions, parent.Left == node)
+			}
 		}
 
 		node = parent
@@ -90,28 +172,57 @@ func VerifyProof(hash, rootHash string, proof *Proof) bool {
 	return GetProofHash(hash, proof) == rootHash
 }
 
+// VerifyProofWithMode verifies a Merkle proof built in the given mode
+func VerifyProofWithMode(hash, rootHash string, proof *Proof, mode Mode) bool {
+	return GetProofHashWithMode(hash, proof, mode) == rootHash
+}
+
 // GetProofHash returns the rooHash based in the proof given
 func GetProofHash(hash string, proof *Proof) string {
+	return GetProofHashWithMode(hash, proof, SHA256)
+}
+
+// GetProofHashWithMode returns the rootHash based in the proof given and
+// the mode used to build the tree
+func GetProofHashWithMode(hash string, proof *Proof, mode Mode) string {
 	hashStr := hash
 	for i, p := range proof.Hashes {
-		var combinedHash []byte
+		if mode == Keccak256Sorted {
+			// The pair is sorted so the position does not matter
+			hashStr = mode.hashPair(hashStr, p)
+			continue
+		}
+		if i >= len(proof.Positions) {
+			return ""
+		}
 		if proof.Positions[i] {
 			// If the position is true, the proof hash is on the right
-			combinedHash = append([]byte(hashStr), []byte(p)...)
+			hashStr = mode.hashPair(hashStr, p)
 		} else {
 			// If the position is false, the proof hash is on the left
-			combinedHash = append([]byte(p), []byte(hashStr)...)
+			hashStr = mode.hashPair(p, hashStr)
 		}
-		hash := sha256.Sum256(combinedHash)
-		hashStr = hex.EncodeToString(hash[:])
 	}
 
 	return hashStr
 }
 
+// Bytes32 returns the proof hashes 0x prefixed as expected by the
+// bytes32[] argument of the OpenZeppelin MerkleProof.verify function
+func (p *Proof) Bytes32() []string {
+	result := make([]string, len(p.Hashes))
+	for i, h := range p.Hashes {
+		result[i] = "0x" + h
+	}
+	return result
+}
+
 // buildTree recursively builds the Merkle Tree
 // TODO: change to iterative to save memory and avoid deep recursivity
-func buildTree(nodes []*Node) *Node {
+func buildTree(nodes []*Node, mode Mode) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
 	if len(nodes) == 1 {
 		return nodes[0]
 	}
@@ -119,9 +230,8 @@ func buildTree(nodes []*Node) *Node {
 	var newLevel []*Node
 	for i := 0; i < len(nodes); i += 2 {
 		if i+1 < len(nodes) {
-			hash := sha256.Sum256([]byte(nodes[i].Hash + nodes[i+1].Hash))
 			newLevel = append(newLevel, &Node{
-				Hash:  hex.EncodeToString(hash[:]),
+				Hash:  mode.hashPair(nodes[i].Hash, nodes[i+1].Hash),
 				Left:  nodes[i],
 				Right: nodes[i+1],
 			})
@@ -130,7 +240,7 @@ func buildTree(nodes []*Node) *Node {
 		}
 	}
 
-	return buildTree(newLevel)
+	return buildTree(newLevel, mode)
 }
 
 // findNode finds a node with the given hash in the Merkle Tree
@@ -1,6 +1,8 @@
 package mkt
 
 import (
+	"bytes"
+	"encoding/hex"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -24,3 +26,83 @@ func TestHappyPath(t *testing.T) {
 		require.True(t, isValid)
 	})
 }
+
+func TestKeccak256(t *testing.T) {
+	hash := Keccak256([]byte(""))
+	require.Equal(t, "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470", hex.EncodeToString(hash[:]))
+
+	hash = Keccak256([]byte("abc"))
+	require.Equal(t, "4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45", hex.EncodeToString(hash[:]))
+}
+
+func TestNewLeafHash(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	for _, mode := range []Mode{SHA256, Keccak256Sorted} {
+		// Writes crossing the block boundaries give the same hash
+		for _, size := range []int{1, 7, 135, 136, 137, 1000} {
+			h := mode.NewLeafHash()
+			for i := 0; i < len(data); i += size {
+				end := i + size
+				if end > len(data) {
+					end = len(data)
+				}
+				h.Write(data[i:end])
+			}
+			require.Equal(t, mode.HashLeaf(data), hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+}
+
+func TestKeccak256Sorted(t *testing.T) {
+	files := []string{"file1", "file2", "file3", "file4", "file5"}
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = Keccak256Sorted.HashLeaf([]byte(f))
+	}
+
+	m, err := NewMerkleTreeWithMode(hashes, Keccak256Sorted)
+	require.NoError(t, err)
+	require.Equal(t, Keccak256Sorted, m.Mode)
+
+	for _, h := range hashes {
+		proof, err := m.GetProof(h)
+		require.NoError(t, err)
+		require.Empty(t, proof.Positions)
+		require.True(t, VerifyProofWithMode(h, m.Root.Hash, proof, Keccak256Sorted))
+		require.False(t, VerifyProof(h, m.Root.Hash, proof))
+		require.Len(t, proof.Bytes32(), len(proof.Hashes))
+	}
+
+	// The pair is sorted before hashing, so the order of the leaves does
+	// not change the parent as in the OpenZeppelin implementation
+	a, b := hashes[0], hashes[1]
+	ab, err := NewMerkleTreeWithMode([]string{a, b}, Keccak256Sorted)
+	require.NoError(t, err)
+	ba, err := NewMerkleTreeWithMode([]string{b, a}, Keccak256Sorted)
+	require.NoError(t, err)
+	require.Equal(t, ab.Root.Hash, ba.Root.Hash)
+}
+
+func TestEmptyTree(t *testing.T) {
+	for _, mode := range []Mode{SHA256, Keccak256Sorted} {
+		_, err := NewMerkleTreeWithMode(nil, mode)
+		require.ErrorIs(t, err, ErrNoLeaves)
+		_, err = DirectoryHash(nil, mode)
+		require.ErrorIs(t, err, ErrNoLeaves)
+	}
+	require.Nil(t, NewMerkleTree(nil).Root)
+}
+
+func TestParseMode(t *testing.T) {
+	m, err := ParseMode("")
+	require.NoError(t, err)
+	require.Equal(t, SHA256, m)
+
+	m, err = ParseMode("keccak256-sorted")
+	require.NoError(t, err)
+	require.Equal(t, Keccak256Sorted, m)
+
+	_, err = ParseMode("md5")
+	require.Error(t, err)
+}
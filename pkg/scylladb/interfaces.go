@@ -7,9 +7,16 @@ import "github.com/gocql/gocql"
 // Session is an interface for gocql.Session
 type Session interface {
 	Query(stmt string, values ...interface{}) Query
+	ExecuteBatch(stmts []Statement) error
 	Close()
 }
 
+// Statement is a query of a batch with its values
+type Statement struct {
+	Stmt   string
+	Values []interface{}
+}
+
 // Query is an interface for gocql.Query
 type Query interface {
 	Consistency(c gocql.Consistency) Query
@@ -33,6 +40,16 @@ func (s *gocqlSessionAdapter) Query(stmt string, values ...interface{}) Query {
 	return &gocqlQueryAdapter{s.Session.Query(stmt, values...)}
 }
 
+// ExecuteBatch executes the statements in a logged batch, so they are
+// applied all or none
+func (s *gocqlSessionAdapter) ExecuteBatch(stmts []Statement) error {
+	b := s.Session.NewBatch(gocql.LoggedBatch)
+	for _, st := range stmts {
+		b.Query(st.Stmt, st.Values...)
+	}
+	return s.Session.ExecuteBatch(b)
+}
+
 // gocqlQueryAdapter wraps *gocql.Query to implement the Query interface
 type gocqlQueryAdapter struct {
 	*gocql.Query
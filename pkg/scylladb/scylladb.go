@@ -1,9 +1,11 @@
 package scylladb
 
 import (
+	"errors"
 	"time"
 
 	"github.com/gocql/gocql"
+	"github.com/jmsilvadev/zc/pkg/db"
 )
 
 // DB is the structure that represents the database
@@ -55,6 +57,9 @@ func New(hosts []string, keyspace string) (*DB, error) {
 func (d *DB) Get(key string) ([]byte, error) {
 	var value []byte
 	err := d.session.Query(`SELECT value FROM kv WHERE key = ?`, key).Scan(&value)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, db.ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +106,84 @@ func (d *DB) GetByPrefix(prefix string) (map[string][]byte, error) {
 	return result, nil
 }
 
+// KeysByPrefix returns the keys that have the given prefix
+func (d *DB) KeysByPrefix(prefix string) ([]string, error) {
+	var keys []string
+
+	query := `SELECT key FROM kv WHERE key >= ? AND key < ? ALLOW FILTERING`
+	iter := d.session.Query(query, prefix, prefix+"\uFFFF").Iter()
+
+	var key string
+	for iter.Scan(&key) {
+		keys = append(keys, key)
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// batch keeps the statements until the batch is written. The statements of
+// a batch have the same timestamp, so a delete would win over a put of the
+// same key, only the last statement of each key is kept
+type batch struct {
+	stmts []Statement
+	keys  map[string]int
+}
+
+func (b *batch) add(key string, st Statement) {
+	if i, ok := b.keys[key]; ok {
+		b.stmts[i] = st
+		return
+	}
+	if b.keys == nil {
+		b.keys = make(map[string]int)
+	}
+	b.keys[key] = len(b.stmts)
+	b.stmts = append(b.stmts, st)
+}
+
+func (b *batch) Put(key string, value []byte) {
+	b.add(key, Statement{
+		Stmt:   `INSERT INTO kv (key, value) VALUES (?, ?)`,
+		Values: []interface{}{key, value},
+	})
+}
+
+func (b *batch) Delete(key string) {
+	b.add(key, Statement{
+		Stmt:   `DELETE FROM kv WHERE key = ?`,
+		Values: []interface{}{key},
+	})
+}
+
+func (b *batch) Len() int {
+	return len(b.stmts)
+}
+
+// NewBatch returns an empty batch of writes
+func (d *DB) NewBatch() db.Batch {
+	return &batch{}
+}
+
+// Write executes the batch as a logged batch, scylla guarantees that all
+// the statements are eventually applied once the batch log is written. The
+// batches are refused over the batch_size_fail_threshold of the cluster, so
+// they only have small values: the large ones, such as the contents of the
+// files, are written before them with Put under keys derived from their
+// content, where writing them again changes nothing
+func (d *DB) Write(b db.Batch) error {
+	sb, ok := b.(*batch)
+	if !ok {
+		return db.ErrInvalidBatch
+	}
+	if len(sb.stmts) == 0 {
+		return nil
+	}
+	return d.session.ExecuteBatch(sb.stmts)
+}
+
 // DeleteByPrefix deletes all key-value pairs that have the given prefix
 func (d *DB) DeleteByPrefix(prefix string) error {
 	keys, err := d.GetByPrefix(prefix)
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/gocql/gocql"
+	dbi "github.com/jmsilvadev/zc/pkg/db"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -19,6 +20,11 @@ func (m *MockSession) Query(stmt string, values ...interface{}) Query {
 	return args.Get(0).(Query)
 }
 
+func (m *MockSession) ExecuteBatch(stmts []Statement) error {
+	args := m.Called(stmts)
+	return args.Error(0)
+}
+
 func (m *MockSession) Close() {
 	m.Called()
 }
@@ -89,6 +95,19 @@ func TestGet(t *testing.T) {
 	mockQuery.AssertExpectations(t)
 }
 
+func TestGetNotFound(t *testing.T) {
+	mockSession := new(MockSession)
+	mockQuery := new(MockQuery)
+
+	mockSession.On("Query", `SELECT value FROM kv WHERE key = ?`, []interface{}{"test_key"}).Return(mockQuery)
+	mockQuery.On("Scan", mock.Anything).Return(gocql.ErrNotFound)
+
+	db := &DB{session: mockSession}
+	_, err := db.Get("test_key")
+
+	assert.ErrorIs(t, err, dbi.ErrNotFound)
+}
+
 func TestDelete(t *testing.T) {
 	mockSession := new(MockSession)
 	mockQuery := new(MockQuery)
@@ -193,3 +212,46 @@ func TestDeleteByPrefix(t *testing.T) {
 	mockQuery.AssertExpectations(t)
 	mockIter.AssertExpectations(t)
 }
+
+func TestBatch(t *testing.T) {
+	mockSession := new(MockSession)
+	db := &DB{session: mockSession}
+
+	b := db.NewBatch()
+	require.NoError(t, db.Write(b))
+
+	b.Delete("key1")
+	b.Put("key1", []byte("value1"))
+	b.Delete("key2")
+	assert.Equal(t, 2, b.Len())
+
+	mockSession.On("ExecuteBatch", []Statement{
+		{Stmt: `INSERT INTO kv (key, value) VALUES (?, ?)`, Values: []interface{}{"key1", []byte("value1")}},
+		{Stmt: `DELETE FROM kv WHERE key = ?`, Values: []interface{}{"key2"}},
+	}).Return(nil)
+
+	require.NoError(t, db.Write(b))
+	mockSession.AssertExpectations(t)
+
+	require.ErrorIs(t, db.Write(nil), dbi.ErrInvalidBatch)
+}
+
+func TestKeysByPrefix(t *testing.T) {
+	mockSession := new(MockSession)
+	mockQuery := new(MockQuery)
+	mockIter := new(MockIter)
+
+	mockSession.On("Query", `SELECT key FROM kv WHERE key >= ? AND key < ? ALLOW FILTERING`, []interface{}{"prefix", "prefix\uFFFF"}).Return(mockQuery)
+	mockQuery.On("Iter").Return(mockIter)
+	mockIter.On("Scan", mock.Anything).Run(func(args mock.Arguments) {
+		arg := args.Get(0).([]interface{})
+		*arg[0].(*string) = "prefix_key"
+	}).Return(true).Once()
+	mockIter.On("Scan", mock.Anything).Return(false).Once()
+	mockIter.On("Close").Return(nil)
+
+	db := &DB{session: mockSession}
+	keys, err := db.KeysByPrefix("prefix")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prefix_key"}, keys)
+}
@@ -0,0 +1,379 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: zc.proto
+
+// The gRPC api of the server, it serves the collections of the HTTP api
+// with the same storage, proofs, credentials and access control
+
+package zcpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Storage_Upload_FullMethodName   = "/zc.v1.Storage/Upload"
+	Storage_Update_FullMethodName   = "/zc.v1.Storage/Update"
+	Storage_Download_FullMethodName = "/zc.v1.Storage/Download"
+	Storage_List_FullMethodName     = "/zc.v1.Storage/List"
+	Storage_Proof_FullMethodName    = "/zc.v1.Storage/Proof"
+)
+
+// StorageClient is the client API for Storage service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Storage uploads, updates and downloads the files of the collections with
+// their Merkle proofs
+type StorageClient interface {
+	// Upload creates a collection with the streamed files
+	Upload(ctx context.Context, opts ...grpc.CallOption) (Storage_UploadClient, error)
+	// Update adds the streamed files to the collection of the root of the
+	// options, the new root is its next version
+	Update(ctx context.Context, opts ...grpc.CallOption) (Storage_UpdateClient, error)
+	// Download streams the proof of a file and then its content
+	Download(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (Storage_DownloadClient, error)
+	// List returns the roots the caller can read sorted by hash
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Proof returns the proof of a file without its content
+	Proof(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (*ProofResponse, error)
+}
+
+type storageClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStorageClient(cc grpc.ClientConnInterface) StorageClient {
+	return &storageClient{cc}
+}
+
+func (c *storageClient) Upload(ctx context.Context, opts ...grpc.CallOption) (Storage_UploadClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[0], Storage_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageUploadClient{ClientStream: stream}
+	return x, nil
+}
+
+type Storage_UploadClient interface {
+	Send(*UploadRequest) error
+	CloseAndRecv() (*TreeResult, error)
+	grpc.ClientStream
+}
+
+type storageUploadClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageUploadClient) Send(m *UploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *storageUploadClient) CloseAndRecv() (*TreeResult, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(TreeResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageClient) Update(ctx context.Context, opts ...grpc.CallOption) (Storage_UpdateClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[1], Storage_Update_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageUpdateClient{ClientStream: stream}
+	return x, nil
+}
+
+type Storage_UpdateClient interface {
+	Send(*UploadRequest) error
+	CloseAndRecv() (*TreeResult, error)
+	grpc.ClientStream
+}
+
+type storageUpdateClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageUpdateClient) Send(m *UploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *storageUpdateClient) CloseAndRecv() (*TreeResult, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(TreeResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageClient) Download(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (Storage_DownloadClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Storage_ServiceDesc.Streams[2], Storage_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageDownloadClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Storage_DownloadClient interface {
+	Recv() (*DownloadResponse, error)
+	grpc.ClientStream
+}
+
+type storageDownloadClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageDownloadClient) Recv() (*DownloadResponse, error) {
+	m := new(DownloadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Storage_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) Proof(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (*ProofResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProofResponse)
+	err := c.cc.Invoke(ctx, Storage_Proof_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StorageServer is the server API for Storage service.
+// All implementations must embed UnimplementedStorageServer
+// for forward compatibility
+//
+// Storage uploads, updates and downloads the files of the collections with
+// their Merkle proofs
+type StorageServer interface {
+	// Upload creates a collection with the streamed files
+	Upload(Storage_UploadServer) error
+	// Update adds the streamed files to the collection of the root of the
+	// options, the new root is its next version
+	Update(Storage_UpdateServer) error
+	// Download streams the proof of a file and then its content
+	Download(*FileRequest, Storage_DownloadServer) error
+	// List returns the roots the caller can read sorted by hash
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Proof returns the proof of a file without its content
+	Proof(context.Context, *FileRequest) (*ProofResponse, error)
+	mustEmbedUnimplementedStorageServer()
+}
+
+// UnimplementedStorageServer must be embedded to have forward compatible implementations.
+type UnimplementedStorageServer struct {
+}
+
+func (UnimplementedStorageServer) Upload(Storage_UploadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedStorageServer) Update(Storage_UpdateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedStorageServer) Download(*FileRequest, Storage_DownloadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedStorageServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedStorageServer) Proof(context.Context, *FileRequest) (*ProofResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Proof not implemented")
+}
+func (UnimplementedStorageServer) mustEmbedUnimplementedStorageServer() {}
+
+// UnsafeStorageServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StorageServer will
+// result in compilation errors.
+type UnsafeStorageServer interface {
+	mustEmbedUnimplementedStorageServer()
+}
+
+func RegisterStorageServer(s grpc.ServiceRegistrar, srv StorageServer) {
+	s.RegisterService(&Storage_ServiceDesc, srv)
+}
+
+func _Storage_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServer).Upload(&storageUploadServer{ServerStream: stream})
+}
+
+type Storage_UploadServer interface {
+	SendAndClose(*TreeResult) error
+	Recv() (*UploadRequest, error)
+	grpc.ServerStream
+}
+
+type storageUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageUploadServer) SendAndClose(m *TreeResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *storageUploadServer) Recv() (*UploadRequest, error) {
+	m := new(UploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Storage_Update_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServer).Update(&storageUpdateServer{ServerStream: stream})
+}
+
+type Storage_UpdateServer interface {
+	SendAndClose(*TreeResult) error
+	Recv() (*UploadRequest, error)
+	grpc.ServerStream
+}
+
+type storageUpdateServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageUpdateServer) SendAndClose(m *TreeResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *storageUpdateServer) Recv() (*UploadRequest, error) {
+	m := new(UploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Storage_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServer).Download(m, &storageDownloadServer{ServerStream: stream})
+}
+
+type Storage_DownloadServer interface {
+	Send(*DownloadResponse) error
+	grpc.ServerStream
+}
+
+type storageDownloadServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageDownloadServer) Send(m *DownloadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Storage_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_Proof_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).Proof(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Storage_Proof_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).Proof(ctx, req.(*FileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Storage_ServiceDesc is the grpc.ServiceDesc for Storage service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Storage_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "zc.v1.Storage",
+	HandlerType: (*StorageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "List",
+			Handler:    _Storage_List_Handler,
+		},
+		{
+			MethodName: "Proof",
+			Handler:    _Storage_Proof_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _Storage_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Update",
+			Handler:       _Storage_Update_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _Storage_Download_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "zc.proto",
+}